@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/api"
+	"github.com/example/granite-db/engine/internal/storage"
+)
+
+func TestParseInspectArgs(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		args    []string
+		want    inspectArgs
+		wantErr bool
+	}{{
+		name: "page with json",
+		args: []string{"page", "7", "--json", "demo.gdb"},
+		want: inspectArgs{target: "page", page: 7, dbPath: "demo.gdb", jsonOut: true},
+	}, {
+		name: "heap",
+		args: []string{"heap", "orders", "demo.gdb"},
+		want: inspectArgs{target: "heap", table: "orders", dbPath: "demo.gdb"},
+	}, {
+		name: "free list",
+		args: []string{"-json", "freelist", "demo.gdb"},
+		want: inspectArgs{target: "freelist", dbPath: "demo.gdb", jsonOut: true},
+	}, {
+		name:    "invalid page id",
+		args:    []string{"page", "seven", "demo.gdb"},
+		wantErr: true,
+	}, {
+		name:    "missing database",
+		args:    []string{"heap", "orders"},
+		wantErr: true,
+	}, {
+		name:    "unknown target",
+		args:    []string{"index", "demo.gdb"},
+		wantErr: true,
+	}}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseInspectArgs(tc.args)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %+v want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInspectReports(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "inspect.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	statements := []string{
+		"CREATE TABLE notes(id INT NOT NULL, body VARCHAR(20), PRIMARY KEY(id))",
+		"INSERT INTO notes(id, body) VALUES (1, 'first')",
+		"INSERT INTO notes(id, body) VALUES (2, NULL)",
+		"INSERT INTO notes(id, body) VALUES (3, 'third')",
+		"DELETE FROM notes WHERE id = 2",
+		"CREATE INDEX idx_notes_body ON notes(body)",
+		"CREATE TABLE scratch(id INT NOT NULL, PRIMARY KEY(id))",
+		"DROP TABLE scratch",
+	}
+	for _, stmt := range statements {
+		if _, err := db.Execute(stmt); err != nil {
+			t.Fatalf("execute %q: %v", stmt, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	db, err = api.OpenWithOptions(path, api.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	defer db.Close()
+
+	heap, err := db.InspectHeap("notes")
+	if err != nil {
+		t.Fatalf("inspect heap: %v", err)
+	}
+	if len(heap.Pages) != 1 || heap.Problem != "" {
+		t.Fatalf("expected a single heap page, got %+v", heap)
+	}
+	page := heap.Pages[0]
+	if page.Heap.SlotCount != 3 || page.Heap.LiveSlots != 2 || page.Heap.DeadSlots != 1 || page.Heap.Slots[1].Live {
+		t.Fatalf("unexpected slot directory %+v", page.Heap)
+	}
+	if len(page.Rows) != 2 || page.Rows[1].RowID != fmt.Sprintf("%d:2", page.ID) || *page.Rows[1].Values[1] != "third" {
+		t.Fatalf("unexpected rows %+v", page.Rows)
+	}
+
+	single, err := db.InspectPage(page.ID)
+	if err != nil {
+		t.Fatalf("inspect page: %v", err)
+	}
+	if single.Kind != "heap" || single.Table != "notes" || len(single.Rows) != 2 {
+		t.Fatalf("unexpected page report %+v", single)
+	}
+	header, err := db.InspectPage(0)
+	if err != nil {
+		t.Fatalf("inspect header: %v", err)
+	}
+	if header.Kind != "header" || header.Header.PageCount == 0 {
+		t.Fatalf("unexpected header report %+v", header)
+	}
+
+	var node *api.PageReport
+	for id := storage.PageID(1); id < storage.PageID(header.Header.PageCount); id++ {
+		report, err := db.InspectPage(id)
+		if err != nil {
+			t.Fatalf("inspect page %d: %v", id, err)
+		}
+		if report.Kind == "index" && report.Index == "idx_notes_body" {
+			node = report
+			break
+		}
+	}
+	if node == nil || node.Index != "idx_notes_body" || !node.Node.Leaf || node.Node.Entries != 2 {
+		t.Fatalf("expected the index root to be a leaf with two entries, got %+v", node)
+	}
+
+	free, err := db.InspectFreeList()
+	if err != nil {
+		t.Fatalf("inspect free list: %v", err)
+	}
+	if len(free.Pages) == 0 || free.Head != free.Pages[0] || len(free.Problems) != 0 {
+		t.Fatalf("expected the dropped table's pages on the free list, got %+v", free)
+	}
+	freePage, err := db.InspectPage(free.Head)
+	if err != nil {
+		t.Fatalf("inspect free page: %v", err)
+	}
+	if freePage.Kind != "free" {
+		t.Fatalf("expected a free page, got %+v", freePage)
+	}
+
+	data, err := json.Marshal(single)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if payload := string(data); !strings.Contains(payload, `"rowId"`) || !strings.Contains(payload, `"slotCount":3`) {
+		t.Fatalf("unexpected JSON %s", payload)
+	}
+}
@@ -10,13 +10,22 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/example/granite-db/engine/internal/api"
 	"github.com/example/granite-db/engine/internal/catalog"
+	"github.com/example/granite-db/engine/internal/compression"
 	"github.com/example/granite-db/engine/internal/exec"
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/upgrade"
 )
 
+// defaultLockTimeout is how long commands wait for another process, such as
+// a query still running from the IDE, to release the database.
+const defaultLockTimeout = 5 * time.Second
+
 func main() {
 	if len(os.Args) < 2 {
 		usage()
@@ -34,6 +43,18 @@ func main() {
 		runExplain(os.Args[2:])
 	case "meta":
 		runMeta(os.Args[2:])
+	case "vacuum":
+		runVacuum(os.Args[2:])
+	case "compact":
+		runCompact(os.Args[2:])
+	case "check":
+		runCheck(os.Args[2:])
+	case "inspect":
+		runInspect(os.Args[2:])
+	case "upgrade":
+		runUpgrade(os.Args[2:])
+	case "rekey":
+		runRekey(os.Args[2:])
 	default:
 		fmt.Fprintf(os.Stderr, "unknown command: %s\n", cmd)
 		usage()
@@ -44,17 +65,25 @@ func main() {
 func usage() {
 	fmt.Println("GraniteDB control utility")
 	fmt.Println("Usage:")
-	fmt.Println("  granitectl new <dbfile>")
-	fmt.Println("  granitectl exec [-q <SQL> | -f <file.sql>] [--format table|csv|json] [--continue-on-error] <dbfile>")
+	fmt.Println("  granitectl new [--page-size <bytes>] [--encrypt] <dbfile>")
+	fmt.Println("  granitectl exec [-q <SQL> | -f <file.sql>] [--format table|csv|json] [--continue-on-error] [--read-only] [--lock-timeout <duration>] <dbfile>")
 	fmt.Println("  granitectl dump <dbfile>")
 	fmt.Println("  granitectl explain -q <SQL> [--json] [--out <file>] <dbfile>")
 	fmt.Println("  granitectl meta [--json] <dbfile>")
+	fmt.Println("  granitectl vacuum [--table <name>] <dbfile>")
+	fmt.Println("  granitectl compact <dbfile>")
+	fmt.Println("  granitectl check [--json] <dbfile>")
+	fmt.Println("  granitectl inspect page <id> | heap <table> | freelist [--json] <dbfile>")
+	fmt.Println("  granitectl upgrade [--dry-run] [--no-backup] [--backup-dir <dir>] <dbfile>")
+	fmt.Println("  granitectl rekey <dbfile>")
 }
 
 func runNew(args []string) {
 	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	pageSize := fs.Int("page-size", 0, "Page size in bytes: 4096, 8192, 16384 or 32768")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the database with the key in "+api.KeyEnv)
 	fs.Usage = func() {
-		fmt.Println("Usage: granitectl new <dbfile>")
+		fmt.Println("Usage: granitectl new [--page-size <bytes>] [--encrypt] <dbfile>")
 	}
 	fs.Parse(args)
 	if fs.NArg() != 1 {
@@ -62,7 +91,15 @@ func runNew(args []string) {
 		os.Exit(1)
 	}
 	path := fs.Arg(0)
-	if err := api.Create(path); err != nil {
+	opts := api.CreateOptions{PageSize: *pageSize}
+	if *encrypt {
+		opts.Key = os.Getenv(api.KeyEnv)
+		if opts.Key == "" {
+			fmt.Fprintf(os.Stderr, "error: --encrypt needs the key in %s\n", api.KeyEnv)
+			os.Exit(1)
+		}
+	}
+	if err := api.CreateWithOptions(path, opts); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
@@ -75,8 +112,10 @@ func runExec(args []string) {
 	script := fs.String("f", "", "Path to SQL script file")
 	format := fs.String("format", "table", "Output format: table, csv, or json")
 	continueOnError := fs.Bool("continue-on-error", false, "Continue script execution after errors")
+	readOnly := fs.Bool("read-only", false, "Open the database for queries only, sharing it with other readers")
+	lockTimeout := fs.Duration("lock-timeout", defaultLockTimeout, "How long to wait for another process to release the database")
 	fs.Usage = func() {
-		fmt.Println("Usage: granitectl exec [-q <SQL> | -f <file.sql>] [--format table|csv|json] [--continue-on-error] <dbfile>")
+		fmt.Println("Usage: granitectl exec [-q <SQL> | -f <file.sql>] [--format table|csv|json] [--continue-on-error] [--read-only] [--lock-timeout <duration>] <dbfile>")
 	}
 	fs.Parse(args)
 	if fs.NArg() != 1 {
@@ -91,7 +130,7 @@ func runExec(args []string) {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
-	db, err := api.Open(fs.Arg(0))
+	db, err := api.OpenWithOptions(fs.Arg(0), api.OpenOptions{ReadOnly: *readOnly, LockTimeout: *lockTimeout})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -154,7 +193,7 @@ func runDump(args []string) {
 		fs.Usage()
 		os.Exit(1)
 	}
-	db, err := api.Open(fs.Arg(0))
+	db, err := api.OpenWithOptions(fs.Arg(0), api.OpenOptions{ReadOnly: true, LockTimeout: defaultLockTimeout})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -171,7 +210,11 @@ func runDump(args []string) {
 		return
 	}
 	for _, table := range tables {
-		fmt.Printf("Table %s (%d row(s))\n", table.Name, table.RowCount)
+		if table.Compression != compression.None {
+			fmt.Printf("Table %s (%d row(s), %s compression)\n", table.Name, table.RowCount, table.Compression)
+		} else {
+			fmt.Printf("Table %s (%d row(s))\n", table.Name, table.RowCount)
+		}
 		for _, col := range table.Columns {
 			fmt.Printf("  - %s %s", col.Name, describeType(col))
 			if col.NotNull {
@@ -203,6 +246,400 @@ func runDump(args []string) {
 	}
 }
 
+func runVacuum(args []string) {
+	fs := flag.NewFlagSet("vacuum", flag.ExitOnError)
+	table := fs.String("table", "", "Vacuum only the named table")
+	fs.Usage = func() {
+		fmt.Println("Usage: granitectl vacuum [--table <name>] <dbfile>")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	db, err := api.OpenWithOptions(fs.Arg(0), api.OpenOptions{LockTimeout: defaultLockTimeout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	stmt := "VACUUM"
+	if *table != "" {
+		stmt += " " + *table
+	}
+	result, err := db.Execute(stmt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := renderResult(os.Stdout, result, "table"); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(result.Message)
+}
+
+func runCompact(args []string) {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println("Usage: granitectl compact <dbfile>")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	db, err := api.OpenWithOptions(fs.Arg(0), api.OpenOptions{LockTimeout: defaultLockTimeout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	result, err := db.Execute("VACUUM FULL")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := renderResult(os.Stdout, result, "table"); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(result.Message)
+}
+
+// runCheck verifies a database and lists the problems found. It exits with 1
+// when there are problems and 2 when the check itself could not run, so that
+// scripts can tell a damaged database from a missing one.
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "Write the report as JSON")
+	fs.Usage = func() {
+		fmt.Println("Usage: granitectl check [--json] <dbfile>")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dbPath := fs.Arg(0)
+	db, err := api.OpenWithOptions(dbPath, api.OpenOptions{ReadOnly: true, LockTimeout: defaultLockTimeout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %v\n", err)
+		os.Exit(2)
+	}
+	problems, err := db.CheckIntegrity()
+	db.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %v\n", err)
+		os.Exit(2)
+	}
+	if problems == nil {
+		problems = []storage.Problem{}
+	}
+
+	if *jsonOut {
+		report := struct {
+			Database string            `json:"database"`
+			OK       bool              `json:"ok"`
+			Problems []storage.Problem `json:"problems"`
+		}{Database: dbPath, OK: len(problems) == 0, Problems: problems}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "check: encode: %v\n", err)
+			os.Exit(2)
+		}
+	} else {
+		fmt.Printf("Database: %s\n", dbPath)
+		for _, p := range problems {
+			location := p.Table
+			if p.Index != "" {
+				location += "." + p.Index
+			}
+			if p.Page != 0 {
+				location += fmt.Sprintf(" page %d", p.Page)
+			}
+			if location = strings.TrimSpace(location); location != "" {
+				fmt.Printf("- [%s] %s: %s\n", p.Check, location, p.Detail)
+			} else {
+				fmt.Printf("- [%s] %s\n", p.Check, p.Detail)
+			}
+		}
+		if len(problems) == 0 {
+			fmt.Println("No problems found")
+		} else {
+			fmt.Printf("%d problem(s) found\n", len(problems))
+		}
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+const inspectUsage = "Usage: granitectl inspect page <id> | heap <table> | freelist [--json] <dbfile>"
+
+// runInspect decodes pages for debugging storage problems: a single page, the
+// heap chain of a table with its rows, or the free list.
+func runInspect(args []string) {
+	req, err := parseInspectArgs(args)
+	if err != nil {
+		if errors.Is(err, errInspectUsage) {
+			fmt.Fprintln(os.Stderr, inspectUsage)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "inspect: %v\n", err)
+		os.Exit(2)
+	}
+
+	db, err := api.OpenWithOptions(req.dbPath, api.OpenOptions{ReadOnly: true, LockTimeout: defaultLockTimeout})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspect: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	var report interface{}
+	switch req.target {
+	case "page":
+		report, err = db.InspectPage(req.page)
+	case "heap":
+		report, err = db.InspectHeap(req.table)
+	case "freelist":
+		report, err = db.InspectFreeList()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspect: %v\n", err)
+		os.Exit(1)
+	}
+	if req.jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "inspect: encode: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	switch r := report.(type) {
+	case *api.PageReport:
+		printPageReport(*r)
+	case *api.HeapReport:
+		fmt.Printf("Table %s: root page %d, free-space map page %d, %d page(s)\n", r.Table, r.Root, r.FreeSpaceMap, len(r.Pages))
+		fmt.Printf("Columns: %s\n", strings.Join(r.Columns, ", "))
+		for _, page := range r.Pages {
+			fmt.Println()
+			printPageReport(page)
+		}
+		if r.Problem != "" {
+			fmt.Printf("\nProblem: %s\n", r.Problem)
+		}
+	case *storage.FreeListInfo:
+		if len(r.Pages) == 0 {
+			fmt.Println("The free list is empty")
+		} else {
+			ids := make([]string, len(r.Pages))
+			for i, id := range r.Pages {
+				ids[i] = strconv.FormatUint(uint64(id), 10)
+			}
+			fmt.Printf("Free list: %d page(s)\n  %s\n", len(r.Pages), strings.Join(ids, " -> "))
+		}
+		for _, p := range r.Problems {
+			fmt.Printf("Problem: %s\n", p.Detail)
+		}
+	}
+}
+
+var errInspectUsage = errors.New("inspect usage")
+
+// inspectArgs is a parsed granitectl inspect command line.
+type inspectArgs struct {
+	target  string // page, heap or freelist
+	page    storage.PageID
+	table   string
+	dbPath  string
+	jsonOut bool
+}
+
+func parseInspectArgs(args []string) (inspectArgs, error) {
+	var (
+		req        inspectArgs
+		positional []string
+	)
+	for _, arg := range args {
+		switch {
+		case arg == "--json" || arg == "-json":
+			req.jsonOut = true
+		case arg == "--help" || arg == "-h":
+			return inspectArgs{}, errInspectUsage
+		case strings.HasPrefix(arg, "-"):
+			return inspectArgs{}, fmt.Errorf("unknown option %s", arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	want := map[string]int{"page": 3, "heap": 3, "freelist": 2}
+	if len(positional) == 0 || want[positional[0]] != len(positional) {
+		return inspectArgs{}, errInspectUsage
+	}
+	req.target = positional[0]
+	req.dbPath = positional[len(positional)-1]
+	switch req.target {
+	case "page":
+		id, err := strconv.ParseUint(positional[1], 10, 32)
+		if err != nil {
+			return inspectArgs{}, fmt.Errorf("invalid page id %q", positional[1])
+		}
+		req.page = storage.PageID(id)
+	case "heap":
+		req.table = positional[1]
+	}
+	return req, nil
+}
+
+func printPageReport(r api.PageReport) {
+	title := fmt.Sprintf("Page %d: %s", r.ID, r.Kind)
+	switch {
+	case r.Index != "":
+		title += fmt.Sprintf(" of index %s on %s", r.Index, r.Table)
+	case r.Table != "":
+		title += " of table " + r.Table
+	}
+	if r.Compression != "" && r.Compression != compression.None.String() {
+		title += fmt.Sprintf(" (%s compression)", r.Compression)
+	}
+	fmt.Println(title)
+	switch {
+	case r.Header != nil:
+		h := r.Header
+		fmt.Printf("  version %d, page size %d, %d page(s)\n", h.Version, h.PageSize, h.PageCount)
+		fmt.Printf("  free list head %d, catalogue root %d (%d bytes), encrypted %t\n", h.FreeListHead, h.CatalogRoot, h.CatalogSize, h.Encrypted)
+	case r.Heap != nil:
+		h := r.Heap
+		fmt.Printf("  next page %d, %d slot(s) (%d live, %d dead), free space %d..%d (%d bytes)\n", h.NextPage, h.SlotCount, h.LiveSlots, h.DeadSlots, h.FreeStart, h.FreeEnd, h.FreeSpace)
+		if h.Problem != "" {
+			fmt.Printf("  problem: %s\n", h.Problem)
+		}
+		if len(h.Slots) > 0 {
+			fmt.Println("  slot  offset  length  state")
+			for _, slot := range h.Slots {
+				state := "dead"
+				switch {
+				case slot.Overflow:
+					state = "live (overflow)"
+				case slot.Live:
+					state = "live"
+				}
+				fmt.Printf("  %-5d %-7d %-7d %s\n", slot.Slot, slot.Offset, slot.Length, state)
+			}
+		}
+		for _, row := range r.Rows {
+			if row.Error != "" {
+				fmt.Printf("  row %s: error: %s\n", row.RowID, row.Error)
+				continue
+			}
+			values := make([]string, len(row.Values))
+			for i, v := range row.Values {
+				values[i] = "NULL"
+				if v != nil {
+					values[i] = *v
+				}
+			}
+			fmt.Printf("  row %s: (%s)\n", row.RowID, strings.Join(values, ", "))
+		}
+	case r.Node != nil:
+		n := r.Node
+		if n.Problem != "" {
+			fmt.Printf("  problem: %s\n", n.Problem)
+		} else if n.Leaf {
+			fmt.Printf("  leaf, %d entries, next leaf %d, %d byte(s) free\n", n.Entries, n.NextPage, n.FreeSpace)
+		} else {
+			fmt.Printf("  internal, %d separator(s), %d byte(s) free\n", n.Entries, n.FreeSpace)
+			fmt.Printf("  children %v\n", n.Children)
+		}
+	case r.Map != nil:
+		fmt.Printf("  next page %d, heap tail %d, %d entries\n", r.Map.NextPage, r.Map.HeapTail, len(r.Map.Entries))
+		for _, entry := range r.Map.Entries {
+			fmt.Printf("  page %d: %d byte(s) free\n", entry.Page, entry.FreeSpace)
+		}
+	case r.Kind == "catalogue" || r.Kind == "overflow":
+		fmt.Printf("  next page %d, %d byte(s) used\n", r.NextPage, r.Used)
+	case r.Kind == "free":
+		fmt.Printf("  next free page %d\n", r.NextPage)
+	}
+}
+
+func runUpgrade(args []string) {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Report the planned steps without changing any file")
+	noBackup := fs.Bool("no-backup", false, "Do not copy the files before upgrading them")
+	backupDir := fs.String("backup-dir", "", "Directory to copy the files into before upgrading")
+	fs.Usage = func() {
+		fmt.Println("Usage: granitectl upgrade [--dry-run] [--no-backup] [--backup-dir <dir>] <dbfile>")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	report, err := upgrade.Run(fs.Arg(0), upgrade.Options{DryRun: *dryRun, NoBackup: *noBackup, BackupDir: *backupDir})
+	if report != nil {
+		for _, file := range report.Plan.Files {
+			if file.UpToDate() {
+				fmt.Printf("%s (%s): version %d, up to date\n", file.Path, file.Component, file.Version)
+				continue
+			}
+			fmt.Printf("%s (%s): version %d -> %d\n", file.Path, file.Component, file.Version, file.Target)
+			for _, step := range file.Steps {
+				fmt.Printf("  v%d -> v%d: %s\n", step.From, step.To, step.Description)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	switch {
+	case report.Plan.Pending() == 0:
+		fmt.Println("Nothing to upgrade")
+	case *dryRun:
+		fmt.Printf("Dry run: %d step(s) would be applied\n", report.Plan.Pending())
+	default:
+		if report.BackupDir != "" {
+			fmt.Printf("Backup written to %s\n", report.BackupDir)
+		}
+		fmt.Printf("Upgrade complete: %d step(s) applied\n", report.Applied)
+	}
+}
+
+// newKeyEnv holds the replacement passphrase for rekey; the current one is
+// read from api.KeyEnv.
+const newKeyEnv = "GRANITEDB_NEW_KEY"
+
+func runRekey(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println("Usage: granitectl rekey <dbfile>")
+		fmt.Printf("The current key is read from %s and the new key from %s.\n", api.KeyEnv, newKeyEnv)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	oldKey, newKey := os.Getenv(api.KeyEnv), os.Getenv(newKeyEnv)
+	if oldKey == "" || newKey == "" {
+		fmt.Fprintf(os.Stderr, "error: rekey needs the current key in %s and the new key in %s\n", api.KeyEnv, newKeyEnv)
+		os.Exit(1)
+	}
+	if err := api.Rekey(fs.Arg(0), oldKey, newKey); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Rekeyed database %s\n", fs.Arg(0))
+}
+
 func runExplain(args []string) {
 	fs := flag.NewFlagSet("explain", flag.ExitOnError)
 	query := fs.String("q", "", "SQL query to explain")
@@ -220,7 +657,7 @@ func runExplain(args []string) {
 		fmt.Fprintln(os.Stderr, "error: -q is required")
 		os.Exit(1)
 	}
-	db, err := api.Open(fs.Arg(0))
+	db, err := api.OpenWithOptions(fs.Arg(0), api.OpenOptions{ReadOnly: true, LockTimeout: defaultLockTimeout})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -271,7 +708,7 @@ func runMeta(args []string) {
 		os.Exit(2)
 	}
 
-	meta, err := api.LoadDatabaseMeta(dbPath)
+	meta, err := api.LoadDatabaseMetaWithOptions(dbPath, api.OpenOptions{ReadOnly: true, LockTimeout: defaultLockTimeout})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "meta: %v\n", err)
 		os.Exit(1)
@@ -293,7 +730,11 @@ func runMeta(args []string) {
 		return
 	}
 	for _, table := range meta.Tables {
-		fmt.Printf("- %s (%d column(s), %d row(s))\n", table.Name, len(table.Columns), table.RowCount)
+		if table.Compression != "none" {
+			fmt.Printf("- %s (%d column(s), %d row(s), %s compression)\n", table.Name, len(table.Columns), table.RowCount, table.Compression)
+		} else {
+			fmt.Printf("- %s (%d column(s), %d row(s))\n", table.Name, len(table.Columns), table.RowCount)
+		}
 		for _, col := range table.Columns {
 			fmt.Printf("    • %s %s", col.Name, col.Type)
 			if col.NotNull {
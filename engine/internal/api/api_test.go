@@ -1,7 +1,11 @@
 package api_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -9,7 +13,11 @@ import (
 	"time"
 
 	"github.com/example/granite-db/engine/internal/api"
+	"github.com/example/granite-db/engine/internal/catalog"
+	"github.com/example/granite-db/engine/internal/encryption"
 	engineexec "github.com/example/granite-db/engine/internal/exec"
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/storage/indexmgr"
 )
 
 func TestEndToEndWorkflow(t *testing.T) {
@@ -126,7 +134,7 @@ func TestMetadataJSONReflectsSchema(t *testing.T) {
 	if !table.Columns[0].IsPrimaryKey {
 		t.Fatalf("expected primary key to be flagged")
 	}
-	if len(table.Indexes) != 1 || table.Indexes[0].Name != "idx_customers_name" {
+	if len(table.Indexes) != 2 || table.Indexes[0].Name != "idx_customers_name" || table.Indexes[1].Name != "pk_customers" || !table.Indexes[1].Unique {
 		t.Fatalf("unexpected indexes: %v", table.Indexes)
 	}
 }
@@ -297,6 +305,780 @@ func TestWriteContentionTimeout(t *testing.T) {
 	mustExec(t, db, "ROLLBACK")
 }
 
+func TestVacuumKeepsIndexesUsable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vacuum.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, "CREATE TABLE notes(id INT NOT NULL, body VARCHAR(255), PRIMARY KEY(id))")
+	mustExec(t, db, "CREATE INDEX idx_notes_id ON notes(id)")
+	body := strings.Repeat("n", 200)
+	for i := 1; i <= 120; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO notes(id, body) VALUES (%d, '%s')", i, body))
+	}
+	mustExec(t, db, "DELETE FROM notes WHERE id <= 110")
+
+	res := mustQuery(t, db, "VACUUM notes")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "notes" {
+		t.Fatalf("unexpected vacuum result: %v", res.Rows)
+	}
+	if res.Rows[0][2] == "0" {
+		t.Fatalf("expected vacuum to free pages, got %v", res.Rows[0])
+	}
+
+	res = mustQuery(t, db, "SELECT id FROM notes WHERE id = 115")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "115" {
+		t.Fatalf("expected index lookup to find moved row, got %v", res.Rows)
+	}
+	res = mustQuery(t, db, "SELECT COUNT(*) FROM notes")
+	if res.Rows[0][0] != "10" {
+		t.Fatalf("expected 10 rows after vacuum, got %v", res.Rows)
+	}
+
+	mustExec(t, db, "BEGIN")
+	if _, err := db.Execute("VACUUM"); err == nil {
+		t.Fatalf("expected VACUUM inside a transaction to fail")
+	}
+	mustExec(t, db, "ROLLBACK")
+}
+
+func TestVacuumFullShrinksFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "compact.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	mustExec(t, db, "CREATE TABLE staging(id INT NOT NULL, body VARCHAR(255), PRIMARY KEY(id))")
+	mustExec(t, db, "CREATE TABLE notes(id INT NOT NULL, body VARCHAR(255), PRIMARY KEY(id))")
+	mustExec(t, db, "CREATE INDEX idx_notes_id ON notes(id)")
+	body := strings.Repeat("s", 250)
+	for i := 1; i <= 200; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO staging(id, body) VALUES (%d, '%s')", i, body))
+		if i%4 == 0 {
+			mustExec(t, db, fmt.Sprintf("INSERT INTO notes(id, body) VALUES (%d, 'note %d')", i, i))
+		}
+	}
+	mustExec(t, db, "DROP TABLE staging")
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+
+	mustExec(t, db, "BEGIN")
+	if _, err := db.Execute("VACUUM FULL"); err == nil {
+		t.Fatalf("expected VACUUM FULL inside a transaction to fail")
+	}
+	mustExec(t, db, "ROLLBACK")
+
+	res := mustQuery(t, db, "VACUUM FULL")
+	if len(res.Rows) != 1 || res.Rows[0][3] == "0" {
+		t.Fatalf("expected VACUUM FULL to reclaim space, got %v", res.Rows)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if after.Size() >= before.Size() {
+		t.Fatalf("expected the file to shrink from %d bytes, got %d", before.Size(), after.Size())
+	}
+
+	res = mustQuery(t, db, "SELECT body FROM notes WHERE id = 120")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "note 120" {
+		t.Fatalf("expected index lookup after compaction, got %v", res.Rows)
+	}
+	mustExec(t, db, "INSERT INTO notes(id, body) VALUES (1000, 'after')")
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	res = mustQuery(t, db, "SELECT COUNT(*) FROM notes")
+	if res.Rows[0][0] != "51" {
+		t.Fatalf("expected 51 rows after reopening, got %v", res.Rows)
+	}
+	res = mustQuery(t, db, "SELECT body FROM notes WHERE id = 1000")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "after" {
+		t.Fatalf("expected the new row after reopening, got %v", res.Rows)
+	}
+}
+
+func TestTruncateTable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "truncate.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	mustExec(t, db, "CREATE TABLE events(id INT NOT NULL, body VARCHAR(255), PRIMARY KEY(id))")
+	mustExec(t, db, "CREATE INDEX idx_events_id ON events(id)")
+	body := strings.Repeat("e", 200)
+	load := func(from, to int) {
+		for i := from; i <= to; i++ {
+			mustExec(t, db, fmt.Sprintf("INSERT INTO events(id, body) VALUES (%d, '%s')", i, body))
+		}
+	}
+	load(1, 100)
+
+	// A rolled-back truncate leaves the rows and their index entries alone,
+	// even when the emptied table was written to in the meantime.
+	mustExec(t, db, "BEGIN")
+	mustExec(t, db, "TRUNCATE TABLE events")
+	res := mustQuery(t, db, "SELECT COUNT(*) FROM events")
+	if res.Rows[0][0] != "0" {
+		t.Fatalf("expected an empty table inside the transaction, got %v", res.Rows)
+	}
+	mustExec(t, db, "INSERT INTO events(id, body) VALUES (500, 'temporary')")
+	mustExec(t, db, "ROLLBACK")
+	res = mustQuery(t, db, "SELECT COUNT(*) FROM events")
+	if res.Rows[0][0] != "100" {
+		t.Fatalf("expected 100 rows after rollback, got %v", res.Rows)
+	}
+	res = mustQuery(t, db, "SELECT id FROM events WHERE id = 42")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "42" {
+		t.Fatalf("expected index lookup after rollback, got %v", res.Rows)
+	}
+	res = mustQuery(t, db, "SELECT id FROM events WHERE id = 500")
+	if len(res.Rows) != 0 {
+		t.Fatalf("expected the rolled-back insert to be gone, got %v", res.Rows)
+	}
+
+	mustExec(t, db, "TRUNCATE events")
+	res = mustQuery(t, db, "SELECT id FROM events WHERE id = 42")
+	if len(res.Rows) != 0 {
+		t.Fatalf("expected the index to be cleared, got %v", res.Rows)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	// The released pages are reused, so reloading the table does not grow
+	// the file.
+	load(1, 100)
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if after.Size() > before.Size() {
+		t.Fatalf("expected the file to stay at %d bytes, got %d", before.Size(), after.Size())
+	}
+
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	res = mustQuery(t, db, "SELECT COUNT(*) FROM events")
+	if res.Rows[0][0] != "100" {
+		t.Fatalf("expected 100 rows after reopening, got %v", res.Rows)
+	}
+	res = mustQuery(t, db, "SELECT id FROM events WHERE id = 42")
+	if len(res.Rows) != 1 {
+		t.Fatalf("expected index lookup after reopening, got %v", res.Rows)
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "check.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	mustExec(t, db, "CREATE TABLE customers(id INT NOT NULL, name VARCHAR(50), PRIMARY KEY(id))")
+	mustExec(t, db, "CREATE TABLE orders(id INT NOT NULL, customer_id INT, note VARCHAR(2000), PRIMARY KEY(id), FOREIGN KEY (customer_id) REFERENCES customers(id))")
+	mustExec(t, db, "CREATE INDEX idx_orders_customer ON orders(customer_id)")
+	for i := 1; i <= 5; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO customers(id, name) VALUES (%d, 'customer %d')", i, i))
+	}
+	for i := 1; i <= 40; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO orders(id, customer_id, note) VALUES (%d, %d, '%s')", i, i%5+1, strings.Repeat("n", 20*i)))
+	}
+	mustExec(t, db, "INSERT INTO orders(id, customer_id, note) VALUES (41, NULL, 'no customer')")
+	mustExec(t, db, "DELETE FROM orders WHERE id > 30")
+
+	res := mustQuery(t, db, "PRAGMA integrity_check")
+	if len(res.Rows) != 0 || res.Message != "Integrity check passed" {
+		t.Fatalf("expected a clean database, got %v (%s)", res.Rows, res.Message)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Damage the database behind the engine's back: delete a customer from
+	// the heap alone, leaving its index entry, row count and orders behind,
+	// and drop one entry from the orders index.
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("storage open: %v", err)
+	}
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("catalog load: %v", err)
+	}
+	customers, _ := cat.GetTable("customers")
+	heap := customers.HeapFile(mgr)
+	var victim storage.RowID
+	if err := heap.Scan(func(rid storage.RowID, _ []byte) error {
+		victim = rid
+		return nil
+	}); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if err := heap.Delete(nil, nil, victim); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	orders, _ := cat.GetTable("orders")
+	index, err := indexmgr.New(mgr).Open(orders.Indexes["idx_orders_customer"].Root)
+	if err != nil {
+		t.Fatalf("index open: %v", err)
+	}
+	entries, err := index.Entries()
+	if err != nil {
+		t.Fatalf("index entries: %v", err)
+	}
+	if err := index.Rebuild(nil, nil, entries[1:], false); err != nil {
+		t.Fatalf("index rebuild: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("storage close: %v", err)
+	}
+
+	reader, err := api.OpenWithOptions(path, api.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	defer reader.Close()
+	problems, err := reader.CheckIntegrity()
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	found := make(map[string]int)
+	for _, p := range problems {
+		found[p.Check+" "+p.Table]++
+	}
+	if found["row-count customers"] != 1 || found["index customers"] != 1 || found["index orders"] != 1 || found["foreign-key orders"] != 6 || len(problems) != 9 {
+		t.Fatalf("unexpected problems %+v", problems)
+	}
+	res = mustQuery(t, reader, "PRAGMA integrity_check")
+	if len(res.Rows) != len(problems) || res.Message != "Integrity check found 9 problem(s)" {
+		t.Fatalf("unexpected pragma result %v (%s)", res.Rows, res.Message)
+	}
+	if _, err := reader.Execute("PRAGMA page_size"); err == nil {
+		t.Fatalf("expected an unknown pragma to fail")
+	}
+}
+
+func TestOpenBuildsIndexesFromLegacyFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	mustExec(t, db, "CREATE TABLE people(id INT NOT NULL, name VARCHAR(32), PRIMARY KEY(id))")
+	mustExec(t, db, "CREATE UNIQUE INDEX idx_people_name ON people(name)")
+	for i := 1; i <= 200; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO people(id, name) VALUES (%d, 'person %03d')", i, i))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Make the index look like one an older engine kept in a file of its
+	// own: no tree recorded in the catalogue and a file next to the database.
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("storage open: %v", err)
+	}
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("catalog load: %v", err)
+	}
+	people, _ := cat.GetTable("people")
+	if err := storage.OpenBTree(mgr, people.Indexes["idx_people_name"].Root).Free(nil, nil); err != nil {
+		t.Fatalf("free index tree: %v", err)
+	}
+	if err := cat.SetIndexRoot("people", "idx_people_name", 0); err != nil {
+		t.Fatalf("clear index root: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("storage close: %v", err)
+	}
+	legacy := indexmgr.LegacyPath(path, "people", "idx_people_name")
+	if err := os.WriteFile(legacy, []byte("GRNIDX01\x02\x00\x00\x00"), 0o644); err != nil {
+		t.Fatalf("write index file: %v", err)
+	}
+
+	reader, err := api.OpenWithOptions(path, api.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("open read-only: %v", err)
+	}
+	res := mustQuery(t, reader, "SELECT id FROM people WHERE name = 'person 042'")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "42" {
+		t.Fatalf("unexpected rows before the rebuild %v", res.Rows)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("close read-only: %v", err)
+	}
+
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("expected the index file to be removed, got %v", err)
+	}
+	res = mustQuery(t, db, "SELECT id FROM people WHERE name = 'person 042'")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "42" {
+		t.Fatalf("unexpected rows after the rebuild %v", res.Rows)
+	}
+	if _, err := db.Execute("INSERT INTO people(id, name) VALUES (201, 'person 042')"); err == nil {
+		t.Fatalf("expected the rebuilt unique index to reject a duplicate")
+	}
+	res = mustQuery(t, db, "PRAGMA integrity_check")
+	if res.Message != "Integrity check passed" {
+		t.Fatalf("expected a clean database, got %v (%s)", res.Rows, res.Message)
+	}
+}
+
+func TestOpenBuildsLegacyPrimaryKeyIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	mustExec(t, db, "CREATE TABLE people(id INT NOT NULL, name VARCHAR(32), PRIMARY KEY(id))")
+	for i := 1; i <= 50; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO people(id, name) VALUES (%d, 'person %02d')", i, i))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Make the file look like a version 5 database, whose primary key had no
+	// index, and give it a duplicate key of the kind such a file could hold.
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("storage open: %v", err)
+	}
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("catalog load: %v", err)
+	}
+	people, _ := cat.GetTable("people")
+	if err := storage.OpenBTree(mgr, people.Indexes["pk_people"].Root).Free(nil, nil); err != nil {
+		t.Fatalf("free index tree: %v", err)
+	}
+	if err := cat.SetIndexRoot("people", "pk_people", 0); err != nil {
+		t.Fatalf("clear index root: %v", err)
+	}
+	record, err := engineexec.EncodeRow(people.Columns, []interface{}{int32(7), "impostor"})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	duplicate, err := people.HeapFile(mgr).Insert(nil, nil, record)
+	if err != nil {
+		t.Fatalf("insert duplicate: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("storage close: %v", err)
+	}
+	setVersion := func(version uint16) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("open file: %v", err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{byte(version), byte(version >> 8)}, 8); err != nil {
+			t.Fatalf("write version: %v", err)
+		}
+	}
+	setVersion(5)
+
+	if _, err := api.Open(path); err == nil || !strings.Contains(err.Error(), "pk_people") {
+		t.Fatalf("expected the duplicate key to stop the index build, got %v", err)
+	}
+	mgr, err = storage.Open(path)
+	if err != nil {
+		t.Fatalf("storage open: %v", err)
+	}
+	if err := people.HeapFile(mgr).Delete(nil, nil, duplicate); err != nil {
+		t.Fatalf("delete duplicate: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("storage close: %v", err)
+	}
+
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	// Covering indexes need version 8, which only an index with included
+	// columns asks for.
+	if version, err := storage.ReadFormatVersion(path); err != nil || version != 7 {
+		t.Fatalf("expected the build to move the file to version 7, got %d, %v", version, err)
+	}
+	if _, err := db.Execute("INSERT INTO people(id, name) VALUES (7, 'again')"); err == nil || !strings.Contains(err.Error(), "pk_people") {
+		t.Fatalf("expected the rebuilt primary key to reject a duplicate, got %v", err)
+	}
+	res := mustQuery(t, db, "PRAGMA integrity_check")
+	if res.Message != "Integrity check passed" {
+		t.Fatalf("expected a clean database, got %v (%s)", res.Rows, res.Message)
+	}
+}
+
+func TestOpenRebuildsIndexesWithLegacyKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	mustExec(t, db, "CREATE TABLE words(id INT NOT NULL, word VARCHAR(16) NOT NULL, PRIMARY KEY(id))")
+	mustExec(t, db, "CREATE INDEX idx_words_word ON words(word DESC)")
+	for i, word := range []string{"b", "abc", "ab", "c", "a"} {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO words(id, word) VALUES (%d, '%s')", i+1, word))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Make the file look like a version 6 database, whose trees held keys
+	// that did not sort in key order.
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("storage open: %v", err)
+	}
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("catalog load: %v", err)
+	}
+	words, _ := cat.GetTable("words")
+	oldRoot := words.Indexes["idx_words_word"].Root
+	for _, idx := range words.Indexes {
+		idx.LegacyKeys = true
+	}
+	if err := cat.SetRowCount("words", words.RowCount); err != nil {
+		t.Fatalf("persist catalogue: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("storage close: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{6, 0}, 8); err != nil {
+		t.Fatalf("write version: %v", err)
+	}
+	f.Close()
+
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	// Covering indexes need version 8, which only an index with included
+	// columns asks for.
+	if version, err := storage.ReadFormatVersion(path); err != nil || version != 7 {
+		t.Fatalf("expected the rebuild to move the file to version 7, got %d, %v", version, err)
+	}
+	res := mustQuery(t, db, "SELECT id FROM words WHERE word >= 'ab' AND word < 'b' ORDER BY word DESC")
+	if len(res.Rows) != 2 || res.Rows[0][0] != "2" || res.Rows[1][0] != "3" {
+		t.Fatalf("unexpected rows from the rebuilt index: %v", res.Rows)
+	}
+	if res := mustQuery(t, db, "PRAGMA integrity_check"); res.Message != "Integrity check passed" {
+		t.Fatalf("expected a clean database, got %v (%s)", res.Rows, res.Message)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	mgr, err = storage.Open(path)
+	if err != nil {
+		t.Fatalf("storage open: %v", err)
+	}
+	defer mgr.Close()
+	cat, err = catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("catalog load: %v", err)
+	}
+	words, _ = cat.GetTable("words")
+	idx := words.Indexes["idx_words_word"]
+	if idx.LegacyKeys || idx.Root == oldRoot || !idx.Desc(0) {
+		t.Fatalf("expected a rebuilt descending index, got %+v", idx)
+	}
+}
+
+func TestOpenSkipsLegacyIndexesWithLongKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy-long.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	long := strings.Repeat("k", 3000)
+	mustExec(t, db, "CREATE TABLE docs(id INT PRIMARY KEY, body VARCHAR(4000))")
+	mustExec(t, db, "INSERT INTO docs VALUES (1, 'short')")
+	mustExec(t, db, fmt.Sprintf("INSERT INTO docs VALUES (2, '%s')", long))
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Older engines kept indexes in files of their own and took keys of any
+	// length, so their catalogue may list an index no tree can hold.
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("storage open: %v", err)
+	}
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("catalog load: %v", err)
+	}
+	if _, err := cat.CreateIndex("docs", "idx_docs_body", []string{"body"}, nil, nil, false, 0); err != nil {
+		t.Fatalf("add legacy index: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("storage close: %v", err)
+	}
+	legacy := indexmgr.LegacyPath(path, "docs", "idx_docs_body")
+	if err := os.WriteFile(legacy, []byte("GRNIDX01\x02\x00\x00\x00"), 0o644); err != nil {
+		t.Fatalf("write index file: %v", err)
+	}
+
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("open with an oversized legacy index: %v", err)
+	}
+	defer db.Close()
+	res := mustQuery(t, db, "SELECT id FROM docs WHERE body = 'short'")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "1" {
+		t.Fatalf("unexpected rows %v", res.Rows)
+	}
+	mustExec(t, db, "INSERT INTO docs VALUES (3, 'another')")
+	mustExec(t, db, "DELETE FROM docs WHERE id = 2")
+
+	res = mustQuery(t, db, "PRAGMA integrity_check")
+	if len(res.Rows) != 1 || res.Rows[0][2] != "idx_docs_body" || !strings.Contains(res.Rows[0][4], "drop the index") {
+		t.Fatalf("expected the unbuilt index to be reported, got %v (%s)", res.Rows, res.Message)
+	}
+	mustExec(t, db, "DROP INDEX idx_docs_body")
+	res = mustQuery(t, db, "PRAGMA integrity_check")
+	if res.Message != "Integrity check passed" {
+		t.Fatalf("expected a clean database, got %v (%s)", res.Rows, res.Message)
+	}
+}
+
+func TestUpdateInPlace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "update.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, "CREATE TABLE items(id INT NOT NULL, body VARCHAR(2000), qty INT, PRIMARY KEY(id))")
+	mustExec(t, db, "CREATE UNIQUE INDEX idx_items_id ON items(id)")
+	mustExec(t, db, "CREATE INDEX idx_items_qty ON items(qty)")
+	for i := 1; i <= 10; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO items(id, body, qty) VALUES (%d, '%s', %d)", i, strings.Repeat("b", 100), i))
+	}
+	rowIDs := func() map[string]string {
+		t.Helper()
+		report, err := db.InspectHeap("items")
+		if err != nil {
+			t.Fatalf("inspect: %v", err)
+		}
+		ids := make(map[string]string)
+		for _, page := range report.Pages {
+			for _, row := range page.Rows {
+				ids[*row.Values[0]] = row.RowID
+			}
+		}
+		return ids
+	}
+	before := rowIDs()
+
+	mustExec(t, db, "UPDATE items SET body = 'short' WHERE id = 3")
+	res := mustQuery(t, db, "UPDATE items SET qty = qty + 100")
+	if res.RowsAffected != 10 {
+		t.Fatalf("expected 10 rows updated, got %d", res.RowsAffected)
+	}
+	mustExec(t, db, "BEGIN")
+	mustExec(t, db, fmt.Sprintf("UPDATE items SET body = '%s' WHERE id = 4", strings.Repeat("l", 300)))
+	mustExec(t, db, "ROLLBACK")
+	if after := rowIDs(); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Fatalf("expected rows to keep their RowIDs, got %v, had %v", after, before)
+	}
+	res = mustQuery(t, db, "SELECT id, body FROM items WHERE qty = 104")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "4" || res.Rows[0][1] != strings.Repeat("b", 100) {
+		t.Fatalf("unexpected rows %v", res.Rows)
+	}
+	if res := mustQuery(t, db, "SELECT id FROM items WHERE qty = 5"); len(res.Rows) != 0 {
+		t.Fatalf("expected the old index key to be gone, got %v", res.Rows)
+	}
+
+	// Rows that no longer fit on their page move, and are updated once.
+	res = mustQuery(t, db, fmt.Sprintf("UPDATE items SET body = '%s'", strings.Repeat("w", 1500)))
+	if res.RowsAffected != 10 {
+		t.Fatalf("expected 10 rows updated, got %d", res.RowsAffected)
+	}
+	res = mustQuery(t, db, "SELECT COUNT(*) FROM items WHERE body = '"+strings.Repeat("w", 1500)+"'")
+	if res.Rows[0][0] != "10" {
+		t.Fatalf("expected 10 updated rows, got %v", res.Rows)
+	}
+	res = mustQuery(t, db, "SELECT id FROM items WHERE qty = 107")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "7" {
+		t.Fatalf("expected index lookup after moving rows, got %v", res.Rows)
+	}
+	if res := mustQuery(t, db, "PRAGMA integrity_check"); len(res.Rows) != 0 {
+		t.Fatalf("expected a clean database, got %v", res.Rows)
+	}
+}
+
+func TestLargeValuesRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "large.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	mustExec(t, db, "CREATE TABLE docs(id INT NOT NULL, body VARCHAR(20000), PRIMARY KEY(id))")
+	first := strings.Repeat("0123456789", 1500)
+	second := strings.Repeat("abcdefghij", 1800)
+	mustExec(t, db, fmt.Sprintf("INSERT INTO docs(id, body) VALUES (1, '%s')", first))
+	mustExec(t, db, fmt.Sprintf("INSERT INTO docs(id, body) VALUES (2, '%s')", second))
+
+	res := mustQuery(t, db, "SELECT id, body FROM docs ORDER BY id")
+	if len(res.Rows) != 2 || res.Rows[0][1] != first || res.Rows[1][1] != second {
+		t.Fatalf("large values did not round-trip")
+	}
+
+	mustExec(t, db, fmt.Sprintf("UPDATE docs SET body = '%s' WHERE id = 1", second))
+	mustExec(t, db, "DELETE FROM docs WHERE id = 2")
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	res = mustQuery(t, db, "SELECT body FROM docs WHERE id = 1")
+	if len(res.Rows) != 1 || res.Rows[0][0] != second {
+		t.Fatalf("updated large value was not persisted")
+	}
+}
+
+func TestCreateWithPageSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "paged.gdb")
+	if err := api.CreateWithOptions(path, api.CreateOptions{PageSize: 8192}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, "CREATE TABLE wide(id INT NOT NULL, body VARCHAR(8000), PRIMARY KEY(id))")
+	body := strings.Repeat("w", 6000)
+	for i := 1; i <= 3; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO wide(id, body) VALUES (%d, '%s')", i, body))
+	}
+	res := mustQuery(t, db, "SELECT body FROM wide WHERE id = 2")
+	if len(res.Rows) != 1 || res.Rows[0][0] != body {
+		t.Fatalf("unexpected row on 8 KiB pages: %d rows", len(res.Rows))
+	}
+}
+
+// BenchmarkInsertRows measures row inserts against a database on disk, one
+// autocommitted statement per row and 1,000 rows per explicit transaction.
+func BenchmarkInsertRows(b *testing.B) {
+	run := func(b *testing.B, perTxn int) {
+		path := filepath.Join(b.TempDir(), "bench.gdb")
+		if err := api.Create(path); err != nil {
+			b.Fatalf("create: %v", err)
+		}
+		db, err := api.Open(path)
+		if err != nil {
+			b.Fatalf("open: %v", err)
+		}
+		defer db.Close()
+		exec := func(sql string) {
+			if _, err := db.Execute(sql); err != nil {
+				b.Fatalf("execute %q: %v", sql, err)
+			}
+		}
+		exec("CREATE TABLE events(id INT PRIMARY KEY, payload VARCHAR(64))")
+		b.ResetTimer()
+		id := 0
+		for i := 0; i < b.N; i++ {
+			if perTxn > 1 {
+				exec("BEGIN")
+			}
+			for j := 0; j < perTxn; j++ {
+				id++
+				exec(fmt.Sprintf("INSERT INTO events VALUES (%d, 'event payload %d')", id, id))
+			}
+			if perTxn > 1 {
+				exec("COMMIT")
+			}
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(id)/b.Elapsed().Seconds(), "rows/s")
+	}
+	b.Run("autocommit", func(b *testing.B) { run(b, 1) })
+	b.Run("txn-1000", func(b *testing.B) { run(b, 1000) })
+}
+
 func mustExec(t *testing.T, db *api.Database, sql string) {
 	t.Helper()
 	if _, err := db.Execute(sql); err != nil {
@@ -316,3 +1098,206 @@ func mustQuery(t *testing.T, db *api.Database, sql string) *engineexec.Result {
 func containsTimeout(msg string) bool {
 	return strings.Contains(msg, "lock timeout")
 }
+
+func TestOpenMemoryDatabase(t *testing.T) {
+	db, err := api.Open(api.MemoryPath)
+	if err != nil {
+		t.Fatalf("open memory: %v", err)
+	}
+	defer db.Close()
+
+	statements := []string{
+		"CREATE TABLE notes(id INT PRIMARY KEY, body VARCHAR(20000))",
+		"CREATE INDEX idx_notes_body ON notes(body)",
+		"INSERT INTO notes VALUES (1, 'first')",
+		fmt.Sprintf("INSERT INTO notes VALUES (2, '%s')", strings.Repeat("m", 12000)),
+	}
+	for _, stmt := range statements {
+		_, err := db.Execute(stmt)
+		if strings.HasPrefix(stmt, "CREATE INDEX") {
+			// Index keys must fit a quarter of a page.
+			if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+				t.Fatalf("%s: expected the index to be rejected, got %v", stmt, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	res, err := db.Execute("SELECT id FROM notes WHERE body = 'first'")
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if len(res.Rows) != 1 || res.Rows[0][0] != "1" {
+		t.Fatalf("unexpected rows %v", res.Rows)
+	}
+
+	// Each in-memory database is independent of every other.
+	other, err := api.OpenMemory()
+	if err != nil {
+		t.Fatalf("open second memory database: %v", err)
+	}
+	defer other.Close()
+	if _, err := other.Execute("SELECT * FROM notes"); err == nil {
+		t.Fatalf("expected second memory database to start empty")
+	}
+}
+
+func TestOpenLocksDatabaseAgainstOtherWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locked.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := db.Execute("CREATE TABLE t(id INT PRIMARY KEY)"); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if _, err := db.Execute("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	_, err = api.Open(path)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("locked by pid %d", os.Getpid())) {
+		t.Fatalf("expected a locked-by-pid error, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	readers := make([]*api.Database, 2)
+	for i := range readers {
+		reader, err := api.OpenWithOptions(path, api.OpenOptions{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("open reader %d: %v", i, err)
+		}
+		defer reader.Close()
+		readers[i] = reader
+	}
+	res, err := readers[1].Execute("SELECT id FROM t")
+	if err != nil || len(res.Rows) != 1 {
+		t.Fatalf("read-only select: %v, %v", res, err)
+	}
+	if _, err := readers[0].Execute("INSERT INTO t VALUES (2)"); !errors.Is(err, storage.ErrReadOnly) {
+		t.Fatalf("expected read-only insert to fail, got %v", err)
+	}
+	if _, err := api.Open(path); !errors.Is(err, storage.ErrLocked) {
+		t.Fatalf("expected a writer to be refused while readers are open, got %v", err)
+	}
+}
+
+func TestEncryptedDatabase(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.gdb")
+	t.Setenv(api.KeyEnv, "")
+	if err := api.CreateWithOptions(path, api.CreateOptions{Key: "first key"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.OpenWithOptions(path, api.OpenOptions{Key: "first key"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	secret := "confidential-" + strings.Repeat("s", 6000)
+	for _, stmt := range []string{
+		"CREATE TABLE vault(id INT PRIMARY KEY, note VARCHAR(8000))",
+		"CREATE INDEX idx_vault_note ON vault(note)",
+		"INSERT INTO vault VALUES (1, 'confidential-short')",
+		fmt.Sprintf("INSERT INTO vault VALUES (2, '%s')", secret),
+	} {
+		_, err := db.Execute(stmt)
+		if strings.HasPrefix(stmt, "CREATE INDEX") {
+			if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+				t.Fatalf("%s: expected the index to be rejected, got %v", stmt, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	for _, entry := range entries {
+		raw, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf("read %s: %v", entry.Name(), err)
+		}
+		if bytes.Contains(raw, []byte("confidential")) || bytes.Contains(raw, []byte("vault")) {
+			t.Fatalf("%s holds plaintext", entry.Name())
+		}
+	}
+
+	if _, err := api.Open(path); !errors.Is(err, storage.ErrKeyRequired) {
+		t.Fatalf("expected a missing key to be reported, got %v", err)
+	}
+	if _, err := api.OpenWithOptions(path, api.OpenOptions{Key: "wrong key"}); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Fatalf("expected a wrong key to fail, got %v", err)
+	}
+	if err := api.Rekey(path, "first key", "second key"); err != nil {
+		t.Fatalf("rekey: %v", err)
+	}
+	if _, err := api.OpenWithOptions(path, api.OpenOptions{Key: "first key"}); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Fatalf("expected the old key to stop working, got %v", err)
+	}
+
+	t.Setenv(api.KeyEnv, "second key")
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("open with key from environment: %v", err)
+	}
+	defer db.Close()
+	res, err := db.Execute("SELECT id FROM vault WHERE note = 'confidential-short'")
+	if err != nil || len(res.Rows) != 1 || res.Rows[0][0] != "1" {
+		t.Fatalf("lookup after rekey: %v, %v", res, err)
+	}
+	res, err = db.Execute("SELECT note FROM vault WHERE id = 2")
+	if err != nil || len(res.Rows) != 1 || res.Rows[0][0] != secret {
+		t.Fatalf("overflow value after rekey: %v", err)
+	}
+}
+
+func TestCompressedTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "compressed.gdb")
+	if err := api.Create(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := api.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := db.Execute("CREATE TABLE bad(id INT) WITH (compression = 'zstd')"); err == nil {
+		t.Fatalf("expected zstd to be rejected")
+	}
+	mustExec(t, db, "CREATE TABLE events(id INT PRIMARY KEY, city VARCHAR(100)) WITH (compression = 'lz4')")
+	for i := 0; i < 200; i++ {
+		mustExec(t, db, fmt.Sprintf("INSERT INTO events VALUES (%d, 'London, United Kingdom')", i))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	meta, err := api.LoadDatabaseMeta(path)
+	if err != nil {
+		t.Fatalf("meta: %v", err)
+	}
+	if len(meta.Tables) != 1 || meta.Tables[0].Compression != "lz4" {
+		t.Fatalf("expected lz4 compression in metadata, got %+v", meta.Tables)
+	}
+	db, err = api.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	res := mustQuery(t, db, "SELECT COUNT(*) FROM events WHERE city = 'London, United Kingdom'")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "200" {
+		t.Fatalf("expected 200 rows after reopen, got %v", res.Rows)
+	}
+}
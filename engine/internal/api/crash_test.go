@@ -0,0 +1,278 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/exec"
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/vfs"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// crashWorkload commits rows 1 to committed one statement at a time on a
+// crashable file system, leaves row 1000 in an open transaction and then
+// crashes, returning the file system a restarted process would find.
+func crashWorkload(t *testing.T, mode wal.SyncMode, committed int, powerLoss bool) *vfs.MemoryFS {
+	t.Helper()
+	const path = "crash.gdb"
+	fsys := vfs.NewCrashable()
+	if err := storage.NewWithOptions(path, storage.CreateOptions{FS: fsys}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := openFS(fsys, path, OpenOptions{})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	crashExec(t, db, "CREATE TABLE events(id INT NOT NULL, note VARCHAR(20), PRIMARY KEY(id))")
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	db, err = openFS(fsys, path, OpenOptions{Synchronous: mode})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	for i := 1; i <= committed; i++ {
+		crashExec(t, db, fmt.Sprintf("INSERT INTO events VALUES (%d, 'committed')", i))
+	}
+	crashExec(t, db, "BEGIN")
+	crashExec(t, db, "INSERT INTO events VALUES (1000, 'in flight')")
+	return fsys.Crash(powerLoss)
+}
+
+// survivingRows reopens a crashed file system, running recovery, and returns
+// the ids left in the table.
+func survivingRows(t *testing.T, fsys *vfs.MemoryFS) map[string]bool {
+	t.Helper()
+	db, err := openFS(fsys, "crash.gdb", OpenOptions{})
+	if err != nil {
+		t.Fatalf("open after crash: %v", err)
+	}
+	defer db.Close()
+	res, err := db.Execute("SELECT id FROM events")
+	if err != nil {
+		t.Fatalf("select after crash: %v", err)
+	}
+	ids := make(map[string]bool, len(res.Rows))
+	for _, row := range res.Rows {
+		ids[row[0]] = true
+	}
+	return ids
+}
+
+func crashExec(t *testing.T, db *Database, sql string) *exec.Result {
+	t.Helper()
+	res, err := db.Execute(sql)
+	if err != nil {
+		t.Fatalf("execute %q: %v", sql, err)
+	}
+	return res
+}
+
+func TestSynchronousModesSurviveCrashes(t *testing.T) {
+	const committed = 20
+	cases := []struct {
+		name      string
+		mode      wal.SyncMode
+		powerLoss bool
+		// durable is whether every committed row must survive; otherwise
+		// the database need only come back without the lost rows.
+		durable bool
+	}{
+		{"full/power-loss", wal.SyncFull, true, true},
+		{"normal/power-loss", wal.SyncNormal, true, true},
+		{"normal/process-crash", wal.SyncNormal, false, true},
+		{"off/process-crash", wal.SyncOff, false, true},
+		{"off/power-loss", wal.SyncOff, true, false},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ids := survivingRows(t, crashWorkload(t, tc.mode, committed, tc.powerLoss))
+			if ids["1000"] {
+				t.Fatalf("the uncommitted row survived the crash")
+			}
+			if tc.durable && len(ids) != committed {
+				t.Fatalf("expected all %d committed rows to survive, got %d", committed, len(ids))
+			}
+			if len(ids) > committed {
+				t.Fatalf("expected at most %d rows, got %d", committed, len(ids))
+			}
+		})
+	}
+}
+
+func TestSynchronousFullSyncsEveryRecord(t *testing.T) {
+	records := func(fsys *vfs.MemoryFS) int {
+		t.Helper()
+		log, err := wal.OpenWithOptions("crash.gdb", wal.Options{FS: fsys})
+		if err != nil {
+			t.Fatalf("open wal: %v", err)
+		}
+		defer log.Close()
+		recs, err := log.Scan()
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		return len(recs)
+	}
+	// Under FULL even the open transaction's page images reach the disk;
+	// under NORMAL they wait for a commit or a page write-back.
+	if full, kept := records(crashWorkload(t, wal.SyncFull, 5, true)), records(crashWorkload(t, wal.SyncFull, 5, false)); full != kept {
+		t.Fatalf("FULL lost log records in a power loss: %d of %d kept", full, kept)
+	}
+	if normal, kept := records(crashWorkload(t, wal.SyncNormal, 5, true)), records(crashWorkload(t, wal.SyncNormal, 5, false)); normal >= kept {
+		t.Fatalf("expected NORMAL to leave the open transaction unsynced, %d of %d kept", normal, kept)
+	}
+}
+
+func TestSetSynchronous(t *testing.T) {
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+	res, err := db.Execute("SET synchronous = off")
+	if err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if res.Message != "Synchronous set to OFF" || db.wal.SyncMode() != wal.SyncOff {
+		t.Fatalf("unexpected result %q with mode %s", res.Message, db.wal.SyncMode())
+	}
+	if _, err := db.Execute("SET synchronous = sometimes"); err == nil {
+		t.Fatalf("expected an unknown mode to fail")
+	}
+	if _, err := db.Execute("SET journal_mode = wal"); err == nil {
+		t.Fatalf("expected an unknown setting to fail")
+	}
+}
+
+// TestCrashKeepsIndexesInStep crashes a database whose log holds a committed
+// transaction that never reached the data file, a rolled-back one and an
+// unfinished one whose heap and index pages did, as if evicted, and checks
+// that recovery leaves the table and its index agreeing.
+func TestCrashKeepsIndexesInStep(t *testing.T) {
+	const path = "index-crash.gdb"
+	name := func(id int) string { return fmt.Sprintf("item-%04d-%s", id, "abcdefghijklmnopqrst") }
+	fsys := vfs.NewCrashable()
+	if err := storage.NewWithOptions(path, storage.CreateOptions{FS: fsys}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	db, err := openFS(fsys, path, OpenOptions{})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	crashExec(t, db, "CREATE TABLE items(id INT NOT NULL, name VARCHAR(40), PRIMARY KEY(id))")
+	crashExec(t, db, "CREATE INDEX idx_items_name ON items(name)")
+	for id := 0; id < 300; id++ {
+		crashExec(t, db, fmt.Sprintf("INSERT INTO items VALUES (%d, '%s')", id, name(id)))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	db, err = openFS(fsys, path, OpenOptions{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	crashExec(t, db, "DELETE FROM items WHERE id < 50")
+	crashExec(t, db, "BEGIN")
+	crashExec(t, db, "DELETE FROM items WHERE id >= 250")
+	crashExec(t, db, "ROLLBACK")
+	crashExec(t, db, "BEGIN")
+	for id := 300; id < 500; id++ {
+		crashExec(t, db, fmt.Sprintf("INSERT INTO items VALUES (%d, '%s')", id, name(id)))
+	}
+	crashExec(t, db, "DELETE FROM items WHERE id >= 100 AND id < 200")
+	if err := db.storage.Flush(); err != nil {
+		t.Fatalf("write back: %v", err)
+	}
+
+	db, err = openFS(fsys.Crash(true), path, OpenOptions{})
+	if err != nil {
+		t.Fatalf("open after crash: %v", err)
+	}
+	defer db.Close()
+	if res := crashExec(t, db, "SELECT COUNT(*) FROM items"); res.Rows[0][0] != "250" {
+		t.Fatalf("expected 250 rows after recovery, got %s", res.Rows[0][0])
+	}
+	for id, want := range map[int]int{10: 0, 120: 1, 260: 1, 400: 0} {
+		res := crashExec(t, db, fmt.Sprintf("SELECT id FROM items WHERE name = '%s'", name(id)))
+		if len(res.Rows) != want {
+			t.Fatalf("expected %d row(s) named after %d, got %v", want, id, res.Rows)
+		}
+	}
+	// Pages the unfinished transaction allocated are left unused.
+	for _, row := range crashExec(t, db, "PRAGMA integrity_check").Rows {
+		if row[0] != "unused" {
+			t.Fatalf("unexpected problem after recovery: %v", row)
+		}
+	}
+	crashExec(t, db, "VACUUM FULL")
+	if res := crashExec(t, db, "PRAGMA integrity_check"); len(res.Rows) != 0 {
+		t.Fatalf("expected VACUUM FULL to leave a clean database, got %v", res.Rows)
+	}
+}
+
+func TestCrashKeepsFreeListIntact(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		release   []string
+		powerLoss bool
+	}{
+		{name: "truncate", release: []string{"TRUNCATE TABLE a"}},
+		{name: "truncate power loss", release: []string{"TRUNCATE TABLE a"}, powerLoss: true},
+		// The deleted rows log images of the pages VACUUM then frees, which
+		// recovery replays.
+		{name: "vacuum", release: []string{"DELETE FROM a WHERE id >= 20", "VACUUM a"}},
+		{name: "vacuum power loss", release: []string{"DELETE FROM a WHERE id >= 20", "VACUUM a"}, powerLoss: true},
+		{name: "drop table", release: []string{"DELETE FROM a WHERE id >= 20", "DROP TABLE a"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const path = "free-crash.gdb"
+			fsys := vfs.NewCrashable()
+			if err := storage.NewWithOptions(path, storage.CreateOptions{FS: fsys}); err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			db, err := openFS(fsys, path, OpenOptions{})
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			crashExec(t, db, "CREATE TABLE a(id INT NOT NULL, note VARCHAR(200), PRIMARY KEY(id))")
+			crashExec(t, db, "CREATE TABLE b(id INT NOT NULL, note VARCHAR(200), PRIMARY KEY(id))")
+			for id := 0; id < 300; id++ {
+				crashExec(t, db, fmt.Sprintf("INSERT INTO a VALUES (%d, '%0200d')", id, id))
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			db, err = openFS(fsys, path, OpenOptions{})
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer db.Close()
+			for _, sql := range tc.release {
+				crashExec(t, db, sql)
+			}
+
+			db, err = openFS(fsys.Crash(tc.powerLoss), path, OpenOptions{})
+			if err != nil {
+				t.Fatalf("open after crash: %v", err)
+			}
+			defer db.Close()
+			// Every page handed out comes off the free list.
+			for id := 0; id < 300; id++ {
+				crashExec(t, db, fmt.Sprintf("INSERT INTO b VALUES (%d, '%0200d')", id, id))
+			}
+			for _, row := range crashExec(t, db, "PRAGMA integrity_check").Rows {
+				if row[0] != "unused" {
+					t.Fatalf("unexpected problem after recovery: %v", row)
+				}
+			}
+		})
+	}
+}
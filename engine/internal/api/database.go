@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
@@ -15,6 +16,7 @@ import (
 	"github.com/example/granite-db/engine/internal/storage"
 	"github.com/example/granite-db/engine/internal/storage/indexmgr"
 	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/vfs"
 	"github.com/example/granite-db/engine/internal/wal"
 )
 
@@ -31,40 +33,153 @@ type Database struct {
 	sessions map[int64]*txn.Transaction
 }
 
+// CreateOptions configures a database created by CreateWithOptions.
+type CreateOptions struct {
+	// PageSize selects the page size in bytes; zero uses the default of
+	// storage.PageSize.
+	PageSize int
+	// Key, when set, encrypts the database, indexes included, and its WAL
+	// with a data key protected by this passphrase.
+	Key string
+}
+
 // Create initialises a new GraniteDB database file at the given path.
 func Create(path string) error {
-	return storage.New(path)
+	return CreateWithOptions(path, CreateOptions{})
+}
+
+// CreateWithOptions initialises a new GraniteDB database file using the
+// supplied options.
+func CreateWithOptions(path string, opts CreateOptions) error {
+	if path == MemoryPath {
+		return fmt.Errorf("api: %s databases are created by Open and need no file", MemoryPath)
+	}
+	return storage.NewWithOptions(path, storage.CreateOptions{PageSize: opts.PageSize, Key: opts.Key})
 }
 
-// Open loads an existing database and prepares it for SQL execution.
+// MemoryPath is the path that Open treats as a request for an in-memory
+// database.
+const MemoryPath = ":memory:"
+
+// OpenOptions configures how Open attaches to an existing database.
+type OpenOptions struct {
+	// ReadOnly opens the database for queries only. Any number of read-only
+	// openers may share a database, but not with a writer.
+	ReadOnly bool
+	// LockTimeout is how long to wait for another process to release the
+	// database. Zero fails immediately with a storage.LockedError.
+	LockTimeout time.Duration
+	// Key is the passphrase of an encrypted database. When empty, the
+	// KeyEnv environment variable is used for encrypted databases.
+	Key string
+	// CommitWindow is how long a commit waits for concurrent commits to
+	// share its log flush. Zero flushes at once.
+	CommitWindow time.Duration
+	// Synchronous selects when the log is synced and so which crashes a
+	// committed transaction survives. The zero value is wal.SyncFull; it
+	// can be changed later with SET synchronous.
+	Synchronous wal.SyncMode
+}
+
+// KeyEnv names the environment variable holding the passphrase of encrypted
+// databases opened without an explicit key.
+const KeyEnv = "GRANITEDB_KEY"
+
+// Open loads an existing database and prepares it for SQL execution. Opening
+// MemoryPath returns a fresh in-memory database, as OpenMemory does.
 func Open(path string) (*Database, error) {
-	mgr, err := storage.Open(path)
-	if err != nil {
+	return OpenWithOptions(path, OpenOptions{})
+}
+
+// OpenWithOptions loads an existing database using the supplied options. The
+// database stays locked against conflicting openers, in this process or any
+// other, until it is closed.
+func OpenWithOptions(path string, opts OpenOptions) (*Database, error) {
+	if path == MemoryPath {
+		return OpenMemory()
+	}
+	return openFS(vfs.OS, path, opts)
+}
+
+// OpenMemory creates a throwaway database whose data file and WAL live in
+// memory. Everything is discarded when the database is closed.
+func OpenMemory() (*Database, error) {
+	fsys := vfs.NewMemory()
+	if err := storage.NewWithOptions(MemoryPath, storage.CreateOptions{FS: fsys}); err != nil {
 		return nil, err
 	}
-	log, err := wal.Open(path)
+	return openFS(fsys, MemoryPath, OpenOptions{})
+}
+
+func openFS(fsys vfs.FS, path string, opts OpenOptions) (*Database, error) {
+	key, err := resolveKey(fsys, path, opts.Key)
 	if err != nil {
-		mgr.Close()
 		return nil, err
 	}
-	if err := recoverDatabase(mgr, log); err != nil {
-		log.Close()
-		mgr.Close()
+	mgr, err := storage.OpenWithOptions(path, storage.Options{
+		FS:          fsys,
+		ReadOnly:    opts.ReadOnly,
+		LockTimeout: opts.LockTimeout,
+		Key:         key,
+	})
+	if err != nil {
 		return nil, err
 	}
+	// A read-only database has no log: it cannot replay one and writes
+	// nothing to it.
+	var log *wal.Manager
+	recovered := false
+	if opts.ReadOnly {
+		pending, err := wal.HasRecords(fsys, path)
+		if err != nil {
+			mgr.Close()
+			return nil, err
+		}
+		if pending {
+			mgr.Close()
+			return nil, fmt.Errorf("api: database %s needs recovery; open it for writing first", path)
+		}
+	} else {
+		log, err = wal.OpenWithOptions(path, wal.Options{FS: fsys, Cipher: mgr.Cipher(), CommitWindow: opts.CommitWindow, Synchronous: opts.Synchronous})
+		if err != nil {
+			mgr.Close()
+			return nil, err
+		}
+		mgr.SetLogFlusher(log)
+		if recovered, err = recoverDatabase(mgr, log); err != nil {
+			log.Close()
+			mgr.Close()
+			return nil, err
+		}
+	}
 	cat, err := catalog.Load(mgr)
 	if err != nil {
 		log.Close()
 		mgr.Close()
 		return nil, err
 	}
-	idx := indexmgr.New(mgr.Path())
+	idx := indexmgr.New(mgr)
 	locks := txn.NewLockManager(0)
 	txns := txn.NewManager(locks, log)
+	executor := exec.New(cat, mgr, idx, locks, log)
+	if recovered {
+		if err := executor.RecountRows(); err != nil {
+			log.Close()
+			mgr.Close()
+			return nil, err
+		}
+	}
+	if !opts.ReadOnly {
+		if err := buildIndexTrees(fsys, mgr, executor); err != nil {
+			log.Close()
+			mgr.Close()
+			return nil, err
+		}
+	}
 	return &Database{
 		storage:  mgr,
 		catalog:  cat,
-		executor: exec.New(cat, mgr, idx, locks, log),
+		executor: executor,
 		indexes:  idx,
 		locks:    locks,
 		txns:     txns,
@@ -73,6 +188,57 @@ func Open(path string) (*Database, error) {
 	}, nil
 }
 
+// buildIndexTrees rebuilds, inside the database file, the indexes that older
+// engines kept in files of their own or whose keys use the older encoding,
+// and removes any such files once the new trees are on disk.
+func buildIndexTrees(fsys vfs.FS, mgr *storage.Manager, executor *exec.Executor) error {
+	built, err := executor.BuildIndexTrees()
+	if err != nil || len(built) == 0 {
+		return err
+	}
+	if err := mgr.Flush(); err != nil {
+		return err
+	}
+	for _, index := range built {
+		err := fsys.Remove(indexmgr.LegacyPath(mgr.Path(), index.Table, index.Index))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveKey returns the passphrase to open the database with: the explicit
+// key if given, otherwise KeyEnv when the database is encrypted.
+func resolveKey(fsys vfs.FS, path, key string) (string, error) {
+	if key != "" {
+		return key, nil
+	}
+	encrypted, err := storage.Encrypted(fsys, path)
+	if err != nil || !encrypted {
+		return "", err
+	}
+	key = os.Getenv(KeyEnv)
+	if key == "" {
+		return "", fmt.Errorf("api: database %s is encrypted; supply a key or set %s: %w", path, KeyEnv, storage.ErrKeyRequired)
+	}
+	return key, nil
+}
+
+// Rekey changes the passphrase protecting an encrypted database. The
+// database must not be open elsewhere.
+func Rekey(path, oldKey, newKey string) error {
+	mgr, err := storage.OpenWithOptions(path, storage.Options{Key: oldKey})
+	if err != nil {
+		return err
+	}
+	err = mgr.Rekey(newKey)
+	if closeErr := mgr.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // Close flushes data and releases resources.
 func (db *Database) Close() error {
 	if db.storage == nil {
@@ -81,14 +247,32 @@ func (db *Database) Close() error {
 	if db.indexes != nil {
 		_ = db.indexes.Close()
 	}
+	// Write back the buffer pool before the log goes away: dirty pages may
+	// still need the log forced up to their LSN.
+	err := db.storage.Close()
+	if err == nil && db.idle() {
+		// Every logged change is now in the data file, so the log can start
+		// afresh and the next open has nothing to replay.
+		err = db.wal.Reset()
+	}
 	if db.wal != nil {
 		_ = db.wal.Close()
 	}
-	err := db.storage.Close()
 	db.storage = nil
 	return err
 }
 
+func (db *Database) idle() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, tx := range db.sessions {
+		if tx != nil && tx.State() == txn.StateActive {
+			return false
+		}
+	}
+	return true
+}
+
 // Execute parses and executes the provided SQL statement string.
 func (db *Database) Execute(sql string) (*exec.Result, error) {
 	stmt, err := parser.Parse(sql)
@@ -96,7 +280,9 @@ func (db *Database) Execute(sql string) (*exec.Result, error) {
 		return nil, err
 	}
 	session := currentSessionID()
-	switch stmt.(type) {
+	switch s := stmt.(type) {
+	case *parser.SetStmt:
+		return db.set(s)
 	case *parser.BeginStmt:
 		return db.begin(session)
 	case *parser.CommitStmt:
@@ -137,6 +323,22 @@ func (db *Database) ExecuteJSON(sql string) ([]byte, error) {
 	return json.Marshal(payload)
 }
 
+// set changes a database-wide setting. The only one is synchronous.
+func (db *Database) set(stmt *parser.SetStmt) (*exec.Result, error) {
+	if stmt.Name != "synchronous" {
+		return nil, fmt.Errorf("api: unknown setting %s", stmt.Name)
+	}
+	mode, err := wal.ParseSyncMode(stmt.Value)
+	if err != nil {
+		return nil, err
+	}
+	if db.wal == nil {
+		return nil, storage.ErrReadOnly
+	}
+	db.wal.SetSyncMode(mode)
+	return &exec.Result{Message: fmt.Sprintf("Synchronous set to %s", mode)}, nil
+}
+
 func (db *Database) begin(session int64) (*exec.Result, error) {
 	if db.txns == nil {
 		return nil, fmt.Errorf("api: transaction support unavailable")
@@ -185,6 +387,9 @@ func (db *Database) executeStatement(session int64, stmt parser.Statement) (*exe
 	if db.executor == nil {
 		return nil, fmt.Errorf("api: database not open")
 	}
+	if !readOnlyStatement(stmt) && db.storage != nil && db.storage.ReadOnly() {
+		return nil, storage.ErrReadOnly
+	}
 	var (
 		tx         *txn.Transaction
 		autocommit bool
@@ -216,6 +421,38 @@ func (db *Database) executeStatement(session int64, stmt parser.Statement) (*exe
 	return res, nil
 }
 
+// readOnlyStatement reports whether stmt can run against a read-only database.
+func readOnlyStatement(stmt parser.Statement) bool {
+	switch stmt.(type) {
+	case *parser.SelectStmt, *parser.PragmaStmt:
+		return true
+	default:
+		return false
+	}
+}
+
+// CheckIntegrity verifies the database's pages, rows, indexes and foreign
+// keys, returning every problem found. An empty list means the database is
+// sound. It works on read-only databases.
+func (db *Database) CheckIntegrity() ([]storage.Problem, error) {
+	if db.executor == nil || db.txns == nil {
+		return nil, fmt.Errorf("api: database not open")
+	}
+	tx := db.txns.Begin()
+	tx.SetAutocommit(true)
+	problems, err := db.executor.CheckIntegrity(tx)
+	if err != nil {
+		if rbErr := db.txns.Rollback(tx.ID()); rbErr != nil {
+			return nil, fmt.Errorf("api: rollback failed after error: %v (original: %w)", rbErr, err)
+		}
+		return nil, err
+	}
+	if err := db.txns.Commit(tx.ID()); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
 // Explain parses the SQL string and returns the executor's plan representation.
 func (db *Database) Explain(sql string) (*exec.Plan, error) {
 	stmt, err := parser.Parse(sql)
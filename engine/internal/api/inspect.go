@@ -0,0 +1,154 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/example/granite-db/engine/internal/catalog"
+	"github.com/example/granite-db/engine/internal/exec"
+	"github.com/example/granite-db/engine/internal/storage"
+)
+
+// PageReport is a decoded page as shown by granitectl inspect. Heap pages also
+// carry their rows.
+type PageReport struct {
+	storage.PageInfo
+	Rows []RowReport `json:"rows,omitempty"`
+}
+
+// RowReport is one row of a heap page. Values holds the decoded columns, with
+// nil for NULL; Error explains why the row could not be read instead.
+type RowReport struct {
+	RowID  string    `json:"rowId"`
+	Values []*string `json:"values,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// HeapReport is the decoded heap chain of a table.
+type HeapReport struct {
+	Table        string         `json:"table"`
+	Columns      []string       `json:"columns"`
+	Root         storage.PageID `json:"root"`
+	FreeSpaceMap storage.PageID `json:"freeSpaceMap"`
+	Pages        []PageReport   `json:"pages"`
+	// Problem reports a chain that loops or leaves the file; Pages then holds
+	// the pages read before it.
+	Problem string `json:"problem,omitempty"`
+}
+
+// InspectPage decodes a single page for debugging.
+func (db *Database) InspectPage(id storage.PageID) (*PageReport, error) {
+	if db.storage == nil || db.catalog == nil {
+		return nil, fmt.Errorf("api: database not open")
+	}
+	heaps := make(map[string]*storage.HeapFile)
+	tables := make(map[string]*catalog.Table)
+	var indexes []storage.IndexTree
+	for _, snapshot := range db.catalog.ListTables() {
+		if table, ok := db.catalog.GetTable(snapshot.Name); ok {
+			heaps[table.Name] = table.HeapFile(db.storage)
+			tables[table.Name] = table
+			for _, idx := range table.Indexes {
+				if idx.Root != 0 {
+					indexes = append(indexes, storage.IndexTree{Table: table.Name, Index: idx.Name, Tree: storage.OpenBTree(db.storage, idx.Root)})
+				}
+			}
+		}
+	}
+	info, err := db.storage.InspectPage(id, heaps, indexes)
+	if err != nil {
+		return nil, err
+	}
+	report := &PageReport{PageInfo: *info}
+	if table, ok := tables[info.Table]; ok && info.Heap != nil {
+		report.Rows = db.inspectRows(table, heaps[table.Name], id, info.Heap)
+	}
+	return report, nil
+}
+
+// InspectHeap decodes every page of a table's heap chain, with its rows.
+func (db *Database) InspectHeap(name string) (*HeapReport, error) {
+	if db.storage == nil || db.catalog == nil {
+		return nil, fmt.Errorf("api: database not open")
+	}
+	table, ok := db.catalog.GetTable(name)
+	if !ok {
+		return nil, fmt.Errorf("api: table %s not found", name)
+	}
+	heap := table.HeapFile(db.storage)
+	report := &HeapReport{Table: table.Name, Root: heap.Root(), FreeSpaceMap: heap.FreeSpaceMap(), Pages: []PageReport{}}
+	for _, col := range table.Columns {
+		report.Columns = append(report.Columns, col.Name)
+	}
+	pages, err := db.storage.InspectHeap(heap)
+	if err != nil {
+		report.Problem = err.Error()
+	}
+	for _, page := range pages {
+		page.Table = table.Name
+		report.Pages = append(report.Pages, PageReport{PageInfo: page, Rows: db.inspectRows(table, heap, page.ID, page.Heap)})
+	}
+	return report, nil
+}
+
+// InspectFreeList lists the pages on the database free list.
+func (db *Database) InspectFreeList() (*storage.FreeListInfo, error) {
+	if db.storage == nil {
+		return nil, fmt.Errorf("api: database not open")
+	}
+	return db.storage.InspectFreeList()
+}
+
+func (db *Database) inspectRows(table *catalog.Table, heap *storage.HeapFile, id storage.PageID, page *storage.HeapPageInfo) []RowReport {
+	rows := make([]RowReport, 0, page.LiveSlots)
+	for _, slot := range page.Slots {
+		if !slot.Live {
+			continue
+		}
+		row := RowReport{RowID: fmt.Sprintf("%d:%d", id, slot.Slot)}
+		record, err := heap.Fetch(storage.RowID{Page: id, Slot: slot.Slot})
+		if err != nil {
+			row.Error = err.Error()
+			rows = append(rows, row)
+			continue
+		}
+		values, err := exec.DecodeRow(table.Columns, record)
+		if err != nil {
+			row.Error = err.Error()
+			rows = append(rows, row)
+			continue
+		}
+		for i, value := range values {
+			row.Values = append(row.Values, formatInspectValue(table.Columns[i], value))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func formatInspectValue(col catalog.Column, value interface{}) *string {
+	if value == nil {
+		return nil
+	}
+	var text string
+	switch v := value.(type) {
+	case decimal.Decimal:
+		text = v.StringFixed(int32(col.Scale))
+	case time.Time:
+		if col.Type == catalog.ColumnTypeDate {
+			text = v.Format("2006-01-02")
+		} else {
+			text = v.Format(time.RFC3339)
+		}
+	case bool:
+		text = "FALSE"
+		if v {
+			text = "TRUE"
+		}
+	default:
+		text = fmt.Sprintf("%v", v)
+	}
+	return &text
+}
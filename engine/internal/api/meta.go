@@ -19,6 +19,7 @@ type DatabaseMeta struct {
 type TableMeta struct {
 	Name        string           `json:"name"`
 	RowCount    int64            `json:"rowCount"`
+	Compression string           `json:"compression"`
 	Columns     []ColumnMeta     `json:"columns"`
 	Indexes     []IndexMeta      `json:"indexes"`
 	ForeignKeys []ForeignKeyMeta `json:"foreignKeys"`
@@ -51,9 +52,16 @@ type ForeignKeyMeta struct {
 	OnUpdate    string   `json:"onUpdate"`
 }
 
-// LoadDatabaseMeta opens the database at dbPath and extracts catalogue metadata.
+// LoadDatabaseMeta opens the database at dbPath read-only and extracts
+// catalogue metadata.
 func LoadDatabaseMeta(dbPath string) (DatabaseMeta, error) {
-	db, err := Open(dbPath)
+	return LoadDatabaseMetaWithOptions(dbPath, OpenOptions{ReadOnly: true})
+}
+
+// LoadDatabaseMetaWithOptions extracts catalogue metadata, opening the
+// database with the supplied options.
+func LoadDatabaseMetaWithOptions(dbPath string, opts OpenOptions) (DatabaseMeta, error) {
+	db, err := OpenWithOptions(dbPath, opts)
 	if err != nil {
 		return DatabaseMeta{}, err
 	}
@@ -160,6 +168,7 @@ func buildTableMeta(table *catalog.Table) TableMeta {
 	return TableMeta{
 		Name:        table.Name,
 		RowCount:    rowCount,
+		Compression: table.Compression.String(),
 		Columns:     columns,
 		Indexes:     indexes,
 		ForeignKeys: foreignKeys,
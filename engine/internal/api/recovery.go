@@ -1,47 +1,121 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/example/granite-db/engine/internal/storage"
 	"github.com/example/granite-db/engine/internal/wal"
 )
 
-func recoverDatabase(mgr *storage.Manager, log *wal.Manager) error {
+// recoverDatabase brings the data file back in line with the log after a
+// crash. Transactions that ended, by committing or by rolling back, are
+// redone: a rollback logs the pages it puts back like any other change, so
+// replaying them leaves no trace of the transaction. Transactions that never
+// ended are undone instead, by restoring each page they changed to the image
+// logged before their first change to it. Index pages are logged like heap
+// pages, so the two come back in step.
+//
+// A single pass in log order suffices because a transaction holds an
+// exclusive lock on every table it changes until it ends, and frees pages
+// only after that: nobody else changes a page between an unfinished
+// transaction's first change and the crash. Pages of the catalogue chain are
+// skipped: the chain is written outside the log, so an image the log holds
+// for one of them dates from before the page was freed and reused. Once every
+// page is written back, the log is emptied, so that the transactions of the
+// next session, whose ids start again from one, are never mistaken for these.
+// It reports whether the log held anything to recover.
+func recoverDatabase(mgr *storage.Manager, log *wal.Manager) (bool, error) {
 	if log == nil {
-		return nil
+		return false, nil
 	}
 	records, err := log.Scan()
 	if err != nil {
-		return err
+		return false, err
 	}
-	committed := make(map[uint64]bool)
-	aborted := make(map[uint64]bool)
+	ended := make(map[uint64]bool)
 	for _, rec := range records {
 		switch rec.Type {
-		case wal.RecordCommit:
-			committed[rec.TxnID] = true
-		case wal.RecordAbort:
-			aborted[rec.TxnID] = true
+		case wal.RecordCommit, wal.RecordAbort:
+			ended[rec.TxnID] = true
 		}
 	}
+	if err := repairTornPages(mgr, records); err != nil {
+		return false, err
+	}
+	catalog, err := mgr.CatalogPages()
+	if err != nil {
+		return false, err
+	}
+	unlogged := make(map[uint32]bool, len(catalog))
+	for _, id := range catalog {
+		unlogged[uint32(id)] = true
+	}
+	pageCount := mgr.InspectHeader().PageCount
 	for _, rec := range records {
-		switch rec.Type {
-		case wal.RecordInsert, wal.RecordUpdate, wal.RecordDelete, wal.RecordPageMeta:
-			if rec.TxnID == 0 {
-				continue
-			}
-			if !committed[rec.TxnID] || aborted[rec.TxnID] {
-				continue
-			}
-			if len(rec.Payload) != storage.PageSize {
-				return fmt.Errorf("api: invalid WAL payload length for page %d", rec.PageID)
-			}
-			page := make([]byte, len(rec.Payload))
-			copy(page, rec.Payload)
-			if err := mgr.WritePage(storage.PageID(rec.PageID), page); err != nil {
-				return err
-			}
+		if !isPageImage(rec.Type) || rec.TxnID == 0 || unlogged[rec.PageID] {
+			continue
+		}
+		// Redo applies the images written by a change, undo the images
+		// logged ahead of one.
+		undo := !ended[rec.TxnID]
+		if undo != (rec.Type == wal.RecordBeforeImage) {
+			continue
+		}
+		if undo && rec.PageID >= pageCount {
+			// The page was allocated by the unfinished transaction and the
+			// file never grew to hold it, so there is nothing to undo.
+			continue
+		}
+		if len(rec.Payload) != mgr.PageSize() {
+			return false, fmt.Errorf("api: invalid WAL payload length for page %d", rec.PageID)
+		}
+		page := make([]byte, len(rec.Payload))
+		copy(page, rec.Payload)
+		if err := mgr.WritePage(storage.PageID(rec.PageID), page); err != nil {
+			return false, err
+		}
+	}
+	if len(records) == 0 {
+		return false, nil
+	}
+	if err := mgr.Flush(); err != nil {
+		return false, err
+	}
+	return true, log.Reset()
+}
+
+func isPageImage(typ wal.RecordType) bool {
+	switch typ {
+	case wal.RecordInsert, wal.RecordUpdate, wal.RecordDelete, wal.RecordPageMeta, wal.RecordIndexPage, wal.RecordBeforeImage:
+		return true
+	}
+	return false
+}
+
+// repairTornPages restores pages whose on-disk checksum fails from the newest
+// full-page image in the log, whatever the outcome of the transaction that
+// wrote it. Redo and undo then run on top as usual.
+func repairTornPages(mgr *storage.Manager, records []wal.Record) error {
+	latest := make(map[uint32][]byte)
+	order := make([]uint32, 0)
+	for _, rec := range records {
+		if !isPageImage(rec.Type) || len(rec.Payload) != mgr.PageSize() {
+			continue
+		}
+		if _, seen := latest[rec.PageID]; !seen {
+			order = append(order, rec.PageID)
+		}
+		latest[rec.PageID] = rec.Payload
+	}
+	for _, id := range order {
+		if _, err := mgr.ReadPage(storage.PageID(id)); !errors.Is(err, storage.ErrCorruptPage) {
+			continue
+		}
+		page := make([]byte, mgr.PageSize())
+		copy(page, latest[id])
+		if err := mgr.WritePage(storage.PageID(id), page); err != nil {
+			return err
 		}
 	}
 	return nil
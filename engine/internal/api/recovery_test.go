@@ -35,7 +35,7 @@ func TestRecoveryRedoAppliesCommittedRecord(t *testing.T) {
 	if err != nil {
 		t.Fatalf("open wal: %v", err)
 	}
-	payload := bytes.Repeat([]byte{0xAB}, storage.PageSize)
+	payload := pageImage(0xAB)
 	lsn, err := log.Append(1, 0, wal.RecordInsert, uint32(pageID), payload)
 	if err != nil {
 		t.Fatalf("append insert: %v", err)
@@ -106,7 +106,7 @@ func TestRecoveryIgnoresAbortedTransactions(t *testing.T) {
 	if err != nil {
 		t.Fatalf("open wal: %v", err)
 	}
-	committed := bytes.Repeat([]byte{0xCD}, storage.PageSize)
+	committed := pageImage(0xCD)
 	lsn1, err := log.Append(100, 0, wal.RecordInsert, uint32(page1), committed)
 	if err != nil {
 		t.Fatalf("append committed: %v", err)
@@ -121,7 +121,7 @@ func TestRecoveryIgnoresAbortedTransactions(t *testing.T) {
 		t.Fatalf("sync commit: %v", err)
 	}
 
-	abortedPayload := bytes.Repeat([]byte{0xEF}, storage.PageSize)
+	abortedPayload := pageImage(0xEF)
 	lsn2, err := log.Append(200, 0, wal.RecordInsert, uint32(page2), abortedPayload)
 	if err != nil {
 		t.Fatalf("append abort payload: %v", err)
@@ -129,7 +129,12 @@ func TestRecoveryIgnoresAbortedTransactions(t *testing.T) {
 	if err := log.Sync(); err != nil {
 		t.Fatalf("sync abort payload: %v", err)
 	}
-	if _, err := log.Append(200, lsn2, wal.RecordAbort, 0, nil); err != nil {
+	// The rollback logs the page it puts back before the abort record.
+	lsn3, err := log.Append(200, lsn2, wal.RecordDelete, uint32(page2), blank)
+	if err != nil {
+		t.Fatalf("append rollback image: %v", err)
+	}
+	if _, err := log.Append(200, lsn3, wal.RecordAbort, 0, nil); err != nil {
 		t.Fatalf("append abort: %v", err)
 	}
 	if err := log.Sync(); err != nil {
@@ -187,7 +192,7 @@ func TestRecoveryIdempotent(t *testing.T) {
 	if err != nil {
 		t.Fatalf("open wal: %v", err)
 	}
-	payload := bytes.Repeat([]byte{0x11}, storage.PageSize)
+	payload := pageImage(0x11)
 	lsn, err := log.Append(1, 0, wal.RecordInsert, uint32(pageID), payload)
 	if err != nil {
 		t.Fatalf("append payload: %v", err)
@@ -251,7 +256,7 @@ func TestRecoverySkipsUncommitted(t *testing.T) {
 	if err != nil {
 		t.Fatalf("open wal: %v", err)
 	}
-	payload := bytes.Repeat([]byte{0x77}, storage.PageSize)
+	payload := pageImage(0x77)
 	if _, err := log.Append(10, 0, wal.RecordInsert, uint32(pageID), payload); err != nil {
 		t.Fatalf("append payload: %v", err)
 	}
@@ -311,7 +316,7 @@ func TestRecoverySkipsCorruptTail(t *testing.T) {
 	if err != nil {
 		t.Fatalf("open wal: %v", err)
 	}
-	payload1 := bytes.Repeat([]byte{0x33}, storage.PageSize)
+	payload1 := pageImage(0x33)
 	lsn1, err := log.Append(1, 0, wal.RecordInsert, uint32(page1), payload1)
 	if err != nil {
 		t.Fatalf("append txn1: %v", err)
@@ -326,7 +331,7 @@ func TestRecoverySkipsCorruptTail(t *testing.T) {
 		t.Fatalf("sync commit1: %v", err)
 	}
 
-	payload2 := bytes.Repeat([]byte{0x44}, storage.PageSize)
+	payload2 := pageImage(0x44)
 	lsn2, err := log.Append(2, 0, wal.RecordInsert, uint32(page2), payload2)
 	if err != nil {
 		t.Fatalf("append txn2: %v", err)
@@ -384,3 +389,153 @@ func TestRecoverySkipsCorruptTail(t *testing.T) {
 	}
 	_ = mgr2.Close()
 }
+
+func TestRecoveryRepairsTornPageFromLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "torn.gdb")
+	if err := storage.New(path); err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("open storage: %v", err)
+	}
+	pageID, _, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate page: %v", err)
+	}
+	image := pageImage(0x5A)
+	if err := mgr.WritePage(pageID, image); err != nil {
+		t.Fatalf("write page: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close storage: %v", err)
+	}
+
+	// Only the first half of a rewrite reaches the disk.
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open data file: %v", err)
+	}
+	half := bytes.Repeat([]byte{0x00}, storage.PageSize/2)
+	if _, err := f.WriteAt(half, int64(pageID)*storage.PageSize+storage.PageSize/2); err != nil {
+		t.Fatalf("tear page: %v", err)
+	}
+	f.Close()
+
+	// The image was logged by a transaction that later aborted, so redo alone
+	// would leave the torn page in place.
+	log, err := wal.Open(path)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	lsn, err := log.Append(7, 0, wal.RecordUpdate, uint32(pageID), image)
+	if err != nil {
+		t.Fatalf("append image: %v", err)
+	}
+	if _, err := log.Append(7, lsn, wal.RecordAbort, 0, nil); err != nil {
+		t.Fatalf("append abort: %v", err)
+	}
+	if err := log.Sync(); err != nil {
+		t.Fatalf("sync wal: %v", err)
+	}
+	_ = log.Close()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close database: %v", err)
+	}
+
+	mgr2, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("reopen storage: %v", err)
+	}
+	defer mgr2.Close()
+	page, err := mgr2.ReadPage(pageID)
+	if err != nil {
+		t.Fatalf("read repaired page: %v", err)
+	}
+	if !bytes.Equal(page, image) {
+		t.Fatalf("torn page was not restored from the log")
+	}
+}
+
+// pageImage returns a page filled with b, leaving bytes 10..16 clear because
+// the storage manager keeps the compression codec and page checksum there.
+func pageImage(b byte) []byte {
+	page := bytes.Repeat([]byte{b}, storage.PageSize)
+	copy(page[10:16], []byte{0, 0, 0, 0, 0, 0})
+	return page
+}
+
+func TestRecoveryReplaysEncryptedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sealed.gdb")
+	const key = "recovery passphrase"
+	if err := storage.NewWithOptions(path, storage.CreateOptions{Key: key}); err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	mgr, err := storage.OpenWithOptions(path, storage.Options{Key: key})
+	if err != nil {
+		t.Fatalf("open storage: %v", err)
+	}
+	pageID, _, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate page: %v", err)
+	}
+	cipher := mgr.Cipher()
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close storage: %v", err)
+	}
+
+	log, err := wal.OpenWithOptions(path, wal.Options{Cipher: cipher})
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	payload := pageImage(0xCD)
+	lsn, err := log.Append(1, 0, wal.RecordInsert, uint32(pageID), payload)
+	if err != nil {
+		t.Fatalf("append insert: %v", err)
+	}
+	if _, err := log.Append(1, lsn, wal.RecordCommit, 0, nil); err != nil {
+		t.Fatalf("append commit: %v", err)
+	}
+	if err := log.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("close wal: %v", err)
+	}
+	raw, err := os.ReadFile(wal.PathFor(path))
+	if err != nil {
+		t.Fatalf("read wal: %v", err)
+	}
+	if bytes.Contains(raw, payload[16:64]) {
+		t.Fatalf("page image stored in the log in the clear")
+	}
+	if _, err := wal.Open(path); err == nil {
+		t.Fatalf("expected an encrypted log to need a key")
+	}
+
+	db, err := OpenWithOptions(path, OpenOptions{Key: key})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close database: %v", err)
+	}
+	mgr2, err := storage.OpenWithOptions(path, storage.Options{Key: key})
+	if err != nil {
+		t.Fatalf("reopen storage: %v", err)
+	}
+	defer mgr2.Close()
+	page, err := mgr2.ReadPage(pageID)
+	if err != nil {
+		t.Fatalf("read page: %v", err)
+	}
+	if !bytes.Equal(page, payload) {
+		t.Fatalf("expected sealed log record to be replayed")
+	}
+}
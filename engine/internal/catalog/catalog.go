@@ -8,7 +8,10 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/example/granite-db/engine/internal/compression"
 	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/wal"
 )
 
 // ColumnType enumerates supported GraniteDB column kinds.
@@ -40,6 +43,15 @@ const maxColumnLength = 0xFFFF
 const (
 	indexSectionMarker      uint16 = 0xFFFF
 	foreignKeySectionMarker uint16 = 0xFFFE
+	storageSectionMarker    uint16 = 0xFFFD
+)
+
+// Index key flags. indexOrderedKeys marks an index whose tree holds keys that
+// sort in key order; indexIncludesColumns marks one whose entries store
+// included columns, named after the key column directions.
+const (
+	indexOrderedKeys     byte = 1
+	indexIncludesColumns byte = 2
 )
 
 func encodeColumnMetadata(col Column) (uint16, error) {
@@ -121,12 +133,34 @@ type ForeignKey struct {
 
 // Table captures metadata for a user table.
 type Table struct {
-	Name        string
-	Columns     []Column
-	RootPage    storage.PageID
-	RowCount    uint64
-	Indexes     map[string]*Index
-	ForeignKeys map[string]*ForeignKey
+	Name         string
+	Columns      []Column
+	RootPage     storage.PageID
+	FreeSpaceMap storage.PageID
+	RowCount     uint64
+	Indexes      map[string]*Index
+	ForeignKeys  map[string]*ForeignKey
+	// Compression is the codec applied to the table's heap pages on disk.
+	Compression compression.Codec
+	// PrimaryKey names the unique index that enforces the table's primary
+	// key, or is empty when the table has none.
+	PrimaryKey string
+}
+
+// HeapFile opens the heap file that stores the table's rows.
+func (t *Table) HeapFile(mgr *storage.Manager) *storage.HeapFile {
+	return storage.NewHeapFileWithMap(mgr, t.RootPage, t.FreeSpaceMap)
+}
+
+// PrimaryKeyColumns returns the primary key columns in key order, or nil when
+// the table has no primary key.
+func (t *Table) PrimaryKeyColumns() []string {
+	if idx, ok := t.Indexes[strings.ToLower(t.PrimaryKey)]; ok && t.PrimaryKey != "" {
+		cols := make([]string, len(idx.Columns))
+		copy(cols, idx.Columns)
+		return cols
+	}
+	return nil
 }
 
 // Index describes a secondary index definition.
@@ -134,6 +168,48 @@ type Index struct {
 	Name     string
 	Columns  []string
 	IsUnique bool
+	// Descending marks the key columns that sort in descending order. It is
+	// nil when every column sorts in ascending order.
+	Descending []bool
+	// Include lists the columns whose values each entry stores after its
+	// key, so that a query reading only indexed columns can skip the table.
+	Include []string
+	// Root is the page holding the root of the index's B+tree. It is zero for
+	// an index carried over from a database whose indexes lived in files of
+	// their own, until the index is rebuilt.
+	Root storage.PageID
+	// LegacyKeys is set for a tree written before index keys sorted in key
+	// order. Such a tree only serves until the index is rebuilt, which
+	// happens when the database is next opened for writing.
+	LegacyKeys bool
+}
+
+// Built reports whether the index has a tree in the current key encoding.
+// Only such an index is read or kept up to date.
+func (idx *Index) Built() bool {
+	return idx.Root != 0 && !idx.LegacyKeys
+}
+
+// Desc reports whether the key column at position i sorts in descending
+// order.
+func (idx *Index) Desc(i int) bool {
+	return i < len(idx.Descending) && idx.Descending[i]
+}
+
+func (idx *Index) clone() *Index {
+	cols := make([]string, len(idx.Columns))
+	copy(cols, idx.Columns)
+	clone := *idx
+	clone.Columns = cols
+	if idx.Descending != nil {
+		clone.Descending = make([]bool, len(idx.Descending))
+		copy(clone.Descending, idx.Descending)
+	}
+	if idx.Include != nil {
+		clone.Include = make([]string, len(idx.Include))
+		copy(clone.Include, idx.Include)
+	}
+	return &clone
 }
 
 // Catalog holds definitions of all tables within the database.
@@ -231,11 +307,88 @@ func Load(mgr *storage.Manager) (*Catalog, error) {
 		if err := readForeignKeyMetadata(reader, table); err != nil {
 			return nil, err
 		}
+		if err := readStorageMetadata(reader, table); err != nil {
+			return nil, err
+		}
+		if err := resolvePrimaryKey(table); err != nil {
+			return nil, err
+		}
 		cat.tables[strings.ToLower(name)] = table
 	}
 	return cat, nil
 }
 
+// resolvePrimaryKey marks every column of the table's primary key. Catalogues
+// written before primary keys were backed by an index record a single column
+// and no index; such a key adopts a unique index already defined on that
+// column or, failing that, gains a new index without a tree, which is built
+// when the database is next opened for writing.
+func resolvePrimaryKey(table *Table) error {
+	if table.PrimaryKey != "" {
+		idx, ok := table.Indexes[strings.ToLower(table.PrimaryKey)]
+		if !ok || !idx.IsUnique {
+			return fmt.Errorf("catalog: table %s has no unique index %s for its primary key", table.Name, table.PrimaryKey)
+		}
+		for _, name := range idx.Columns {
+			pos := columnPosition(table.Columns, name)
+			if pos < 0 {
+				return fmt.Errorf("catalog: primary key column %s not found in table %s", name, table.Name)
+			}
+			table.Columns[pos].PrimaryKey = true
+			table.Columns[pos].NotNull = true
+		}
+		return nil
+	}
+	var column string
+	for i := range table.Columns {
+		if table.Columns[i].PrimaryKey {
+			table.Columns[i].NotNull = true
+			column = table.Columns[i].Name
+			break
+		}
+	}
+	if column == "" {
+		return nil
+	}
+	for _, name := range sortedIndexNames(table) {
+		idx := table.Indexes[strings.ToLower(name)]
+		if idx.IsUnique && len(idx.Columns) == 1 && strings.EqualFold(idx.Columns[0], column) {
+			table.PrimaryKey = idx.Name
+			return nil
+		}
+	}
+	name := primaryKeyIndexName(table, "")
+	table.Indexes[strings.ToLower(name)] = &Index{Name: name, Columns: []string{column}, IsUnique: true}
+	table.PrimaryKey = name
+	return nil
+}
+
+// primaryKeyIndexName returns the name of the index backing a primary key:
+// the constraint name when one was given, otherwise pk_<table>, suffixed if
+// an index of that name already exists.
+func primaryKeyIndexName(table *Table, constraint string) string {
+	if constraint != "" {
+		return constraint
+	}
+	base := "pk_" + strings.ToLower(table.Name)
+	name := base
+	for i := 1; ; i++ {
+		if _, exists := table.Indexes[strings.ToLower(name)]; !exists {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+}
+
+func columnPosition(columns []Column, name string) int {
+	for i := range columns {
+		if strings.EqualFold(columns[i].Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
 func readString(r *bytes.Reader) (string, error) {
 	var length uint16
 	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
@@ -387,6 +540,178 @@ func readForeignKeyMetadata(r *bytes.Reader, table *Table) error {
 	return nil
 }
 
+// The storage section is length-prefixed so that fields added later can be
+// skipped by readers that do not know about them.
+func readStorageMetadata(r *bytes.Reader, table *Table) error {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	var marker uint16
+	if err := binary.Read(r, binary.LittleEndian, &marker); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if marker != storageSectionMarker {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		return nil
+	}
+	var length uint16
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return err
+	}
+	section := make([]byte, length)
+	if _, err := io.ReadFull(r, section); err != nil {
+		return err
+	}
+	if len(section) >= 4 {
+		table.FreeSpaceMap = storage.PageID(binary.LittleEndian.Uint32(section[0:4]))
+	}
+	if len(section) >= 5 {
+		table.Compression = compression.Codec(section[4])
+		if !table.Compression.Valid() {
+			return fmt.Errorf("catalog: table %s uses unknown compression codec %d", table.Name, section[4])
+		}
+	}
+	if len(section) >= 7 {
+		names := sortedIndexNames(table)
+		count := int(binary.LittleEndian.Uint16(section[5:7]))
+		if count != len(names) || len(section) < 7+4*count {
+			return fmt.Errorf("catalog: table %s records %d index roots for %d indexes", table.Name, count, len(names))
+		}
+		for i, name := range names {
+			offset := 7 + 4*i
+			table.Indexes[strings.ToLower(name)].Root = storage.PageID(binary.LittleEndian.Uint32(section[offset : offset+4]))
+		}
+		rest := section[7+4*count:]
+		if len(rest) >= 2 {
+			length := int(binary.LittleEndian.Uint16(rest[0:2]))
+			if len(rest) < 2+length {
+				return fmt.Errorf("catalog: table %s has a truncated primary key entry", table.Name)
+			}
+			table.PrimaryKey = string(rest[2 : 2+length])
+			rest = rest[2+length:]
+		}
+		// Each index then records whether its keys sort in key order, the
+		// direction of every key column and any included columns. Sections
+		// written before keys sorted in key order end here.
+		if len(rest) == 0 {
+			for _, name := range names {
+				table.Indexes[strings.ToLower(name)].LegacyKeys = true
+			}
+			return nil
+		}
+		for _, name := range names {
+			idx := table.Indexes[strings.ToLower(name)]
+			if len(rest) < 1+len(idx.Columns) {
+				return fmt.Errorf("catalog: table %s has truncated key metadata for index %s", table.Name, idx.Name)
+			}
+			idx.LegacyKeys = rest[0]&indexOrderedKeys == 0
+			for i := range idx.Columns {
+				if rest[1+i] != 0 {
+					if idx.Descending == nil {
+						idx.Descending = make([]bool, len(idx.Columns))
+					}
+					idx.Descending[i] = true
+				}
+			}
+			flags := rest[0]
+			rest = rest[1+len(idx.Columns):]
+			if flags&indexIncludesColumns == 0 {
+				continue
+			}
+			if len(rest) < 1 {
+				return fmt.Errorf("catalog: table %s has truncated included columns for index %s", table.Name, idx.Name)
+			}
+			count := int(rest[0])
+			rest = rest[1:]
+			idx.Include = make([]string, count)
+			for i := range idx.Include {
+				if len(rest) < 2 {
+					return fmt.Errorf("catalog: table %s has truncated included columns for index %s", table.Name, idx.Name)
+				}
+				length := int(binary.LittleEndian.Uint16(rest[:2]))
+				if len(rest) < 2+length {
+					return fmt.Errorf("catalog: table %s has truncated included columns for index %s", table.Name, idx.Name)
+				}
+				idx.Include[i] = string(rest[2 : 2+length])
+				rest = rest[2+length:]
+			}
+		}
+	}
+	return nil
+}
+
+// writeStorageMetadata records the free-space map, the compression codec, the
+// root page of each index, in the same name order as the index section, the
+// name of the primary key index and then, again per index, its key flags, the
+// direction of each key column and the names of any included columns.
+func writeStorageMetadata(buf *bytes.Buffer, table *Table) error {
+	names := sortedIndexNames(table)
+	end := 7 + 4*len(names)
+	keys := make([]byte, 0, 2*len(names))
+	for _, name := range names {
+		idx := table.Indexes[strings.ToLower(name)]
+		var flags byte
+		if !idx.LegacyKeys {
+			flags |= indexOrderedKeys
+		}
+		if len(idx.Include) > 0 {
+			flags |= indexIncludesColumns
+		}
+		keys = append(keys, flags)
+		for i := range idx.Columns {
+			var desc byte
+			if idx.Desc(i) {
+				desc = 1
+			}
+			keys = append(keys, desc)
+		}
+		if len(idx.Include) > 0 {
+			keys = append(keys, byte(len(idx.Include)))
+			for _, name := range idx.Include {
+				keys = binary.LittleEndian.AppendUint16(keys, uint16(len(name)))
+				keys = append(keys, name...)
+			}
+		}
+	}
+	section := make([]byte, end+2+len(table.PrimaryKey), end+2+len(table.PrimaryKey)+len(keys))
+	binary.LittleEndian.PutUint32(section[0:4], uint32(table.FreeSpaceMap))
+	section[4] = byte(table.Compression)
+	binary.LittleEndian.PutUint16(section[5:7], uint16(len(names)))
+	for i, name := range names {
+		offset := 7 + 4*i
+		binary.LittleEndian.PutUint32(section[offset:offset+4], uint32(table.Indexes[strings.ToLower(name)].Root))
+	}
+	binary.LittleEndian.PutUint16(section[end:end+2], uint16(len(table.PrimaryKey)))
+	copy(section[end+2:], table.PrimaryKey)
+	section = append(section, keys...)
+	if len(section) > 0xFFFF {
+		return fmt.Errorf("catalog: storage metadata of table %s is too large", table.Name)
+	}
+	if err := binary.Write(buf, binary.LittleEndian, storageSectionMarker); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, uint16(len(section))); err != nil {
+		return err
+	}
+	_, err := buf.Write(section)
+	return err
+}
+
+func sortedIndexNames(table *Table) []string {
+	names := make([]string, 0, len(table.Indexes))
+	for _, idx := range table.Indexes {
+		names = append(names, idx.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func writeString(buf *bytes.Buffer, value string) error {
 	if len(value) > 0xFFFF {
 		return fmt.Errorf("catalog: string too long")
@@ -539,12 +864,11 @@ func (c *Catalog) persist() error {
 		if err := binary.Write(buf, binary.LittleEndian, uint16(len(table.Columns))); err != nil {
 			return err
 		}
+		// Older engines read a single primary key column here; the full key
+		// is the index named in the storage section.
 		var primaryIndex int16 = -1
-		for idx, col := range table.Columns {
-			if col.PrimaryKey {
-				primaryIndex = int16(idx)
-				break
-			}
+		if cols := table.PrimaryKeyColumns(); len(cols) > 0 {
+			primaryIndex = int16(columnPosition(table.Columns, cols[0]))
 		}
 		if err := binary.Write(buf, binary.LittleEndian, primaryIndex); err != nil {
 			return err
@@ -577,12 +901,35 @@ func (c *Catalog) persist() error {
 		if err := writeForeignKeyMetadata(buf, table); err != nil {
 			return err
 		}
+		if err := writeStorageMetadata(buf, table); err != nil {
+			return err
+		}
 	}
 	return c.storage.UpdateCatalog(buf.Bytes())
 }
 
+// TableOptions holds the storage settings of a new table.
+type TableOptions struct {
+	// Compression is applied to the table's heap pages when they are
+	// written to disk.
+	Compression compression.Codec
+	// PrimaryKeyName names the unique index that enforces the primary key.
+	// It defaults to pk_<table>.
+	PrimaryKeyName string
+	// PrimaryKeyRoot is the page holding the root of that index's tree.
+	PrimaryKeyRoot storage.PageID
+}
+
 // CreateTable registers a new table and allocates its first heap page.
-func (c *Catalog) CreateTable(name string, columns []Column, primaryKey string, foreignKeys []*ForeignKey) (*Table, error) {
+func (c *Catalog) CreateTable(name string, columns []Column, primaryKey []string, foreignKeys []*ForeignKey) (*Table, error) {
+	return c.CreateTableWithOptions(name, columns, primaryKey, foreignKeys, TableOptions{})
+}
+
+// CreateTableWithOptions registers a new table with the given storage
+// settings and allocates its first heap page. A primary key is registered
+// together with the unique index that enforces it, and its columns become
+// NOT NULL.
+func (c *Catalog) CreateTableWithOptions(name string, columns []Column, primaryKey []string, foreignKeys []*ForeignKey, opts TableOptions) (*Table, error) {
 	if name == "" {
 		return nil, fmt.Errorf("catalog: table name required")
 	}
@@ -597,17 +944,30 @@ func (c *Catalog) CreateTable(name string, columns []Column, primaryKey string,
 			return nil, err
 		}
 	}
-	if primaryKey != "" {
-		matched := false
-		for i := range cols {
-			if strings.EqualFold(cols[i].Name, primaryKey) {
-				cols[i].PrimaryKey = true
-				matched = true
-				break
-			}
+	keyCols := make([]string, len(primaryKey))
+	for i, column := range primaryKey {
+		pos := columnPosition(cols, column)
+		if pos < 0 {
+			return nil, fmt.Errorf("catalog: primary key column %s not found", column)
+		}
+		if cols[pos].PrimaryKey {
+			return nil, fmt.Errorf("catalog: primary key column %s listed twice", column)
+		}
+		cols[pos].PrimaryKey = true
+		cols[pos].NotNull = true
+		keyCols[i] = cols[pos].Name
+	}
+	if !opts.Compression.Valid() {
+		return nil, fmt.Errorf("catalog: unknown compression codec %d", uint8(opts.Compression))
+	}
+	if opts.Compression != compression.None {
+		if err := c.storage.EnableCompression(); err != nil {
+			return nil, err
 		}
-		if !matched {
-			return nil, fmt.Errorf("catalog: primary key column %s not found", primaryKey)
+	}
+	if len(keyCols) > 0 {
+		if err := c.storage.EnablePrimaryKeys(); err != nil {
+			return nil, err
 		}
 	}
 	rootID, buf, err := c.storage.AllocatePage()
@@ -617,16 +977,27 @@ func (c *Catalog) CreateTable(name string, columns []Column, primaryKey string,
 	if err := storage.InitialiseHeapPage(buf); err != nil {
 		return nil, err
 	}
+	storage.SetPageCompression(buf, opts.Compression)
 	if err := c.storage.WritePage(rootID, buf); err != nil {
 		return nil, err
 	}
+	fsmID, err := storage.CreateFreeSpaceMap(c.storage, rootID)
+	if err != nil {
+		return nil, err
+	}
 	table := &Table{
-		Name:        name,
-		Columns:     cols,
-		RootPage:    rootID,
-		RowCount:    0,
-		Indexes:     make(map[string]*Index),
-		ForeignKeys: make(map[string]*ForeignKey),
+		Name:         name,
+		Columns:      cols,
+		RootPage:     rootID,
+		FreeSpaceMap: fsmID,
+		RowCount:     0,
+		Indexes:      make(map[string]*Index),
+		ForeignKeys:  make(map[string]*ForeignKey),
+		Compression:  opts.Compression,
+	}
+	if len(keyCols) > 0 {
+		table.PrimaryKey = primaryKeyIndexName(table, opts.PrimaryKeyName)
+		table.Indexes[strings.ToLower(table.PrimaryKey)] = &Index{Name: table.PrimaryKey, Columns: keyCols, IsUnique: true, Root: opts.PrimaryKeyRoot}
 	}
 	for _, fk := range foreignKeys {
 		if fk == nil {
@@ -655,8 +1026,10 @@ func (c *Catalog) CreateTable(name string, columns []Column, primaryKey string,
 	return table, nil
 }
 
-// DropTable removes a table definition and frees its pages.
-func (c *Catalog) DropTable(name string) error {
+// DropTable removes a table definition and frees its pages. Under a
+// transaction the pages return to the free list once it has ended, since
+// undoing its changes to the table still writes to them.
+func (c *Catalog) DropTable(tx *txn.Transaction, log *wal.Manager, name string) error {
 	lower := strings.ToLower(name)
 	table, ok := c.tables[lower]
 	if !ok {
@@ -672,18 +1045,26 @@ func (c *Catalog) DropTable(name string) error {
 			}
 		}
 	}
-	heap := storage.NewHeapFile(c.storage, table.RootPage)
+	heap := table.HeapFile(c.storage)
 	pages, err := heap.Pages()
 	if err != nil {
 		return err
 	}
-	for _, id := range pages {
-		if err := c.storage.FreePage(id); err != nil {
-			return err
-		}
+	mapPages, err := heap.FreeSpaceMapPages()
+	if err != nil {
+		return err
 	}
+	overflowPages, err := heap.OverflowPages()
+	if err != nil {
+		return err
+	}
+	pages = append(pages, mapPages...)
+	pages = append(pages, overflowPages...)
 	delete(c.tables, lower)
-	return c.persist()
+	if err := c.persist(); err != nil {
+		return err
+	}
+	return c.storage.ReleasePages(tx, log, pages...)
 }
 
 // GetTable retrieves the table metadata if present.
@@ -707,9 +1088,7 @@ func (c *Catalog) ListTables() []*Table {
 		copyIdx := make(map[string]*Index, len(table.Indexes))
 		if len(table.Indexes) > 0 {
 			for key, idx := range table.Indexes {
-				cols := make([]string, len(idx.Columns))
-				copy(cols, idx.Columns)
-				copyIdx[key] = &Index{Name: idx.Name, Columns: cols, IsUnique: idx.IsUnique}
+				copyIdx[key] = idx.clone()
 			}
 		}
 		copyFks := make(map[string]*ForeignKey, len(table.ForeignKeys))
@@ -732,19 +1111,25 @@ func (c *Catalog) ListTables() []*Table {
 			}
 		}
 		result = append(result, &Table{
-			Name:        table.Name,
-			Columns:     copyCols,
-			RootPage:    table.RootPage,
-			RowCount:    table.RowCount,
-			Indexes:     copyIdx,
-			ForeignKeys: copyFks,
+			Name:         table.Name,
+			Columns:      copyCols,
+			RootPage:     table.RootPage,
+			FreeSpaceMap: table.FreeSpaceMap,
+			RowCount:     table.RowCount,
+			Indexes:      copyIdx,
+			ForeignKeys:  copyFks,
+			Compression:  table.Compression,
+			PrimaryKey:   table.PrimaryKey,
 		})
 	}
 	return result
 }
 
 // CreateIndex registers a new index definition on an existing table.
-func (c *Catalog) CreateIndex(tableName, indexName string, columns []string, unique bool) (*Index, error) {
+// Descending marks the key columns that sort in descending order and may be
+// nil; include names the columns stored alongside the key. Root is the page
+// holding the root of the index's tree.
+func (c *Catalog) CreateIndex(tableName, indexName string, columns []string, descending []bool, include []string, unique bool, root storage.PageID) (*Index, error) {
 	table, ok := c.tables[strings.ToLower(tableName)]
 	if !ok {
 		return nil, fmt.Errorf("catalog: table %s not found", tableName)
@@ -756,21 +1141,36 @@ func (c *Catalog) CreateIndex(tableName, indexName string, columns []string, uni
 	if _, exists := table.Indexes[lower]; exists {
 		return nil, fmt.Errorf("catalog: index %s already exists on table %s", indexName, tableName)
 	}
-	resolved := make([]string, len(columns))
-	for i, name := range columns {
-		found := false
-		for _, col := range table.Columns {
-			if strings.EqualFold(col.Name, name) {
-				resolved[i] = col.Name
-				found = true
-				break
-			}
-		}
-		if !found {
+	resolved := make([]string, len(columns)+len(include))
+	seen := make(map[string]bool, len(resolved))
+	for i, name := range append(append([]string{}, columns...), include...) {
+		pos := columnPosition(table.Columns, name)
+		if pos < 0 {
 			return nil, fmt.Errorf("catalog: column %s not found in table %s", name, tableName)
 		}
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("catalog: column %s appears more than once in index %s", name, indexName)
+		}
+		seen[strings.ToLower(name)] = true
+		resolved[i] = table.Columns[pos].Name
+	}
+	if descending != nil && len(descending) != len(columns) {
+		return nil, fmt.Errorf("catalog: index %s has %d key directions for %d columns", indexName, len(descending), len(columns))
+	}
+	idx := &Index{Name: indexName, Columns: resolved[:len(columns):len(columns)], IsUnique: unique, Root: root}
+	if len(include) > 0 {
+		if err := c.storage.EnableCoveringIndexes(); err != nil {
+			return nil, err
+		}
+		idx.Include = resolved[len(columns):]
+	}
+	for i := range descending {
+		if descending[i] {
+			idx.Descending = make([]bool, len(descending))
+			copy(idx.Descending, descending)
+			break
+		}
 	}
-	idx := &Index{Name: indexName, Columns: resolved, IsUnique: unique}
 	table.Indexes[lower] = idx
 	if err := c.persist(); err != nil {
 		delete(table.Indexes, lower)
@@ -789,6 +1189,9 @@ func (c *Catalog) DropIndex(tableName, indexName string) error {
 	if _, exists := table.Indexes[lower]; !exists {
 		return fmt.Errorf("catalog: index %s not found on table %s", indexName, tableName)
 	}
+	if strings.EqualFold(table.PrimaryKey, indexName) {
+		return fmt.Errorf("catalog: index %s enforces the primary key of table %s", indexName, table.Name)
+	}
 	delete(table.Indexes, lower)
 	return c.persist()
 }
@@ -821,9 +1224,7 @@ func (c *Catalog) TableIndexes(tableName string) []*Index {
 		if idx == nil {
 			continue
 		}
-		cols := make([]string, len(idx.Columns))
-		copy(cols, idx.Columns)
-		result = append(result, &Index{Name: idx.Name, Columns: cols, IsUnique: idx.IsUnique})
+		result = append(result, idx.clone())
 	}
 	return result
 }
@@ -885,7 +1286,7 @@ func (c *Catalog) DecrementRowCount(name string) error {
 	return c.persist()
 }
 
-// SetRowCount sets the exact row count (used by tests).
+// SetRowCount sets the exact row count.
 func (c *Catalog) SetRowCount(name string, count uint64) error {
 	table, ok := c.tables[strings.ToLower(name)]
 	if !ok {
@@ -894,3 +1295,63 @@ func (c *Catalog) SetRowCount(name string, count uint64) error {
 	table.RowCount = count
 	return c.persist()
 }
+
+// Reload discards the in-memory definitions and reads them from storage
+// again, after the catalogue pages were restored underneath it.
+func (c *Catalog) Reload() error {
+	fresh, err := Load(c.storage)
+	if err != nil {
+		return err
+	}
+	c.tables = fresh.tables
+	return nil
+}
+
+// RelocatePages rewrites the page ids of every table after a compaction has
+// moved them.
+func (c *Catalog) RelocatePages(plan *storage.Compaction) error {
+	for _, table := range c.tables {
+		table.RootPage = plan.Relocate(table.RootPage)
+		table.FreeSpaceMap = plan.Relocate(table.FreeSpaceMap)
+		for _, idx := range table.Indexes {
+			idx.Root = plan.Relocate(idx.Root)
+		}
+	}
+	return c.persist()
+}
+
+// SetIndexRoot records the page holding the root of an index's tree, which
+// must hold keys in the current encoding.
+func (c *Catalog) SetIndexRoot(tableName, indexName string, root storage.PageID) error {
+	table, ok := c.tables[strings.ToLower(tableName)]
+	if !ok {
+		return fmt.Errorf("catalog: table %s not found", tableName)
+	}
+	idx, ok := table.Indexes[strings.ToLower(indexName)]
+	if !ok {
+		return fmt.Errorf("catalog: index %s not found on table %s", indexName, tableName)
+	}
+	if root != 0 && strings.EqualFold(table.PrimaryKey, idx.Name) {
+		// A primary key inherited from an older catalogue now has its
+		// index; older engines would let that index be dropped.
+		if err := c.storage.EnablePrimaryKeys(); err != nil {
+			return err
+		}
+	}
+	idx.Root = root
+	idx.LegacyKeys = false
+	return c.persist()
+}
+
+// SetFreeSpaceMap records the first free-space map page for the table.
+func (c *Catalog) SetFreeSpaceMap(name string, id storage.PageID) error {
+	table, ok := c.tables[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("catalog: table %s not found", name)
+	}
+	if table.FreeSpaceMap == id {
+		return nil
+	}
+	table.FreeSpaceMap = id
+	return c.persist()
+}
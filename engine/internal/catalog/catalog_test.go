@@ -1,12 +1,16 @@
 package catalog_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/example/granite-db/engine/internal/catalog"
 	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/txn"
 )
 
 func TestCatalogCreateAndListTables(t *testing.T) {
@@ -30,7 +34,7 @@ func TestCatalogCreateAndListTables(t *testing.T) {
 		{Name: "id", Type: catalog.ColumnTypeInt, NotNull: true},
 		{Name: "name", Type: catalog.ColumnTypeVarChar, Length: 32},
 	}
-	table, err := cat.CreateTable("people", cols, "id", nil)
+	table, err := cat.CreateTable("people", cols, []string{"id"}, nil)
 	if err != nil {
 		t.Fatalf("create table: %v", err)
 	}
@@ -75,7 +79,7 @@ func TestCatalogPersistDecimalMetadata(t *testing.T) {
 		{Name: "id", Type: catalog.ColumnTypeInt},
 		{Name: "balance", Type: catalog.ColumnTypeDecimal, Precision: 18, Scale: 4},
 	}
-	if _, err := cat.CreateTable("accounts", cols, "", nil); err != nil {
+	if _, err := cat.CreateTable("accounts", cols, nil, nil); err != nil {
 		t.Fatalf("create table: %v", err)
 	}
 	if err := mgr.Close(); err != nil {
@@ -121,10 +125,10 @@ func TestCatalogPersistIndexes(t *testing.T) {
 		t.Fatalf("load catalog: %v", err)
 	}
 	cols := []catalog.Column{{Name: "id", Type: catalog.ColumnTypeInt, NotNull: true}, {Name: "name", Type: catalog.ColumnTypeVarChar, Length: 32}}
-	if _, err := cat.CreateTable("people", cols, "id", nil); err != nil {
+	if _, err := cat.CreateTable("people", cols, []string{"id"}, nil); err != nil {
 		t.Fatalf("create table: %v", err)
 	}
-	if _, err := cat.CreateIndex("people", "idx_people_name", []string{"name"}, true); err != nil {
+	if _, err := cat.CreateIndex("people", "idx_people_name", []string{"name"}, []bool{true}, []string{"ID"}, true, 42); err != nil {
 		t.Fatalf("create index: %v", err)
 	}
 	mgr.Close()
@@ -142,8 +146,8 @@ func TestCatalogPersistIndexes(t *testing.T) {
 	if !ok {
 		t.Fatalf("expected people table present")
 	}
-	if len(table.Indexes) != 1 {
-		t.Fatalf("expected 1 index, got %d", len(table.Indexes))
+	if len(table.Indexes) != 2 || table.PrimaryKey != "pk_people" {
+		t.Fatalf("expected the primary key index and one more, got %d indexes and primary key %q", len(table.Indexes), table.PrimaryKey)
 	}
 	idx, ok := table.Indexes["idx_people_name"]
 	if !ok {
@@ -164,6 +168,15 @@ func TestCatalogPersistIndexes(t *testing.T) {
 	if len(idx.Columns) != 1 || idx.Columns[0] != "name" {
 		t.Fatalf("unexpected columns: %+v", idx.Columns)
 	}
+	if idx.Root != 42 {
+		t.Fatalf("expected index root 42, got %d", idx.Root)
+	}
+	if !idx.Desc(0) || idx.LegacyKeys {
+		t.Fatalf("expected a descending key in the current encoding, got %+v", idx)
+	}
+	if len(idx.Include) != 1 || idx.Include[0] != "id" {
+		t.Fatalf("expected id to be included, got %v", idx.Include)
+	}
 }
 
 func TestCatalogPersistForeignKeys(t *testing.T) {
@@ -181,7 +194,7 @@ func TestCatalogPersistForeignKeys(t *testing.T) {
 		t.Fatalf("load catalog: %v", err)
 	}
 	parentCols := []catalog.Column{{Name: "id", Type: catalog.ColumnTypeInt, NotNull: true}}
-	if _, err := cat.CreateTable("parents", parentCols, "id", nil); err != nil {
+	if _, err := cat.CreateTable("parents", parentCols, []string{"id"}, nil); err != nil {
 		t.Fatalf("create parents: %v", err)
 	}
 	childCols := []catalog.Column{{Name: "id", Type: catalog.ColumnTypeInt, NotNull: true}, {Name: "parent_id", Type: catalog.ColumnTypeInt}}
@@ -195,7 +208,7 @@ func TestCatalogPersistForeignKeys(t *testing.T) {
 		Deferrable:    false,
 		Valid:         true,
 	}
-	if _, err := cat.CreateTable("children", childCols, "id", []*catalog.ForeignKey{fk}); err != nil {
+	if _, err := cat.CreateTable("children", childCols, []string{"id"}, []*catalog.ForeignKey{fk}); err != nil {
 		t.Fatalf("create children: %v", err)
 	}
 	if err := mgr.Close(); err != nil {
@@ -240,3 +253,226 @@ func TestCatalogPersistForeignKeys(t *testing.T) {
 		t.Fatalf("expected foreign key to be marked valid")
 	}
 }
+
+func TestCatalogLargeSchemaSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wide.gdb")
+	if err := storage.New(path); err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("load catalog: %v", err)
+	}
+
+	const tables, columns = 300, 24
+	for i := 0; i < tables; i++ {
+		cols := make([]catalog.Column, columns)
+		for c := range cols {
+			cols[c] = catalog.Column{Name: fmt.Sprintf("column_with_a_long_name_%02d", c), Type: catalog.ColumnTypeVarChar, Length: 64}
+		}
+		cols[0].NotNull = true
+		if _, err := cat.CreateTable(fmt.Sprintf("table_%03d", i), cols, []string{cols[0].Name}, nil); err != nil {
+			t.Fatalf("create table %d: %v", i, err)
+		}
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	mgr, err = storage.Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer mgr.Close()
+	cat, err = catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("reload catalog: %v", err)
+	}
+	listed := cat.ListTables()
+	if len(listed) != tables {
+		t.Fatalf("expected %d tables, got %d", tables, len(listed))
+	}
+	last, ok := cat.GetTable(fmt.Sprintf("table_%03d", tables-1))
+	if !ok {
+		t.Fatalf("last table missing after reopen")
+	}
+	if len(last.Columns) != columns || last.Columns[columns-1].Name != fmt.Sprintf("column_with_a_long_name_%02d", columns-1) {
+		t.Fatalf("unexpected columns after reopen: %+v", last.Columns)
+	}
+
+	for i := 0; i < tables-1; i++ {
+		if err := cat.DropTable(nil, nil, fmt.Sprintf("table_%03d", i)); err != nil {
+			t.Fatalf("drop table %d: %v", i, err)
+		}
+	}
+	if got := len(cat.ListTables()); got != 1 {
+		t.Fatalf("expected 1 table after drops, got %d", got)
+	}
+}
+
+func TestCatalogDropTableReleasesPagesWhenTheTransactionEnds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drop.gdb")
+	if err := storage.New(path); err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer mgr.Close()
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("load catalog: %v", err)
+	}
+	table, err := cat.CreateTable("logs", []catalog.Column{{Name: "line", Type: catalog.ColumnTypeVarChar, Length: 400}}, nil, nil)
+	if err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	heap := table.HeapFile(mgr)
+	for i := 0; i < 50; i++ {
+		if _, err := heap.Insert(nil, nil, bytes.Repeat([]byte{'l'}, 400)); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	pages, err := heap.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	freed := func() int {
+		info, err := mgr.InspectFreeList()
+		if err != nil {
+			t.Fatalf("free list: %v", err)
+		}
+		onList := make(map[storage.PageID]bool, len(info.Pages))
+		for _, id := range info.Pages {
+			onList[id] = true
+		}
+		n := 0
+		for _, id := range pages {
+			if onList[id] {
+				n++
+			}
+		}
+		return n
+	}
+	txns := txn.NewManager(txn.NewLockManager(0), nil)
+	tx := txns.Begin()
+	if err := cat.DropTable(tx, nil, "logs"); err != nil {
+		t.Fatalf("drop table: %v", err)
+	}
+	// Undoing the transaction's changes to the table still writes its pages.
+	if n := freed(); n != 0 {
+		t.Fatalf("expected no heap pages on the free list before the transaction ends, got %d", n)
+	}
+	if err := txns.Commit(tx.ID()); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if n := freed(); n != len(pages) {
+		t.Fatalf("expected %d heap pages on the free list after the commit, got %d", len(pages), n)
+	}
+}
+
+func TestCatalogCompositePrimaryKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pk.gdb")
+	if err := storage.New(path); err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("load catalog: %v", err)
+	}
+	cols := []catalog.Column{
+		{Name: "a", Type: catalog.ColumnTypeInt},
+		{Name: "b", Type: catalog.ColumnTypeInt},
+		{Name: "note", Type: catalog.ColumnTypeVarChar, Length: 16},
+	}
+	opts := catalog.TableOptions{PrimaryKeyName: "pk_pairs_ba", PrimaryKeyRoot: 42}
+	if _, err := cat.CreateTableWithOptions("pairs", cols, []string{"B", "a"}, nil, opts); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	mgr, err = storage.Open(path)
+	if err != nil {
+		t.Fatalf("reopen db: %v", err)
+	}
+	defer mgr.Close()
+	cat, err = catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("reload catalog: %v", err)
+	}
+	table, _ := cat.GetTable("pairs")
+	if got := table.PrimaryKeyColumns(); len(got) != 2 || got[0] != "b" || got[1] != "a" {
+		t.Fatalf("expected primary key (b, a), got %v", got)
+	}
+	idx := table.Indexes["pk_pairs_ba"]
+	if idx == nil || !idx.IsUnique || idx.Root != 42 {
+		t.Fatalf("unexpected primary key index %+v", idx)
+	}
+	for _, col := range table.Columns[:2] {
+		if !col.PrimaryKey || !col.NotNull {
+			t.Fatalf("expected %s to be a NOT NULL primary key column", col.Name)
+		}
+	}
+	if table.Columns[2].PrimaryKey {
+		t.Fatalf("note should not be part of the primary key")
+	}
+	if err := cat.DropIndex("pairs", "pk_pairs_ba"); err == nil || !strings.Contains(err.Error(), "primary key") {
+		t.Fatalf("expected the primary key index to be protected, got %v", err)
+	}
+}
+
+func TestCatalogGivesLegacyPrimaryKeyAnIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.gdb")
+	if err := storage.New(path); err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	mgr, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer mgr.Close()
+	// A catalogue from before primary keys had an index: the key is the
+	// column ordinal in the table entry, and nothing else records it.
+	buf := &bytes.Buffer{}
+	writeLegacy := func(values ...interface{}) {
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				binary.Write(buf, binary.LittleEndian, uint16(len(s)))
+				buf.WriteString(s)
+				continue
+			}
+			binary.Write(buf, binary.LittleEndian, v)
+		}
+	}
+	writeLegacy(uint16(1), "people", uint32(1), uint64(0), uint16(2), int16(1))
+	writeLegacy("name", uint8(catalog.ColumnTypeVarChar), uint16(32), uint8(0))
+	writeLegacy("id", uint8(catalog.ColumnTypeInt), uint16(0), uint8(0))
+	if err := mgr.UpdateCatalog(buf.Bytes()); err != nil {
+		t.Fatalf("write catalogue: %v", err)
+	}
+
+	cat, err := catalog.Load(mgr)
+	if err != nil {
+		t.Fatalf("load catalog: %v", err)
+	}
+	table, _ := cat.GetTable("people")
+	idx := table.Indexes["pk_people"]
+	if table.PrimaryKey != "pk_people" || idx == nil || !idx.IsUnique || idx.Root != 0 {
+		t.Fatalf("expected an unbuilt pk_people index, got %q %+v", table.PrimaryKey, idx)
+	}
+	if got := table.PrimaryKeyColumns(); len(got) != 1 || got[0] != "id" || !table.Columns[1].NotNull {
+		t.Fatalf("unexpected primary key %v", got)
+	}
+}
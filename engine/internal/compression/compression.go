@@ -0,0 +1,136 @@
+// Package compression provides the codecs used to compress heap pages.
+//
+// Every codec is pure Go: LZ4 is implemented here in its block format, and
+// deflate comes from the standard library. A codec is identified on disk by a
+// single byte, so the values of the Codec constants must never change.
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Codec identifies a compression algorithm.
+type Codec uint8
+
+const (
+	// None stores data uncompressed.
+	None Codec = iota
+	// LZ4 favours speed over ratio.
+	LZ4
+	// Deflate compresses harder than LZ4 at a higher CPU cost.
+	Deflate
+)
+
+// ErrCorrupt is returned when compressed data cannot be decoded.
+var ErrCorrupt = errors.New("compression: corrupt data")
+
+// Parse returns the codec with the given name, as written in
+// CREATE TABLE ... WITH (compression = '...').
+func Parse(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return None, nil
+	case "lz4":
+		return LZ4, nil
+	case "deflate":
+		return Deflate, nil
+	case "zstd":
+		return None, fmt.Errorf("compression: zstd is not supported (no pure-Go codec is bundled); use lz4 or deflate")
+	default:
+		return None, fmt.Errorf("compression: unknown codec %q", name)
+	}
+}
+
+// String returns the name accepted by Parse.
+func (c Codec) String() string {
+	switch c {
+	case None:
+		return "none"
+	case LZ4:
+		return "lz4"
+	case Deflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(c))
+	}
+}
+
+// Valid reports whether c is a codec this build understands.
+func (c Codec) Valid() bool {
+	return c <= Deflate
+}
+
+// Compress appends the compressed form of src to dst.
+func (c Codec) Compress(dst, src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return append(dst, src...), nil
+	case LZ4:
+		return lz4Compress(dst, src), nil
+	case Deflate:
+		return deflateCompress(dst, src)
+	default:
+		return nil, fmt.Errorf("compression: unknown codec %d", uint8(c))
+	}
+}
+
+// Decompress decodes src into dst, which must be exactly the size of the
+// original data.
+func (c Codec) Decompress(dst, src []byte) error {
+	switch c {
+	case None:
+		if len(src) != len(dst) {
+			return ErrCorrupt
+		}
+		copy(dst, src)
+		return nil
+	case LZ4:
+		return lz4Decompress(dst, src)
+	case Deflate:
+		return deflateDecompress(dst, src)
+	default:
+		return fmt.Errorf("compression: unknown codec %d", uint8(c))
+	}
+}
+
+// Deflate writers allocate several hundred kilobytes of state, so they are
+// pooled rather than created for every page.
+var deflateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+func deflateCompress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := deflateWriters.Get().(*flate.Writer)
+	defer deflateWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func deflateDecompress(dst, src []byte) error {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return ErrCorrupt
+	}
+	var extra [1]byte
+	if n, _ := r.Read(extra[:]); n != 0 {
+		return ErrCorrupt
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package compression
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 4096)
+	rng.Read(random)
+	inputs := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("granite"),
+		"repetitive": bytes.Repeat([]byte("customer-0042,London,active;"), 150),
+		"zeros":      make([]byte, 8192),
+		"random":     random,
+	}
+	for _, codec := range []Codec{None, LZ4, Deflate} {
+		for name, input := range inputs {
+			compressed, err := codec.Compress(nil, input)
+			if err != nil {
+				t.Fatalf("%s/%s: compress: %v", codec, name, err)
+			}
+			out := make([]byte, len(input))
+			if err := codec.Decompress(out, compressed); err != nil {
+				t.Fatalf("%s/%s: decompress: %v", codec, name, err)
+			}
+			if !bytes.Equal(out, input) {
+				t.Fatalf("%s/%s: round trip changed the data", codec, name)
+			}
+			if codec != None && name == "repetitive" && len(compressed) > len(input)/4 {
+				t.Fatalf("%s: expected repetitive input to compress well, got %d of %d bytes", codec, len(compressed), len(input))
+			}
+		}
+	}
+}
+
+func TestLZ4RejectsCorruptInput(t *testing.T) {
+	input := bytes.Repeat([]byte("abcdefgh"), 64)
+	compressed := lz4Compress(nil, input)
+	out := make([]byte, len(input))
+	if err := lz4Decompress(out, compressed[:len(compressed)/2]); err == nil {
+		t.Fatalf("expected truncated input to be rejected")
+	}
+	if err := lz4Decompress(make([]byte, len(input)+1), compressed); err == nil {
+		t.Fatalf("expected a size mismatch to be rejected")
+	}
+}
+
+func TestParse(t *testing.T) {
+	for name, want := range map[string]Codec{"none": None, "LZ4": LZ4, "deflate": Deflate} {
+		got, err := Parse(name)
+		if err != nil || got != want {
+			t.Fatalf("Parse(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := Parse("zstd"); err == nil {
+		t.Fatalf("expected zstd to be rejected")
+	}
+}
@@ -0,0 +1,160 @@
+package compression
+
+import "encoding/binary"
+
+// LZ4 block format: a series of sequences, each a token byte whose high nibble
+// is the literal length and low nibble the match length minus minMatch, the
+// literals, a little-endian 16-bit back-reference offset and any extended
+// match length. Lengths of 15 or more continue in following bytes, each 255
+// meaning "add 255 and keep reading". The final sequence carries literals
+// only.
+const (
+	minMatch = 4
+	// lastLiterals bytes at the end of a block are always literals, and no
+	// match may start within mfLimit bytes of the end.
+	lastLiterals = 5
+	mfLimit      = 12
+	maxOffset    = 0xFFFF
+	hashLog      = 12
+)
+
+// lz4Compress is a greedy single-pass compressor: it looks up each 4-byte
+// sequence in a hash table of recent positions and emits the longest match
+// it finds there.
+func lz4Compress(dst, src []byte) []byte {
+	var table [1 << hashLog]int32 // position + 1; zero means empty
+	anchor := 0
+	limit := len(src) - mfLimit
+	for i := 0; i < limit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - hashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > maxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+			i--
+			ref--
+		}
+		end := i + minMatch
+		for end < len(src)-lastLiterals && src[end] == src[ref+end-i] {
+			end++
+		}
+		dst = appendSequence(dst, src[anchor:i], i-ref, end-i)
+		i = end
+		anchor = end
+	}
+	return appendSequence(dst, src[anchor:], 0, 0)
+}
+
+// appendSequence encodes literals followed by a match; a zero matchLen ends
+// the block.
+func appendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	var token byte
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	extra := matchLen - minMatch
+	if matchLen > 0 {
+		if extra >= 15 {
+			token |= 15
+		} else {
+			token |= byte(extra)
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = appendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if extra >= 15 {
+		dst = appendLength(dst, extra-15)
+	}
+	return dst
+}
+
+func appendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+func lz4Decompress(dst, src []byte) error {
+	di, si := 0, 0
+	for si < len(src) {
+		token := src[si]
+		si++
+		literals := int(token >> 4)
+		if literals == 15 {
+			n, next, ok := readLength(src, si)
+			if !ok {
+				return ErrCorrupt
+			}
+			literals += n
+			si = next
+		}
+		if literals > len(src)-si || literals > len(dst)-di {
+			return ErrCorrupt
+		}
+		copy(dst[di:], src[si:si+literals])
+		di += literals
+		si += literals
+		if si == len(src) {
+			break
+		}
+
+		if len(src)-si < 2 {
+			return ErrCorrupt
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > di {
+			return ErrCorrupt
+		}
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			n, next, ok := readLength(src, si)
+			if !ok {
+				return ErrCorrupt
+			}
+			matchLen += n
+			si = next
+		}
+		matchLen += minMatch
+		if matchLen > len(dst)-di {
+			return ErrCorrupt
+		}
+		// Byte by byte, because a match may overlap the bytes it produces.
+		for k := 0; k < matchLen; k++ {
+			dst[di+k] = dst[di-offset+k]
+		}
+		di += matchLen
+	}
+	if di != len(dst) {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func readLength(src []byte, si int) (int, int, bool) {
+	n := 0
+	for si < len(src) {
+		b := src[si]
+		si++
+		n += int(b)
+		if b != 255 {
+			return n, si, true
+		}
+	}
+	return 0, si, false
+}
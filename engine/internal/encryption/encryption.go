@@ -0,0 +1,193 @@
+// Package encryption seals database pages, WAL records and index files with
+// AES-256-GCM.
+//
+// Data is encrypted with a random data key. The data key is stored in the
+// database header wrapped by a key-encryption key derived from the user's
+// passphrase with PBKDF2-HMAC-SHA256, so changing the passphrase only rewraps
+// the data key, and a wrong passphrase is detected when unwrapping fails.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	keySize   = 32
+	nonceSize = 12
+	tagSize   = 16
+	saltSize  = 16
+
+	// Overhead is the number of bytes Seal adds to a plaintext.
+	Overhead = nonceSize + tagSize
+
+	// DefaultIterations is the PBKDF2 iteration count for new key headers.
+	DefaultIterations = 200_000
+
+	kdfPBKDF2SHA256 = 1
+	wrappedKeySize  = keySize + Overhead
+
+	// HeaderSize is the encoded size of a KeyHeader.
+	HeaderSize = 1 + 1 + 2 + 4 + saltSize + wrappedKeySize
+)
+
+// ErrWrongKey is returned when a passphrase does not unlock a key header.
+var ErrWrongKey = errors.New("encryption: wrong key")
+
+// ErrAuthentication is returned when sealed data fails authentication,
+// because it was damaged or sealed under another key.
+var ErrAuthentication = errors.New("encryption: message authentication failed")
+
+// Cipher seals and opens data with the database's data key.
+type Cipher struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+func newCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{key: key, aead: aead}, nil
+}
+
+// Seal encrypts plaintext under a fresh random nonce and appends
+// nonce || ciphertext || tag to dst. additional is authenticated but not
+// stored; callers use it to bind the data to its location.
+func (c *Cipher) Seal(dst, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, plaintext, additional), nil
+}
+
+// Open authenticates and decrypts data produced by Seal, appending the
+// plaintext to dst.
+func (c *Cipher) Open(dst, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, ErrAuthentication
+	}
+	plain, err := c.aead.Open(dst, sealed[:nonceSize], sealed[nonceSize:], additional)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return plain, nil
+}
+
+// KeyHeader holds everything needed to recover the data key from a
+// passphrase. It is stored unencrypted.
+type KeyHeader struct {
+	KDF        uint8
+	Iterations uint32
+	Salt       [saltSize]byte
+	WrappedKey [wrappedKeySize]byte
+}
+
+// NewKey generates a data key protected by passphrase.
+func NewKey(passphrase string) (*KeyHeader, *Cipher, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	c, err := newCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := wrap(c, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, c, nil
+}
+
+// Rewrap protects the data key of c with a new passphrase and a fresh salt.
+func Rewrap(c *Cipher, passphrase string) (*KeyHeader, error) {
+	return wrap(c, passphrase)
+}
+
+func wrap(c *Cipher, passphrase string) (*KeyHeader, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("encryption: empty key")
+	}
+	header := &KeyHeader{KDF: kdfPBKDF2SHA256, Iterations: DefaultIterations}
+	if _, err := rand.Read(header.Salt[:]); err != nil {
+		return nil, err
+	}
+	kek, err := header.keyEncryptionKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := kek.Seal(nil, c.key, header.additionalData())
+	if err != nil {
+		return nil, err
+	}
+	copy(header.WrappedKey[:], wrapped)
+	return header, nil
+}
+
+// Unlock derives the key-encryption key from passphrase and unwraps the data
+// key, failing with ErrWrongKey when the passphrase does not match.
+func (h *KeyHeader) Unlock(passphrase string) (*Cipher, error) {
+	kek, err := h.keyEncryptionKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := kek.Open(nil, h.WrappedKey[:], h.additionalData())
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return newCipher(key)
+}
+
+func (h *KeyHeader) keyEncryptionKey(passphrase string) (*Cipher, error) {
+	if h.KDF != kdfPBKDF2SHA256 {
+		return nil, fmt.Errorf("encryption: unsupported key derivation function %d", h.KDF)
+	}
+	if h.Iterations == 0 {
+		return nil, fmt.Errorf("encryption: invalid iteration count")
+	}
+	return newCipher(pbkdf2SHA256([]byte(passphrase), h.Salt[:], int(h.Iterations), keySize))
+}
+
+// additionalData binds the wrapped key to the KDF parameters so that they
+// cannot be altered without unwrapping failing.
+func (h *KeyHeader) additionalData() []byte {
+	buf := make([]byte, 8+saltSize)
+	buf[0] = h.KDF
+	binary.LittleEndian.PutUint32(buf[4:8], h.Iterations)
+	copy(buf[8:], h.Salt[:])
+	return buf
+}
+
+// Encode writes the header into buf, which must hold HeaderSize bytes.
+func (h *KeyHeader) Encode(buf []byte) {
+	buf[0] = h.KDF
+	buf[1] = 0
+	binary.LittleEndian.PutUint16(buf[2:4], 0)
+	binary.LittleEndian.PutUint32(buf[4:8], h.Iterations)
+	copy(buf[8:8+saltSize], h.Salt[:])
+	copy(buf[8+saltSize:HeaderSize], h.WrappedKey[:])
+}
+
+// DecodeHeader reads a header written by Encode. It returns nil when buf
+// records no key, meaning the data is not encrypted.
+func DecodeHeader(buf []byte) *KeyHeader {
+	if buf[0] == 0 {
+		return nil
+	}
+	h := &KeyHeader{KDF: buf[0], Iterations: binary.LittleEndian.Uint32(buf[4:8])}
+	copy(h.Salt[:], buf[8:8+saltSize])
+	copy(h.WrappedKey[:], buf[8+saltSize:HeaderSize])
+	return h
+}
@@ -0,0 +1,65 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// RFC 7914 section 11 lists PBKDF2-HMAC-SHA256 test vectors.
+func TestPBKDF2Vectors(t *testing.T) {
+	got := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(got) != want {
+		t.Fatalf("unexpected derived key %x", got)
+	}
+}
+
+func TestKeyHeaderRoundTrip(t *testing.T) {
+	header, c, err := NewKey("correct horse")
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	buf := make([]byte, HeaderSize)
+	header.Encode(buf)
+	decoded := DecodeHeader(buf)
+	if decoded == nil {
+		t.Fatalf("expected an encoded header to decode")
+	}
+	if _, err := decoded.Unlock("battery staple"); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("expected wrong key error, got %v", err)
+	}
+	unlocked, err := decoded.Unlock("correct horse")
+	if err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	sealed, err := c.Seal(nil, []byte("page image"), []byte{7})
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	plain, err := unlocked.Open(nil, sealed, []byte{7})
+	if err != nil || !bytes.Equal(plain, []byte("page image")) {
+		t.Fatalf("open: %q, %v", plain, err)
+	}
+	if _, err := unlocked.Open(nil, sealed, []byte{8}); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected data bound to another location to be rejected, got %v", err)
+	}
+
+	rewrapped, err := Rewrap(unlocked, "new passphrase")
+	if err != nil {
+		t.Fatalf("rewrap: %v", err)
+	}
+	again, err := rewrapped.Unlock("new passphrase")
+	if err != nil {
+		t.Fatalf("unlock rewrapped: %v", err)
+	}
+	if plain, err := again.Open(nil, sealed, []byte{7}); err != nil || !bytes.Equal(plain, []byte("page image")) {
+		t.Fatalf("rewrapped key should open existing data: %v", err)
+	}
+	if DecodeHeader(make([]byte, HeaderSize)) != nil {
+		t.Fatalf("expected an all-zero header to mean no encryption")
+	}
+}
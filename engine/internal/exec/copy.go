@@ -0,0 +1,413 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/example/granite-db/engine/internal/catalog"
+	"github.com/example/granite-db/engine/internal/sql/parser"
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/storage/indexmgr"
+	"github.com/example/granite-db/engine/internal/txn"
+)
+
+// copyBatchSize is how many rows COPY buffers before writing them to the heap.
+const copyBatchSize = 1000
+
+// maxNDJSONLine bounds the length of a single NDJSON line.
+const maxNDJSONLine = 64 << 20
+
+// copyLoader accumulates the rows of a COPY. Rows are checked as they are
+// read and buffered; the heap receives them a batch at a time and the indexes
+// are rebuilt once at the end.
+type copyLoader struct {
+	executor *Executor
+	tx       *txn.Transaction
+	table    *catalog.Table
+	heap     *storage.HeapFile
+	indexes  []indexInfo
+	fks      []foreignKeyInfo
+	// unique holds the keys loaded so far for each unique index, which the
+	// index file does not see until the end.
+	unique  []map[string]bool
+	entries [][]indexmgr.Entry
+	records [][]byte
+	values  [][]interface{}
+	loaded  []storage.RowID
+	rejects [][]string
+}
+
+// executeCopy bulk-loads a CSV or NDJSON file into a table. Rows that cannot
+// be converted or break a constraint are skipped and reported with their line
+// numbers; the rest are loaded. The table is locked exclusively, so the rows
+// are not locked individually.
+func (e *Executor) executeCopy(tx *txn.Transaction, stmt *parser.CopyStmt) (*Result, error) {
+	table, ok := e.catalog.GetTable(stmt.Table)
+	if !ok {
+		return nil, fmt.Errorf("exec: table %s not found", stmt.Table)
+	}
+	if err := e.acquireTableLock(tx, table.Name, txn.LockModeExclusive); err != nil {
+		return nil, err
+	}
+	targets, err := copyTargets(table, stmt.Columns)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := buildIndexInfos(table)
+	if err != nil {
+		return nil, err
+	}
+	fks, err := e.buildForeignKeyInfos(table)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(stmt.Path)
+	if err != nil {
+		return nil, fmt.Errorf("exec: COPY cannot open %s: %w", stmt.Path, err)
+	}
+	defer file.Close()
+
+	l := &copyLoader{
+		executor: e,
+		tx:       tx,
+		table:    table,
+		heap:     table.HeapFile(e.storage),
+		indexes:  infos,
+		fks:      fks,
+		unique:   make([]map[string]bool, len(infos)),
+		entries:  make([][]indexmgr.Entry, len(infos)),
+	}
+	for i, info := range infos {
+		if info.def.IsUnique {
+			l.unique[i] = make(map[string]bool)
+		}
+	}
+	// Undo the heap inserts batch by batch, so that a failure half-way
+	// leaves nothing behind once the transaction rolls back.
+	tx.RegisterRollback(func() error {
+		for _, rid := range l.loaded {
+			if err := l.heap.Delete(tx, e.wal, rid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	switch stmt.Format {
+	case "ndjson":
+		err = l.readNDJSON(file, targets)
+	default:
+		err = l.readCSV(file, targets, stmt.Header, stmt.Delimiter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := l.flush(); err != nil {
+		return nil, err
+	}
+	if err := l.finish(); err != nil {
+		return nil, err
+	}
+
+	total := len(l.loaded)
+	result := &Result{RowsAffected: total, Message: fmt.Sprintf("%d row(s) copied", total)}
+	if len(l.rejects) > 0 {
+		result.Columns, result.Rows = []string{"line", "error"}, l.rejects
+		result.Message += fmt.Sprintf(", %d rejected", len(l.rejects))
+	}
+	return result, nil
+}
+
+// copyTargets maps the listed columns to their table positions; without a
+// list every column is loaded in table order.
+func copyTargets(table *catalog.Table, columns []string) ([]int, error) {
+	if len(columns) == 0 {
+		targets := make([]int, len(table.Columns))
+		for i := range targets {
+			targets[i] = i
+		}
+		return targets, nil
+	}
+	targets := make([]int, len(columns))
+	seen := make(map[int]bool, len(columns))
+	for i, name := range columns {
+		pos := -1
+		for j, col := range table.Columns {
+			if strings.EqualFold(col.Name, name) {
+				pos = j
+				break
+			}
+		}
+		if pos < 0 {
+			return nil, fmt.Errorf("exec: column %s not found in table %s", name, table.Name)
+		}
+		if seen[pos] {
+			return nil, fmt.Errorf("exec: column %s listed more than once", name)
+		}
+		seen[pos] = true
+		targets[i] = pos
+	}
+	return targets, nil
+}
+
+func (l *copyLoader) readCSV(r io.Reader, targets []int, header bool, delimiter rune) error {
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	for first := true; ; first = false {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			l.reject(parseErr.StartLine, parseErr.Err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		if first && header {
+			continue
+		}
+		if len(fields) != len(targets) {
+			l.reject(line, fmt.Errorf("expected %d field(s), found %d", len(targets), len(fields)))
+			continue
+		}
+		literals := make(map[int]parser.Literal, len(targets))
+		for i, pos := range targets {
+			literals[pos] = textLiteral(fields[i], l.table.Columns[pos])
+		}
+		if err := l.add(line, literals); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *copyLoader) readNDJSON(r io.Reader, targets []int) error {
+	byName := make(map[string]int, len(targets))
+	for _, pos := range targets {
+		byName[strings.ToLower(l.table.Columns[pos].Name)] = pos
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLine)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.UseNumber()
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil || object == nil {
+			l.reject(line, fmt.Errorf("expected a JSON object"))
+			continue
+		}
+		literals := make(map[int]parser.Literal, len(object))
+		var bad error
+		for key, value := range object {
+			pos, ok := byName[strings.ToLower(key)]
+			if !ok {
+				bad = fmt.Errorf("unknown column %s", key)
+				break
+			}
+			lit, err := jsonLiteral(value, l.table.Columns[pos])
+			if err != nil {
+				bad = err
+				break
+			}
+			literals[pos] = lit
+		}
+		if bad != nil {
+			l.reject(line, bad)
+			continue
+		}
+		if err := l.add(line, literals); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("exec: COPY read failed: %w", err)
+	}
+	return nil
+}
+
+// textLiteral reads a CSV field as a literal of the column's type. An empty
+// field is NULL.
+func textLiteral(text string, col catalog.Column) parser.Literal {
+	if text == "" {
+		return parser.Literal{Kind: parser.LiteralNull}
+	}
+	switch col.Type {
+	case catalog.ColumnTypeInt, catalog.ColumnTypeBigInt:
+		return parser.Literal{Kind: parser.LiteralNumber, Value: text}
+	case catalog.ColumnTypeBoolean:
+		if strings.EqualFold(text, "true") || strings.EqualFold(text, "false") {
+			return parser.Literal{Kind: parser.LiteralBoolean, Value: text}
+		}
+	}
+	return parser.Literal{Kind: parser.LiteralString, Value: text}
+}
+
+// jsonLiteral converts a decoded JSON value into a literal, keeping its JSON
+// type so that, as in INSERT, a string is not accepted for a number column.
+func jsonLiteral(value interface{}, col catalog.Column) (parser.Literal, error) {
+	switch v := value.(type) {
+	case nil:
+		return parser.Literal{Kind: parser.LiteralNull}, nil
+	case string:
+		return parser.Literal{Kind: parser.LiteralString, Value: v}, nil
+	case bool:
+		return parser.Literal{Kind: parser.LiteralBoolean, Value: strings.ToUpper(strconv.FormatBool(v))}, nil
+	case json.Number:
+		text := v.String()
+		if strings.ContainsAny(text, ".eE") {
+			return parser.Literal{Kind: parser.LiteralDecimal, Value: text}, nil
+		}
+		return parser.Literal{Kind: parser.LiteralNumber, Value: text}, nil
+	default:
+		return parser.Literal{}, fmt.Errorf("unsupported JSON value for column %s", col.Name)
+	}
+}
+
+// add converts and checks a row; columns without a literal are NULL. A row
+// that fails is rejected rather than ending the load.
+func (l *copyLoader) add(line int, literals map[int]parser.Literal) error {
+	values := make([]interface{}, len(l.table.Columns))
+	for i, col := range l.table.Columns {
+		lit, ok := literals[i]
+		if !ok {
+			lit = parser.Literal{Kind: parser.LiteralNull}
+		}
+		value, err := convertLiteral(lit, col)
+		if err != nil {
+			l.reject(line, err)
+			return nil
+		}
+		values[i] = value
+	}
+	if err := l.executor.ensureUniqueIndexes(l.table, l.indexes, values, nil); err != nil {
+		l.reject(line, err)
+		return nil
+	}
+	keys := make([]string, len(l.indexes))
+	for i, info := range l.indexes {
+		key, ok, err := indexKeyFor(l.table.Columns, info.positions, info.def.Descending, values)
+		if err != nil {
+			l.reject(line, err)
+			return nil
+		}
+		if !ok {
+			continue
+		}
+		if info.def.IsUnique && l.unique[i][key] {
+			l.reject(line, fmt.Errorf("exec: duplicate key value violates unique index \"%s\"", info.def.Name))
+			return nil
+		}
+		keys[i] = key
+	}
+	if err := l.executor.ensureForeignKeys(l.table, l.fks, values); err != nil {
+		l.reject(line, err)
+		return nil
+	}
+	encoded, err := EncodeRow(l.table.Columns, values)
+	if err != nil {
+		l.reject(line, err)
+		return nil
+	}
+	for i, info := range l.indexes {
+		if info.def.IsUnique && keys[i] != "" {
+			l.unique[i][keys[i]] = true
+		}
+	}
+	l.records = append(l.records, encoded)
+	l.values = append(l.values, values)
+	if len(l.records) >= copyBatchSize {
+		return l.flush()
+	}
+	return nil
+}
+
+func (l *copyLoader) reject(line int, err error) {
+	l.rejects = append(l.rejects, []string{strconv.Itoa(line), err.Error()})
+}
+
+// flush writes the buffered rows to the heap and queues their index entries.
+func (l *copyLoader) flush() error {
+	if len(l.records) == 0 {
+		return nil
+	}
+	rids, err := l.heap.InsertBatch(l.tx, l.executor.wal, l.records)
+	if err != nil {
+		return err
+	}
+	l.loaded = append(l.loaded, rids...)
+	for n, values := range l.values {
+		for i, info := range l.indexes {
+			entry, ok, err := indexEntryFor(l.table.Columns, info, values, rids[n])
+			if err != nil {
+				return err
+			}
+			if ok {
+				l.entries[i] = append(l.entries[i], entry)
+			}
+		}
+	}
+	l.records, l.values = l.records[:0], l.values[:0]
+	return nil
+}
+
+// finish rebuilds each index once with the loaded entries and records the
+// new row count, arranging for both to be restored on rollback.
+func (l *copyLoader) finish() error {
+	if len(l.loaded) == 0 {
+		return nil
+	}
+	for i, info := range l.indexes {
+		file, err := l.executor.indexes.Open(info.def.Root)
+		if err != nil {
+			return err
+		}
+		existing, err := file.Entries()
+		if err != nil {
+			return err
+		}
+		merged := make([]indexmgr.Entry, len(existing), len(existing)+len(l.entries[i]))
+		copy(merged, existing)
+		if len(info.included) > 0 {
+			// Split the stored keys so that uniqueness ignores the
+			// included values.
+			values := make([]interface{}, len(l.table.Columns))
+			for j, entry := range merged {
+				keyLen, err := decodeIndexEntry(l.table.Columns, info, entry.Key, values)
+				if err != nil {
+					return err
+				}
+				merged[j].Key, merged[j].Included = entry.Key[:keyLen:keyLen], entry.Key[keyLen:]
+			}
+		}
+		if err := file.Rebuild(l.tx, l.executor.wal, append(merged, l.entries[i]...), info.def.IsUnique); err != nil {
+			return err
+		}
+		l.tx.RegisterRollback(func() error {
+			return file.Rebuild(l.tx, l.executor.wal, existing, false)
+		})
+	}
+	rowCount := l.table.RowCount
+	if err := l.executor.catalog.SetRowCount(l.table.Name, rowCount+uint64(len(l.loaded))); err != nil {
+		return err
+	}
+	l.tx.RegisterRollback(func() error {
+		return l.executor.catalog.SetRowCount(l.table.Name, rowCount)
+	})
+	return nil
+}
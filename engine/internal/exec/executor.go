@@ -12,6 +12,7 @@ import (
 	"github.com/shopspring/decimal"
 
 	"github.com/example/granite-db/engine/internal/catalog"
+	"github.com/example/granite-db/engine/internal/compression"
 	"github.com/example/granite-db/engine/internal/sql/expr"
 	"github.com/example/granite-db/engine/internal/sql/parser"
 	"github.com/example/granite-db/engine/internal/sql/validator"
@@ -36,11 +37,17 @@ type Executor struct {
 	indexes *indexmgr.Manager
 	locks   *txn.LockManager
 	wal     *wal.Manager
+	// unbuilt holds, by lower-case index name, why BuildIndexTrees left an
+	// index without a tree. The integrity check reports it.
+	unbuilt map[string]string
 }
 
 type indexInfo struct {
 	def       *catalog.Index
 	positions []int
+	// included holds the positions of the columns the index stores after
+	// its key.
+	included []int
 }
 
 type indexChoice struct {
@@ -53,6 +60,16 @@ type indexChoice struct {
 	upperInclusive bool
 	lowerValue     interface{}
 	upperValue     interface{}
+	// ordered is set when the scan returns rows in the order the ORDER BY
+	// clause asks for, so they need no sort.
+	ordered bool
+	// limit, when non-zero, makes an ordered scan apply the filter itself
+	// and stop once that many rows have passed it.
+	limit  int
+	filter expr.TypedExpr
+	// covering is set when the index holds every column the query reads,
+	// so the scan decodes rows from the index and never visits the table.
+	covering bool
 }
 
 type columnRestriction struct {
@@ -84,7 +101,7 @@ var errStopScan = errors.New("stop scan")
 
 // New creates an executor for the given catalog and storage manager.
 func New(cat *catalog.Catalog, mgr *storage.Manager, idx *indexmgr.Manager, locks *txn.LockManager, log *wal.Manager) *Executor {
-	return &Executor{catalog: cat, storage: mgr, indexes: idx, locks: locks, wal: log}
+	return &Executor{catalog: cat, storage: mgr, indexes: idx, locks: locks, wal: log, unbuilt: make(map[string]string)}
 }
 
 func (e *Executor) acquireTableLock(tx *txn.Transaction, table string, mode txn.LockMode) error {
@@ -124,6 +141,14 @@ func (e *Executor) Execute(tx *txn.Transaction, stmt parser.Statement) (*Result,
 		return e.executeDelete(tx, s)
 	case *parser.SelectStmt:
 		return e.executeSelect(tx, s)
+	case *parser.VacuumStmt:
+		return e.executeVacuum(tx, s)
+	case *parser.TruncateStmt:
+		return e.executeTruncate(tx, s)
+	case *parser.PragmaStmt:
+		return e.executePragma(tx, s)
+	case *parser.CopyStmt:
+		return e.executeCopy(tx, s)
 	default:
 		return nil, fmt.Errorf("exec: unsupported statement type %T", stmt)
 	}
@@ -163,6 +188,17 @@ func (e *Executor) Explain(stmt parser.Statement) (*Plan, error) {
 		return newPlan("Delete", map[string]interface{}{"table": s.Table}), nil
 	case *parser.SelectStmt:
 		return e.explainSelect(s)
+	case *parser.TruncateStmt:
+		return newPlan("Truncate", map[string]interface{}{"tables": s.Tables}), nil
+	case *parser.PragmaStmt:
+		return newPlan("Pragma", map[string]interface{}{"name": s.Name}), nil
+	case *parser.CopyStmt:
+		return newPlan("Copy", map[string]interface{}{"table": s.Table, "file": s.Path, "format": s.Format}), nil
+	case *parser.VacuumStmt:
+		if s.Full {
+			return newPlan("VacuumFull", nil), nil
+		}
+		return newPlan("Vacuum", map[string]interface{}{"table": s.Table}), nil
 	default:
 		return nil, fmt.Errorf("exec: unsupported statement type %T", stmt)
 	}
@@ -194,10 +230,36 @@ func (e *Executor) executeCreateTable(_ *txn.Transaction, stmt *parser.CreateTab
 	if err != nil {
 		return nil, err
 	}
-	table, err := e.catalog.CreateTable(stmt.Name, cols, stmt.PrimaryKey, foreignKeys)
+	codec, err := compression.Parse(stmt.Compression)
 	if err != nil {
 		return nil, err
 	}
+	opts := catalog.TableOptions{Compression: codec, PrimaryKeyName: stmt.PrimaryKeyName}
+	if len(stmt.PrimaryKey) > 0 {
+		positions := make([]int, 0, len(stmt.PrimaryKey))
+		for _, name := range stmt.PrimaryKey {
+			if pos := findColumnIndex(cols, name); pos >= 0 {
+				positions = append(positions, pos)
+			}
+		}
+		if err := e.checkKeySize("PRIMARY KEY", cols, positions, nil); err != nil {
+			return nil, err
+		}
+		// The table starts empty, so the primary key index starts as an
+		// empty tree.
+		idxFile, err := e.indexes.Create()
+		if err != nil {
+			return nil, err
+		}
+		opts.PrimaryKeyRoot = idxFile.Root()
+	}
+	table, err := e.catalog.CreateTableWithOptions(stmt.Name, cols, stmt.PrimaryKey, foreignKeys, opts)
+	if err != nil {
+		if opts.PrimaryKeyRoot != 0 {
+			e.indexes.Drop(nil, nil, opts.PrimaryKeyRoot)
+		}
+		return nil, err
+	}
 	return &Result{Message: fmt.Sprintf("Table %s created", table.Name)}, nil
 }
 
@@ -284,13 +346,13 @@ func (e *Executor) buildForeignKeys(stmt *parser.CreateTableStmt, cols []catalog
 	return result, nil
 }
 
-func (e *Executor) executeDropTable(_ *txn.Transaction, stmt *parser.DropTableStmt) (*Result, error) {
+func (e *Executor) executeDropTable(tx *txn.Transaction, stmt *parser.DropTableStmt) (*Result, error) {
 	indexes := e.catalog.TableIndexes(stmt.Name)
-	if err := e.catalog.DropTable(stmt.Name); err != nil {
+	if err := e.catalog.DropTable(tx, e.wal, stmt.Name); err != nil {
 		return nil, err
 	}
 	for _, idx := range indexes {
-		if err := e.indexes.Drop(stmt.Name, idx.Name); err != nil {
+		if err := e.indexes.Drop(tx, e.wal, idx.Root); err != nil {
 			return nil, err
 		}
 	}
@@ -310,62 +372,47 @@ func (e *Executor) executeCreateIndex(_ *txn.Transaction, stmt *parser.CreateInd
 			return nil, fmt.Errorf("exec: index %s already exists on table %s", stmt.Name, stmt.Table)
 		}
 	}
-	positions := make([]int, len(stmt.Columns))
-	resolved := make([]string, len(stmt.Columns))
-	for i, name := range stmt.Columns {
-		found := false
-		for pos, col := range table.Columns {
-			if strings.EqualFold(col.Name, name) {
-				positions[i] = pos
-				resolved[i] = col.Name
-				found = true
-				break
-			}
-		}
-		if !found {
-			return nil, fmt.Errorf("exec: column %s not found in table %s", name, stmt.Table)
-		}
+	def := &catalog.Index{Name: stmt.Name, Columns: stmt.Columns, Descending: stmt.Descending, Include: stmt.Include, IsUnique: stmt.Unique}
+	info, err := newIndexInfo(table, def)
+	if err != nil {
+		return nil, err
 	}
-	idxFile, err := e.indexes.Create(table.Name, stmt.Name)
+	if err := e.checkKeySize(stmt.Name, table.Columns, info.positions, info.included); err != nil {
+		return nil, err
+	}
+	entries, err := e.indexEntries(table, info)
 	if err != nil {
 		return nil, err
 	}
-	entries := make([]indexmgr.Entry, 0, table.RowCount)
-	heap := storage.NewHeapFile(e.storage, table.RootPage)
-	if err := heap.Scan(func(rid storage.RowID, record []byte) error {
-		values, err := DecodeRow(table.Columns, record)
-		if err != nil {
-			return err
-		}
-		components, skip, err := buildIndexComponents(table.Columns, positions, values)
-		if err != nil {
-			return err
-		}
-		if skip {
-			return nil
-		}
-		entry := indexmgr.Entry{Key: encodeIndexKey(components), Row: rid}
-		entries = append(entries, entry)
-		return nil
-	}); err != nil {
-		e.indexes.Drop(table.Name, stmt.Name)
+	idxFile, err := e.indexes.Create()
+	if err != nil {
 		return nil, err
 	}
-	if err := idxFile.Rebuild(entries, stmt.Unique); err != nil {
-		e.indexes.Drop(table.Name, stmt.Name)
+	if err := idxFile.Rebuild(nil, nil, entries, stmt.Unique); err != nil {
+		e.indexes.Drop(nil, nil, idxFile.Root())
 		if strings.Contains(err.Error(), "duplicate") {
 			return nil, fmt.Errorf("exec: duplicate key value violates unique index \"%s\"", stmt.Name)
 		}
 		return nil, err
 	}
-	if _, err := e.catalog.CreateIndex(table.Name, stmt.Name, resolved, stmt.Unique); err != nil {
-		e.indexes.Drop(table.Name, stmt.Name)
+	if _, err := e.catalog.CreateIndex(table.Name, stmt.Name, stmt.Columns, stmt.Descending, stmt.Include, stmt.Unique, idxFile.Root()); err != nil {
+		e.indexes.Drop(nil, nil, idxFile.Root())
 		return nil, err
 	}
 	return &Result{Message: fmt.Sprintf("Index %s created", stmt.Name)}, nil
 }
 
-func (e *Executor) executeDropIndex(_ *txn.Transaction, stmt *parser.DropIndexStmt) (*Result, error) {
+// checkKeySize rejects an index whose declared columns make for keys the
+// tree cannot hold, rather than leaving the first long value to fail.
+func (e *Executor) checkKeySize(name string, cols []catalog.Column, positions, included []int) error {
+	size, bounded := declaredKeySize(cols, positions, included)
+	if limit := e.indexes.MaxKeySize(); bounded && size > limit {
+		return fmt.Errorf("exec: index %s would hold keys of up to %d bytes, which exceeds the limit of %d bytes", name, size, limit)
+	}
+	return nil
+}
+
+func (e *Executor) executeDropIndex(tx *txn.Transaction, stmt *parser.DropIndexStmt) (*Result, error) {
 	table, idx, found := e.catalog.FindIndex(stmt.Name)
 	if !found {
 		return nil, fmt.Errorf("exec: index %s not found", stmt.Name)
@@ -373,12 +420,111 @@ func (e *Executor) executeDropIndex(_ *txn.Transaction, stmt *parser.DropIndexSt
 	if err := e.catalog.DropIndex(table.Name, idx.Name); err != nil {
 		return nil, err
 	}
-	if err := e.indexes.Drop(table.Name, idx.Name); err != nil {
+	if err := e.indexes.Drop(tx, e.wal, idx.Root); err != nil {
 		return nil, err
 	}
 	return &Result{Message: fmt.Sprintf("Index %s dropped", idx.Name)}, nil
 }
 
+// indexEntries reads the table's heap and returns the index entry of every
+// row.
+func (e *Executor) indexEntries(table *catalog.Table, info indexInfo) ([]indexmgr.Entry, error) {
+	entries := make([]indexmgr.Entry, 0, table.RowCount)
+	heap := table.HeapFile(e.storage)
+	err := heap.Scan(func(rid storage.RowID, record []byte) error {
+		values, err := DecodeRow(table.Columns, record)
+		if err != nil {
+			return err
+		}
+		entry, ok, err := indexEntryFor(table.Columns, info, values, rid)
+		if err != nil || !ok {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// BuildIndexTrees builds the tree of every index that has none yet, which is
+// the case for the indexes of a database whose indexes lived in files of
+// their own, and rebuilds every tree whose keys use the older encoding. It
+// returns the indexes it built. Older engines accepted keys of any length;
+// an index with a key too long for a tree is left unbuilt, so that queries
+// and writes pass it by, and the integrity check asks for it to be dropped.
+func (e *Executor) BuildIndexTrees() ([]storage.IndexTree, error) {
+	var built []storage.IndexTree
+	limit := e.indexes.MaxKeySize()
+	for _, table := range e.catalog.ListTables() {
+		for _, idx := range table.Indexes {
+			if idx.Built() {
+				continue
+			}
+			info, err := newIndexInfo(table, idx)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := e.indexEntries(table, info)
+			if err != nil {
+				return nil, err
+			}
+			if longest := longestKey(entries); longest > limit {
+				e.unbuilt[strings.ToLower(idx.Name)] = fmt.Sprintf("the index was not built because it holds a key of %d bytes, which exceeds the limit of %d bytes; drop the index", longest, limit)
+				continue
+			}
+			idxFile, err := e.indexes.Create()
+			if err != nil {
+				return nil, err
+			}
+			if err := idxFile.Rebuild(nil, nil, entries, idx.IsUnique); err != nil {
+				e.indexes.Drop(nil, nil, idxFile.Root())
+				return nil, fmt.Errorf("exec: building index %s: %w", idx.Name, err)
+			}
+			if err := e.catalog.SetIndexRoot(table.Name, idx.Name, idxFile.Root()); err != nil {
+				return nil, err
+			}
+			if err := e.indexes.Drop(nil, nil, idx.Root); err != nil {
+				return nil, err
+			}
+			built = append(built, storage.IndexTree{Table: table.Name, Index: idx.Name, Tree: storage.OpenBTree(e.storage, idxFile.Root())})
+		}
+	}
+	return built, nil
+}
+
+func longestKey(entries []indexmgr.Entry) int {
+	longest := 0
+	for _, entry := range entries {
+		if n := len(entry.Key) + len(entry.Included); n > longest {
+			longest = n
+		}
+	}
+	return longest
+}
+
+// RecountRows sets the row count the catalogue records for every table to
+// the number of rows in its heap. The counts are not logged, so recovery
+// calls this once it has redone and undone the heap pages.
+func (e *Executor) RecountRows() error {
+	for _, table := range e.catalog.ListTables() {
+		var count uint64
+		err := table.HeapFile(e.storage).Scan(func(storage.RowID, []byte) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if count == table.RowCount {
+			continue
+		}
+		if err := e.catalog.SetRowCount(table.Name, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *Executor) executeInsert(tx *txn.Transaction, stmt *parser.InsertStmt) (*Result, error) {
 	table, ok := e.catalog.GetTable(stmt.Table)
 	if !ok {
@@ -405,7 +551,7 @@ func (e *Executor) executeInsert(tx *txn.Transaction, stmt *parser.InsertStmt) (
 			columnOrder[i] = idx
 		}
 	}
-	heap := storage.NewHeapFile(e.storage, table.RootPage)
+	heap := table.HeapFile(e.storage)
 	indexInfos, err := buildIndexInfos(table)
 	if err != nil {
 		return nil, err
@@ -446,18 +592,18 @@ func (e *Executor) executeInsert(tx *txn.Transaction, stmt *parser.InsertStmt) (
 			_ = heap.Delete(tx, e.wal, rid)
 			return nil, err
 		}
-		if err := e.insertIntoIndexes(table, indexInfos, values, rid); err != nil {
+		if err := e.insertIntoIndexes(tx, table, indexInfos, values, rid); err != nil {
 			_ = heap.Delete(tx, e.wal, rid)
 			return nil, err
 		}
 		if err := e.catalog.IncrementRowCount(table.Name); err != nil {
-			_ = e.removeFromIndexes(table, indexInfos, values, rid)
+			_ = e.removeFromIndexes(tx, table, indexInfos, values, rid)
 			_ = heap.Delete(tx, e.wal, rid)
 			return nil, err
 		}
 		valuesCopy := cloneValues(values)
 		tx.RegisterRollback(func() error {
-			if err := e.removeFromIndexes(table, indexInfos, valuesCopy, rid); err != nil {
+			if err := e.removeFromIndexes(tx, table, indexInfos, valuesCopy, rid); err != nil {
 				return err
 			}
 			if err := heap.Delete(tx, e.wal, rid); err != nil {
@@ -482,7 +628,7 @@ func (e *Executor) executeDelete(tx *txn.Transaction, stmt *parser.DeleteStmt) (
 	if err := e.acquireTableLock(tx, validated.Table.Name, txn.LockModeExclusive); err != nil {
 		return nil, err
 	}
-	heap := storage.NewHeapFile(e.storage, validated.Table.RootPage)
+	heap := validated.Table.HeapFile(e.storage)
 	indexInfos, err := buildIndexInfos(validated.Table)
 	if err != nil {
 		return nil, err
@@ -521,7 +667,7 @@ func (e *Executor) executeDelete(tx *txn.Transaction, stmt *parser.DeleteStmt) (
 				return err
 			}
 		}
-		if err := e.removeFromIndexes(validated.Table, indexInfos, values, rid); err != nil {
+		if err := e.removeFromIndexes(tx, validated.Table, indexInfos, values, rid); err != nil {
 			return err
 		}
 		if err := heap.Delete(tx, e.wal, rid); err != nil {
@@ -531,7 +677,7 @@ func (e *Executor) executeDelete(tx *txn.Transaction, stmt *parser.DeleteStmt) (
 			encoded, encErr := EncodeRow(validated.Table.Columns, values)
 			if encErr == nil {
 				if restoredRID, insErr := heap.Insert(tx, e.wal, encoded); insErr == nil {
-					_ = e.insertIntoIndexes(validated.Table, indexInfos, values, restoredRID)
+					_ = e.insertIntoIndexes(tx, validated.Table, indexInfos, values, restoredRID)
 				}
 			}
 			return err
@@ -546,7 +692,7 @@ func (e *Executor) executeDelete(tx *txn.Transaction, stmt *parser.DeleteStmt) (
 			if err != nil {
 				return err
 			}
-			if err := e.insertIntoIndexes(validated.Table, indexInfos, valuesCopy, restoredRID); err != nil {
+			if err := e.insertIntoIndexes(tx, validated.Table, indexInfos, valuesCopy, restoredRID); err != nil {
 				return err
 			}
 			if err := e.catalog.IncrementRowCount(validated.Table.Name); err != nil {
@@ -572,7 +718,7 @@ func (e *Executor) executeUpdate(tx *txn.Transaction, stmt *parser.UpdateStmt) (
 	if err := e.acquireTableLock(tx, validated.Table.Name, txn.LockModeExclusive); err != nil {
 		return nil, err
 	}
-	heap := storage.NewHeapFile(e.storage, validated.Table.RootPage)
+	heap := validated.Table.HeapFile(e.storage)
 	indexInfos, err := buildIndexInfos(validated.Table)
 	if err != nil {
 		return nil, err
@@ -586,6 +732,8 @@ func (e *Executor) executeUpdate(tx *txn.Transaction, stmt *parser.UpdateStmt) (
 		return nil, err
 	}
 	evaluator := newValueEvaluator()
+	// processed holds rows this statement moved to another page, which the
+	// scan may reach again; rows updated in place keep their RowID.
 	processed := make(map[storage.RowID]struct{})
 	updated := 0
 	err = heap.Scan(func(rid storage.RowID, record []byte) error {
@@ -649,64 +797,75 @@ func (e *Executor) executeUpdate(tx *txn.Transaction, stmt *parser.UpdateStmt) (
 				}
 			}
 		}
-		if err := e.ensureUniqueIndexes(validated.Table, indexInfos, newValues, &rid); err != nil {
+		changedIndexes := changedIndexInfos(indexInfos, values, newValues)
+		if err := e.ensureUniqueIndexes(validated.Table, changedIndexes, newValues, &rid); err != nil {
 			return err
 		}
-		if err := e.ensureForeignKeys(validated.Table, fkInfos, newValues); err != nil {
+		if err := e.ensureForeignKeys(validated.Table, changedForeignKeyInfos(fkInfos, values, newValues), newValues); err != nil {
 			return err
 		}
-		if err := e.removeFromIndexes(validated.Table, indexInfos, values, rid); err != nil {
+		encodedNew, err := EncodeRow(validated.Table.Columns, newValues)
+		if err != nil {
 			return err
 		}
-		if err := heap.Delete(tx, e.wal, rid); err != nil {
+		encodedOld, err := EncodeRow(validated.Table.Columns, values)
+		if err != nil {
 			return err
 		}
-		encodedNew, err := EncodeRow(validated.Table.Columns, newValues)
+		oldCopy := cloneValues(values)
+		newCopy := cloneValues(newValues)
+
+		// Overwrite the row in place when it still fits on its page: the
+		// RowID and its lock stay valid and only the indexes whose key
+		// changed need new entries.
+		inPlace, err := heap.Update(tx, e.wal, rid, encodedNew)
 		if err != nil {
 			return err
 		}
+		if inPlace {
+			if err := e.removeFromIndexes(tx, validated.Table, changedIndexes, values, rid); err != nil {
+				return err
+			}
+			if err := e.insertIntoIndexes(tx, validated.Table, changedIndexes, newValues, rid); err != nil {
+				_ = e.removeFromIndexes(tx, validated.Table, changedIndexes, newValues, rid)
+				if _, restoreErr := heap.Update(tx, e.wal, rid, encodedOld); restoreErr == nil {
+					_ = e.insertIntoIndexes(tx, validated.Table, changedIndexes, values, rid)
+				}
+				return err
+			}
+			tx.RegisterRollback(func() error {
+				return e.restoreUpdatedRow(tx, validated.Table, heap, indexInfos, rid, newCopy, oldCopy, encodedOld)
+			})
+			return nil
+		}
+
+		// Otherwise move the row to a page with room.
+		if err := e.removeFromIndexes(tx, validated.Table, indexInfos, values, rid); err != nil {
+			return err
+		}
+		if err := heap.Delete(tx, e.wal, rid); err != nil {
+			return err
+		}
 		newRid, err := heap.Insert(tx, e.wal, encodedNew)
 		if err != nil {
-			encodedOld, encErr := EncodeRow(validated.Table.Columns, values)
-			if encErr == nil {
-				if restoredRID, insErr := heap.Insert(tx, e.wal, encodedOld); insErr == nil {
-					_ = e.insertIntoIndexes(validated.Table, indexInfos, values, restoredRID)
-				}
+			if restoredRID, insErr := heap.Insert(tx, e.wal, encodedOld); insErr == nil {
+				_ = e.insertIntoIndexes(tx, validated.Table, indexInfos, values, restoredRID)
 			}
 			return err
 		}
-		if err := e.insertIntoIndexes(validated.Table, indexInfos, newValues, newRid); err != nil {
-			_ = e.removeFromIndexes(validated.Table, indexInfos, newValues, newRid)
+		if err := e.acquireRowLock(tx, validated.Table.Name, newRid, txn.LockModeExclusive); err != nil {
+			return err
+		}
+		if err := e.insertIntoIndexes(tx, validated.Table, indexInfos, newValues, newRid); err != nil {
+			_ = e.removeFromIndexes(tx, validated.Table, indexInfos, newValues, newRid)
 			_ = heap.Delete(tx, e.wal, newRid)
-			encodedOld, encErr := EncodeRow(validated.Table.Columns, values)
-			if encErr == nil {
-				if restoredRID, insErr := heap.Insert(tx, e.wal, encodedOld); insErr == nil {
-					_ = e.insertIntoIndexes(validated.Table, indexInfos, values, restoredRID)
-				}
+			if restoredRID, insErr := heap.Insert(tx, e.wal, encodedOld); insErr == nil {
+				_ = e.insertIntoIndexes(tx, validated.Table, indexInfos, values, restoredRID)
 			}
 			return err
 		}
-		oldCopy := cloneValues(values)
-		newCopy := cloneValues(newValues)
 		tx.RegisterRollback(func() error {
-			if err := e.removeFromIndexes(validated.Table, indexInfos, newCopy, newRid); err != nil {
-				return err
-			}
-			if err := heap.Delete(tx, e.wal, newRid); err != nil {
-				return err
-			}
-			encodedOld, err := EncodeRow(validated.Table.Columns, oldCopy)
-			if err != nil {
-				return err
-			}
-			restoredRID, err := heap.Insert(tx, e.wal, encodedOld)
-			if err != nil {
-				return err
-			}
-			if err := e.insertIntoIndexes(validated.Table, indexInfos, oldCopy, restoredRID); err != nil {
-				return err
-			}
-			return nil
+			return e.restoreUpdatedRow(tx, validated.Table, heap, indexInfos, newRid, newCopy, oldCopy, encodedOld)
 		})
 		processed[newRid] = struct{}{}
 		return nil
@@ -718,6 +877,54 @@ func (e *Executor) executeUpdate(tx *txn.Transaction, stmt *parser.UpdateStmt) (
 	return &Result{RowsAffected: updated, Message: message}, nil
 }
 
+// restoreUpdatedRow undoes an UPDATE of the row at rid. The old row goes back
+// in place when it fits, and moves to a page with room otherwise; either way
+// every index entry is rebuilt for where it ends up.
+func (e *Executor) restoreUpdatedRow(tx *txn.Transaction, table *catalog.Table, heap *storage.HeapFile, infos []indexInfo, rid storage.RowID, newValues, oldValues []interface{}, encodedOld []byte) error {
+	if err := e.removeFromIndexes(tx, table, infos, newValues, rid); err != nil {
+		return err
+	}
+	restored, err := heap.Update(tx, e.wal, rid, encodedOld)
+	if err != nil {
+		return err
+	}
+	if !restored {
+		if err := heap.Delete(tx, e.wal, rid); err != nil {
+			return err
+		}
+		if rid, err = heap.Insert(tx, e.wal, encodedOld); err != nil {
+			return err
+		}
+	}
+	return e.insertIntoIndexes(tx, table, infos, oldValues, rid)
+}
+
+// changedIndexInfos returns the indexes whose key or included values differ
+// between the old and new values of a row.
+func changedIndexInfos(infos []indexInfo, oldValues, newValues []interface{}) []indexInfo {
+	var changed []indexInfo
+	for _, info := range infos {
+		if !valuesEqualSlice(extractKeyValues(oldValues, info.positions), extractKeyValues(newValues, info.positions)) ||
+			!valuesEqualSlice(extractKeyValues(oldValues, info.included), extractKeyValues(newValues, info.included)) {
+			changed = append(changed, info)
+		}
+	}
+	return changed
+}
+
+// changedForeignKeyInfos returns the foreign keys whose child columns differ
+// between the old and new values of a row; unchanged references need no
+// parent lookup.
+func changedForeignKeyInfos(infos []foreignKeyInfo, oldValues, newValues []interface{}) []foreignKeyInfo {
+	var changed []foreignKeyInfo
+	for _, info := range infos {
+		if !valuesEqualSlice(extractKeyValues(oldValues, info.childPositions), extractKeyValues(newValues, info.childPositions)) {
+			changed = append(changed, info)
+		}
+	}
+	return changed
+}
+
 func (e *Executor) executeSelect(tx *txn.Transaction, stmt *parser.SelectStmt) (*Result, error) {
 	validated, err := validator.ValidateSelect(e.catalog, stmt)
 	if err != nil {
@@ -750,7 +957,12 @@ func (e *Executor) executeSelect(tx *txn.Transaction, stmt *parser.SelectStmt) (
 		return nil, err
 	}
 
-	rows, err = e.applyFilter(rows, validated.Filter, evaluator)
+	filter := validated.Filter
+	if idxChoice != nil && idxChoice.limit > 0 {
+		// The scan applied the filter while it looked for enough rows.
+		filter = nil
+	}
+	rows, err = e.applyFilter(rows, filter, evaluator)
 	if err != nil {
 		return nil, err
 	}
@@ -765,8 +977,10 @@ func (e *Executor) executeSelect(tx *txn.Transaction, stmt *parser.SelectStmt) (
 		return nil, err
 	}
 
-	if err := e.applyOrdering(rows, validated.OrderBy, evaluator); err != nil {
-		return nil, err
+	if idxChoice == nil || !idxChoice.ordered {
+		if err := e.applyOrdering(rows, validated.OrderBy, evaluator); err != nil {
+			return nil, err
+		}
 	}
 
 	rows = applyLimit(rows, validated.Limit)
@@ -789,13 +1003,13 @@ func (e *Executor) buildFromRows(validated *validator.ValidatedSelect, evaluator
 		return [][]interface{}{{nil}}, nil
 	}
 
-	leftRows, err := e.scanSourceRows(validated.Sources[0], choice)
+	leftRows, err := e.scanSourceRows(validated.Sources[0], choice, evaluator)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, join := range validated.Joins {
-		rightRows, err := e.scanSourceRows(join.Right, nil)
+		rightRows, err := e.scanSourceRows(join.Right, nil, evaluator)
 		if err != nil {
 			return nil, err
 		}
@@ -808,12 +1022,12 @@ func (e *Executor) buildFromRows(validated *validator.ValidatedSelect, evaluator
 	return leftRows, nil
 }
 
-func (e *Executor) scanSourceRows(source *validator.TableSource, choice *indexChoice) ([][]interface{}, error) {
+func (e *Executor) scanSourceRows(source *validator.TableSource, choice *indexChoice, evaluator *valueEvaluator) ([][]interface{}, error) {
 	if choice != nil && choice.source == source {
-		return e.executeIndexScan(choice)
+		return e.executeIndexScan(choice, evaluator)
 	}
 	rows := make([][]interface{}, 0, source.Table.RowCount)
-	heap := storage.NewHeapFile(e.storage, source.Table.RootPage)
+	heap := source.Table.HeapFile(e.storage)
 	if err := heap.Scan(func(rid storage.RowID, record []byte) error {
 		values, err := DecodeRow(source.Table.Columns, record)
 		if err != nil {
@@ -829,45 +1043,98 @@ func (e *Executor) scanSourceRows(source *validator.TableSource, choice *indexCh
 	return rows, nil
 }
 
-func (e *Executor) executeIndexScan(choice *indexChoice) ([][]interface{}, error) {
-	idxFile, err := e.indexes.Open(choice.source.Table.Name, choice.info.def.Name)
+func (e *Executor) executeIndexScan(choice *indexChoice, evaluator *valueEvaluator) ([][]interface{}, error) {
+	idxFile, err := e.indexes.Open(choice.info.def.Root)
 	if err != nil {
 		return nil, err
 	}
-	heap := storage.NewHeapFile(e.storage, choice.source.Table.RootPage)
+	heap := choice.source.Table.HeapFile(e.storage)
 	prefixKey := encodeIndexKey(choice.prefix)
-	var rids []storage.RowID
-	switch {
-	case choice.lower != nil || choice.upper != nil:
-		rids = idxFile.Range(prefixKey, choice.lower, choice.lowerInclusive, choice.upper, choice.upperInclusive)
-	case len(prefixKey) > 0:
-		rids = idxFile.SeekPrefix(prefixKey)
-	default:
+	if len(prefixKey) == 0 && choice.lower == nil && choice.upper == nil && !choice.ordered {
 		return nil, fmt.Errorf("exec: index scan requires at least one predicate")
 	}
-	rows := make([][]interface{}, 0, len(rids))
-	for _, rid := range rids {
-		record, err := heap.Fetch(rid)
+	// The range bounds are values; a descending column keeps the lower
+	// value's key after the upper value's.
+	lower, lowerInclusive := choice.lower, choice.lowerInclusive
+	upper, upperInclusive := choice.upper, choice.upperInclusive
+	if choice.info.def.Desc(len(choice.prefix)) {
+		lower, lowerInclusive, upper, upperInclusive = upper, upperInclusive, lower, lowerInclusive
+	}
+	rows := make([][]interface{}, 0)
+	var scanErr error
+	err = idxFile.Ascend(prefixKey, lower, lowerInclusive, upper, upperInclusive, func(key []byte, rid storage.RowID) bool {
+		clone, err := e.indexScanRow(choice, heap, key, rid)
 		if err != nil {
-			return nil, err
+			scanErr = err
+			return false
 		}
-		values, err := DecodeRow(choice.source.Table.Columns, record)
-		if err != nil {
-			return nil, err
+		if choice.limit > 0 && choice.filter != nil {
+			evaluator.setRow(clone)
+			value, err := evaluator.eval(choice.filter)
+			if err != nil {
+				scanErr = err
+				return false
+			}
+			truth, err := toTruthValue(value)
+			if err != nil {
+				scanErr = err
+				return false
+			}
+			if truth != truthTrue {
+				return true
+			}
 		}
-		clone := make([]interface{}, len(values))
-		copy(clone, values)
 		rows = append(rows, clone)
+		return choice.limit == 0 || len(rows) < choice.limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, scanErr
 	}
 	return rows, nil
 }
 
+// indexScanRow returns the row an index entry points at. A covering scan
+// decodes it from the entry, leaving the columns the index lacks NULL;
+// otherwise the row is fetched from the table.
+func (e *Executor) indexScanRow(choice *indexChoice, heap *storage.HeapFile, key []byte, rid storage.RowID) ([]interface{}, error) {
+	cols := choice.source.Table.Columns
+	if choice.covering {
+		values := make([]interface{}, len(cols))
+		if _, err := decodeIndexEntry(cols, choice.info, key, values); err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+	record, err := heap.Fetch(rid)
+	if err != nil {
+		return nil, err
+	}
+	values, err := DecodeRow(cols, record)
+	if err != nil {
+		return nil, err
+	}
+	clone := make([]interface{}, len(values))
+	copy(clone, values)
+	return clone, nil
+}
+
 func buildIndexInfos(table *catalog.Table) ([]indexInfo, error) {
 	if len(table.Indexes) == 0 {
 		return nil, nil
 	}
 	indexes := make([]*catalog.Index, 0, len(table.Indexes))
 	for _, idx := range table.Indexes {
+		// An index without a tree, or whose tree holds keys in the older
+		// encoding, is seen on a read-only open of a database that still
+		// has to rebuild it, which never writes to it, and for an index
+		// BuildIndexTrees could not build, which is left alone until it is
+		// dropped.
+		if !idx.Built() {
+			continue
+		}
 		indexes = append(indexes, idx)
 	}
 	sort.Slice(indexes, func(i, j int) bool {
@@ -875,25 +1142,45 @@ func buildIndexInfos(table *catalog.Table) ([]indexInfo, error) {
 	})
 	infos := make([]indexInfo, 0, len(indexes))
 	for _, idx := range indexes {
-		positions := make([]int, len(idx.Columns))
-		for i, name := range idx.Columns {
-			found := false
-			for pos, col := range table.Columns {
-				if strings.EqualFold(col.Name, name) {
-					positions[i] = pos
-					found = true
-					break
-				}
-			}
-			if !found {
-				return nil, fmt.Errorf("exec: index column %s not found on table %s", name, table.Name)
-			}
+		info, err := newIndexInfo(table, idx)
+		if err != nil {
+			return nil, err
 		}
-		infos = append(infos, indexInfo{def: idx, positions: positions})
+		infos = append(infos, info)
 	}
 	return infos, nil
 }
 
+func newIndexInfo(table *catalog.Table, idx *catalog.Index) (indexInfo, error) {
+	positions, err := columnPositions(table, idx.Columns)
+	if err != nil {
+		return indexInfo{}, err
+	}
+	included, err := columnPositions(table, idx.Include)
+	if err != nil {
+		return indexInfo{}, err
+	}
+	return indexInfo{def: idx, positions: positions, included: included}, nil
+}
+
+func columnPositions(table *catalog.Table, names []string) ([]int, error) {
+	positions := make([]int, len(names))
+	for i, name := range names {
+		found := false
+		for pos, col := range table.Columns {
+			if strings.EqualFold(col.Name, name) {
+				positions[i] = pos
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("exec: index column %s not found on table %s", name, table.Name)
+		}
+	}
+	return positions, nil
+}
+
 func (e *Executor) buildForeignKeyInfos(table *catalog.Table) ([]foreignKeyInfo, error) {
 	if len(table.ForeignKeys) == 0 {
 		return nil, nil
@@ -967,7 +1254,7 @@ func (e *Executor) ensureUniqueIndexes(table *catalog.Table, infos []indexInfo,
 		if !info.def.IsUnique {
 			continue
 		}
-		components, skip, err := buildIndexComponents(table.Columns, info.positions, values)
+		components, skip, err := buildIndexComponents(table.Columns, info.positions, info.def.Descending, values)
 		if err != nil {
 			return err
 		}
@@ -975,11 +1262,15 @@ func (e *Executor) ensureUniqueIndexes(table *catalog.Table, infos []indexInfo,
 			continue
 		}
 		key := encodeIndexKey(components)
-		idxFile, err := e.indexes.Open(table.Name, info.def.Name)
+		idxFile, err := e.indexes.Open(info.def.Root)
 		if err != nil {
 			return err
 		}
-		if existing := idxFile.SeekExact(key); len(existing) > 0 {
+		existing, err := idxFile.SeekExact(key)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
 			if current != nil {
 				filtered := existing[:0]
 				for _, rid := range existing {
@@ -999,21 +1290,20 @@ func (e *Executor) ensureUniqueIndexes(table *catalog.Table, infos []indexInfo,
 	return nil
 }
 
-func (e *Executor) insertIntoIndexes(table *catalog.Table, infos []indexInfo, values []interface{}, rid storage.RowID) error {
+func (e *Executor) insertIntoIndexes(tx *txn.Transaction, table *catalog.Table, infos []indexInfo, values []interface{}, rid storage.RowID) error {
 	for _, info := range infos {
-		components, skip, err := buildIndexComponents(table.Columns, info.positions, values)
+		entry, ok, err := indexEntryFor(table.Columns, info, values, rid)
 		if err != nil {
 			return err
 		}
-		if skip {
+		if !ok {
 			continue
 		}
-		key := encodeIndexKey(components)
-		idxFile, err := e.indexes.Open(table.Name, info.def.Name)
+		idxFile, err := e.indexes.Open(info.def.Root)
 		if err != nil {
 			return err
 		}
-		if err := idxFile.Insert(key, rid, info.def.IsUnique); err != nil {
+		if err := idxFile.Insert(tx, e.wal, entry, info.def.IsUnique); err != nil {
 			if info.def.IsUnique && strings.Contains(err.Error(), "duplicate") {
 				return fmt.Errorf("exec: duplicate key value violates unique index \"%s\"", info.def.Name)
 			}
@@ -1023,21 +1313,20 @@ func (e *Executor) insertIntoIndexes(table *catalog.Table, infos []indexInfo, va
 	return nil
 }
 
-func (e *Executor) removeFromIndexes(table *catalog.Table, infos []indexInfo, values []interface{}, rid storage.RowID) error {
+func (e *Executor) removeFromIndexes(tx *txn.Transaction, table *catalog.Table, infos []indexInfo, values []interface{}, rid storage.RowID) error {
 	for _, info := range infos {
-		components, skip, err := buildIndexComponents(table.Columns, info.positions, values)
+		entry, ok, err := indexEntryFor(table.Columns, info, values, rid)
 		if err != nil {
 			return err
 		}
-		if skip {
+		if !ok {
 			continue
 		}
-		key := encodeIndexKey(components)
-		idxFile, err := e.indexes.Open(table.Name, info.def.Name)
+		idxFile, err := e.indexes.Open(info.def.Root)
 		if err != nil {
 			return err
 		}
-		if err := idxFile.Delete(key, rid); err != nil {
+		if err := idxFile.Delete(tx, e.wal, entry); err != nil {
 			return err
 		}
 	}
@@ -1070,21 +1359,24 @@ func (e *Executor) parentRowExists(info foreignKeyInfo, keyValues []interface{})
 		parentValues[pos] = keyValues[i]
 	}
 	if info.parentIndex != nil {
-		components, skip, err := buildIndexComponents(info.parentTable.Columns, info.parentPositions, parentValues)
+		components, skip, err := buildIndexComponents(info.parentTable.Columns, info.parentPositions, info.parentIndex.Descending, parentValues)
 		if err != nil {
 			return false, err
 		}
 		if skip {
 			return false, nil
 		}
-		idxFile, err := e.indexes.Open(info.parentTable.Name, info.parentIndex.Name)
+		idxFile, err := e.indexes.Open(info.parentIndex.Root)
+		if err != nil {
+			return false, err
+		}
+		results, err := idxFile.SeekExact(encodeIndexKey(components))
 		if err != nil {
 			return false, err
 		}
-		results := idxFile.SeekExact(encodeIndexKey(components))
 		return len(results) > 0, nil
 	}
-	heap := storage.NewHeapFile(e.storage, info.parentTable.RootPage)
+	heap := info.parentTable.HeapFile(e.storage)
 	found := false
 	err := heap.Scan(func(_ storage.RowID, record []byte) error {
 		values, err := DecodeRow(info.parentTable.Columns, record)
@@ -1206,21 +1498,24 @@ func (e *Executor) hasReferencingRows(info referencingForeignKey, keyValues []in
 		childValues[pos] = keyValues[i]
 	}
 	if info.childIndex != nil {
-		components, skip, err := buildIndexComponents(info.table.Columns, info.childPositions, childValues)
+		components, skip, err := buildIndexComponents(info.table.Columns, info.childPositions, info.childIndex.Descending, childValues)
 		if err != nil {
 			return false, err
 		}
 		if skip {
 			return false, nil
 		}
-		idxFile, err := e.indexes.Open(info.table.Name, info.childIndex.Name)
+		idxFile, err := e.indexes.Open(info.childIndex.Root)
+		if err != nil {
+			return false, err
+		}
+		results, err := idxFile.SeekExact(encodeIndexKey(components))
 		if err != nil {
 			return false, err
 		}
-		results := idxFile.SeekExact(encodeIndexKey(components))
 		return len(results) > 0, nil
 	}
-	heap := storage.NewHeapFile(e.storage, info.table.RootPage)
+	heap := info.table.HeapFile(e.storage)
 	found := false
 	err := heap.Scan(func(_ storage.RowID, record []byte) error {
 		values, err := DecodeRow(info.table.Columns, record)
@@ -1257,31 +1552,197 @@ func (e *Executor) ensureNoReferencingRows(fk referencingForeignKey, keyValues [
 	return nil
 }
 
+// chooseIndex picks the index the scan of a single-table query should use.
+// An index that both narrows the scan and yields rows in ORDER BY order is
+// preferred; with a LIMIT, an index that only yields the order comes next,
+// since the scan can stop early. Otherwise an index that narrows the scan is
+// used, and failing that one that spares the sort. Among equals, an index
+// holding every column the query reads wins, since its scan never visits
+// the table.
 func (e *Executor) chooseIndex(validated *validator.ValidatedSelect) *indexChoice {
 	if len(validated.Sources) != 1 || len(validated.Joins) > 0 {
 		return nil
 	}
-	if validated.Filter == nil {
+	if validated.Filter == nil && len(validated.OrderBy) == 0 {
 		return nil
 	}
 	source := validated.Sources[0]
 	restrictions := make(map[int]*columnRestriction)
-	if !collectRestrictions(validated.Filter, restrictions, source.ColumnStart, source.ColumnStart+source.ColumnCount) {
-		return nil
-	}
-	if len(restrictions) == 0 {
-		return nil
+	if validated.Filter != nil && !collectRestrictions(validated.Filter, restrictions, source.ColumnStart, source.ColumnStart+source.ColumnCount) {
+		restrictions = make(map[int]*columnRestriction)
 	}
 	infos, err := buildIndexInfos(source.Table)
 	if err != nil || len(infos) == 0 {
 		return nil
 	}
+	referenced, known := referencedColumns(validated, source)
+	var best *indexChoice
+	bestRank := 0
 	for _, info := range infos {
-		if choice := buildChoiceForIndex(source, info, restrictions); choice != nil {
-			return choice
+		if !indexCoversRows(source.Table, info, restrictions) {
+			continue
+		}
+		choice := buildChoiceForIndex(source, info, restrictions)
+		fixed := 0
+		if choice != nil {
+			fixed = len(choice.prefix)
+		}
+		ordered := indexSatisfiesOrder(validated, source, info, restrictions, fixed)
+		rank := 0
+		switch {
+		case choice != nil && ordered:
+			rank = 8
+		case ordered && validated.Limit != nil:
+			rank = 6
+		case choice != nil:
+			rank = 4
+		case ordered:
+			rank = 2
+		default:
+			continue
+		}
+		if choice == nil {
+			choice = &indexChoice{source: source, info: info}
+		}
+		choice.ordered = ordered
+		choice.covering = known && indexHoldsColumns(info, referenced)
+		if choice.covering {
+			rank++
+		}
+		if rank > bestRank {
+			best, bestRank = choice, rank
+		}
+	}
+	if best != nil && best.ordered {
+		return orderedChoice(validated, best)
+	}
+	return best
+}
+
+// referencedColumns returns the positions, within the source table, of the
+// columns a single-table query reads. Known is false when the query holds
+// an expression this cannot see into.
+func referencedColumns(validated *validator.ValidatedSelect, source *validator.TableSource) (map[int]bool, bool) {
+	columns := make(map[int]bool)
+	var visit func(node expr.TypedExpr) bool
+	visit = func(node expr.TypedExpr) bool {
+		switch n := node.(type) {
+		case nil:
+			return true
+		case *expr.ColumnRef:
+			columns[n.Index-source.ColumnStart] = true
+			return true
+		case *expr.GroupRef, *expr.AggregateRef, *expr.Literal:
+			return true
+		case *expr.UnaryExpr:
+			return visit(n.Expr)
+		case *expr.BinaryExpr:
+			return visit(n.Left) && visit(n.Right)
+		case *expr.FunctionExpr:
+			for _, arg := range n.Args {
+				if !visit(arg) {
+					return false
+				}
+			}
+			return true
+		case *expr.CoalesceExpr:
+			return visit(n.Left) && visit(n.Right)
+		case *expr.IsNullExpr:
+			return visit(n.Expr)
+		default:
+			return false
 		}
 	}
-	return nil
+	exprs := []expr.TypedExpr{validated.Filter, validated.Having}
+	for _, out := range validated.Outputs {
+		exprs = append(exprs, out.Expr)
+	}
+	for _, grouping := range validated.Groupings {
+		exprs = append(exprs, grouping.Expr)
+	}
+	for _, agg := range validated.Aggregates {
+		exprs = append(exprs, agg.Arg)
+	}
+	for _, term := range validated.OrderBy {
+		exprs = append(exprs, term.Expr)
+	}
+	for _, node := range exprs {
+		if !visit(node) {
+			return nil, false
+		}
+	}
+	return columns, true
+}
+
+// indexHoldsColumns reports whether the index stores every given column, as
+// part of its key or alongside it.
+func indexHoldsColumns(info indexInfo, columns map[int]bool) bool {
+	held := make(map[int]bool, len(info.positions)+len(info.included))
+	for _, pos := range info.positions {
+		held[pos] = true
+	}
+	for _, pos := range info.included {
+		held[pos] = true
+	}
+	for col := range columns {
+		if !held[col] {
+			return false
+		}
+	}
+	return true
+}
+
+// orderedChoice has an ordered choice for a query with a LIMIT stop once it
+// has the rows the limit keeps.
+func orderedChoice(validated *validator.ValidatedSelect, choice *indexChoice) *indexChoice {
+	if validated.Limit != nil && validated.Limit.Limit >= 0 {
+		offset := validated.Limit.Offset
+		if offset < 0 {
+			offset = 0
+		}
+		choice.limit = offset + validated.Limit.Limit
+		choice.filter = validated.Filter
+	}
+	return choice
+}
+
+// indexCoversRows reports whether a scan of the index can stand in for a
+// scan of the table. Rows with a NULL key column have no entry, so every
+// key column must be NOT NULL or compared by the filter, which rejects NULL.
+func indexCoversRows(table *catalog.Table, info indexInfo, restrictions map[int]*columnRestriction) bool {
+	for _, pos := range info.positions {
+		if !table.Columns[pos].NotNull && restrictions[pos] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// indexSatisfiesOrder reports whether scanning the index yields rows in the
+// order the ORDER BY clause asks for, given that its first fixed columns are
+// pinned by equality. Terms on columns the filter pins are constant and
+// skipped; the rest must follow the remaining index columns in their
+// directions.
+func indexSatisfiesOrder(validated *validator.ValidatedSelect, source *validator.TableSource, info indexInfo, restrictions map[int]*columnRestriction, fixed int) bool {
+	if len(validated.OrderBy) == 0 || len(validated.Groupings) > 0 || len(validated.Aggregates) > 0 {
+		return false
+	}
+	next := fixed
+	for _, term := range validated.OrderBy {
+		ref, ok := term.Expr.(*expr.ColumnRef)
+		if !ok {
+			return false
+		}
+		column := ref.Index - source.ColumnStart
+		if res := restrictions[column]; res != nil && res.eqValue != nil {
+			continue
+		}
+		if next >= len(info.positions) || info.positions[next] != column || info.def.Desc(next) != term.Desc {
+			return false
+		}
+		next++
+	}
+	return true
 }
 
 func collectRestrictions(node expr.TypedExpr, restrictions map[int]*columnRestriction, start, end int) bool {
@@ -1344,15 +1805,6 @@ func ensureForeignKeyTypeCompatibility(name string, child, parent *catalog.Colum
 }
 
 func ensureParentHasUniqueKey(parent *catalog.Table, columns []string) error {
-	pkCols := make([]string, 0)
-	for _, col := range parent.Columns {
-		if col.PrimaryKey {
-			pkCols = append(pkCols, col.Name)
-		}
-	}
-	if len(pkCols) == len(columns) && len(pkCols) > 0 && columnsMatch(pkCols, columns) {
-		return nil
-	}
 	for _, idx := range parent.Indexes {
 		if !idx.IsUnique {
 			continue
@@ -1387,7 +1839,7 @@ func findColumnIndex(columns []catalog.Column, name string) int {
 
 func findMatchingUniqueIndex(table *catalog.Table, columns []string) *catalog.Index {
 	for _, idx := range table.Indexes {
-		if idx.IsUnique && columnsMatch(idx.Columns, columns) {
+		if idx.IsUnique && idx.Built() && columnsMatch(idx.Columns, columns) {
 			return idx
 		}
 	}
@@ -1396,7 +1848,7 @@ func findMatchingUniqueIndex(table *catalog.Table, columns []string) *catalog.In
 
 func findIndexByColumns(indexes map[string]*catalog.Index, columns []string) *catalog.Index {
 	for _, idx := range indexes {
-		if columnsMatch(idx.Columns, columns) {
+		if idx.Built() && columnsMatch(idx.Columns, columns) {
 			return idx
 		}
 	}
@@ -1501,13 +1953,14 @@ func buildChoiceForIndex(source *validator.TableSource, info indexInfo, restrict
 	lowerInclusive, upperInclusive := true, true
 	var lowerValue, upperValue interface{}
 	usedRange := false
-	for _, pos := range info.positions {
+	for i, pos := range info.positions {
 		res := restrictions[pos]
 		if res == nil {
 			break
 		}
+		desc := info.def.Desc(i)
 		if res.eqValue != nil {
-			comp, err := encodeComponent(source.Table.Columns[pos], res.eqValue)
+			comp, err := encodeKeyComponent(source.Table.Columns[pos], res.eqValue, desc)
 			if err != nil {
 				return nil
 			}
@@ -1518,7 +1971,7 @@ func buildChoiceForIndex(source *validator.TableSource, info indexInfo, restrict
 			break
 		}
 		if res.lowerValue != nil {
-			lb, err := encodeComponent(source.Table.Columns[pos], res.lowerValue)
+			lb, err := encodeKeyComponent(source.Table.Columns[pos], res.lowerValue, desc)
 			if err != nil {
 				return nil
 			}
@@ -1527,7 +1980,7 @@ func buildChoiceForIndex(source *validator.TableSource, info indexInfo, restrict
 			lowerValue = res.lowerValue
 		}
 		if res.upperValue != nil {
-			ub, err := encodeComponent(source.Table.Columns[pos], res.upperValue)
+			ub, err := encodeKeyComponent(source.Table.Columns[pos], res.upperValue, desc)
 			if err != nil {
 				return nil
 			}
@@ -2190,7 +2643,7 @@ func (e *Executor) explainSelect(stmt *parser.SelectStmt) (*Plan, error) {
 		current.Children = append(current.Children, limitNode)
 		current = limitNode
 	}
-	if len(validated.OrderBy) > 0 {
+	if len(validated.OrderBy) > 0 && (idxChoice == nil || !idxChoice.ordered) {
 		terms := make([]map[string]interface{}, len(validated.OrderBy))
 		for i, term := range validated.OrderBy {
 			terms[i] = map[string]interface{}{"expr": term.Text, "desc": term.Desc}
@@ -2292,6 +2745,12 @@ func planForSource(source *validator.TableSource, choice *indexChoice) *PlanNode
 			}
 			detail["range"] = rangeInfo
 		}
+		if choice.ordered {
+			detail["ordered"] = true
+		}
+		if choice.covering {
+			return &PlanNode{Name: "IndexOnlyScan", Detail: detail}
+		}
 		return &PlanNode{Name: "IndexScan", Detail: detail}
 	}
 	return &PlanNode{Name: "SeqScan", Detail: detail}
@@ -1,6 +1,8 @@
 package exec_test
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -51,7 +53,7 @@ func TestExecutorForeignKeyEnforcementSingleColumn(t *testing.T) {
 	mustExec(t, executor, txns, "INSERT INTO orders(id, customer_id, total) VALUES (100,1,42.50)")
 	mustExec(t, executor, txns, "INSERT INTO orders(id, customer_id, total) VALUES (101,2,7.50)")
 
-	if err := execExpectError(t, executor, txns, "INSERT INTO orders(id, customer_id, total) VALUES (101,3,10.00)"); !strings.Contains(err.Error(), "no parent row") {
+	if err := execExpectError(t, executor, txns, "INSERT INTO orders(id, customer_id, total) VALUES (103,3,10.00)"); !strings.Contains(err.Error(), "no parent row") {
 		t.Fatalf("expected missing parent error, got %v", err)
 	}
 
@@ -108,6 +110,50 @@ func TestExecutorForeignKeyCompositeKeys(t *testing.T) {
 	mustExec(t, executor, txns, "DELETE FROM categories WHERE code=1 AND region=10")
 }
 
+func TestExecutorPrimaryKey(t *testing.T) {
+	executor, txns, cleanup := newDMLExecutor(t)
+	defer cleanup()
+
+	mustExec(t, executor, txns, "CREATE TABLE stock(warehouse INT, sku INT, qty INT, CONSTRAINT pk_stock_sku PRIMARY KEY (sku, warehouse))")
+	mustExec(t, executor, txns, "INSERT INTO stock(warehouse, sku, qty) VALUES (1,100,5),(2,100,7),(1,200,3)")
+
+	if err := execExpectError(t, executor, txns, "INSERT INTO stock(warehouse, sku, qty) VALUES (2,100,1)"); !strings.Contains(err.Error(), "pk_stock_sku") {
+		t.Fatalf("expected duplicate primary key error, got %v", err)
+	}
+	if err := execExpectError(t, executor, txns, "INSERT INTO stock(warehouse, sku, qty) VALUES (NULL,300,1)"); !strings.Contains(err.Error(), "NULL") {
+		t.Fatalf("expected NULL primary key error, got %v", err)
+	}
+	if err := execExpectError(t, executor, txns, "UPDATE stock SET warehouse=1 WHERE warehouse=2"); !strings.Contains(err.Error(), "pk_stock_sku") {
+		t.Fatalf("expected update duplicate primary key error, got %v", err)
+	}
+	if err := execExpectError(t, executor, txns, "UPDATE stock SET sku=NULL WHERE sku=200"); !strings.Contains(err.Error(), "NULL") {
+		t.Fatalf("expected update NULL primary key error, got %v", err)
+	}
+	if err := execExpectError(t, executor, txns, "DROP INDEX pk_stock_sku"); !strings.Contains(err.Error(), "primary key") {
+		t.Fatalf("expected the primary key index to be protected, got %v", err)
+	}
+	mustExec(t, executor, txns, "UPDATE stock SET warehouse=3 WHERE warehouse=2")
+	mustExec(t, executor, txns, "DELETE FROM stock WHERE sku=200")
+	mustExec(t, executor, txns, "INSERT INTO stock(warehouse, sku, qty) VALUES (1,200,9)")
+
+	// The key is a unique key in its own column order, so a foreign key can
+	// reference it.
+	mustExec(t, executor, txns, `CREATE TABLE moves(
+                id INT PRIMARY KEY,
+                sku INT,
+                warehouse INT,
+                FOREIGN KEY(sku, warehouse) REFERENCES stock(sku, warehouse)
+        )`)
+	mustExec(t, executor, txns, "INSERT INTO moves(id, sku, warehouse) VALUES (1,100,3)")
+	if err := execExpectError(t, executor, txns, "INSERT INTO moves(id, sku, warehouse) VALUES (2,100,2)"); !strings.Contains(err.Error(), "no parent row") {
+		t.Fatalf("expected missing parent error, got %v", err)
+	}
+	res := execQuery(t, executor, txns, "SELECT warehouse, qty FROM stock WHERE sku = 100 ORDER BY warehouse")
+	if len(res.Rows) != 2 || res.Rows[0][0] != "1" || res.Rows[1][0] != "3" || res.Rows[1][1] != "7" {
+		t.Fatalf("unexpected rows %v", res.Rows)
+	}
+}
+
 func TestExecutorForeignKeyIndexAssistedLookup(t *testing.T) {
 	executor, txns, cleanup := newDMLExecutor(t)
 	defer cleanup()
@@ -132,3 +178,142 @@ func TestExecutorForeignKeyIndexAssistedLookup(t *testing.T) {
 	mustExec(t, executor, txns, "DELETE FROM dependents WHERE id=10")
 	mustExec(t, executor, txns, "DELETE FROM parents WHERE id=1")
 }
+
+func TestExecutorTruncateForeignKeys(t *testing.T) {
+	executor, txns, cleanup := newDMLExecutor(t)
+	defer cleanup()
+
+	mustExec(t, executor, txns, "CREATE TABLE customers(id INT NOT NULL, name VARCHAR(50), PRIMARY KEY(id))")
+	mustExec(t, executor, txns, `CREATE TABLE orders(
+                id INT NOT NULL,
+                customer_id INT,
+                PRIMARY KEY(id),
+                CONSTRAINT fk_orders_customer FOREIGN KEY(customer_id)
+                        REFERENCES customers(id)
+        )`)
+	mustExec(t, executor, txns, "CREATE TABLE notes(id INT NOT NULL, body VARCHAR(50), PRIMARY KEY(id))")
+	mustExec(t, executor, txns, "INSERT INTO customers(id, name) VALUES (1,'Ada'),(2,'Grace')")
+	mustExec(t, executor, txns, "INSERT INTO orders(id, customer_id) VALUES (100,1),(101,2)")
+	mustExec(t, executor, txns, "INSERT INTO notes(id, body) VALUES (1,'keep')")
+
+	if err := execExpectError(t, executor, txns, "TRUNCATE TABLE customers"); !strings.Contains(err.Error(), "fk_orders_customer") {
+		t.Fatalf("expected truncate to be refused, got %v", err)
+	}
+	mustExec(t, executor, txns, "TRUNCATE orders")
+	if res := execQuery(t, executor, txns, "SELECT COUNT(*) FROM orders"); res.Rows[0][0] != "0" {
+		t.Fatalf("expected orders to be empty, got %v", res.Rows)
+	}
+
+	mustExec(t, executor, txns, "INSERT INTO orders(id, customer_id) VALUES (102,2)")
+	mustExec(t, executor, txns, "TRUNCATE customers RESTART IDENTITY CASCADE")
+	for _, table := range []string{"customers", "orders"} {
+		if res := execQuery(t, executor, txns, "SELECT COUNT(*) FROM "+table); res.Rows[0][0] != "0" {
+			t.Fatalf("expected %s to be empty, got %v", table, res.Rows)
+		}
+	}
+	if res := execQuery(t, executor, txns, "SELECT COUNT(*) FROM notes"); res.Rows[0][0] != "1" {
+		t.Fatalf("expected notes to be untouched, got %v", res.Rows)
+	}
+	mustExec(t, executor, txns, "INSERT INTO customers(id, name) VALUES (1,'Ada')")
+	mustExec(t, executor, txns, "INSERT INTO orders(id, customer_id) VALUES (100,1)")
+}
+
+func TestExecutorCopyFrom(t *testing.T) {
+	executor, txns, cleanup := newDMLExecutor(t)
+	defer cleanup()
+
+	mustExec(t, executor, txns, "CREATE TABLE customers(id INT NOT NULL, name VARCHAR(50), PRIMARY KEY(id))")
+	mustExec(t, executor, txns, `CREATE TABLE orders(
+                id INT NOT NULL,
+                customer_id INT,
+                total DECIMAL(10,2),
+                placed DATE,
+                PRIMARY KEY(id),
+                CONSTRAINT fk_orders_customer FOREIGN KEY(customer_id) REFERENCES customers(id)
+        )`)
+	mustExec(t, executor, txns, "CREATE UNIQUE INDEX idx_orders_id ON orders(id)")
+	mustExec(t, executor, txns, "CREATE INDEX idx_orders_customer ON orders(customer_id)")
+	mustExec(t, executor, txns, "INSERT INTO customers(id, name) VALUES (1,'Ada'),(2,'Grace')")
+	mustExec(t, executor, txns, "INSERT INTO orders(id, customer_id, total, placed) VALUES (1,1,10.00,'2024-01-01')")
+
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "orders.csv")
+	csvData := "id;customer_id;total;placed\n" +
+		"2;1;12.50;2024-02-01\n" +
+		"3;2;\"1,5\";2024-02-02\n" + // a quoted field: not a decimal
+		"4;;7.25;\n" + // empty fields are NULL
+		"five;1;1.00;2024-02-03\n" +
+		"1;1;1.00;2024-02-04\n" + // already in the table
+		"2;2;1.00;2024-02-05\n" + // earlier in the file
+		"6;9;1.00;2024-02-06\n" + // no such customer
+		"7;2\n" +
+		"8;2;3.00;2024-02-07\n"
+	if err := os.WriteFile(csvPath, []byte(csvData), 0o644); err != nil {
+		t.Fatalf("write csv: %v", err)
+	}
+	res := execQuery(t, executor, txns, fmt.Sprintf("COPY orders FROM '%s' WITH (FORMAT csv, HEADER, DELIMITER ';')", csvPath))
+	if res.RowsAffected != 3 || res.Message != "3 row(s) copied, 6 rejected" {
+		t.Fatalf("unexpected result %d %q", res.RowsAffected, res.Message)
+	}
+	wantLines := []string{"3", "5", "6", "7", "8", "9"}
+	for i, row := range res.Rows {
+		if i >= len(wantLines) || row[0] != wantLines[i] {
+			t.Fatalf("unexpected rejects %v", res.Rows)
+		}
+	}
+	if !strings.Contains(res.Rows[2][1], "duplicate") || !strings.Contains(res.Rows[4][1], "fk_orders_customer") {
+		t.Fatalf("unexpected reject reasons %v", res.Rows)
+	}
+
+	jsonPath := filepath.Join(dir, "customers.ndjson")
+	jsonData := `{"id": 3, "name": "Edsger"}` + "\n\n" +
+		`{"id": "4", "name": "Barbara"}` + "\n" +
+		`{"id": 5, "nickname": "Ken"}` + "\n" +
+		`{"id": 6}` + "\n" +
+		`not json` + "\n"
+	if err := os.WriteFile(jsonPath, []byte(jsonData), 0o644); err != nil {
+		t.Fatalf("write ndjson: %v", err)
+	}
+	res = execQuery(t, executor, txns, fmt.Sprintf("COPY customers FROM '%s' WITH (FORMAT ndjson)", jsonPath))
+	if res.RowsAffected != 2 || len(res.Rows) != 3 || res.Rows[0][0] != "3" || res.Rows[1][0] != "4" || res.Rows[2][0] != "6" {
+		t.Fatalf("unexpected NDJSON result %q %v", res.Message, res.Rows)
+	}
+
+	if res := execQuery(t, executor, txns, "SELECT id FROM orders WHERE customer_id = 2"); len(res.Rows) != 1 || res.Rows[0][0] != "8" {
+		t.Fatalf("expected the index to find the copied order, got %v", res.Rows)
+	}
+	if err := execExpectError(t, executor, txns, "INSERT INTO orders(id, customer_id, total, placed) VALUES (8,1,1.00,'2024-03-01')"); !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("expected the copied key to be unique, got %v", err)
+	}
+
+	// A rolled back COPY leaves no rows or index entries behind.
+	stmt, err := parser.Parse(fmt.Sprintf("COPY customers (id, name) FROM '%s' WITH (FORMAT csv)", writeCopyFile(t, dir, "10,Niklaus\n11,Donald\n")))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	tx := txns.Begin()
+	if _, err := executor.Execute(tx, stmt); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if err := txns.Rollback(tx.ID()); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if res := execQuery(t, executor, txns, "SELECT COUNT(*) FROM customers"); res.Rows[0][0] != "4" {
+		t.Fatalf("expected the rollback to remove the copied rows, got %v", res.Rows)
+	}
+	tx = txns.Begin()
+	problems, err := executor.CheckIntegrity(tx)
+	_ = txns.Commit(tx.ID())
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("expected a sound database, got %+v (%v)", problems, err)
+	}
+}
+
+func writeCopyFile(t *testing.T, dir, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, "extra.csv")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path
+}
@@ -3,6 +3,7 @@ package exec_test
 import (
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/example/granite-db/engine/internal/catalog"
@@ -180,7 +181,7 @@ func newExecutor(t *testing.T, path string) (*engineexec.Executor, *txn.Manager,
 	if err != nil {
 		t.Fatalf("catalog load: %v", err)
 	}
-	idx := indexmgr.New(mgr.Path())
+	idx := indexmgr.New(mgr)
 	locks := txn.NewLockManager(0)
 	executor := engineexec.New(cat, mgr, idx, locks, log)
 	txns := txn.NewManager(locks, log)
@@ -277,6 +278,29 @@ func TestExecutorUniqueIndex(t *testing.T) {
 	}
 }
 
+func TestExecutorRejectsIndexesWiderThanTheKeyLimit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wide.gdb")
+	executor, txns, cleanup := newExecutor(t, path)
+	defer cleanup()
+
+	mustExec(t, executor, txns, "CREATE TABLE docs(id INT PRIMARY KEY, title VARCHAR(1006), body VARCHAR(1007), summary VARCHAR(600))")
+	// A string key takes its length and two bytes for its end.
+	mustExec(t, executor, txns, "CREATE INDEX idx_docs_title ON docs(title)")
+	for _, sql := range []string{
+		"CREATE INDEX idx_docs_body ON docs(body)",
+		"CREATE INDEX idx_docs_pair ON docs(id, title)",
+		"CREATE INDEX idx_docs_id ON docs(id) INCLUDE (title)",
+		"CREATE TABLE pages(url VARCHAR(2000) PRIMARY KEY)",
+	} {
+		err := execExpectError(t, executor, txns, sql)
+		if !strings.Contains(err.Error(), "exceeds the limit of 1008 bytes") {
+			t.Fatalf("%s: expected the key limit to be reported, got %v", sql, err)
+		}
+	}
+	mustExec(t, executor, txns, "CREATE INDEX idx_docs_summary ON docs(id) INCLUDE (summary)")
+}
+
 func containsIndexScan(node *engineexec.PlanNode) bool {
 	if node == nil {
 		return false
@@ -291,3 +315,142 @@ func containsIndexScan(node *engineexec.PlanNode) bool {
 	}
 	return false
 }
+
+func TestExecutorOrderedIndexScan(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ordered.gdb")
+	executor, txns, cleanup := newExecutor(t, path)
+	defer cleanup()
+
+	mustExec(t, executor, txns, "CREATE TABLE events(id INT PRIMARY KEY, kind VARCHAR(10) NOT NULL, at INT NOT NULL)")
+	mustExec(t, executor, txns, "INSERT INTO events VALUES (1,'a',10),(2,'b',50),(3,'a',30),(4,'a',20),(5,'b',40),(6,'a',40)")
+	mustExec(t, executor, txns, "CREATE INDEX idx_events_kind_at ON events(kind, at DESC)")
+
+	latest := execQuery(t, executor, txns, "SELECT id FROM events WHERE kind = 'a' ORDER BY at DESC LIMIT 2 OFFSET 1")
+	if want := [][]string{{"3"}, {"4"}}; !equalRows(latest.Rows, want) {
+		t.Fatalf("unexpected page of latest events: %v", latest.Rows)
+	}
+	ranged := execQuery(t, executor, txns, "SELECT id FROM events WHERE kind = 'a' AND at >= 20 AND at < 40 ORDER BY at DESC")
+	if want := [][]string{{"3"}, {"4"}}; !equalRows(ranged.Rows, want) {
+		t.Fatalf("unexpected rows for a range on a descending column: %v", ranged.Rows)
+	}
+	all := execQuery(t, executor, txns, "SELECT id FROM events ORDER BY kind, at DESC LIMIT 5")
+	if want := [][]string{{"6"}, {"3"}, {"4"}, {"1"}, {"2"}}; !equalRows(all.Rows, want) {
+		t.Fatalf("unexpected rows for a full ordered scan: %v", all.Rows)
+	}
+
+	stmt, err := parser.Parse("SELECT id FROM events WHERE kind = 'a' ORDER BY at DESC LIMIT 2")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	physical, err := executor.PhysicalPlan(stmt)
+	if err != nil {
+		t.Fatalf("physical plan: %v", err)
+	}
+	node := physical
+	for node.Node != "IndexScan" {
+		if node.Node == "Sort" {
+			t.Fatalf("expected the index order to replace the sort")
+		}
+		if len(node.Children) != 1 {
+			t.Fatalf("expected an index scan under %s", node.Node)
+		}
+		node = node.Children[0]
+	}
+	if node.Props.UsingIndexOrder == nil || !*node.Props.UsingIndexOrder {
+		t.Fatalf("expected the index scan to report its order, got %+v", node.Props)
+	}
+
+	// The index sorts by kind first, so it cannot order by at alone.
+	stmt, err = parser.Parse("SELECT id FROM events ORDER BY at DESC")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	plan, err := executor.Explain(stmt)
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if containsIndexScan(plan.Root) {
+		t.Fatalf("expected a sequential scan and a sort, got %v", plan.Root)
+	}
+}
+
+func TestExecutorIndexRangeOnVarchar(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "varchar.gdb")
+	executor, txns, cleanup := newExecutor(t, path)
+	defer cleanup()
+
+	mustExec(t, executor, txns, "CREATE TABLE words(id INT PRIMARY KEY, word VARCHAR(10))")
+	mustExec(t, executor, txns, "INSERT INTO words VALUES (1,'b'),(2,'abc'),(3,'ab'),(4,'c'),(5,'a'),(6,NULL)")
+	mustExec(t, executor, txns, "CREATE INDEX idx_words_word ON words(word)")
+
+	res := execQuery(t, executor, txns, "SELECT id FROM words WHERE word >= 'ab' AND word < 'b' ORDER BY word")
+	if want := [][]string{{"3"}, {"2"}}; !equalRows(res.Rows, want) {
+		t.Fatalf("unexpected rows: %v", res.Rows)
+	}
+	// NULL words have no entry, so an unfiltered scan of the index would
+	// miss a row.
+	all := execQuery(t, executor, txns, "SELECT id FROM words ORDER BY word LIMIT 10")
+	if len(all.Rows) != 6 {
+		t.Fatalf("expected every row, got %v", all.Rows)
+	}
+}
+
+func TestExecutorIndexOnlyScan(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "covering.gdb")
+	executor, txns, cleanup := newExecutor(t, path)
+	defer cleanup()
+
+	mustExec(t, executor, txns, "CREATE TABLE orders(id INT PRIMARY KEY, customer VARCHAR(20) NOT NULL, placed DATE NOT NULL, total DECIMAL(10,2), note VARCHAR(40))")
+	mustExec(t, executor, txns, "INSERT INTO orders VALUES (1,'ada','2024-01-05',12.50,'first'),(2,'bob','2024-02-01',NULL,NULL),(3,'ada','2024-03-09',7.25,'third'),(4,'ada','2024-02-14',3.00,'refund')")
+	mustExec(t, executor, txns, "CREATE INDEX idx_orders_customer ON orders(customer, placed DESC) INCLUDE (total)")
+
+	query := "SELECT placed, total FROM orders WHERE customer = 'ada' ORDER BY placed DESC"
+	res := execQuery(t, executor, txns, query)
+	if want := [][]string{{"2024-03-09", "7.25"}, {"2024-02-14", "3.00"}, {"2024-01-05", "12.50"}}; !equalRows(res.Rows, want) {
+		t.Fatalf("unexpected rows from the index: %v", res.Rows)
+	}
+	if res := execQuery(t, executor, txns, "SELECT customer, total FROM orders WHERE customer = 'bob'"); !equalRows(res.Rows, [][]string{{"bob", "NULL"}}) {
+		t.Fatalf("expected a NULL included value, got %v", res.Rows)
+	}
+
+	scanNode := func(sql string) string {
+		t.Helper()
+		stmt, err := parser.Parse(sql)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		node, err := executor.PhysicalPlan(stmt)
+		if err != nil {
+			t.Fatalf("physical plan: %v", err)
+		}
+		for len(node.Children) == 1 {
+			node = node.Children[0]
+		}
+		return node.Node
+	}
+	if got := scanNode(query); got != "IndexOnlyScan" {
+		t.Fatalf("expected an index-only scan, got %s", got)
+	}
+	// The note is only in the heap.
+	if got := scanNode("SELECT note FROM orders WHERE customer = 'ada'"); got != "IndexScan" {
+		t.Fatalf("expected an index scan that fetches rows, got %s", got)
+	}
+
+	// Changing an included column rewrites the entry.
+	mustExec(t, executor, txns, "UPDATE orders SET total = 99.99 WHERE id = 3")
+	mustExec(t, executor, txns, "DELETE FROM orders WHERE id = 4")
+	res = execQuery(t, executor, txns, query)
+	if want := [][]string{{"2024-03-09", "99.99"}, {"2024-01-05", "12.50"}}; !equalRows(res.Rows, want) {
+		t.Fatalf("unexpected rows after the update: %v", res.Rows)
+	}
+
+	tx := txns.Begin()
+	problems, err := executor.CheckIntegrity(tx)
+	_ = txns.Commit(tx.ID())
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("expected a sound database, got %+v (%v)", problems, err)
+	}
+}
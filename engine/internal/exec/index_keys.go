@@ -8,16 +8,189 @@ import (
         "github.com/shopspring/decimal"
 
         "github.com/example/granite-db/engine/internal/catalog"
+        "github.com/example/granite-db/engine/internal/storage"
+        "github.com/example/granite-db/engine/internal/storage/indexmgr"
 )
 
-func buildIndexComponents(cols []catalog.Column, order []int, values []interface{}) ([][]byte, bool, error) {
+// indexEntryFor builds the entry a row has in an index: its key and the
+// values of any included columns. Rows with a NULL key column are not
+// indexed, which the second result reports.
+func indexEntryFor(cols []catalog.Column, info indexInfo, values []interface{}, rid storage.RowID) (indexmgr.Entry, bool, error) {
+        components, skip, err := buildIndexComponents(cols, info.positions, info.def.Descending, values)
+        if err != nil || skip {
+                return indexmgr.Entry{}, false, err
+        }
+        entry := indexmgr.Entry{Key: encodeIndexKey(components), Row: rid}
+        if len(info.included) > 0 {
+                entry.Included, err = encodeIncluded(cols, info.included, values)
+                if err != nil {
+                        return indexmgr.Entry{}, false, err
+                }
+        }
+        return entry, true, nil
+}
+
+// encodeIncluded encodes the values of included columns. They only need to
+// decode again, so each is a marker byte, 0 for NULL and 1 otherwise,
+// followed by the value's key encoding.
+func encodeIncluded(cols []catalog.Column, positions []int, values []interface{}) ([]byte, error) {
+        var buf []byte
+        for _, pos := range positions {
+                if values[pos] == nil {
+                        buf = append(buf, 0)
+                        continue
+                }
+                comp, err := encodeComponent(cols[pos], values[pos])
+                if err != nil {
+                        return nil, err
+                }
+                buf = append(append(buf, 1), comp...)
+        }
+        return buf, nil
+}
+
+// declaredKeySize returns the longest key, included values and all, that an
+// index on the given columns stores, going by their declared types. Zero
+// bytes in a string take two bytes each, so a key may still exceed it. The
+// second result is false when a VARCHAR column declares no length.
+func declaredKeySize(cols []catalog.Column, positions, included []int) (int, bool) {
+        size := 0
+        for _, pos := range positions {
+                width, ok := componentWidth(cols[pos])
+                if !ok {
+                        return 0, false
+                }
+                size += width
+        }
+        for _, pos := range included {
+                width, ok := componentWidth(cols[pos])
+                if !ok {
+                        return 0, false
+                }
+                size += 1 + width
+        }
+        return size, true
+}
+
+func componentWidth(col catalog.Column) (int, bool) {
+        switch col.Type {
+        case catalog.ColumnTypeVarChar:
+                if col.Length <= 0 {
+                        return 0, false
+                }
+                return col.Length + 2, true
+        case catalog.ColumnTypeBoolean:
+                return 1, true
+        default:
+                return 8, true
+        }
+}
+
+// decodeIndexEntry fills in, from a key as the index stores it, the values of
+// the index's key and included columns. The other values are left alone.
+// It returns the length of the key proper, before the included values.
+func decodeIndexEntry(cols []catalog.Column, info indexInfo, key []byte, values []interface{}) (int, error) {
+        pos := 0
+        for i, col := range info.positions {
+                value, n, err := decodeComponent(cols[col], key[pos:], info.def.Desc(i))
+                if err != nil {
+                        return 0, err
+                }
+                values[col] = value
+                pos += n
+        }
+        keyLen := pos
+        for _, col := range info.included {
+                if pos >= len(key) {
+                        return 0, fmt.Errorf("exec: truncated included value for column %s", cols[col].Name)
+                }
+                pos++
+                if key[pos-1] == 0 {
+                        values[col] = nil
+                        continue
+                }
+                value, n, err := decodeComponent(cols[col], key[pos:], false)
+                if err != nil {
+                        return 0, err
+                }
+                values[col] = value
+                pos += n
+        }
+        if pos != len(key) {
+                return 0, fmt.Errorf("exec: index key length mismatch (expected %d, used %d)", len(key), pos)
+        }
+        return keyLen, nil
+}
+
+// decodeComponent reverses encodeKeyComponent, returning the value and the
+// number of bytes it took.
+func decodeComponent(col catalog.Column, data []byte, desc bool) (interface{}, int, error) {
+        at := func(i int) byte {
+                if desc {
+                        return ^data[i]
+                }
+                return data[i]
+        }
+        if col.Type == catalog.ColumnTypeVarChar {
+                str := make([]byte, 0, len(data))
+                for i := 0; i+1 < len(data); i++ {
+                        if at(i) != 0 {
+                                str = append(str, at(i))
+                                continue
+                        }
+                        switch at(i + 1) {
+                        case 0xFF:
+                                str = append(str, 0)
+                                i++
+                        case 1:
+                                return string(str), i + 2, nil
+                        default:
+                                return nil, 0, fmt.Errorf("exec: invalid key encoding for column %s", col.Name)
+                        }
+                }
+                return nil, 0, fmt.Errorf("exec: truncated key for column %s", col.Name)
+        }
+        if col.Type == catalog.ColumnTypeBoolean {
+                if len(data) < 1 {
+                        return nil, 0, fmt.Errorf("exec: truncated key for column %s", col.Name)
+                }
+                return at(0) == 1, 1, nil
+        }
+        if len(data) < 8 {
+                return nil, 0, fmt.Errorf("exec: truncated key for column %s", col.Name)
+        }
+        var buf [8]byte
+        for i := range buf {
+                buf[i] = at(i)
+        }
+        v := int64(binary.BigEndian.Uint64(buf[:]) ^ (uint64(1) << 63))
+        switch col.Type {
+        case catalog.ColumnTypeInt:
+                return int32(v), 8, nil
+        case catalog.ColumnTypeBigInt:
+                return v, 8, nil
+        case catalog.ColumnTypeDate:
+                return time.Unix(v*86400, 0).UTC(), 8, nil
+        case catalog.ColumnTypeTimestamp:
+                return time.Unix(0, v).UTC(), 8, nil
+        case catalog.ColumnTypeDecimal:
+                return decimal.New(v, -int32(col.Scale)), 8, nil
+        default:
+                return nil, 0, fmt.Errorf("exec: unsupported index column type %d", col.Type)
+        }
+}
+
+// buildIndexComponents encodes the key columns of a row in index order. Desc
+// marks the columns that sort in descending order and may be nil. Rows with
+// a NULL key column are not indexed, which the second result reports.
+func buildIndexComponents(cols []catalog.Column, order []int, desc []bool, values []interface{}) ([][]byte, bool, error) {
         components := make([][]byte, len(order))
         for i, idx := range order {
                 value := values[idx]
                 if value == nil {
                         return nil, true, nil
                 }
-                comp, err := encodeComponent(cols[idx], value)
+                comp, err := encodeKeyComponent(cols[idx], value, i < len(desc) && desc[i])
                 if err != nil {
                         return nil, false, err
                 }
@@ -26,21 +199,35 @@ func buildIndexComponents(cols []catalog.Column, order []int, values []interface
         return components, false, nil
 }
 
+// encodeIndexKey joins key components. Every component marks its own end, so
+// keys compare byte by byte in the order of their columns.
 func encodeIndexKey(components [][]byte) []byte {
         size := 0
         for _, comp := range components {
-                size += 2 + len(comp)
+                size += len(comp)
         }
         key := make([]byte, 0, size)
         for _, comp := range components {
-                var lenBuf [2]byte
-                binary.BigEndian.PutUint16(lenBuf[:], uint16(len(comp)))
-                key = append(key, lenBuf[:]...)
                 key = append(key, comp...)
         }
         return key
 }
 
+// encodeKeyComponent encodes a value so that its bytes sort in the order of
+// the values, or in the reverse order for a descending column.
+func encodeKeyComponent(col catalog.Column, value interface{}, desc bool) ([]byte, error) {
+        comp, err := encodeComponent(col, value)
+        if err != nil {
+                return nil, err
+        }
+        if desc {
+                for i := range comp {
+                        comp[i] = ^comp[i]
+                }
+        }
+        return comp, nil
+}
+
 func encodeComponent(col catalog.Column, value interface{}) ([]byte, error) {
         switch col.Type {
         case catalog.ColumnTypeInt:
@@ -69,7 +256,7 @@ func encodeComponent(col catalog.Column, value interface{}) ([]byte, error) {
                 if !ok {
                         return nil, fmt.Errorf("exec: expected VARCHAR value for column %s", col.Name)
                 }
-                return []byte(str), nil
+                return encodeString(str), nil
         case catalog.ColumnTypeDate:
                 t, ok := value.(time.Time)
                 if !ok {
@@ -98,6 +285,19 @@ func encodeComponent(col catalog.Column, value interface{}) ([]byte, error) {
         }
 }
 
+// encodeString escapes each zero byte as 0x00 0xFF and ends the string with
+// 0x00 0x01, so a string sorts before every longer string it begins.
+func encodeString(str string) []byte {
+        buf := make([]byte, 0, len(str)+2)
+        for i := 0; i < len(str); i++ {
+                buf = append(buf, str[i])
+                if str[i] == 0 {
+                        buf = append(buf, 0xFF)
+                }
+        }
+        return append(buf, 0, 1)
+}
+
 func encodeInt64(v int64) []byte {
         var buf [8]byte
         u := uint64(v) ^ (uint64(1) << 63)
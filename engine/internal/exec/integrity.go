@@ -0,0 +1,298 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/example/granite-db/engine/internal/catalog"
+	"github.com/example/granite-db/engine/internal/sql/parser"
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/txn"
+)
+
+func (e *Executor) executePragma(tx *txn.Transaction, stmt *parser.PragmaStmt) (*Result, error) {
+	if !strings.EqualFold(stmt.Name, "integrity_check") {
+		return nil, fmt.Errorf("exec: unknown pragma %s", stmt.Name)
+	}
+	problems, err := e.CheckIntegrity(tx)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Columns: []string{"check", "table", "index", "page", "detail"}}
+	for _, p := range problems {
+		page := ""
+		if p.Page != 0 {
+			page = strconv.FormatUint(uint64(p.Page), 10)
+		}
+		result.Rows = append(result.Rows, []string{p.Check, p.Table, p.Index, page, p.Detail})
+	}
+	if len(problems) == 0 {
+		result.Message = "Integrity check passed"
+	} else {
+		result.Message = fmt.Sprintf("Integrity check found %d problem(s)", len(problems))
+	}
+	return result, nil
+}
+
+// CheckIntegrity verifies the whole database and returns every problem found.
+// On top of the page structure checked by storage.Manager.CheckPages it
+// decodes every row, compares each table's row count, cross-checks every
+// index against the heap in both directions and looks for rows whose foreign
+// keys have no parent. Tables with a damaged heap are not scanned.
+func (e *Executor) CheckIntegrity(tx *txn.Transaction) ([]storage.Problem, error) {
+	tables, err := e.maintenanceTargets("")
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		if err := e.acquireTableLock(tx, table.Name, txn.LockModeShared); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.storage.Flush(); err != nil {
+		return nil, err
+	}
+	heaps := make(map[string]*storage.HeapFile, len(tables))
+	var indexes []storage.IndexTree
+	for _, table := range tables {
+		heaps[table.Name] = table.HeapFile(e.storage)
+		for _, idx := range table.Indexes {
+			if idx.Root != 0 {
+				indexes = append(indexes, storage.IndexTree{Table: table.Name, Index: idx.Name, Tree: storage.OpenBTree(e.storage, idx.Root)})
+			}
+		}
+	}
+	pages, err := e.storage.CheckPages(heaps, indexes)
+	if err != nil {
+		return nil, err
+	}
+	c := &integrityChecker{
+		executor: e,
+		problems: pages.Problems,
+		damaged:  pages.Damaged,
+		keys:     make(map[*catalog.ForeignKey]map[string]bool),
+	}
+	for _, table := range tables {
+		for _, idx := range table.Indexes {
+			if reason, ok := e.unbuilt[strings.ToLower(idx.Name)]; ok && !idx.Built() {
+				c.report(storage.Problem{Check: "index", Table: table.Name, Index: idx.Name, Detail: reason})
+			}
+		}
+	}
+
+	// Work out the foreign keys first, so that each table is scanned once to
+	// collect both its references and the keys other tables reference.
+	references := make(map[string][]foreignKeyInfo)
+	for _, table := range tables {
+		infos, err := e.buildForeignKeyInfos(table)
+		if err != nil {
+			c.report(storage.Problem{Check: "foreign-key", Table: table.Name, Detail: err.Error()})
+			continue
+		}
+		for _, info := range infos {
+			if c.damaged[info.parentTable.Name] {
+				continue
+			}
+			c.keys[info.def] = make(map[string]bool)
+			parent := strings.ToLower(info.parentTable.Name)
+			references[parent] = append(references[parent], info)
+		}
+	}
+
+	children := make(map[string][]foreignKeyRow)
+	for _, table := range tables {
+		if c.damaged[table.Name] {
+			continue
+		}
+		children[table.Name] = c.checkTable(table, references[strings.ToLower(table.Name)])
+	}
+	for _, table := range tables {
+		for _, row := range children[table.Name] {
+			keys, ok := c.keys[row.info.def]
+			if !ok || keys[row.key] {
+				continue
+			}
+			c.report(storage.Problem{
+				Check:  "foreign-key",
+				Table:  table.Name,
+				Page:   row.rid.Page,
+				Detail: fmt.Sprintf("row %d:%d violates %s: no parent row in %s for key (%s) = (%s)", row.rid.Page, row.rid.Slot, row.info.def.Name, row.info.parentTable.Name, strings.Join(row.info.def.ChildColumns, ", "), formatKeyValues(row.values)),
+			})
+		}
+	}
+	return c.problems, nil
+}
+
+type integrityChecker struct {
+	executor *Executor
+	problems []storage.Problem
+	damaged  map[string]bool
+	// keys holds, for each foreign key, the encoded keys of its parent rows.
+	keys map[*catalog.ForeignKey]map[string]bool
+}
+
+// foreignKeyRow is a child row's reference to its parent.
+type foreignKeyRow struct {
+	info   foreignKeyInfo
+	rid    storage.RowID
+	values []interface{}
+	key    string
+}
+
+type indexEntry struct {
+	key string
+	rid storage.RowID
+}
+
+func (c *integrityChecker) report(p storage.Problem) {
+	c.problems = append(c.problems, p)
+}
+
+// checkTable scans a table, checking its rows and row count and then its
+// indexes. It records the parent keys referenced by foreign keys in
+// references and returns the table's own references to its parents.
+func (c *integrityChecker) checkTable(table *catalog.Table, references []foreignKeyInfo) []foreignKeyRow {
+	indexInfos, err := buildIndexInfos(table)
+	if err != nil {
+		c.report(storage.Problem{Check: "index", Table: table.Name, Detail: err.Error()})
+		indexInfos = nil
+	}
+	foreignKeys, err := c.executor.buildForeignKeyInfos(table)
+	if err != nil {
+		foreignKeys = nil
+	}
+	expected := make([]map[indexEntry]bool, len(indexInfos))
+	for i := range expected {
+		expected[i] = make(map[indexEntry]bool)
+	}
+	present := make(map[storage.RowID]bool)
+	var parents []foreignKeyRow
+	count := uint64(0)
+
+	err = table.HeapFile(c.executor.storage).Scan(func(rid storage.RowID, record []byte) error {
+		count++
+		present[rid] = true
+		values, err := DecodeRow(table.Columns, record)
+		if err != nil {
+			c.report(storage.Problem{Check: "row", Table: table.Name, Page: rid.Page, Detail: fmt.Sprintf("row %d:%d cannot be decoded: %v", rid.Page, rid.Slot, err)})
+			return nil
+		}
+		for i, info := range indexInfos {
+			entry, ok, err := indexEntryFor(table.Columns, info, values, rid)
+			if err != nil {
+				c.report(storage.Problem{Check: "index", Table: table.Name, Index: info.def.Name, Page: rid.Page, Detail: fmt.Sprintf("row %d:%d: %v", rid.Page, rid.Slot, err)})
+				continue
+			}
+			if ok {
+				expected[i][indexEntry{key: string(entry.StoredKey()), rid: rid}] = true
+			}
+		}
+		for _, info := range references {
+			key, ok, err := indexKeyFor(table.Columns, info.parentPositions, nil, values)
+			if err == nil && ok {
+				c.keys[info.def][key] = true
+			}
+		}
+		for _, info := range foreignKeys {
+			keyValues := extractKeyValues(values, info.childPositions)
+			if allValuesNull(keyValues) {
+				continue
+			}
+			parentValues := make([]interface{}, len(info.parentTable.Columns))
+			for i, pos := range info.parentPositions {
+				parentValues[pos] = keyValues[i]
+			}
+			key, ok, err := indexKeyFor(info.parentTable.Columns, info.parentPositions, nil, parentValues)
+			if err != nil || !ok {
+				// A partly NULL key never matches a parent and is not checked.
+				continue
+			}
+			parents = append(parents, foreignKeyRow{info: info, rid: rid, values: keyValues, key: key})
+		}
+		return nil
+	})
+	if err != nil {
+		c.report(storage.Problem{Check: "row", Table: table.Name, Detail: fmt.Sprintf("scan stopped: %v", err)})
+		return parents
+	}
+	if count != table.RowCount {
+		c.report(storage.Problem{Check: "row-count", Table: table.Name, Detail: fmt.Sprintf("the catalogue records %d row(s) but the heap holds %d", table.RowCount, count)})
+	}
+	for i, info := range indexInfos {
+		c.checkIndex(table, info, expected[i], present)
+	}
+	return parents
+}
+
+// checkIndex compares an index file with the entries its table's rows call
+// for: every entry must point at a row with that key and every row must have
+// its entry.
+func (c *integrityChecker) checkIndex(table *catalog.Table, info indexInfo, expected map[indexEntry]bool, present map[storage.RowID]bool) {
+	report := func(page storage.PageID, format string, args ...interface{}) {
+		c.report(storage.Problem{Check: "index", Table: table.Name, Index: info.def.Name, Page: page, Detail: fmt.Sprintf(format, args...)})
+	}
+	file, err := c.executor.indexes.Open(info.def.Root)
+	if err != nil {
+		report(0, "cannot open the index: %v", err)
+		return
+	}
+	entries, err := file.Entries()
+	if err != nil {
+		report(info.def.Root, "cannot read the index: %v", err)
+		return
+	}
+	// keyOf strips included values, which take no part in uniqueness.
+	values := make([]interface{}, len(table.Columns))
+	keyOf := func(stored []byte) []byte {
+		if len(info.included) == 0 {
+			return stored
+		}
+		keyLen, err := decodeIndexEntry(table.Columns, info, stored, values)
+		if err != nil {
+			return stored
+		}
+		return stored[:keyLen]
+	}
+	for i, entry := range entries {
+		rid := entry.Row
+		if info.def.IsUnique && i > 0 && bytes.Equal(keyOf(entries[i-1].Key), keyOf(entry.Key)) {
+			report(rid.Page, "rows %d:%d and %d:%d share a key in a unique index", entries[i-1].Row.Page, entries[i-1].Row.Slot, rid.Page, rid.Slot)
+		}
+		want := indexEntry{key: string(entry.Key), rid: rid}
+		switch {
+		case expected[want]:
+			delete(expected, want)
+		case present[rid]:
+			report(rid.Page, "the entry for row %d:%d does not match the row's key", rid.Page, rid.Slot)
+		default:
+			report(rid.Page, "the entry points at row %d:%d, which does not exist", rid.Page, rid.Slot)
+		}
+	}
+	missing := make([]storage.RowID, 0, len(expected))
+	for entry := range expected {
+		missing = append(missing, entry.rid)
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if missing[i].Page != missing[j].Page {
+			return missing[i].Page < missing[j].Page
+		}
+		return missing[i].Slot < missing[j].Slot
+	})
+	for _, rid := range missing {
+		report(rid.Page, "row %d:%d has no entry", rid.Page, rid.Slot)
+	}
+}
+
+// indexKeyFor encodes the index key of values, with key columns sorting in
+// the directions desc gives; ok is false when a key column is NULL, since
+// such rows are not indexed.
+func indexKeyFor(cols []catalog.Column, positions []int, desc []bool, values []interface{}) (string, bool, error) {
+	components, skip, err := buildIndexComponents(cols, positions, desc, values)
+	if err != nil || skip {
+		return "", false, err
+	}
+	return string(encodeIndexKey(components)), true, nil
+}
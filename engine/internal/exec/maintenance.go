@@ -0,0 +1,155 @@
+package exec
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/example/granite-db/engine/internal/catalog"
+	"github.com/example/granite-db/engine/internal/sql/parser"
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/txn"
+)
+
+func (e *Executor) executeVacuum(tx *txn.Transaction, stmt *parser.VacuumStmt) (*Result, error) {
+	if !tx.Autocommit() {
+		// Vacuum relocates rows, which would invalidate the RowIDs captured
+		// by rollback actions registered earlier in the same transaction.
+		return nil, fmt.Errorf("exec: VACUUM cannot run inside a transaction block")
+	}
+	if stmt.Full {
+		return e.vacuumFull(tx)
+	}
+	tables, err := e.maintenanceTargets(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Columns: []string{"table", "pages", "pages_freed", "rows_moved", "bytes_reclaimed"}}
+	freed, moved := 0, 0
+	for _, table := range tables {
+		stats, err := e.vacuumTable(tx, table)
+		if err != nil {
+			return nil, err
+		}
+		freed += stats.PagesFreed
+		moved += stats.RowsMoved
+		result.Rows = append(result.Rows, []string{
+			table.Name,
+			strconv.Itoa(stats.PagesScanned - stats.PagesFreed),
+			strconv.Itoa(stats.PagesFreed),
+			strconv.Itoa(stats.RowsMoved),
+			strconv.Itoa(stats.BytesReclaimed),
+		})
+	}
+	result.Message = fmt.Sprintf("VACUUM complete: %d page(s) freed, %d row(s) moved", freed, moved)
+	return result, nil
+}
+
+// maintenanceTargets resolves the tables named by a maintenance statement; an
+// empty name selects every table.
+func (e *Executor) maintenanceTargets(name string) ([]*catalog.Table, error) {
+	if name != "" {
+		table, ok := e.catalog.GetTable(name)
+		if !ok {
+			return nil, fmt.Errorf("exec: table %s not found", name)
+		}
+		return []*catalog.Table{table}, nil
+	}
+	snapshots := e.catalog.ListTables()
+	tables := make([]*catalog.Table, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if table, ok := e.catalog.GetTable(snapshot.Name); ok {
+			tables = append(tables, table)
+		}
+	}
+	return tables, nil
+}
+
+func (e *Executor) vacuumTable(tx *txn.Transaction, table *catalog.Table) (storage.VacuumStats, error) {
+	if err := e.acquireTableLock(tx, table.Name, txn.LockModeExclusive); err != nil {
+		return storage.VacuumStats{}, err
+	}
+	indexInfos, err := buildIndexInfos(table)
+	if err != nil {
+		return storage.VacuumStats{}, err
+	}
+	heap := table.HeapFile(e.storage)
+	stats, err := heap.Vacuum(tx, e.wal, func(from, to storage.RowID, record []byte) error {
+		if len(indexInfos) == 0 {
+			return nil
+		}
+		values, err := DecodeRow(table.Columns, record)
+		if err != nil {
+			return err
+		}
+		if err := e.removeFromIndexes(tx, table, indexInfos, values, from); err != nil {
+			return err
+		}
+		return e.insertIntoIndexes(tx, table, indexInfos, values, to)
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := e.catalog.SetFreeSpaceMap(table.Name, stats.FreeSpaceMap); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// vacuumFull compacts the database file. Every table is locked exclusively for
+// the duration, so no other transaction holds uncommitted changes, and the
+// write-ahead log is emptied first: its page images refer to page ids that the
+// compaction is about to reuse.
+func (e *Executor) vacuumFull(tx *txn.Transaction) (*Result, error) {
+	tables, err := e.maintenanceTargets("")
+	if err != nil {
+		return nil, err
+	}
+	heaps := make([]*storage.HeapFile, 0, len(tables))
+	var trees []*storage.BTree
+	for _, table := range tables {
+		if err := e.acquireTableLock(tx, table.Name, txn.LockModeExclusive); err != nil {
+			return nil, err
+		}
+		heaps = append(heaps, table.HeapFile(e.storage))
+		for _, idx := range table.Indexes {
+			if idx.Root != 0 {
+				trees = append(trees, storage.OpenBTree(e.storage, idx.Root))
+			}
+		}
+	}
+	if err := e.storage.Flush(); err != nil {
+		return nil, err
+	}
+	if err := e.wal.Reset(); err != nil {
+		return nil, err
+	}
+	plan, err := e.storage.PlanCompaction(heaps, trees)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := e.storage.Compact(plan, nil, func() error {
+		return e.catalog.RelocatePages(plan)
+	})
+	// Index handles are keyed by root page, which the compaction may have
+	// moved.
+	_ = e.indexes.Close()
+	if err != nil {
+		// The file was rolled back, so cached definitions may describe the
+		// abandoned layout.
+		if reloadErr := e.catalog.Reload(); reloadErr != nil {
+			return nil, fmt.Errorf("exec: VACUUM FULL failed (%v) and the catalogue could not be reloaded: %w", err, reloadErr)
+		}
+		return nil, err
+	}
+	result := &Result{
+		Columns: []string{"pages_before", "pages_after", "pages_moved", "bytes_reclaimed"},
+		Rows: [][]string{{
+			strconv.Itoa(stats.PagesBefore),
+			strconv.Itoa(stats.PagesAfter),
+			strconv.Itoa(stats.PagesMoved),
+			strconv.FormatInt(stats.BytesReclaimed, 10),
+		}},
+		Message: fmt.Sprintf("VACUUM FULL complete: %d page(s) released, %d page(s) moved", stats.PagesBefore-stats.PagesAfter, stats.PagesMoved),
+	}
+	return result, nil
+}
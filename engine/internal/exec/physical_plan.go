@@ -92,7 +92,7 @@ func (b *physicalPlanBuilder) build() *PhysicalPlanNode {
 	if b.validated.Having != nil && b.validated.HavingText != "" {
 		input = newFilterNode(b.validated.HavingText, input)
 	}
-	if len(b.validated.OrderBy) > 0 {
+	if len(b.validated.OrderBy) > 0 && (b.idxChoice == nil || !b.idxChoice.ordered) {
 		input = b.wrapSort(input)
 	}
 	if b.validated.Limit != nil {
@@ -136,6 +136,13 @@ func (b *physicalPlanBuilder) planForSource(source *validator.TableSource, choic
 		idxName := choice.info.def.Name
 		props.Index = &idxName
 		node.Node = "IndexScan"
+		if choice.covering {
+			node.Node = "IndexOnlyScan"
+		}
+		if choice.ordered {
+			ordered := true
+			props.UsingIndexOrder = &ordered
+		}
 	}
 	if props.hasValues() {
 		node.Props = props
@@ -0,0 +1,111 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/example/granite-db/engine/internal/catalog"
+	"github.com/example/granite-db/engine/internal/sql/parser"
+	"github.com/example/granite-db/engine/internal/txn"
+)
+
+// executeTruncate empties whole tables without visiting their rows. The old
+// pages stay linked to the transaction until it commits, so a rollback can
+// put them back. GraniteDB has no identity columns, so RESTART IDENTITY has
+// nothing to reset and is accepted for compatibility.
+func (e *Executor) executeTruncate(tx *txn.Transaction, stmt *parser.TruncateStmt) (*Result, error) {
+	tables, err := e.truncateTargets(stmt)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		if err := e.acquireTableLock(tx, table.Name, txn.LockModeExclusive); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		if err := e.truncateTable(tx, table); err != nil {
+			return nil, err
+		}
+		names[i] = table.Name
+	}
+	return &Result{Message: fmt.Sprintf("Truncated %s", strings.Join(names, ", "))}, nil
+}
+
+// truncateTargets resolves the named tables and the tables whose foreign keys
+// reference them. Without CASCADE every referencing table must be named too.
+func (e *Executor) truncateTargets(stmt *parser.TruncateStmt) ([]*catalog.Table, error) {
+	var tables []*catalog.Table
+	included := make(map[string]bool)
+	for _, name := range stmt.Tables {
+		table, ok := e.catalog.GetTable(name)
+		if !ok {
+			return nil, fmt.Errorf("exec: table %s not found", name)
+		}
+		if lower := strings.ToLower(table.Name); !included[lower] {
+			included[lower] = true
+			tables = append(tables, table)
+		}
+	}
+	for i := 0; i < len(tables); i++ {
+		for _, snapshot := range e.catalog.ListTables() {
+			child, ok := e.catalog.GetTable(snapshot.Name)
+			if !ok || included[strings.ToLower(child.Name)] {
+				continue
+			}
+			for _, fk := range child.ForeignKeys {
+				if !strings.EqualFold(fk.ParentTable, tables[i].Name) {
+					continue
+				}
+				if !stmt.Cascade {
+					return nil, fmt.Errorf("exec: cannot truncate table %s: foreign key %s on table %s references it (truncate %s as well or use CASCADE)", tables[i].Name, fk.Name, child.Name, child.Name)
+				}
+				included[strings.ToLower(child.Name)] = true
+				tables = append(tables, child)
+				break
+			}
+		}
+	}
+	return tables, nil
+}
+
+func (e *Executor) truncateTable(tx *txn.Transaction, table *catalog.Table) error {
+	for _, idx := range table.Indexes {
+		if !idx.Built() {
+			continue
+		}
+		file, err := e.indexes.Open(idx.Root)
+		if err != nil {
+			return err
+		}
+		entries, err := file.Entries()
+		if err != nil {
+			return err
+		}
+		if err := file.Rebuild(tx, e.wal, nil, false); err != nil {
+			return err
+		}
+		tx.RegisterRollback(func() error {
+			return file.Rebuild(tx, e.wal, entries, false)
+		})
+	}
+
+	truncation, err := table.HeapFile(e.storage).Truncate(tx, e.wal)
+	if err != nil {
+		return err
+	}
+	tx.RegisterRollback(func() error {
+		return truncation.Restore(tx, e.wal)
+	})
+	tx.RegisterCommit(truncation.Release)
+
+	rowCount := table.RowCount
+	if err := e.catalog.SetRowCount(table.Name, 0); err != nil {
+		return err
+	}
+	tx.RegisterRollback(func() error {
+		return e.catalog.SetRowCount(table.Name, rowCount)
+	})
+	return nil
+}
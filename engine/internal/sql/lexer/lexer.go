@@ -51,6 +51,8 @@ var keywords = map[string]TokenType{
 	"COALESCE":    Ident,
 	"COMMIT":      Ident,
 	"CONSTRAINT":  Ident,
+	"CONTINUE":    Ident,
+	"COPY":        Ident,
 	"CREATE":      Ident,
 	"DATE":        Ident,
 	"DECIMAL":     Ident,
@@ -60,6 +62,8 @@ var keywords = map[string]TokenType{
 	"FALSE":       Ident,
 	"FOREIGN":     Ident,
 	"FROM":        Ident,
+	"FULL":        Ident,
+	"IDENTITY":    Ident,
 	"INNER":       Ident,
 	"INSERT":      Ident,
 	"INT":         Ident,
@@ -78,8 +82,10 @@ var keywords = map[string]TokenType{
 	"OR":          Ident,
 	"ORDER":       Ident,
 	"OUTER":       Ident,
+	"PRAGMA":      Ident,
 	"PRIMARY":     Ident,
 	"REFERENCES":  Ident,
+	"RESTART":     Ident,
 	"RESTRICT":    Ident,
 	"ROLLBACK":    Ident,
 	"SELECT":      Ident,
@@ -89,12 +95,15 @@ var keywords = map[string]TokenType{
 	"TIMESTAMP":   Ident,
 	"TRANSACTION": Ident,
 	"TRUE":        Ident,
+	"TRUNCATE":    Ident,
 	"UPDATE":      Ident,
 	"UPPER":       Ident,
 	"USING":       Ident,
+	"VACUUM":      Ident,
 	"VALUES":      Ident,
 	"VARCHAR":     Ident,
 	"WHERE":       Ident,
+	"WITH":        Ident,
 }
 
 // Lexer performs tokenisation over the input SQL string.
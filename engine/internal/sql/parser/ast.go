@@ -50,10 +50,17 @@ type ForeignKeyDef struct {
 
 // CreateTableStmt represents a CREATE TABLE statement.
 type CreateTableStmt struct {
-	Name        string
-	Columns     []ColumnDef
-	PrimaryKey  string
-	ForeignKeys []ForeignKeyDef
+	Name    string
+	Columns []ColumnDef
+	// PrimaryKey lists the primary key columns in key order.
+	PrimaryKey []string
+	// PrimaryKeyName is the name given by CONSTRAINT name PRIMARY KEY, or
+	// empty when the constraint is unnamed.
+	PrimaryKeyName string
+	ForeignKeys    []ForeignKeyDef
+	// Compression is the codec named by WITH (compression = '...'), or empty
+	// when the table is stored uncompressed.
+	Compression string
 }
 
 func (*CreateTableStmt) stmt() {}
@@ -65,11 +72,55 @@ type DropTableStmt struct {
 
 func (*DropTableStmt) stmt() {}
 
+// TruncateStmt represents TRUNCATE [TABLE] t [, ...] [RESTART IDENTITY |
+// CONTINUE IDENTITY] [CASCADE | RESTRICT].
+type TruncateStmt struct {
+	Tables          []string
+	RestartIdentity bool
+	Cascade         bool
+}
+
+func (*TruncateStmt) stmt() {}
+
+// PragmaStmt represents PRAGMA name.
+type PragmaStmt struct {
+	Name string
+}
+
+func (*PragmaStmt) stmt() {}
+
+// CopyStmt represents COPY table [(columns)] FROM 'file' [WITH (...)], which
+// bulk-loads rows from a CSV or NDJSON file. Format is "csv" or "ndjson";
+// Header and Delimiter apply to CSV only.
+type CopyStmt struct {
+	Table     string
+	Columns   []string
+	Path      string
+	Format    string
+	Header    bool
+	Delimiter rune
+}
+
+func (*CopyStmt) stmt() {}
+
+// SetStmt represents SET name = value, which changes a database setting.
+type SetStmt struct {
+	Name  string
+	Value string
+}
+
+func (*SetStmt) stmt() {}
+
 // CreateIndexStmt models CREATE INDEX statements.
 type CreateIndexStmt struct {
 	Name    string
 	Table   string
 	Columns []string
+	// Descending marks the key columns declared DESC, in column order.
+	Descending []bool
+	// Include lists the columns stored alongside the key, so that queries
+	// reading only indexed columns need not visit the table.
+	Include []string
 	Unique  bool
 }
 
@@ -127,6 +178,15 @@ type SelectStmt struct {
 
 func (*SelectStmt) stmt() {}
 
+// VacuumStmt represents VACUUM [table] or VACUUM FULL. An empty Table
+// vacuums every table; Full compacts the whole database file.
+type VacuumStmt struct {
+	Table string
+	Full  bool
+}
+
+func (*VacuumStmt) stmt() {}
+
 // BeginStmt represents the start of an explicit transaction.
 type BeginStmt struct{}
 
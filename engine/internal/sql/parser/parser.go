@@ -60,6 +60,16 @@ func (p *Parser) parseStatement() (Statement, error) {
 		return p.parseUpdate()
 	case "DELETE":
 		return p.parseDelete()
+	case "VACUUM":
+		return p.parseVacuum()
+	case "TRUNCATE":
+		return p.parseTruncate()
+	case "PRAGMA":
+		return p.parsePragma()
+	case "SET":
+		return p.parseSet()
+	case "COPY":
+		return p.parseCopy()
 	default:
 		return nil, fmt.Errorf("parser: unexpected token %s", p.curToken.Literal)
 	}
@@ -162,12 +172,13 @@ func (p *Parser) parseCreateTable() (Statement, error) {
 
 	cols := []ColumnDef{}
 	foreignKeys := []ForeignKeyDef{}
-	var primaryKey string
+	var primaryKey []string
+	var primaryKeyName string
 	for {
 		upper := strings.ToUpper(p.curToken.Literal)
 		switch upper {
 		case "PRIMARY":
-			if primaryKey != "" {
+			if primaryKey != nil {
 				return nil, fmt.Errorf("parser: primary key already defined")
 			}
 			pk, err := p.parsePrimaryKeyClause()
@@ -185,7 +196,7 @@ func (p *Parser) parseCreateTable() (Statement, error) {
 			next := strings.ToUpper(p.curToken.Literal)
 			switch next {
 			case "PRIMARY":
-				if primaryKey != "" {
+				if primaryKey != nil {
 					return nil, fmt.Errorf("parser: primary key already defined")
 				}
 				pk, err := p.parsePrimaryKeyClause()
@@ -193,6 +204,7 @@ func (p *Parser) parseCreateTable() (Statement, error) {
 					return nil, err
 				}
 				primaryKey = pk
+				primaryKeyName = constraintName
 			case "FOREIGN":
 				fk, err := p.parseTableForeignKey(constraintName)
 				if err != nil {
@@ -214,10 +226,10 @@ func (p *Parser) parseCreateTable() (Statement, error) {
 				return nil, err
 			}
 			if col.PrimaryKey {
-				if primaryKey != "" {
+				if primaryKey != nil {
 					return nil, fmt.Errorf("parser: primary key already defined")
 				}
-				primaryKey = col.Name
+				primaryKey = []string{col.Name}
 			}
 			cols = append(cols, col)
 			if len(inline) > 0 {
@@ -237,7 +249,55 @@ func (p *Parser) parseCreateTable() (Statement, error) {
 	}
 	p.nextToken()
 
-	return &CreateTableStmt{Name: name, Columns: cols, PrimaryKey: primaryKey, ForeignKeys: foreignKeys}, nil
+	stmt := &CreateTableStmt{Name: name, Columns: cols, PrimaryKey: primaryKey, PrimaryKeyName: primaryKeyName, ForeignKeys: foreignKeys}
+	if strings.ToUpper(p.curToken.Literal) == "WITH" {
+		p.nextToken()
+		if err := p.parseTableOptions(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// parseTableOptions parses the storage parameters of CREATE TABLE ... WITH
+// (name = value, ...).
+func (p *Parser) parseTableOptions(stmt *CreateTableStmt) error {
+	if p.curToken.Type != lexer.LParen {
+		return fmt.Errorf("parser: expected ( after WITH")
+	}
+	p.nextToken()
+	for {
+		if p.curToken.Type != lexer.Ident {
+			return fmt.Errorf("parser: expected table option name but found %s", p.curToken.Literal)
+		}
+		option := strings.ToLower(p.curToken.Literal)
+		p.nextToken()
+		if p.curToken.Type != lexer.Equal {
+			return fmt.Errorf("parser: expected = after table option %s", option)
+		}
+		p.nextToken()
+		if p.curToken.Type != lexer.String && p.curToken.Type != lexer.Ident {
+			return fmt.Errorf("parser: expected a value for table option %s", option)
+		}
+		value := p.curToken.Literal
+		p.nextToken()
+		switch option {
+		case "compression":
+			stmt.Compression = value
+		default:
+			return fmt.Errorf("parser: unknown table option %s", option)
+		}
+		if p.curToken.Type == lexer.Comma {
+			p.nextToken()
+			continue
+		}
+		break
+	}
+	if p.curToken.Type != lexer.RParen {
+		return fmt.Errorf("parser: expected ) to close table options")
+	}
+	p.nextToken()
+	return nil
 }
 
 func (p *Parser) parseCreateIndex(unique bool) (Statement, error) {
@@ -261,14 +321,65 @@ func (p *Parser) parseCreateIndex(unique bool) (Statement, error) {
 		return nil, fmt.Errorf("parser: expected column list for CREATE INDEX")
 	}
 	p.nextToken()
-	columns, err := p.parseIdentifierList()
+	columns, descending, err := p.parseIndexColumnList()
 	if err != nil {
 		return nil, err
 	}
 	if len(columns) == 0 {
 		return nil, fmt.Errorf("parser: CREATE INDEX requires at least one column")
 	}
-	return &CreateIndexStmt{Name: name, Table: table, Columns: columns, Unique: unique}, nil
+	var include []string
+	if strings.ToUpper(p.curToken.Literal) == "INCLUDE" {
+		p.nextToken()
+		if p.curToken.Type != lexer.LParen {
+			return nil, fmt.Errorf("parser: expected ( after INCLUDE")
+		}
+		p.nextToken()
+		include, err = p.parseIdentifierList()
+		if err != nil {
+			return nil, err
+		}
+	}
+	seen := make(map[string]struct{}, len(columns)+len(include))
+	for _, column := range append(append([]string{}, columns...), include...) {
+		if _, dup := seen[strings.ToLower(column)]; dup {
+			return nil, fmt.Errorf("parser: column %s appears more than once in index %s", column, name)
+		}
+		seen[strings.ToLower(column)] = struct{}{}
+	}
+	return &CreateIndexStmt{Name: name, Table: table, Columns: columns, Descending: descending, Include: include, Unique: unique}, nil
+}
+
+// parseIndexColumnList parses the key columns of CREATE INDEX, each with an
+// optional ASC or DESC, up to and including the closing parenthesis.
+func (p *Parser) parseIndexColumnList() ([]string, []bool, error) {
+	var columns []string
+	var descending []bool
+	for {
+		if p.curToken.Type != lexer.Ident {
+			return nil, nil, fmt.Errorf("parser: expected column name in CREATE INDEX")
+		}
+		columns = append(columns, p.curToken.Literal)
+		p.nextToken()
+		desc := false
+		switch strings.ToUpper(p.curToken.Literal) {
+		case "ASC":
+			p.nextToken()
+		case "DESC":
+			desc = true
+			p.nextToken()
+		}
+		descending = append(descending, desc)
+		if p.curToken.Type == lexer.Comma {
+			p.nextToken()
+			continue
+		}
+		if p.curToken.Type == lexer.RParen {
+			p.nextToken()
+			return columns, descending, nil
+		}
+		return nil, nil, fmt.Errorf("parser: unexpected token in CREATE INDEX column list: %s", p.curToken.Literal)
+	}
 }
 
 func (p *Parser) parseColumnDef() (ColumnDef, []ForeignKeyDef, error) {
@@ -336,27 +447,32 @@ func (p *Parser) parseColumnDef() (ColumnDef, []ForeignKeyDef, error) {
 	}
 }
 
-func (p *Parser) parsePrimaryKeyClause() (string, error) {
+func (p *Parser) parsePrimaryKeyClause() ([]string, error) {
 	if err := p.consumeKeyword("PRIMARY"); err != nil {
-		return "", err
+		return nil, err
 	}
 	if err := p.consumeKeyword("KEY"); err != nil {
-		return "", err
+		return nil, err
 	}
 	if p.curToken.Type != lexer.LParen {
-		return "", fmt.Errorf("parser: expected ( after PRIMARY KEY")
+		return nil, fmt.Errorf("parser: expected ( after PRIMARY KEY")
 	}
 	p.nextToken()
 	if p.curToken.Type != lexer.Ident {
-		return "", fmt.Errorf("parser: expected column name in PRIMARY KEY")
+		return nil, fmt.Errorf("parser: expected column name in PRIMARY KEY")
 	}
-	column := p.curToken.Literal
-	p.nextToken()
-	if p.curToken.Type != lexer.RParen {
-		return "", fmt.Errorf("parser: expected ) after PRIMARY KEY column")
+	columns, err := p.parseIdentifierList()
+	if err != nil {
+		return nil, err
 	}
-	p.nextToken()
-	return column, nil
+	seen := make(map[string]struct{}, len(columns))
+	for _, column := range columns {
+		if _, dup := seen[strings.ToLower(column)]; dup {
+			return nil, fmt.Errorf("parser: column %s appears more than once in PRIMARY KEY", column)
+		}
+		seen[strings.ToLower(column)] = struct{}{}
+	}
+	return columns, nil
 }
 
 func (p *Parser) parseTableForeignKey(name string) (ForeignKeyDef, error) {
@@ -569,6 +685,178 @@ func (p *Parser) parseDrop() (Statement, error) {
 	}
 }
 
+func (p *Parser) parsePragma() (Statement, error) {
+	if err := p.consumeKeyword("PRAGMA"); err != nil {
+		return nil, err
+	}
+	if p.curToken.Type != lexer.Ident {
+		return nil, fmt.Errorf("parser: expected pragma name after PRAGMA")
+	}
+	stmt := &PragmaStmt{Name: strings.ToLower(p.curToken.Literal)}
+	p.nextToken()
+	return stmt, nil
+}
+
+func (p *Parser) parseSet() (Statement, error) {
+	if err := p.consumeKeyword("SET"); err != nil {
+		return nil, err
+	}
+	if p.curToken.Type != lexer.Ident {
+		return nil, fmt.Errorf("parser: expected setting name after SET")
+	}
+	stmt := &SetStmt{Name: strings.ToLower(p.curToken.Literal)}
+	p.nextToken()
+	if p.curToken.Type != lexer.Equal && strings.ToUpper(p.curToken.Literal) != "TO" {
+		return nil, fmt.Errorf("parser: expected = or TO after SET %s", stmt.Name)
+	}
+	p.nextToken()
+	switch p.curToken.Type {
+	case lexer.Ident, lexer.String, lexer.Number:
+		stmt.Value = p.curToken.Literal
+	default:
+		return nil, fmt.Errorf("parser: expected a value for SET %s", stmt.Name)
+	}
+	p.nextToken()
+	return stmt, nil
+}
+
+func (p *Parser) parseCopy() (Statement, error) {
+	if err := p.consumeKeyword("COPY"); err != nil {
+		return nil, err
+	}
+	if p.curToken.Type != lexer.Ident {
+		return nil, fmt.Errorf("parser: expected table name after COPY")
+	}
+	stmt := &CopyStmt{Table: p.curToken.Literal, Format: "csv", Delimiter: ','}
+	p.nextToken()
+	if p.curToken.Type == lexer.LParen {
+		p.nextToken()
+		columns, err := p.parseIdentifierList()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = columns
+	}
+	if err := p.consumeKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if p.curToken.Type != lexer.String {
+		return nil, fmt.Errorf("parser: expected a quoted file name after COPY %s FROM", stmt.Table)
+	}
+	stmt.Path = p.curToken.Literal
+	p.nextToken()
+	if strings.ToUpper(p.curToken.Literal) == "WITH" {
+		p.nextToken()
+		if err := p.parseCopyOptions(stmt); err != nil {
+			return nil, err
+		}
+	}
+	if stmt.Format != "csv" && (stmt.Header || stmt.Delimiter != ',') {
+		return nil, fmt.Errorf("parser: HEADER and DELIMITER only apply to FORMAT csv")
+	}
+	return stmt, nil
+}
+
+// parseCopyOptions parses the options of COPY ... WITH (name [value], ...).
+// The value may also follow an =, and a bare HEADER means HEADER true.
+func (p *Parser) parseCopyOptions(stmt *CopyStmt) error {
+	if p.curToken.Type != lexer.LParen {
+		return fmt.Errorf("parser: expected ( after WITH")
+	}
+	p.nextToken()
+	for {
+		if p.curToken.Type != lexer.Ident {
+			return fmt.Errorf("parser: expected COPY option name but found %s", p.curToken.Literal)
+		}
+		option := strings.ToLower(p.curToken.Literal)
+		p.nextToken()
+		if p.curToken.Type == lexer.Equal {
+			p.nextToken()
+		}
+		value, hasValue := "", false
+		switch p.curToken.Type {
+		case lexer.Ident, lexer.String, lexer.Number:
+			value, hasValue = p.curToken.Literal, true
+			p.nextToken()
+		}
+		switch option {
+		case "format":
+			format := strings.ToLower(value)
+			if format != "csv" && format != "ndjson" {
+				return fmt.Errorf("parser: unknown COPY format %q; use csv or ndjson", value)
+			}
+			stmt.Format = format
+		case "header":
+			switch strings.ToLower(value) {
+			case "", "true", "on", "1":
+				stmt.Header = true
+			case "false", "off", "0":
+				stmt.Header = false
+			default:
+				return fmt.Errorf("parser: invalid HEADER value %q", value)
+			}
+		case "delimiter":
+			if value == `\t` {
+				value = "\t"
+			}
+			runes := []rune(value)
+			if !hasValue || len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+				return fmt.Errorf("parser: DELIMITER must be a single character")
+			}
+			stmt.Delimiter = runes[0]
+		default:
+			return fmt.Errorf("parser: unknown COPY option %s", option)
+		}
+		if p.curToken.Type == lexer.Comma {
+			p.nextToken()
+			continue
+		}
+		break
+	}
+	if p.curToken.Type != lexer.RParen {
+		return fmt.Errorf("parser: expected ) to close COPY options")
+	}
+	p.nextToken()
+	return nil
+}
+
+func (p *Parser) parseTruncate() (Statement, error) {
+	if err := p.consumeKeyword("TRUNCATE"); err != nil {
+		return nil, err
+	}
+	if strings.ToUpper(p.curToken.Literal) == "TABLE" {
+		p.nextToken()
+	}
+	stmt := &TruncateStmt{}
+	for {
+		if p.curToken.Type != lexer.Ident {
+			return nil, fmt.Errorf("parser: expected table name after TRUNCATE")
+		}
+		stmt.Tables = append(stmt.Tables, p.curToken.Literal)
+		p.nextToken()
+		if p.curToken.Type != lexer.Comma {
+			break
+		}
+		p.nextToken()
+	}
+	switch strings.ToUpper(p.curToken.Literal) {
+	case "RESTART", "CONTINUE":
+		stmt.RestartIdentity = strings.ToUpper(p.curToken.Literal) == "RESTART"
+		p.nextToken()
+		if err := p.consumeKeyword("IDENTITY"); err != nil {
+			return nil, err
+		}
+	}
+	switch strings.ToUpper(p.curToken.Literal) {
+	case "CASCADE":
+		stmt.Cascade = true
+		p.nextToken()
+	case "RESTRICT":
+		p.nextToken()
+	}
+	return stmt, nil
+}
+
 func (p *Parser) parseInsert() (Statement, error) {
 	if err := p.consumeKeyword("INSERT"); err != nil {
 		return nil, err
@@ -693,6 +981,26 @@ func (p *Parser) parseDelete() (Statement, error) {
 	return &DeleteStmt{Table: table, Where: where}, nil
 }
 
+func (p *Parser) parseVacuum() (Statement, error) {
+	if err := p.consumeKeyword("VACUUM"); err != nil {
+		return nil, err
+	}
+	stmt := &VacuumStmt{}
+	if p.curToken.Type == lexer.Ident && p.curToken.Literal == "FULL" {
+		stmt.Full = true
+		p.nextToken()
+		if p.curToken.Type == lexer.Ident {
+			return nil, fmt.Errorf("parser: VACUUM FULL compacts the whole database and takes no table name")
+		}
+		return stmt, nil
+	}
+	if p.curToken.Type == lexer.Ident {
+		stmt.Table = p.curToken.Literal
+		p.nextToken()
+	}
+	return stmt, nil
+}
+
 func (p *Parser) parseSelect() (Statement, error) {
 	if err := p.consumeKeyword("SELECT"); err != nil {
 		return nil, err
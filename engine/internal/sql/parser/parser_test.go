@@ -1,6 +1,7 @@
 package parser_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/example/granite-db/engine/internal/sql/parser"
@@ -186,8 +187,8 @@ func TestCreateTableInlinePrimaryKey(t *testing.T) {
 		t.Fatalf("parse: %v", err)
 	}
 	create := stmt.(*parser.CreateTableStmt)
-	if create.PrimaryKey != "id" {
-		t.Fatalf("expected primary key id, got %s", create.PrimaryKey)
+	if len(create.PrimaryKey) != 1 || create.PrimaryKey[0] != "id" {
+		t.Fatalf("expected primary key id, got %v", create.PrimaryKey)
 	}
 	if len(create.Columns) != 2 {
 		t.Fatalf("expected 2 columns, got %d", len(create.Columns))
@@ -197,6 +198,42 @@ func TestCreateTableInlinePrimaryKey(t *testing.T) {
 	}
 }
 
+func TestCreateTableCompositePrimaryKey(t *testing.T) {
+	stmt, err := parser.Parse("CREATE TABLE t(a INT, b INT, CONSTRAINT pk_ab PRIMARY KEY (b, a));")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	create := stmt.(*parser.CreateTableStmt)
+	if len(create.PrimaryKey) != 2 || create.PrimaryKey[0] != "b" || create.PrimaryKey[1] != "a" {
+		t.Fatalf("expected primary key (b, a), got %v", create.PrimaryKey)
+	}
+	if create.PrimaryKeyName != "pk_ab" {
+		t.Fatalf("expected constraint name pk_ab, got %q", create.PrimaryKeyName)
+	}
+	for _, sql := range []string{
+		"CREATE TABLE t(a INT, b INT, PRIMARY KEY (a, a));",
+		"CREATE TABLE t(a INT PRIMARY KEY, b INT, PRIMARY KEY (a, b));",
+		"CREATE TABLE t(a INT, PRIMARY KEY ());",
+	} {
+		if _, err := parser.Parse(sql); err == nil {
+			t.Fatalf("expected %q to be rejected", sql)
+		}
+	}
+}
+
+func TestCreateTableWithCompression(t *testing.T) {
+	stmt, err := parser.Parse("CREATE TABLE logs(id INT, body VARCHAR(200)) WITH (compression = 'lz4');")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if create := stmt.(*parser.CreateTableStmt); create.Compression != "lz4" {
+		t.Fatalf("expected lz4 compression, got %q", create.Compression)
+	}
+	if _, err := parser.Parse("CREATE TABLE logs(id INT) WITH (fillfactor = 70)"); err == nil {
+		t.Fatalf("expected unknown table option to be rejected")
+	}
+}
+
 func TestCreateTableForeignKeyParsing(t *testing.T) {
 	sql := `CREATE TABLE order_items(
                 id INT PRIMARY KEY,
@@ -427,6 +464,40 @@ func TestCreateUniqueIndexParsing(t *testing.T) {
 	}
 }
 
+func TestCreateIndexKeyDirections(t *testing.T) {
+	stmt, err := parser.Parse("CREATE INDEX idx_recent ON events(kind ASC, created DESC, id);")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	create := stmt.(*parser.CreateIndexStmt)
+	if len(create.Columns) != 3 || create.Columns[1] != "created" {
+		t.Fatalf("unexpected columns: %+v", create.Columns)
+	}
+	if len(create.Descending) != 3 || create.Descending[0] || !create.Descending[1] || create.Descending[2] {
+		t.Fatalf("unexpected directions: %+v", create.Descending)
+	}
+	if _, err := parser.Parse("CREATE INDEX idx ON events(created DESC DESC);"); err == nil {
+		t.Fatalf("expected a repeated direction to fail")
+	}
+}
+
+func TestCreateIndexInclude(t *testing.T) {
+	stmt, err := parser.Parse("CREATE UNIQUE INDEX idx_users_email ON users(email) INCLUDE (name, id);")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	create := stmt.(*parser.CreateIndexStmt)
+	if !create.Unique || len(create.Columns) != 1 || len(create.Include) != 2 || create.Include[0] != "name" || create.Include[1] != "id" {
+		t.Fatalf("unexpected statement: %+v", create)
+	}
+	if _, err := parser.Parse("CREATE INDEX idx ON users(email) INCLUDE (Email);"); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatalf("expected a key column in INCLUDE to fail, got %v", err)
+	}
+	if _, err := parser.Parse("CREATE INDEX idx ON users(email) INCLUDE name;"); err == nil {
+		t.Fatalf("expected INCLUDE without parentheses to fail")
+	}
+}
+
 func TestDropIndexParsing(t *testing.T) {
 	stmt, err := parser.Parse("DROP INDEX idx_total;")
 	if err != nil {
@@ -447,6 +518,117 @@ func TestCreateIndexRequiresColumn(t *testing.T) {
 	}
 }
 
+func TestVacuumFullParsing(t *testing.T) {
+	stmt, err := parser.Parse("VACUUM FULL;")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	vacuum, ok := stmt.(*parser.VacuumStmt)
+	if !ok {
+		t.Fatalf("expected VacuumStmt, got %T", stmt)
+	}
+	if !vacuum.Full || vacuum.Table != "" {
+		t.Fatalf("unexpected statement %+v", vacuum)
+	}
+	if _, err := parser.Parse("VACUUM FULL orders"); err == nil {
+		t.Fatalf("expected VACUUM FULL with a table name to fail")
+	}
+}
+
+func TestTruncateParsing(t *testing.T) {
+	stmt, err := parser.Parse("TRUNCATE TABLE orders, order_items RESTART IDENTITY CASCADE;")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	truncate, ok := stmt.(*parser.TruncateStmt)
+	if !ok {
+		t.Fatalf("expected TruncateStmt, got %T", stmt)
+	}
+	if len(truncate.Tables) != 2 || truncate.Tables[0] != "orders" || truncate.Tables[1] != "order_items" {
+		t.Fatalf("unexpected tables %v", truncate.Tables)
+	}
+	if !truncate.RestartIdentity || !truncate.Cascade {
+		t.Fatalf("unexpected options %+v", truncate)
+	}
+	stmt, err = parser.Parse("TRUNCATE orders CONTINUE IDENTITY RESTRICT")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if truncate := stmt.(*parser.TruncateStmt); truncate.RestartIdentity || truncate.Cascade {
+		t.Fatalf("unexpected options %+v", truncate)
+	}
+	if _, err := parser.Parse("TRUNCATE TABLE"); err == nil {
+		t.Fatalf("expected TRUNCATE without a table to fail")
+	}
+}
+
+func TestPragmaParsing(t *testing.T) {
+	stmt, err := parser.Parse("PRAGMA Integrity_Check;")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	pragma, ok := stmt.(*parser.PragmaStmt)
+	if !ok {
+		t.Fatalf("expected PragmaStmt, got %T", stmt)
+	}
+	if pragma.Name != "integrity_check" {
+		t.Fatalf("unexpected pragma %q", pragma.Name)
+	}
+	if _, err := parser.Parse("PRAGMA"); err == nil {
+		t.Fatalf("expected PRAGMA without a name to fail")
+	}
+}
+
+func TestCopyParsing(t *testing.T) {
+	stmt, err := parser.Parse(`COPY orders (id, total) FROM 'orders.tsv' WITH (FORMAT csv, HEADER, DELIMITER '\t')`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	cp, ok := stmt.(*parser.CopyStmt)
+	if !ok {
+		t.Fatalf("expected CopyStmt, got %T", stmt)
+	}
+	if cp.Table != "orders" || len(cp.Columns) != 2 || cp.Path != "orders.tsv" || cp.Format != "csv" || !cp.Header || cp.Delimiter != '\t' {
+		t.Fatalf("unexpected statement %+v", cp)
+	}
+	stmt, err = parser.Parse("COPY orders FROM 'orders.ndjson' WITH (FORMAT = ndjson)")
+	if err != nil {
+		t.Fatalf("parse ndjson: %v", err)
+	}
+	if cp := stmt.(*parser.CopyStmt); cp.Format != "ndjson" || cp.Header || cp.Delimiter != ',' {
+		t.Fatalf("unexpected statement %+v", cp)
+	}
+	for _, sql := range []string{
+		"COPY orders FROM orders.csv",
+		"COPY orders FROM 'orders.csv' WITH (FORMAT xml)",
+		"COPY orders FROM 'orders.csv' WITH (DELIMITER ';;')",
+		"COPY orders FROM 'orders.ndjson' WITH (FORMAT ndjson, HEADER)",
+	} {
+		if _, err := parser.Parse(sql); err == nil {
+			t.Fatalf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestSetParsing(t *testing.T) {
+	for _, sql := range []string{"SET synchronous = off", "SET Synchronous TO 'OFF';"} {
+		stmt, err := parser.Parse(sql)
+		if err != nil {
+			t.Fatalf("parse %q: %v", sql, err)
+		}
+		set, ok := stmt.(*parser.SetStmt)
+		if !ok {
+			t.Fatalf("expected SetStmt, got %T", stmt)
+		}
+		if set.Name != "synchronous" || (set.Value != "off" && set.Value != "OFF") {
+			t.Fatalf("unexpected setting %+v", set)
+		}
+	}
+	if _, err := parser.Parse("SET synchronous"); err == nil {
+		t.Fatalf("expected SET without a value to fail")
+	}
+}
+
 func TestTransactionStatementParsing(t *testing.T) {
 	cases := map[string]func(parser.Statement) bool{
 		"BEGIN": func(stmt parser.Statement) bool {
@@ -0,0 +1,653 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// Index entries live in B+trees whose nodes are pages of the data file. Every
+// node starts with a 16-byte header:
+//
+//	0..4   leaf: the next leaf in key order, or 0 for the last one;
+//	       internal: the leftmost child
+//	4..6   the number of entries
+//	8      the node kind (btreeLeaf or btreeInternal)
+//	10..16 reserved, like on every page, for compression and the checksum
+//
+// followed by the entries. A leaf entry is a 2-byte key length, the key and
+// the RowID it points at (4-byte page, 2-byte slot). An internal entry is a
+// separator in the same form followed by the child holding the entries at or
+// above it. Entries are ordered by key and then by RowID, so that the
+// duplicate keys of a non-unique index each have their place.
+//
+// The root keeps its page for the lifetime of the tree, so the catalogue only
+// records that page: a root that splits moves its two halves into new pages
+// and becomes their parent, and a root left with a single child takes over
+// the child's contents.
+//
+// Changes made under a transaction log every node they rewrite, like heap
+// changes, and hand the nodes they free to the transaction to release once it
+// has ended. Recovery can then redo or undo the tree along with the heap.
+const (
+	btreeLeaf     = 1
+	btreeInternal = 2
+
+	btreeHeaderSize = 16
+	btreeKindOffset = 8
+	btreeRowSize    = 6
+	btreeChildSize  = 4
+)
+
+type btreeEntry struct {
+	key []byte
+	row RowID
+}
+
+// btreeNode is the decoded form of a node. Internal nodes have one more child
+// than entries.
+type btreeNode struct {
+	leaf     bool
+	next     PageID
+	entries  []btreeEntry
+	children []PageID
+}
+
+// btreeSplit describes the new right sibling created by a split, together
+// with the separator the parent needs for it.
+type btreeSplit struct {
+	sep   btreeEntry
+	right PageID
+}
+
+func compareEntries(a, b btreeEntry) int {
+	if cmp := bytes.Compare(a.key, b.key); cmp != 0 {
+		return cmp
+	}
+	switch {
+	case a.row.Page != b.row.Page:
+		if a.row.Page < b.row.Page {
+			return -1
+		}
+		return 1
+	case a.row.Slot < b.row.Slot:
+		return -1
+	case a.row.Slot > b.row.Slot:
+		return 1
+	}
+	return 0
+}
+
+func (n *btreeNode) entrySize(e btreeEntry) int {
+	size := 2 + len(e.key) + btreeRowSize
+	if !n.leaf {
+		size += btreeChildSize
+	}
+	return size
+}
+
+func (n *btreeNode) size() int {
+	size := btreeHeaderSize
+	for _, e := range n.entries {
+		size += n.entrySize(e)
+	}
+	return size
+}
+
+// childFor returns the child an entry belongs under.
+func (n *btreeNode) childFor(e btreeEntry) int {
+	return sort.Search(len(n.entries), func(i int) bool {
+		return compareEntries(n.entries[i], e) > 0
+	})
+}
+
+// firstChildFor returns the leftmost child that may hold key.
+func (n *btreeNode) firstChildFor(key []byte) int {
+	return sort.Search(len(n.entries), func(i int) bool {
+		return bytes.Compare(n.entries[i].key, key) >= 0
+	})
+}
+
+// splitPoint returns where to divide an overfull node: the first entry past
+// half of its bytes, leaving at least one entry on either side (two on the
+// right of an internal node, whose middle entry moves up).
+func (n *btreeNode) splitPoint() int {
+	half := (n.size() - btreeHeaderSize) / 2
+	at, used := 0, 0
+	for at < len(n.entries)-1 && used < half {
+		used += n.entrySize(n.entries[at])
+		at++
+	}
+	limit := len(n.entries) - 1
+	if !n.leaf {
+		limit--
+	}
+	return max(1, min(at, limit))
+}
+
+// divide splits a node at entry at. A leaf keeps entries before at and
+// separates the halves with the first entry on the right; an internal node
+// moves entry at up to the parent.
+func (n *btreeNode) divide(at int) (*btreeNode, *btreeNode, btreeEntry) {
+	left := &btreeNode{leaf: n.leaf}
+	right := &btreeNode{leaf: n.leaf}
+	if n.leaf {
+		left.entries = slices.Clone(n.entries[:at])
+		right.entries = slices.Clone(n.entries[at:])
+		return left, right, right.entries[0]
+	}
+	left.entries = slices.Clone(n.entries[:at])
+	left.children = slices.Clone(n.children[:at+1])
+	right.entries = slices.Clone(n.entries[at+1:])
+	right.children = slices.Clone(n.children[at+1:])
+	return left, right, n.entries[at]
+}
+
+// mergeNodes joins two siblings and the separator between them.
+func mergeNodes(left *btreeNode, sep btreeEntry, right *btreeNode) *btreeNode {
+	merged := &btreeNode{leaf: left.leaf}
+	merged.entries = append(slices.Clone(left.entries), right.entries...)
+	if left.leaf {
+		merged.next = right.next
+		return merged
+	}
+	merged.entries = slices.Insert(merged.entries, len(left.entries), sep)
+	merged.children = append(slices.Clone(left.children), right.children...)
+	return merged
+}
+
+func decodeBTreeNode(id PageID, page []byte) (*btreeNode, error) {
+	kind := page[btreeKindOffset]
+	if kind != btreeLeaf && kind != btreeInternal {
+		return nil, fmt.Errorf("storage: page %d is not an index page", id)
+	}
+	n := &btreeNode{leaf: kind == btreeLeaf}
+	first := PageID(binary.LittleEndian.Uint32(page[0:4]))
+	count := int(binary.LittleEndian.Uint16(page[4:6]))
+	if n.leaf {
+		n.next = first
+	} else {
+		n.children = make([]PageID, 1, count+1)
+		n.children[0] = first
+	}
+	n.entries = make([]btreeEntry, 0, count)
+	offset := btreeHeaderSize
+	for i := 0; i < count; i++ {
+		if offset+2 > len(page) {
+			return nil, fmt.Errorf("storage: index page %d is corrupt", id)
+		}
+		keyLen := int(binary.LittleEndian.Uint16(page[offset:]))
+		offset += 2
+		end := offset + keyLen + btreeRowSize
+		if !n.leaf {
+			end += btreeChildSize
+		}
+		if end > len(page) {
+			return nil, fmt.Errorf("storage: index page %d is corrupt", id)
+		}
+		key := make([]byte, keyLen)
+		copy(key, page[offset:])
+		offset += keyLen
+		row := RowID{Page: PageID(binary.LittleEndian.Uint32(page[offset:])), Slot: binary.LittleEndian.Uint16(page[offset+4:])}
+		offset += btreeRowSize
+		n.entries = append(n.entries, btreeEntry{key: key, row: row})
+		if !n.leaf {
+			n.children = append(n.children, PageID(binary.LittleEndian.Uint32(page[offset:])))
+			offset += btreeChildSize
+		}
+	}
+	return n, nil
+}
+
+func (n *btreeNode) encode(page []byte) {
+	clear(page)
+	if n.leaf {
+		page[btreeKindOffset] = btreeLeaf
+		binary.LittleEndian.PutUint32(page[0:4], uint32(n.next))
+	} else {
+		page[btreeKindOffset] = btreeInternal
+		binary.LittleEndian.PutUint32(page[0:4], uint32(n.children[0]))
+	}
+	binary.LittleEndian.PutUint16(page[4:6], uint16(len(n.entries)))
+	offset := btreeHeaderSize
+	for i, e := range n.entries {
+		binary.LittleEndian.PutUint16(page[offset:], uint16(len(e.key)))
+		offset += 2
+		offset += copy(page[offset:], e.key)
+		binary.LittleEndian.PutUint32(page[offset:], uint32(e.row.Page))
+		binary.LittleEndian.PutUint16(page[offset+4:], e.row.Slot)
+		offset += btreeRowSize
+		if !n.leaf {
+			binary.LittleEndian.PutUint32(page[offset:], uint32(n.children[i+1]))
+			offset += btreeChildSize
+		}
+	}
+}
+
+// BTree is the B+tree holding the entries of one index.
+type BTree struct {
+	manager *Manager
+	root    PageID
+}
+
+// CreateBTree allocates the root page of a new, empty tree.
+func CreateBTree(mgr *Manager) (*BTree, error) {
+	id, _, err := mgr.AllocatePage()
+	if err != nil {
+		return nil, err
+	}
+	t := &BTree{manager: mgr, root: id}
+	if err := t.write(nil, nil, id, &btreeNode{leaf: true}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenBTree returns the tree whose root is at the given page.
+func OpenBTree(mgr *Manager, root PageID) *BTree {
+	return &BTree{manager: mgr, root: root}
+}
+
+// Root returns the page holding the root node.
+func (t *BTree) Root() PageID {
+	return t.root
+}
+
+// MaxKeySize returns the longest key a tree on pages of the given size
+// accepts, which guarantees that every node holds at least four entries.
+func MaxKeySize(pageSize int) int {
+	return (pageSize-btreeHeaderSize)/4 - 2 - btreeRowSize - btreeChildSize
+}
+
+// MaxKeySize returns the longest key the tree accepts.
+func (t *BTree) MaxKeySize() int {
+	return MaxKeySize(t.manager.pageSize)
+}
+
+func (t *BTree) checkKey(key []byte) error {
+	if limit := t.MaxKeySize(); len(key) > limit {
+		return fmt.Errorf("storage: index key of %d bytes exceeds the limit of %d bytes", len(key), limit)
+	}
+	return nil
+}
+
+func (t *BTree) read(id PageID) (*btreeNode, error) {
+	page, err := t.manager.ReadPage(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBTreeNode(id, page)
+}
+
+func (t *BTree) write(tx *txn.Transaction, log *wal.Manager, id PageID, n *btreeNode) error {
+	page := make([]byte, t.manager.pageSize)
+	n.encode(page)
+	return persistPage(tx, log, t.manager, wal.RecordIndexPage, id, page)
+}
+
+// minNodeSize is the size below which a node is merged with, or refilled
+// from, a sibling after a delete.
+func (t *BTree) minNodeSize() int {
+	return btreeHeaderSize + (t.manager.pageSize-btreeHeaderSize)/4
+}
+
+// Insert adds an entry to the tree. Only the nodes on the path to its leaf
+// are rewritten, plus the new siblings of any that split.
+func (t *BTree) Insert(tx *txn.Transaction, log *wal.Manager, key []byte, row RowID) error {
+	if err := t.checkKey(key); err != nil {
+		return err
+	}
+	split, err := t.insert(tx, log, t.root, btreeEntry{key: slices.Clone(key), row: row})
+	if err != nil || split == nil {
+		return err
+	}
+	// The root split in place: move its left half out so that the root
+	// page can become the parent of both halves.
+	page, err := t.manager.ReadPage(t.root)
+	if err != nil {
+		return err
+	}
+	left, _, err := t.manager.AllocatePage()
+	if err != nil {
+		return err
+	}
+	if err := persistPage(tx, log, t.manager, wal.RecordIndexPage, left, page); err != nil {
+		return err
+	}
+	return t.write(tx, log, t.root, &btreeNode{entries: []btreeEntry{split.sep}, children: []PageID{left, split.right}})
+}
+
+func (t *BTree) insert(tx *txn.Transaction, log *wal.Manager, id PageID, e btreeEntry) (*btreeSplit, error) {
+	n, err := t.read(id)
+	if err != nil {
+		return nil, err
+	}
+	var pos int
+	if n.leaf {
+		pos = n.childFor(e)
+		n.entries = slices.Insert(n.entries, pos, e)
+	} else {
+		child := n.childFor(e)
+		split, err := t.insert(tx, log, n.children[child], e)
+		if err != nil || split == nil {
+			return nil, err
+		}
+		pos = child
+		n.entries = slices.Insert(n.entries, child, split.sep)
+		n.children = slices.Insert(n.children, child+1, split.right)
+	}
+	if n.size() <= t.manager.pageSize {
+		return nil, t.write(tx, log, id, n)
+	}
+	// Keys that arrive in ascending order always land at the end of the
+	// rightmost node; splitting off just the last entry leaves full nodes
+	// behind instead of half-empty ones.
+	at := n.splitPoint()
+	if pos == len(n.entries)-1 && (!n.leaf || n.next == 0) {
+		at = len(n.entries) - 1
+		if !n.leaf {
+			at--
+		}
+	}
+	return t.split(tx, log, id, n, at)
+}
+
+// split divides an overfull node, keeping the left half in its page.
+func (t *BTree) split(tx *txn.Transaction, log *wal.Manager, id PageID, n *btreeNode, at int) (*btreeSplit, error) {
+	rightID, _, err := t.manager.AllocatePage()
+	if err != nil {
+		return nil, err
+	}
+	left, right, sep := n.divide(at)
+	if n.leaf {
+		right.next = n.next
+		left.next = rightID
+	}
+	if err := t.write(tx, log, rightID, right); err != nil {
+		return nil, err
+	}
+	if err := t.write(tx, log, id, left); err != nil {
+		return nil, err
+	}
+	return &btreeSplit{sep: sep, right: rightID}, nil
+}
+
+// Delete removes an entry, reporting whether it was present. Nodes left less
+// than a quarter full are merged with a sibling, or refilled from one when
+// the two do not fit in a page.
+func (t *BTree) Delete(tx *txn.Transaction, log *wal.Manager, key []byte, row RowID) (bool, error) {
+	found, err := t.remove(tx, log, t.root, btreeEntry{key: key, row: row})
+	if err != nil || !found {
+		return found, err
+	}
+	for {
+		root, err := t.read(t.root)
+		if err != nil {
+			return true, err
+		}
+		if root.leaf || len(root.entries) > 0 {
+			return true, nil
+		}
+		// A merge left the root with one child: pull the child up.
+		child := root.children[0]
+		page, err := t.manager.ReadPage(child)
+		if err != nil {
+			return true, err
+		}
+		if err := persistPage(tx, log, t.manager, wal.RecordIndexPage, t.root, page); err != nil {
+			return true, err
+		}
+		if err := t.manager.ReleasePages(tx, log, child); err != nil {
+			return true, err
+		}
+	}
+}
+
+func (t *BTree) remove(tx *txn.Transaction, log *wal.Manager, id PageID, e btreeEntry) (bool, error) {
+	n, err := t.read(id)
+	if err != nil {
+		return false, err
+	}
+	if n.leaf {
+		i := sort.Search(len(n.entries), func(i int) bool {
+			return compareEntries(n.entries[i], e) >= 0
+		})
+		if i == len(n.entries) || compareEntries(n.entries[i], e) != 0 {
+			return false, nil
+		}
+		n.entries = slices.Delete(n.entries, i, i+1)
+		return true, t.write(tx, log, id, n)
+	}
+	child := n.childFor(e)
+	found, err := t.remove(tx, log, n.children[child], e)
+	if err != nil || !found {
+		return false, err
+	}
+	return true, t.rebalance(tx, log, id, n, child)
+}
+
+// rebalance fixes up the child of parent at index i after a delete if it has
+// become too small.
+func (t *BTree) rebalance(tx *txn.Transaction, log *wal.Manager, id PageID, parent *btreeNode, i int) error {
+	child, err := t.read(parent.children[i])
+	if err != nil {
+		return err
+	}
+	if child.size() >= t.minNodeSize() {
+		return nil
+	}
+	if i == len(parent.children)-1 {
+		i--
+	}
+	leftID, rightID := parent.children[i], parent.children[i+1]
+	left, err := t.read(leftID)
+	if err != nil {
+		return err
+	}
+	right, err := t.read(rightID)
+	if err != nil {
+		return err
+	}
+	merged := mergeNodes(left, parent.entries[i], right)
+	if merged.size() <= t.manager.pageSize {
+		if err := t.write(tx, log, leftID, merged); err != nil {
+			return err
+		}
+		if err := t.manager.ReleasePages(tx, log, rightID); err != nil {
+			return err
+		}
+		parent.entries = slices.Delete(parent.entries, i, i+1)
+		parent.children = slices.Delete(parent.children, i+1, i+2)
+		return t.write(tx, log, id, parent)
+	}
+	left, right, sep := merged.divide(merged.splitPoint())
+	if left.leaf {
+		left.next = rightID
+		right.next = merged.next
+	}
+	parent.entries[i] = sep
+	if parent.size() > t.manager.pageSize {
+		// A longer separator would overflow the parent; an underfull node
+		// is the lesser evil.
+		return nil
+	}
+	if err := t.write(tx, log, leftID, left); err != nil {
+		return err
+	}
+	if err := t.write(tx, log, rightID, right); err != nil {
+		return err
+	}
+	return t.write(tx, log, id, parent)
+}
+
+// BTreeCursor walks the entries of a tree in key order along the leaf chain.
+type BTreeCursor struct {
+	tree  *BTree
+	node  *btreeNode
+	pos   int
+	steps uint32
+}
+
+// Seek returns a cursor on the first entry whose key is not less than key.
+// A nil key starts at the first entry of the tree.
+func (t *BTree) Seek(key []byte) (*BTreeCursor, error) {
+	id := t.root
+	for depth := 0; ; depth++ {
+		n, err := t.read(id)
+		if err != nil {
+			return nil, err
+		}
+		if n.leaf {
+			return &BTreeCursor{tree: t, node: n, pos: n.firstChildFor(key)}, nil
+		}
+		if depth > 64 {
+			return nil, fmt.Errorf("storage: index rooted at page %d loops", t.root)
+		}
+		id = n.children[n.firstChildFor(key)]
+	}
+}
+
+// Next returns the entry under the cursor and advances it. ok is false once
+// the last entry has been returned.
+func (c *BTreeCursor) Next() (key []byte, row RowID, ok bool, err error) {
+	for c.pos >= len(c.node.entries) {
+		if c.node.next == 0 {
+			return nil, RowID{}, false, nil
+		}
+		c.steps++
+		if c.steps > c.tree.manager.InspectHeader().PageCount {
+			return nil, RowID{}, false, fmt.Errorf("storage: leaf chain of the index rooted at page %d loops", c.tree.root)
+		}
+		n, err := c.tree.read(c.node.next)
+		if err != nil {
+			return nil, RowID{}, false, err
+		}
+		c.node, c.pos = n, 0
+	}
+	e := c.node.entries[c.pos]
+	c.pos++
+	return e.key, e.row, true, nil
+}
+
+// Load replaces the contents of the tree with entries, which must be sorted
+// by key and RowID. The old nodes other than the root are freed and the new
+// ones are packed full, bottom up.
+func (t *BTree) Load(tx *txn.Transaction, log *wal.Manager, keys [][]byte, rows []RowID) error {
+	old, err := t.Pages()
+	if err != nil {
+		return err
+	}
+	// Pages lists the root first.
+	if err := t.manager.ReleasePages(tx, log, old[1:]...); err != nil {
+		return err
+	}
+
+	var nodes []*btreeNode
+	current := &btreeNode{leaf: true}
+	for i, key := range keys {
+		if err := t.checkKey(key); err != nil {
+			return err
+		}
+		e := btreeEntry{key: slices.Clone(key), row: rows[i]}
+		if len(current.entries) > 0 && current.size()+current.entrySize(e) > t.manager.pageSize {
+			nodes = append(nodes, current)
+			current = &btreeNode{leaf: true}
+		}
+		current.entries = append(current.entries, e)
+	}
+	nodes = append(nodes, current)
+	if len(nodes) == 1 {
+		return t.write(tx, log, t.root, nodes[0])
+	}
+
+	firsts := make([]btreeEntry, len(nodes))
+	for i, n := range nodes {
+		firsts[i] = n.entries[0]
+	}
+	for len(nodes) > 1 {
+		ids := make([]PageID, len(nodes))
+		for i := range nodes {
+			if ids[i], _, err = t.manager.AllocatePage(); err != nil {
+				return err
+			}
+		}
+		for i, n := range nodes {
+			if n.leaf && i+1 < len(ids) {
+				n.next = ids[i+1]
+			}
+			if err := t.write(tx, log, ids[i], n); err != nil {
+				return err
+			}
+		}
+		nodes, firsts = packInternal(ids, firsts, t.manager.pageSize)
+	}
+	return t.write(tx, log, t.root, nodes[0])
+}
+
+// packInternal builds the level of internal nodes above children, given the
+// first entry under each child, and returns the first entry under each of the
+// new nodes. Every node gets at least two children.
+func packInternal(children []PageID, firsts []btreeEntry, pageSize int) ([]*btreeNode, []btreeEntry) {
+	var nodes []*btreeNode
+	nodeFirsts := []btreeEntry{firsts[0]}
+	current := &btreeNode{children: []PageID{children[0]}}
+	for i := 1; i < len(children); i++ {
+		if current.size()+current.entrySize(firsts[i]) > pageSize {
+			nodes = append(nodes, current)
+			nodeFirsts = append(nodeFirsts, firsts[i])
+			current = &btreeNode{children: []PageID{children[i]}}
+			continue
+		}
+		current.entries = append(current.entries, firsts[i])
+		current.children = append(current.children, children[i])
+	}
+	if len(current.entries) == 0 && len(nodes) > 0 {
+		// A lone child at the end moves in with the last child of the
+		// previous node, which is full and can spare it.
+		prev := nodes[len(nodes)-1]
+		last := len(prev.entries) - 1
+		current.entries = []btreeEntry{nodeFirsts[len(nodeFirsts)-1]}
+		current.children = []PageID{prev.children[last+1], current.children[0]}
+		nodeFirsts[len(nodeFirsts)-1] = prev.entries[last]
+		prev.entries = prev.entries[:last]
+		prev.children = prev.children[:last+1]
+	}
+	return append(nodes, current), nodeFirsts
+}
+
+// Pages returns every page of the tree, the root first.
+func (t *BTree) Pages() ([]PageID, error) {
+	var ids []PageID
+	stack := []PageID{t.root}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if len(ids) > int(t.manager.InspectHeader().PageCount) {
+			return nil, fmt.Errorf("storage: index rooted at page %d loops", t.root)
+		}
+		ids = append(ids, id)
+		n, err := t.read(id)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(n.children) - 1; i >= 0; i-- {
+			stack = append(stack, n.children[i])
+		}
+	}
+	return ids, nil
+}
+
+// Free releases every page of the tree, root included. Under a transaction
+// the pages return to the free list once it has ended.
+func (t *BTree) Free(tx *txn.Transaction, log *wal.Manager) error {
+	pages, err := t.Pages()
+	if err != nil {
+		return err
+	}
+	return t.manager.ReleasePages(tx, log, pages...)
+}
@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/vfs"
+)
+
+func newBTreeFixture(t *testing.T) (*Manager, *BTree) {
+	t.Helper()
+	fsys := vfs.NewMemory()
+	if err := NewWithOptions("btree.gdb", CreateOptions{FS: fsys}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	mgr, err := OpenWithOptions("btree.gdb", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { mgr.Close() })
+	tree, err := CreateBTree(mgr)
+	if err != nil {
+		t.Fatalf("create tree: %v", err)
+	}
+	return mgr, tree
+}
+
+// btreeKey pads the key so that a few dozen fill a page and the tree grows
+// several levels in a test of modest size.
+func btreeKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%05d-%s", i, strings.Repeat("p", 60)))
+}
+
+// collectBTree returns every entry from key onwards, in cursor order.
+func collectBTree(t *testing.T, tree *BTree, key []byte) []btreeEntry {
+	t.Helper()
+	cursor, err := tree.Seek(key)
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	var entries []btreeEntry
+	for {
+		key, row, ok, err := cursor.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if !ok {
+			return entries
+		}
+		entries = append(entries, btreeEntry{key: key, row: row})
+	}
+}
+
+func checkBTree(t *testing.T, mgr *Manager, heaps map[string]*HeapFile, tree *BTree) {
+	t.Helper()
+	report, err := mgr.CheckPages(heaps, []IndexTree{{Table: "t", Index: "idx", Tree: tree}})
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems %+v", report.Problems)
+	}
+}
+
+func TestBTreeInsertSeekDelete(t *testing.T) {
+	mgr, tree := newBTreeFixture(t)
+	const n = 1500
+	order := rand.New(rand.NewSource(1)).Perm(n)
+	for _, i := range order {
+		if err := tree.Insert(nil, nil, btreeKey(i), RowID{Page: PageID(i + 1), Slot: 1}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	// A second row under an existing key sits next to the first.
+	if err := tree.Insert(nil, nil, btreeKey(700), RowID{Page: 9000, Slot: 2}); err != nil {
+		t.Fatalf("insert duplicate: %v", err)
+	}
+	pages, err := tree.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	if len(pages) < 10 || pages[0] != tree.Root() {
+		t.Fatalf("expected a multi-level tree rooted at %d, got pages %v", tree.Root(), pages)
+	}
+	checkBTree(t, mgr, nil, tree)
+
+	entries := collectBTree(t, tree, nil)
+	if len(entries) != n+1 {
+		t.Fatalf("expected %d entries, got %d", n+1, len(entries))
+	}
+	for i := 1; i < len(entries); i++ {
+		if compareEntries(entries[i-1], entries[i]) >= 0 {
+			t.Fatalf("entries %d and %d are out of order", i-1, i)
+		}
+	}
+	from := collectBTree(t, tree, btreeKey(700))
+	if len(from) != n-700+1 || !bytes.Equal(from[0].key, btreeKey(700)) || !bytes.Equal(from[1].key, btreeKey(700)) {
+		t.Fatalf("seek to key 700 returned %d entries starting at %q", len(from), from[0].key)
+	}
+
+	for _, i := range order[:n/2] {
+		found, err := tree.Delete(nil, nil, btreeKey(i), RowID{Page: PageID(i + 1), Slot: 1})
+		if err != nil || !found {
+			t.Fatalf("delete %d: %v, %v", i, found, err)
+		}
+	}
+	if found, err := tree.Delete(nil, nil, btreeKey(order[0]), RowID{Page: PageID(order[0] + 1), Slot: 1}); err != nil || found {
+		t.Fatalf("expected a deleted entry to be gone: %v, %v", found, err)
+	}
+	checkBTree(t, mgr, nil, tree)
+	if got := len(collectBTree(t, tree, nil)); got != n-n/2+1 {
+		t.Fatalf("expected %d entries after deletes, got %d", n-n/2+1, got)
+	}
+
+	for _, i := range order[n/2:] {
+		if _, err := tree.Delete(nil, nil, btreeKey(i), RowID{Page: PageID(i + 1), Slot: 1}); err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	if _, err := tree.Delete(nil, nil, btreeKey(700), RowID{Page: 9000, Slot: 2}); err != nil {
+		t.Fatalf("delete duplicate: %v", err)
+	}
+	if got := collectBTree(t, tree, nil); len(got) != 0 {
+		t.Fatalf("expected an empty tree, got %d entries", len(got))
+	}
+	if pages, err := tree.Pages(); err != nil || len(pages) != 1 {
+		t.Fatalf("expected the emptied tree to shrink to its root, got %v, %v", pages, err)
+	}
+	checkBTree(t, mgr, nil, tree)
+}
+
+func TestBTreeLoad(t *testing.T) {
+	mgr, tree := newBTreeFixture(t)
+	if err := tree.Insert(nil, nil, btreeKey(5000), RowID{Page: 1, Slot: 1}); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	const n = 1000
+	keys := make([][]byte, n)
+	rows := make([]RowID, n)
+	for i := range keys {
+		keys[i] = btreeKey(i)
+		rows[i] = RowID{Page: PageID(i + 1), Slot: 0}
+	}
+	if err := tree.Load(nil, nil, keys, rows); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	checkBTree(t, mgr, nil, tree)
+	entries := collectBTree(t, tree, nil)
+	if len(entries) != n {
+		t.Fatalf("expected the load to replace the contents with %d entries, got %d", n, len(entries))
+	}
+	for i, entry := range entries {
+		if !bytes.Equal(entry.key, keys[i]) || entry.row != rows[i] {
+			t.Fatalf("entry %d is %q %v", i, entry.key, entry.row)
+		}
+	}
+
+	// A loaded tree takes further inserts and deletes.
+	if err := tree.Insert(nil, nil, btreeKey(500), RowID{Page: 7000, Slot: 0}); err != nil {
+		t.Fatalf("insert after load: %v", err)
+	}
+	if found, err := tree.Delete(nil, nil, btreeKey(10), rows[10]); err != nil || !found {
+		t.Fatalf("delete after load: %v, %v", found, err)
+	}
+	checkBTree(t, mgr, nil, tree)
+
+	if err := tree.Load(nil, nil, nil, nil); err != nil {
+		t.Fatalf("load empty: %v", err)
+	}
+	if pages, err := tree.Pages(); err != nil || len(pages) != 1 {
+		t.Fatalf("expected an empty load to leave the root alone, got %v, %v", pages, err)
+	}
+}
+
+func TestBTreeReleasesPagesWhenTheTransactionEnds(t *testing.T) {
+	mgr, tree := newBTreeFixture(t)
+	for i := 0; i < 500; i++ {
+		if err := tree.Insert(nil, nil, btreeKey(i), RowID{Page: PageID(i + 1)}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	freeList := func() int {
+		info, err := mgr.InspectFreeList()
+		if err != nil {
+			t.Fatalf("free list: %v", err)
+		}
+		return len(info.Pages)
+	}
+	txns := txn.NewManager(txn.NewLockManager(0), nil)
+	tx := txns.Begin()
+	for i := 0; i < 500; i++ {
+		if _, err := tree.Delete(tx, nil, btreeKey(i), RowID{Page: PageID(i + 1)}); err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	// Undoing the deletes would link the merged nodes back in, so they stay
+	// off the free list until the transaction has ended.
+	if n := freeList(); n != 0 {
+		t.Fatalf("expected no free pages before the commit, got %d", n)
+	}
+	if err := txns.Commit(tx.ID()); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if n := freeList(); n == 0 {
+		t.Fatalf("expected the merged nodes to be freed by the commit")
+	}
+	checkBTree(t, mgr, nil, tree)
+}
+
+func TestBTreeRejectsOverlongKeys(t *testing.T) {
+	_, tree := newBTreeFixture(t)
+	if err := tree.Insert(nil, nil, make([]byte, tree.MaxKeySize()), RowID{Page: 1}); err != nil {
+		t.Fatalf("insert at the limit: %v", err)
+	}
+	err := tree.Insert(nil, nil, make([]byte, tree.MaxKeySize()+1), RowID{Page: 2})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("expected an over-long key to be rejected, got %v", err)
+	}
+}
+
+func TestBTreeFreeReleasesPagesWhenTheTransactionEnds(t *testing.T) {
+	mgr, tree := newBTreeFixture(t)
+	for i := 0; i < 500; i++ {
+		if err := tree.Insert(nil, nil, btreeKey(i), RowID{Page: PageID(i + 1), Slot: 1}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	pages, err := tree.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	freeList := func() int {
+		info, err := mgr.InspectFreeList()
+		if err != nil {
+			t.Fatalf("free list: %v", err)
+		}
+		return len(info.Pages)
+	}
+	before := freeList()
+	txns := txn.NewManager(txn.NewLockManager(0), nil)
+	tx := txns.Begin()
+	if err := tree.Free(tx, nil); err != nil {
+		t.Fatalf("free: %v", err)
+	}
+	// A crash now must leave the tree the catalogue still names intact.
+	if n := freeList(); n != before {
+		t.Fatalf("expected %d free pages before the transaction ends, got %d", before, n)
+	}
+	if err := txns.Rollback(tx.ID()); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if n := freeList(); n != before+len(pages) {
+		t.Fatalf("expected %d free pages once the transaction ended, got %d", before+len(pages), n)
+	}
+}
+
+func TestCompactRelocatesIndexTree(t *testing.T) {
+	fsys := vfs.NewMemory()
+	mgr, live, want := newCompactionFixture(t, fsys)
+	defer mgr.Close()
+	tree, err := CreateBTree(mgr)
+	if err != nil {
+		t.Fatalf("create tree: %v", err)
+	}
+	keys := make(map[RowID][]byte)
+	for rid := range want {
+		key := []byte(fmt.Sprintf("row-%05d-%03d-%s", rid.Page, rid.Slot, strings.Repeat("k", 80)))
+		if err := tree.Insert(nil, nil, key, rid); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		keys[rid] = key
+	}
+	plan, err := mgr.PlanCompaction([]*HeapFile{live}, []*BTree{tree})
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if _, err := mgr.Compact(plan, nil, nil); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	moved := OpenBTree(mgr, plan.Relocate(tree.Root()))
+	heap := NewHeapFileWithMap(mgr, plan.Relocate(live.Root()), plan.Relocate(live.FreeSpaceMap()))
+	checkBTree(t, mgr, map[string]*HeapFile{"t": heap}, moved)
+	entries := collectBTree(t, moved, nil)
+	if len(entries) != len(keys) {
+		t.Fatalf("expected %d entries, got %d", len(keys), len(entries))
+	}
+	for _, entry := range entries {
+		var found bool
+		for rid, key := range keys {
+			if bytes.Equal(key, entry.key) {
+				found = entry.row == plan.RelocateRow(rid)
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("entry %q does not point at its relocated row", entry.key)
+		}
+	}
+}
+
+func TestCompactKeepsDuplicateKeysInRowOrder(t *testing.T) {
+	fsys := vfs.NewMemory()
+	mgr, live, want := newCompactionFixture(t, fsys)
+	defer mgr.Close()
+	// New rows land on pages the staging table freed, which stay where they
+	// are while the older rows move below them.
+	for i := 0; i < 40; i++ {
+		rid, err := live.Insert(nil, nil, bytes.Repeat([]byte{'n'}, 300))
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		want[rid] = nil
+	}
+	tree, err := CreateBTree(mgr)
+	if err != nil {
+		t.Fatalf("create tree: %v", err)
+	}
+	key := []byte("same key")
+	for rid := range want {
+		if err := tree.Insert(nil, nil, key, rid); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	plan, err := mgr.PlanCompaction([]*HeapFile{live}, []*BTree{tree})
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	reordered := false
+	for a := range want {
+		for b := range want {
+			before := compareEntries(btreeEntry{row: a}, btreeEntry{row: b}) < 0
+			after := compareEntries(btreeEntry{row: plan.RelocateRow(a)}, btreeEntry{row: plan.RelocateRow(b)}) < 0
+			reordered = reordered || before != after
+		}
+	}
+	if !reordered {
+		t.Fatalf("expected the compaction to reorder some rows")
+	}
+	if _, err := mgr.Compact(plan, nil, nil); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	moved := OpenBTree(mgr, plan.Relocate(tree.Root()))
+	heap := NewHeapFileWithMap(mgr, plan.Relocate(live.Root()), plan.Relocate(live.FreeSpaceMap()))
+	checkBTree(t, mgr, map[string]*HeapFile{"t": heap}, moved)
+	entries := collectBTree(t, moved, nil)
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i := 1; i < len(entries); i++ {
+		if compareEntries(entries[i-1], entries[i]) >= 0 {
+			t.Fatalf("entries %v and %v are out of order", entries[i-1].row, entries[i].row)
+		}
+	}
+	for rid := range want {
+		found, err := moved.Delete(nil, nil, key, plan.RelocateRow(rid))
+		if err != nil || !found {
+			t.Fatalf("delete %v: found %v, %v", plan.RelocateRow(rid), found, err)
+		}
+	}
+	if entries := collectBTree(t, moved, nil); len(entries) != 0 {
+		t.Fatalf("expected an empty tree, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultBufferPoolPages is the number of page frames cached by a Manager when
+// no explicit pool size is configured (1 MiB with 4 KB pages).
+const DefaultBufferPoolPages = 256
+
+// ErrBufferPoolExhausted is returned when every frame in the pool is pinned and
+// a further page must be brought into memory.
+var ErrBufferPoolExhausted = errors.New("storage: buffer pool exhausted, all frames are pinned")
+
+// LogFlusher is implemented by the write-ahead log. The buffer pool calls
+// FlushTo before writing a dirty page back to the data file so that the log
+// records describing the page are durable first.
+type LogFlusher interface {
+	FlushTo(lsn uint64) error
+}
+
+// PoolStats summarises buffer pool activity.
+type PoolStats struct {
+	Capacity   int
+	Resident   int
+	Dirty      int
+	Pinned     int
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	WriteBacks uint64
+}
+
+type frame struct {
+	id    PageID
+	data  []byte
+	pins  int
+	dirty bool
+	lsn   uint64
+	elem  *list.Element
+}
+
+// bufferPool caches page images in a fixed number of frames. Frames are kept
+// on an LRU list (most recently used at the front); eviction walks from the
+// back and skips pinned frames. Dirty frames are written back on eviction or
+// flush, after the log has been forced up to the frame's LSN.
+type bufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	pageSize int
+	frames   map[PageID]*frame
+	lru      *list.List
+	read     func(id PageID, buf []byte) error
+	write    func(id PageID, buf []byte) error
+	log      LogFlusher
+	stats    PoolStats
+}
+
+func newBufferPool(capacity, pageSize int, read, write func(PageID, []byte) error) *bufferPool {
+	if capacity <= 0 {
+		capacity = DefaultBufferPoolPages
+	}
+	return &bufferPool{
+		capacity: capacity,
+		pageSize: pageSize,
+		frames:   make(map[PageID]*frame, capacity),
+		lru:      list.New(),
+		read:     read,
+		write:    write,
+	}
+}
+
+func (bp *bufferPool) setLog(log LogFlusher) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.log = log
+}
+
+// pin brings the page into memory and returns the frame buffer. The caller
+// must unpin the page once finished with the buffer.
+func (bp *bufferPool) pin(id PageID) ([]byte, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	f, err := bp.fetchLocked(id, true)
+	if err != nil {
+		return nil, err
+	}
+	f.pins++
+	return f.data, nil
+}
+
+func (bp *bufferPool) unpin(id PageID, dirty bool) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	f, ok := bp.frames[id]
+	if !ok || f.pins == 0 {
+		return fmt.Errorf("storage: page %d is not pinned", id)
+	}
+	f.pins--
+	if dirty {
+		f.dirty = true
+	}
+	return nil
+}
+
+// readInto copies the cached image of the page into dst.
+func (bp *bufferPool) readInto(id PageID, dst []byte) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	f, err := bp.fetchLocked(id, true)
+	if err != nil {
+		return err
+	}
+	copy(dst, f.data)
+	return nil
+}
+
+// put replaces the cached image of the page and marks it dirty. lsn records
+// the log position that must be durable before the page reaches disk; zero
+// means the write is not covered by the log.
+func (bp *bufferPool) put(id PageID, data []byte, lsn uint64) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	f, err := bp.fetchLocked(id, false)
+	if err != nil {
+		return err
+	}
+	copy(f.data, data)
+	f.dirty = true
+	if lsn > f.lsn {
+		f.lsn = lsn
+	}
+	return nil
+}
+
+// putThrough replaces the cached image of the page and writes it to the data
+// file immediately. It is used for metadata that is not covered by the log.
+func (bp *bufferPool) putThrough(id PageID, data []byte) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	f, err := bp.fetchLocked(id, false)
+	if err != nil {
+		return err
+	}
+	copy(f.data, data)
+	return bp.writeBackLocked(f)
+}
+
+// flush writes every dirty frame back to the data file in page order.
+func (bp *bufferPool) flush() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	dirty := make([]*frame, 0)
+	for _, f := range bp.frames {
+		if f.dirty {
+			dirty = append(dirty, f)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].id < dirty[j].id })
+	for _, f := range dirty {
+		if err := bp.writeBackLocked(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard drops every frame without writing it back. It fails when a frame is
+// pinned.
+func (bp *bufferPool) discard() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for _, f := range bp.frames {
+		if f.pins > 0 {
+			return fmt.Errorf("storage: page %d is pinned", f.id)
+		}
+	}
+	bp.frames = make(map[PageID]*frame, bp.capacity)
+	bp.lru.Init()
+	return nil
+}
+
+func (bp *bufferPool) snapshot() PoolStats {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	stats := bp.stats
+	stats.Capacity = bp.capacity
+	stats.Resident = len(bp.frames)
+	for _, f := range bp.frames {
+		if f.dirty {
+			stats.Dirty++
+		}
+		if f.pins > 0 {
+			stats.Pinned++
+		}
+	}
+	return stats
+}
+
+func (bp *bufferPool) fetchLocked(id PageID, load bool) (*frame, error) {
+	if f, ok := bp.frames[id]; ok {
+		bp.stats.Hits++
+		bp.lru.MoveToFront(f.elem)
+		return f, nil
+	}
+	var buf []byte
+	if len(bp.frames) >= bp.capacity {
+		victim, err := bp.evictLocked()
+		if err != nil {
+			return nil, err
+		}
+		buf = victim
+	} else {
+		buf = make([]byte, bp.pageSize)
+	}
+	if load {
+		bp.stats.Misses++
+		if err := bp.read(id, buf); err != nil {
+			return nil, err
+		}
+	}
+	f := &frame{id: id, data: buf}
+	f.elem = bp.lru.PushFront(f)
+	bp.frames[id] = f
+	return f, nil
+}
+
+// evictLocked removes the least recently used unpinned frame and returns its
+// buffer for reuse.
+func (bp *bufferPool) evictLocked() ([]byte, error) {
+	for elem := bp.lru.Back(); elem != nil; elem = elem.Prev() {
+		f := elem.Value.(*frame)
+		if f.pins > 0 {
+			continue
+		}
+		if f.dirty {
+			if err := bp.writeBackLocked(f); err != nil {
+				return nil, err
+			}
+		}
+		bp.lru.Remove(elem)
+		delete(bp.frames, f.id)
+		bp.stats.Evictions++
+		return f.data, nil
+	}
+	return nil, ErrBufferPoolExhausted
+}
+
+func (bp *bufferPool) writeBackLocked(f *frame) error {
+	if f.lsn > 0 && bp.log != nil {
+		if err := bp.log.FlushTo(f.lsn); err != nil {
+			return err
+		}
+	}
+	if err := bp.write(f.id, f.data); err != nil {
+		return err
+	}
+	f.dirty = false
+	f.lsn = 0
+	bp.stats.WriteBacks++
+	return nil
+}
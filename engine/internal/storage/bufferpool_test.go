@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+type recordingFlusher struct {
+	flushed []uint64
+}
+
+func (r *recordingFlusher) FlushTo(lsn uint64) error {
+	r.flushed = append(r.flushed, lsn)
+	return nil
+}
+
+func openPoolTestManager(t *testing.T, pages int) (*Manager, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pool.gdb")
+	if err := New(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	mgr, err := OpenWithOptions(path, Options{BufferPoolPages: pages})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return mgr, path
+}
+
+func TestBufferPoolEvictsAndWritesBack(t *testing.T) {
+	mgr, path := openPoolTestManager(t, 3)
+
+	ids := make([]PageID, 0, 8)
+	for i := 0; i < 8; i++ {
+		id, buf, err := mgr.AllocatePage()
+		if err != nil {
+			t.Fatalf("allocate: %v", err)
+		}
+		buf[100] = byte(i + 1)
+		if err := mgr.WritePage(id, buf); err != nil {
+			t.Fatalf("write page %d: %v", id, err)
+		}
+		ids = append(ids, id)
+	}
+
+	stats := mgr.BufferPoolStats()
+	if stats.Resident > 3 {
+		t.Fatalf("expected at most 3 resident frames, got %d", stats.Resident)
+	}
+	if stats.Evictions == 0 || stats.WriteBacks == 0 {
+		t.Fatalf("expected evictions with write-back, got %+v", stats)
+	}
+
+	for i, id := range ids {
+		page, err := mgr.ReadPage(id)
+		if err != nil {
+			t.Fatalf("read page %d: %v", id, err)
+		}
+		if page[100] != byte(i+1) {
+			t.Fatalf("page %d: expected marker %d, got %d", id, i+1, page[100])
+		}
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	for i, id := range ids {
+		page, err := reopened.ReadPage(id)
+		if err != nil {
+			t.Fatalf("read page %d after reopen: %v", id, err)
+		}
+		if page[100] != byte(i+1) {
+			t.Fatalf("page %d not persisted: got %d", id, page[100])
+		}
+	}
+}
+
+func TestBufferPoolFlushesLogBeforeWriteBack(t *testing.T) {
+	mgr, _ := openPoolTestManager(t, 1)
+	defer mgr.Close()
+	flusher := &recordingFlusher{}
+	mgr.SetLogFlusher(flusher)
+
+	first, buf, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if err := mgr.writePageLSN(first, buf, 42); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	second, _, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate second: %v", err)
+	}
+	if _, err := mgr.ReadPage(second); err != nil {
+		t.Fatalf("read second: %v", err)
+	}
+	if len(flusher.flushed) != 1 || flusher.flushed[0] != 42 {
+		t.Fatalf("expected log flush to LSN 42 before eviction, got %v", flusher.flushed)
+	}
+}
+
+func TestBufferPoolKeepsPinnedFrames(t *testing.T) {
+	mgr, _ := openPoolTestManager(t, 1)
+	defer mgr.Close()
+
+	first, _, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	second, _, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate second: %v", err)
+	}
+	frame, err := mgr.PinPage(first)
+	if err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	frame[200] = 7
+	if _, err := mgr.ReadPage(second); !errors.Is(err, ErrBufferPoolExhausted) {
+		t.Fatalf("expected exhausted pool while pinned, got %v", err)
+	}
+	if err := mgr.UnpinPage(first, true); err != nil {
+		t.Fatalf("unpin: %v", err)
+	}
+	if _, err := mgr.ReadPage(second); err != nil {
+		t.Fatalf("read after unpin: %v", err)
+	}
+	page, err := mgr.ReadPage(first)
+	if err != nil {
+		t.Fatalf("reread: %v", err)
+	}
+	if page[200] != 7 {
+		t.Fatalf("expected pinned modification to survive eviction, got %d", page[200])
+	}
+}
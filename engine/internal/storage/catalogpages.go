@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// The serialised catalogue lives in a chain of pages referenced from the
+// header page, using the same page layout as overflow chains. The payload of
+// the whole catalogue is the concatenation of the fragments in chain order.
+
+// catalogPagesLocked returns the ids of the current catalogue chain.
+func (m *Manager) catalogPagesLocked() ([]PageID, error) {
+	var ids []PageID
+	err := m.walkCatalogLocked(func(id PageID, _ []byte) error {
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
+
+// CatalogPages returns the ids of the catalogue chain the header names.
+// Recovery uses it to leave the chain alone: the chain is never logged, so any
+// image the log holds for one of its pages predates the page's reuse.
+func (m *Manager) CatalogPages() ([]PageID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.catalogPagesLocked()
+}
+
+// readCatalogLocked reassembles the catalogue payload from its page chain. The
+// per-page lengths are authoritative; the size in the header is only used to
+// size the buffer.
+func (m *Manager) readCatalogLocked() ([]byte, error) {
+	payload := make([]byte, 0, m.header.CatalogSize)
+	err := m.walkCatalogLocked(func(id PageID, page []byte) error {
+		_, used := readChainPageHeader(page)
+		if used > chainPageCapacity(len(page)) {
+			return fmt.Errorf("storage: catalogue page %d is corrupt", id)
+		}
+		payload = append(payload, page[chainPageHeaderSize:chainPageHeaderSize+used]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// writeCatalogLocked stores the payload in a new catalogue chain. The chain is
+// not covered by the log, so it is never written in place: the new pages are
+// synced before the header points at them, and the old chain is freed only
+// once the header switch is on disk. A crash at any point leaves the header
+// naming one complete chain, at worst leaking the pages of the other.
+//
+// A compaction is the exception. Its journal already holds the old chain, and
+// it may not allocate beyond the pages it keeps, so the chain is reused.
+func (m *Manager) writeCatalogLocked(payload []byte) error {
+	existing, err := m.catalogPagesLocked()
+	if err != nil {
+		return err
+	}
+	capacity := chainPageCapacity(m.pageSize)
+	ids := make([]PageID, (len(payload)+capacity-1)/capacity)
+	reused := 0
+	if m.compacting {
+		reused = min(len(ids), len(existing))
+		copy(ids, existing[:reused])
+	}
+	for i := reused; i < len(ids); i++ {
+		id, _, err := m.allocatePageLocked()
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+	for i, id := range ids {
+		buf := make([]byte, m.pageSize)
+		var next PageID
+		if i+1 < len(ids) {
+			next = ids[i+1]
+		}
+		start := i * capacity
+		end := min(start+capacity, len(payload))
+		writeChainPageHeader(buf, next, end-start)
+		copy(buf[chainPageHeaderSize:], payload[start:end])
+		if err := m.pool.putThrough(id, buf); err != nil {
+			return err
+		}
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+
+	if m.header.Version == legacyHeaderVersion {
+		m.header.Version = catalogChainVersion
+	}
+	m.header.CatalogSize = uint32(len(payload))
+	if len(ids) > 0 {
+		m.header.CatalogRoot = uint32(ids[0])
+	} else {
+		m.header.CatalogRoot = 0
+	}
+	m.setCatalogCache(payload)
+	if err := m.flushHeaderLocked(); err != nil {
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	return m.freePagesLocked(nil, nil, existing[reused:])
+}
+
+func (m *Manager) walkCatalogLocked(fn func(id PageID, page []byte) error) error {
+	if m.header.Version == legacyHeaderVersion {
+		return nil
+	}
+	seen := make(map[PageID]struct{})
+	current := PageID(m.header.CatalogRoot)
+	for current != 0 {
+		if _, loop := seen[current]; loop {
+			return fmt.Errorf("storage: catalogue chain loop at page %d", current)
+		}
+		if current >= PageID(m.header.PageCount) {
+			return fmt.Errorf("storage: catalogue page %d out of bounds", current)
+		}
+		seen[current] = struct{}{}
+		page := make([]byte, m.pageSize)
+		if err := m.pool.readInto(current, page); err != nil {
+			return err
+		}
+		if err := fn(current, page); err != nil {
+			return err
+		}
+		current, _ = readChainPageHeader(page)
+	}
+	return nil
+}
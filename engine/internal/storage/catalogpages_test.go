@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManagerReadsAndMigratesInlineCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.gdb")
+	payload := []byte("legacy catalogue payload")
+
+	// Lay out a version 1 header page with the catalogue stored inline.
+	buf := make([]byte, PageSize)
+	copy(buf[:8], headerMagic)
+	binary.LittleEndian.PutUint16(buf[8:10], legacyHeaderVersion)
+	binary.LittleEndian.PutUint32(buf[12:16], 1)
+	binary.LittleEndian.PutUint32(buf[16:20], freeListNil)
+	binary.LittleEndian.PutUint32(buf[20:24], uint32(len(payload)))
+	copy(buf[legacyCatalogOffset:], payload)
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatalf("write legacy file: %v", err)
+	}
+
+	mgr, err := Open(path)
+	if err != nil {
+		t.Fatalf("open legacy file: %v", err)
+	}
+	got, err := mgr.CatalogData()
+	if err != nil {
+		t.Fatalf("catalog data: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("expected inline catalogue %q, got %q", payload, got)
+	}
+	// Allocations before the first catalogue update must keep the payload.
+	if _, _, err := mgr.AllocatePage(); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	mgr, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got, _ := mgr.CatalogData(); !bytes.Equal(got, payload) {
+		t.Fatalf("inline catalogue lost by header rewrite: %q", got)
+	}
+	large := bytes.Repeat([]byte("catalogue"), PageSize)
+	if err := mgr.UpdateCatalog(large); err != nil {
+		t.Fatalf("update catalogue: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	mgr, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen migrated file: %v", err)
+	}
+	defer mgr.Close()
+	if mgr.header.Version != catalogChainVersion || mgr.header.CatalogRoot == 0 {
+		t.Fatalf("expected catalogue chain after update, got header %+v", mgr.header)
+	}
+	if got, _ := mgr.CatalogData(); !bytes.Equal(got, large) {
+		t.Fatalf("catalogue chain did not round-trip (%d bytes)", len(got))
+	}
+
+	mgr.mu.Lock()
+	before, err := mgr.catalogPagesLocked()
+	mgr.mu.Unlock()
+	if err != nil {
+		t.Fatalf("catalogue pages: %v", err)
+	}
+	if err := mgr.UpdateCatalog(payload); err != nil {
+		t.Fatalf("shrink catalogue: %v", err)
+	}
+	mgr.mu.Lock()
+	after, err := mgr.catalogPagesLocked()
+	mgr.mu.Unlock()
+	if err != nil {
+		t.Fatalf("catalogue pages: %v", err)
+	}
+	if len(before) <= 1 || len(after) != 1 {
+		t.Fatalf("expected shrinking catalogue to release pages: before %d, after %d", len(before), len(after))
+	}
+	if PageID(mgr.header.FreeListHead) != before[len(before)-1] {
+		t.Fatalf("expected surplus catalogue pages on the free list")
+	}
+}
+
+func TestManagerWritesCatalogueToFreshPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fresh.gdb")
+	if err := New(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	mgr, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer mgr.Close()
+	first := bytes.Repeat([]byte("first"), PageSize)
+	if err := mgr.UpdateCatalog(first); err != nil {
+		t.Fatalf("update catalogue: %v", err)
+	}
+	mgr.mu.Lock()
+	before, err := mgr.catalogPagesLocked()
+	mgr.mu.Unlock()
+	if err != nil {
+		t.Fatalf("catalogue pages: %v", err)
+	}
+
+	// A crash while the new chain is written must leave the old one intact,
+	// so none of its pages may be reused for the new chain.
+	second := bytes.Repeat([]byte("second"), PageSize)
+	if err := mgr.UpdateCatalog(second); err != nil {
+		t.Fatalf("update catalogue: %v", err)
+	}
+	mgr.mu.Lock()
+	after, err := mgr.catalogPagesLocked()
+	mgr.mu.Unlock()
+	if err != nil {
+		t.Fatalf("catalogue pages: %v", err)
+	}
+	old := make(map[PageID]bool)
+	for _, id := range before {
+		old[id] = true
+	}
+	for _, id := range after {
+		if old[id] {
+			t.Fatalf("catalogue page %d was rewritten in place", id)
+		}
+	}
+	if got, _ := mgr.CatalogData(); !bytes.Equal(got, second) {
+		t.Fatalf("catalogue did not round-trip (%d bytes)", len(got))
+	}
+	info, err := mgr.InspectFreeList()
+	if err != nil {
+		t.Fatalf("free list: %v", err)
+	}
+	if len(info.Pages) != len(before) {
+		t.Fatalf("expected the old chain of %d pages on the free list, got %v", len(before), info.Pages)
+	}
+}
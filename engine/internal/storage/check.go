@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Problem is one inconsistency found by an integrity check. Check names the
+// kind of problem (for example "heap" or "index"); the other fields locate it
+// as precisely as the check allows.
+type Problem struct {
+	Check  string `json:"check"`
+	Table  string `json:"table,omitempty"`
+	Index  string `json:"index,omitempty"`
+	Page   PageID `json:"page,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// IndexTree names the B+tree of an index for the walks that must know which
+// structure every page belongs to.
+type IndexTree struct {
+	Table string
+	Index string
+	Tree  *BTree
+}
+
+// PageCheck is the outcome of Manager.CheckPages.
+type PageCheck struct {
+	Problems []Problem
+	// Damaged lists the tables whose heap or overflow pages are unsound.
+	// Their rows must not be scanned, since a broken chain may never end.
+	Damaged map[string]bool
+}
+
+// CheckPages verifies the page structure of the file: the header against the
+// file size, the free list, the catalogue chain, for every table in heaps the
+// heap chain, the overflow chains and the free-space map, and the B+tree of
+// every index in indexes. Every page they reach is read, which verifies its
+// checksum, and every page must belong to exactly one of them.
+func (m *Manager) CheckPages(heaps map[string]*HeapFile, indexes []IndexTree) (*PageCheck, error) {
+	c, err := m.walkPages(heaps, indexes)
+	if err != nil {
+		return nil, err
+	}
+	return c.result, nil
+}
+
+// walkPages runs the page checks, leaving in the checker which structure each
+// page belongs to.
+func (m *Manager) walkPages(heaps map[string]*HeapFile, indexes []IndexTree) (*pageChecker, error) {
+	m.mu.Lock()
+	header := m.header
+	m.mu.Unlock()
+	c := newPageChecker(m, header.PageCount)
+
+	size, err := m.file.Size()
+	if err != nil {
+		return nil, err
+	}
+	if want := int64(header.PageCount) * int64(m.stride); size < want {
+		c.report(Problem{Check: "header", Detail: fmt.Sprintf("the header describes %d pages (%d bytes) but the file holds %d bytes", header.PageCount, want, size)})
+	}
+
+	if header.Version != legacyHeaderVersion {
+		c.walkChain("catalogue", "catalogue", "", PageID(header.CatalogRoot), 0, func(page []byte) PageID {
+			next, _ := readChainPageHeader(page)
+			return next
+		}, nil)
+	}
+	if header.FreeListHead != freeListNil {
+		c.walkChain("free-list", "the free list", "", PageID(header.FreeListHead), PageID(freeListNil), func(page []byte) PageID {
+			return PageID(binary.LittleEndian.Uint32(page[0:4]))
+		}, nil)
+	}
+
+	names := make([]string, 0, len(heaps))
+	for name := range heaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.checkHeap(name, heaps[name])
+	}
+	for _, index := range indexes {
+		c.checkIndex(index)
+	}
+
+	for id := PageID(1); uint32(id) < c.count; id++ {
+		if _, ok := c.owners[id]; !ok {
+			c.report(Problem{Check: "unused", Page: id, Detail: fmt.Sprintf("page %d is neither free nor in use; VACUUM FULL reclaims it", id)})
+		}
+	}
+	return c, nil
+}
+
+type pageChecker struct {
+	manager *Manager
+	count   uint32
+	owners  map[PageID]string
+	uses    map[PageID]pageUse
+	result  *PageCheck
+}
+
+// pageUse records the structure a page belongs to: kind is the check that
+// claimed it, and table and index the table and index it serves, if any.
+type pageUse struct {
+	kind  string
+	table string
+	index string
+}
+
+func newPageChecker(m *Manager, count uint32) *pageChecker {
+	return &pageChecker{
+		manager: m,
+		count:   count,
+		owners:  make(map[PageID]string),
+		uses:    make(map[PageID]pageUse),
+		result:  &PageCheck{Damaged: make(map[string]bool)},
+	}
+}
+
+func (c *pageChecker) report(p Problem) {
+	c.result.Problems = append(c.result.Problems, p)
+}
+
+// walkChain follows a chain of pages from first until next returns end or 0,
+// claiming every page for owner. It reports whether the whole chain was sound.
+func (c *pageChecker) walkChain(check, owner, table string, first, end PageID, next func(page []byte) PageID, visit func(id PageID, page []byte) bool) bool {
+	sound := true
+	for current := first; current != 0 && current != end; {
+		if !c.claim(check, owner, table, current) {
+			return false
+		}
+		page, err := c.manager.ReadPage(current)
+		if err != nil {
+			c.report(Problem{Check: "page", Table: table, Page: current, Detail: err.Error()})
+			return false
+		}
+		if visit != nil && !visit(current, page) {
+			sound = false
+		}
+		current = next(page)
+	}
+	return sound
+}
+
+// claim records that owner uses the page, reporting pages outside the file,
+// chains that loop and pages used twice.
+func (c *pageChecker) claim(check, owner, table string, id PageID) bool {
+	if uint32(id) >= c.count {
+		c.report(Problem{Check: check, Table: table, Page: id, Detail: fmt.Sprintf("%s points at page %d, beyond the end of the file (%d pages)", owner, id, c.count)})
+		return false
+	}
+	if previous, ok := c.owners[id]; ok {
+		detail := fmt.Sprintf("page %d is used by both %s and %s", id, previous, owner)
+		if previous == owner {
+			detail = fmt.Sprintf("%s loops back to page %d", owner, id)
+		}
+		c.report(Problem{Check: check, Table: table, Page: id, Detail: detail})
+		return false
+	}
+	c.owners[id] = owner
+	c.uses[id] = pageUse{kind: check, table: table}
+	return true
+}
+
+func (c *pageChecker) checkHeap(table string, hf *HeapFile) {
+	heapPages := make(map[PageID]bool)
+	sound := c.walkChain("heap", "the heap of "+table, table, hf.root, 0, func(page []byte) PageID {
+		return readHeapHeader(page).NextPage
+	}, func(id PageID, page []byte) bool {
+		heapPages[id] = true
+		if err := validateHeapPage(page); err != nil {
+			c.report(Problem{Check: "heap", Table: table, Page: id, Detail: err.Error()})
+			return false
+		}
+		return c.checkOverflow(table, id, page)
+	})
+	if !sound {
+		c.result.Damaged[table] = true
+	}
+	if hf.fsm == 0 {
+		return
+	}
+	first := true
+	c.walkChain("free-space-map", "the free-space map of "+table, table, hf.fsm, 0, func(page []byte) PageID {
+		return readFSMHeader(page).NextPage
+	}, func(id PageID, page []byte) bool {
+		h := readFSMHeader(page)
+		if int(h.Count) > fsmEntriesPerPage(len(page)) {
+			c.report(Problem{Check: "free-space-map", Table: table, Page: id, Detail: fmt.Sprintf("entry count %d exceeds the page capacity", h.Count)})
+			return false
+		}
+		if first && h.HeapTail != 0 && !heapPages[h.HeapTail] {
+			c.report(Problem{Check: "free-space-map", Table: table, Page: id, Detail: fmt.Sprintf("heap tail %d is not a page of the heap", h.HeapTail)})
+		}
+		first = false
+		for i := 0; i < int(h.Count); i++ {
+			if heapID, _ := fsmEntry(page, i); !heapPages[heapID] {
+				c.report(Problem{Check: "free-space-map", Table: table, Page: id, Detail: fmt.Sprintf("entry %d describes page %d, which is not a page of the heap", i, heapID)})
+			}
+		}
+		return true
+	})
+}
+
+// checkIndex walks the B+tree of an index. Every node must decode, hold its
+// keys in order and sit at the same depth as the other leaves, and the leaf
+// chain must link the leaves in key order.
+func (c *pageChecker) checkIndex(index IndexTree) {
+	owner := "the index " + index.Index
+	report := func(id PageID, format string, args ...interface{}) {
+		c.report(Problem{Check: "index", Table: index.Table, Index: index.Index, Page: id, Detail: fmt.Sprintf(format, args...)})
+	}
+	var leaves []PageID
+	next := make(map[PageID]PageID)
+	leafDepth := -1
+	var lastKey []byte
+	var walk func(id PageID, depth int)
+	walk = func(id PageID, depth int) {
+		if !c.claim("index", owner, index.Table, id) {
+			return
+		}
+		c.uses[id] = pageUse{kind: "index", table: index.Table, index: index.Index}
+		page, err := c.manager.ReadPage(id)
+		if err != nil {
+			c.report(Problem{Check: "page", Table: index.Table, Index: index.Index, Page: id, Detail: err.Error()})
+			return
+		}
+		n, err := decodeBTreeNode(id, page)
+		if err != nil {
+			report(id, "%v", err)
+			return
+		}
+		for i := 1; i < len(n.entries); i++ {
+			if bytes.Compare(n.entries[i-1].key, n.entries[i].key) > 0 {
+				report(id, "entries %d and %d are out of order", i-1, i)
+				break
+			}
+		}
+		if !n.leaf {
+			for _, child := range n.children {
+				walk(child, depth+1)
+			}
+			return
+		}
+		if leafDepth < 0 {
+			leafDepth = depth
+		} else if depth != leafDepth {
+			report(id, "leaf is at depth %d but the first leaf is at depth %d", depth, leafDepth)
+		}
+		if len(n.entries) > 0 {
+			if lastKey != nil && bytes.Compare(lastKey, n.entries[0].key) > 0 {
+				report(id, "leaf starts below the last key of the previous leaf")
+			}
+			lastKey = n.entries[len(n.entries)-1].key
+		}
+		leaves = append(leaves, id)
+		next[id] = n.next
+	}
+	walk(index.Tree.Root(), 0)
+	for i, id := range leaves {
+		var want PageID
+		if i+1 < len(leaves) {
+			want = leaves[i+1]
+		}
+		if next[id] != want {
+			report(id, "leaf links to page %d instead of %d", next[id], want)
+		}
+	}
+}
+
+// checkOverflow walks the overflow chain of every external record on a heap
+// page and compares the stored length with the chain's contents.
+func (c *pageChecker) checkOverflow(table string, id PageID, page []byte) bool {
+	p, err := LoadHeapPage(id, page)
+	if err != nil {
+		return false
+	}
+	sound := true
+	_ = p.Records(func(slot uint16, record []byte) error {
+		if !p.External(slot) {
+			return nil
+		}
+		length, first, err := decodeOverflowPointer(record)
+		if err != nil {
+			c.report(Problem{Check: "overflow", Table: table, Page: id, Detail: fmt.Sprintf("slot %d: %v", slot, err)})
+			sound = false
+			return nil
+		}
+		stored := 0
+		valid := c.walkChain("overflow", "the overflow pages of "+table, table, first, 0, func(page []byte) PageID {
+			next, _ := readChainPageHeader(page)
+			return next
+		}, func(chainID PageID, page []byte) bool {
+			_, used := readChainPageHeader(page)
+			if used > chainPageCapacity(len(page)) {
+				c.report(Problem{Check: "overflow", Table: table, Page: chainID, Detail: fmt.Sprintf("used length %d exceeds the page capacity", used)})
+				return false
+			}
+			stored += used
+			return true
+		})
+		if valid && stored != length {
+			c.report(Problem{Check: "overflow", Table: table, Page: id, Detail: fmt.Sprintf("slot %d records %d bytes but its overflow chain holds %d", slot, length, stored)})
+			valid = false
+		}
+		sound = sound && valid
+		return nil
+	})
+	return sound
+}
+
+// validateHeapPage checks that the header and slot directory of a heap page
+// describe records inside the page.
+func validateHeapPage(page []byte) error {
+	h := readHeapHeader(page)
+	if int(h.FreeStart) < heapHeaderSize || h.FreeStart > h.FreeEnd || int(h.FreeEnd)+int(h.SlotCount)*slotSize != len(page) {
+		return fmt.Errorf("corrupt header: %d slots, free space %d..%d", h.SlotCount, h.FreeStart, h.FreeEnd)
+	}
+	p := &HeapPage{data: page, hdr: h}
+	for i := uint16(0); i < h.SlotCount; i++ {
+		offset, length := p.slot(i)
+		size := int(length & slotLengthMask)
+		if size == 0 {
+			continue
+		}
+		if int(offset) < heapHeaderSize || int(offset)+size > int(h.FreeStart) {
+			return fmt.Errorf("slot %d points at bytes %d..%d, outside the record area", i, offset, int(offset)+size)
+		}
+		if length&slotExternal != 0 && size != overflowPointerSize {
+			return fmt.Errorf("slot %d is an overflow pointer of %d bytes", i, size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/vfs"
+)
+
+func TestCheckPagesFindsDamage(t *testing.T) {
+	fsys := vfs.NewMemory()
+	mgr, live, _ := newCompactionFixture(t, fsys)
+	defer mgr.Close()
+	other := createHeap(t, mgr)
+	for i := 0; i < 40; i++ {
+		if _, err := other.Insert(nil, nil, bytes.Repeat([]byte{'o'}, 400)); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	heaps := map[string]*HeapFile{"live": live, "other": other}
+
+	check, err := mgr.CheckPages(heaps, nil)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(check.Problems) != 0 || len(check.Damaged) != 0 {
+		t.Fatalf("expected a sound file, got %+v", check.Problems)
+	}
+
+	// Leak a page and make the second page of the other heap loop back to
+	// the first.
+	leaked, _, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	pages, err := other.Pages()
+	if err != nil || len(pages) < 2 {
+		t.Fatalf("expected several heap pages, got %v (%v)", pages, err)
+	}
+	page, err := mgr.ReadPage(pages[1])
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	header := readHeapHeader(page)
+	header.NextPage = pages[0]
+	writeHeapHeader(page, header)
+	if err := mgr.WritePage(pages[1], page); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	check, err = mgr.CheckPages(heaps, nil)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if !check.Damaged["other"] || check.Damaged["live"] {
+		t.Fatalf("expected only the other heap to be damaged, got %v", check.Damaged)
+	}
+	found := make(map[string]bool)
+	for _, p := range check.Problems {
+		switch {
+		case p.Check == "heap" && p.Table == "other" && p.Page == pages[0]:
+			found["loop"] = true
+		case p.Check == "unused" && p.Page == leaked:
+			found["leak"] = true
+		}
+	}
+	if !found["loop"] || !found["leak"] {
+		t.Fatalf("expected the loop and the leaked page to be reported, got %+v", check.Problems)
+	}
+}
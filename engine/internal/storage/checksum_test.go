@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestReadPageDetectsCorruption(t *testing.T) {
+	mgr, path := openPoolTestManager(t, 4)
+	id, buf, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if err := InitialiseHeapPage(buf); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	page, err := LoadHeapPage(id, buf)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, err := page.Insert(bytes.Repeat([]byte{'c'}, 200)); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := mgr.WritePage(id, page.Data()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	got, err := reopened.ReadPage(id)
+	if err != nil {
+		t.Fatalf("read intact page: %v", err)
+	}
+	if !bytes.Equal(got, page.Data()) {
+		t.Fatalf("checksum bytes leaked into the page image")
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0xFF}, int64(id)*PageSize+PageSize-100); err != nil {
+		t.Fatalf("corrupt page: %v", err)
+	}
+	f.Close()
+
+	reopened, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen corrupt file: %v", err)
+	}
+	defer reopened.Close()
+	_, err = reopened.ReadPage(id)
+	var corrupt *CorruptPageError
+	if !errors.As(err, &corrupt) || !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("expected a corruption error, got %v", err)
+	}
+	if corrupt.Page != id {
+		t.Fatalf("expected corruption reported for page %d, got %d", id, corrupt.Page)
+	}
+}
+
+func TestZeroedChecksumIsOnlyAcceptedFromOlderFormats(t *testing.T) {
+	mgr, path := openPoolTestManager(t, 4)
+	id, buf, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if err := InitialiseHeapPage(buf); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if err := mgr.WritePage(id, buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	patch := func(offset int64, data []byte) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("open file: %v", err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatalf("patch file: %v", err)
+		}
+	}
+	readBack := func() error {
+		t.Helper()
+		reopened, err := Open(path)
+		if err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		defer reopened.Close()
+		_, err = reopened.ReadPage(id)
+		return err
+	}
+
+	// A torn write or a bad sector can zero the checksum along with the page.
+	patch(int64(id)*PageSize+checksumOffset, make([]byte, 4))
+	if err := readBack(); !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("expected a zeroed checksum to be rejected, got %v", err)
+	}
+
+	// Version 8 files may still hold pages written before checksums.
+	patch(8, []byte{byte(coveringIndexVersion), 0})
+	if err := readBack(); err != nil {
+		t.Fatalf("expected an older file to accept the page, got %v", err)
+	}
+	if err := UpgradeChecksums(path); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if version, err := ReadFormatVersion(path); err != nil || version != checksumVersion {
+		t.Fatalf("expected version %d after the upgrade, got %d (%v)", checksumVersion, version, err)
+	}
+	if err := readBack(); err != nil {
+		t.Fatalf("expected the upgrade to stamp the page, got %v", err)
+	}
+}
@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+)
+
+// Compaction shrinks the data file by moving every live page that sits beyond
+// the space the live pages need into a free slot nearer the front, rewriting
+// the page links that point at moved pages and truncating the file. Free-list
+// pages are simply forgotten. Pages are moved in place under the protection
+// of a rollback journal (see journal.go), so a crash part-way through leaves
+// the database as it was before the compaction started.
+
+type pageKind uint8
+
+const (
+	pageHeap pageKind = iota + 1
+	pageFreeSpaceMap
+	pageChain // overflow and catalogue pages
+	pageIndex
+)
+
+// Compaction is the plan produced by PlanCompaction.
+type Compaction struct {
+	// Moves maps the old id of every page that changes place to its new id.
+	Moves map[PageID]PageID
+
+	kinds       map[PageID]pageKind
+	indexRoots  []PageID
+	pagesBefore uint32
+	pagesAfter  uint32
+}
+
+// CompactStats summarises the work performed by Manager.Compact.
+type CompactStats struct {
+	PagesBefore    int
+	PagesAfter     int
+	PagesMoved     int
+	BytesReclaimed int64
+}
+
+// Relocate returns the id a page has after the compaction.
+func (c *Compaction) Relocate(id PageID) PageID {
+	if to, ok := c.Moves[id]; ok {
+		return to
+	}
+	return id
+}
+
+// RelocateRow returns the RowID a record has after the compaction.
+func (c *Compaction) RelocateRow(id RowID) RowID {
+	return RowID{Page: c.Relocate(id.Page), Slot: id.Slot}
+}
+
+// PlanCompaction works out where every live page goes. heaps and indexes must
+// cover every table and index in the database: any page not reachable from
+// them or from the catalogue is treated as free and discarded.
+func (m *Manager) PlanCompaction(heaps []*HeapFile, indexes []*BTree) (*Compaction, error) {
+	m.mu.Lock()
+	count := m.header.PageCount
+	catalogPages, err := m.catalogPagesLocked()
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	plan := &Compaction{
+		Moves:       make(map[PageID]PageID),
+		kinds:       make(map[PageID]pageKind),
+		pagesBefore: count,
+	}
+	claim := func(ids []PageID, kind pageKind) error {
+		for _, id := range ids {
+			if id == 0 || uint32(id) >= count {
+				return fmt.Errorf("storage: page %d is out of range", id)
+			}
+			if _, ok := plan.kinds[id]; ok {
+				return fmt.Errorf("storage: page %d is referenced twice", id)
+			}
+			plan.kinds[id] = kind
+		}
+		return nil
+	}
+	if err := claim(catalogPages, pageChain); err != nil {
+		return nil, err
+	}
+	for _, hf := range heaps {
+		pages, err := hf.Pages()
+		if err != nil {
+			return nil, err
+		}
+		if err := claim(pages, pageHeap); err != nil {
+			return nil, err
+		}
+		if pages, err = hf.FreeSpaceMapPages(); err != nil {
+			return nil, err
+		}
+		if err := claim(pages, pageFreeSpaceMap); err != nil {
+			return nil, err
+		}
+		if pages, err = hf.OverflowPages(); err != nil {
+			return nil, err
+		}
+		if err := claim(pages, pageChain); err != nil {
+			return nil, err
+		}
+	}
+	for _, tree := range indexes {
+		pages, err := tree.Pages()
+		if err != nil {
+			return nil, err
+		}
+		if err := claim(pages, pageIndex); err != nil {
+			return nil, err
+		}
+		plan.indexRoots = append(plan.indexRoots, tree.Root())
+	}
+
+	// The header page plus the live pages fill the front of the file; live
+	// pages beyond that point move into the free slots below it, lowest
+	// first.
+	plan.pagesAfter = uint32(len(plan.kinds)) + 1
+	var movers []PageID
+	for id := range plan.kinds {
+		if uint32(id) >= plan.pagesAfter {
+			movers = append(movers, id)
+		}
+	}
+	sort.Slice(movers, func(i, j int) bool { return movers[i] < movers[j] })
+	next := PageID(1)
+	for _, id := range movers {
+		for {
+			if _, live := plan.kinds[next]; !live {
+				break
+			}
+			next++
+		}
+		plan.Moves[id] = next
+		next++
+	}
+	return plan, nil
+}
+
+// PagesBefore returns the number of pages in the file when it was planned.
+func (c *Compaction) PagesBefore() int {
+	return int(c.pagesBefore)
+}
+
+// PagesAfter returns the number of pages the file keeps.
+func (c *Compaction) PagesAfter() int {
+	return int(c.pagesAfter)
+}
+
+// Compact carries out a plan. Every cached page is written back first and
+// must not be pinned. files lists companion files that rewrite changes; they
+// are saved in the journal alongside the data file. rewrite runs once the
+// pages have moved and the index trees have been rebuilt, with the header
+// already pointing at the relocated catalogue, and is where callers update
+// page ids held elsewhere (catalogue entries); it must not grow the file,
+// since the journal only covers the part of the file that is kept. If
+// anything fails the data file and the companion files are restored, and
+// callers must reload whatever they had cached.
+func (m *Manager) Compact(plan *Compaction, files []string, rewrite func() error) (CompactStats, error) {
+	stats := CompactStats{PagesBefore: plan.PagesBefore(), PagesAfter: plan.PagesAfter(), PagesMoved: len(plan.Moves)}
+	if m.readOnly {
+		return stats, ErrReadOnly
+	}
+	if err := m.Flush(); err != nil {
+		return stats, err
+	}
+	m.mu.Lock()
+	if m.header.PageCount != plan.pagesBefore {
+		m.mu.Unlock()
+		return stats, fmt.Errorf("storage: the database changed after the compaction was planned")
+	}
+	if err := m.pool.discard(); err != nil {
+		m.mu.Unlock()
+		return stats, err
+	}
+	if err := m.journalCompactionLocked(plan, files); err != nil {
+		m.mu.Unlock()
+		return stats, err
+	}
+	err := m.relocatePagesLocked(plan)
+	// Summaries of free-space maps name pages by their old ids.
+	m.forgetFreeSpaceMaps()
+	m.compacting = true
+	m.mu.Unlock()
+	if err == nil {
+		err = m.rebuildIndexes(plan)
+	}
+	if err == nil && rewrite != nil {
+		err = rewrite()
+	}
+	m.mu.Lock()
+	m.compacting = false
+	m.mu.Unlock()
+	if err == nil {
+		err = m.Flush()
+	}
+	if err == nil {
+		// Removing the journal commits the compaction.
+		err = m.fs.Remove(JournalPath(m.path))
+	}
+	if err != nil {
+		return stats, m.abortCompaction(err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.file.Truncate(int64(plan.pagesAfter) * int64(m.stride)); err != nil {
+		return stats, err
+	}
+	if err := m.file.Sync(); err != nil {
+		return stats, err
+	}
+	stats.BytesReclaimed = int64(stats.PagesBefore-stats.PagesAfter) * int64(m.stride)
+	return stats, nil
+}
+
+// journalCompactionLocked saves every region of the file that the compaction
+// may overwrite: the header and the slots the live pages end up in.
+func (m *Manager) journalCompactionLocked(plan *Compaction, files []string) error {
+	j, err := createJournal(m.fs, m.path)
+	if err != nil {
+		return err
+	}
+	err = j.saveRange(m.file, 0, int64(plan.pagesAfter)*int64(m.stride))
+	for _, path := range files {
+		if err != nil {
+			break
+		}
+		err = j.saveFile(m.fs, path)
+	}
+	if err == nil {
+		err = j.seal()
+	}
+	if err != nil {
+		j.abandon(m.fs, m.path)
+		return fmt.Errorf("storage: writing compaction journal: %w", err)
+	}
+	return nil
+}
+
+// relocatePagesLocked rewrites every live page at its new position with its
+// links remapped, then points the header at the relocated catalogue.
+func (m *Manager) relocatePagesLocked(plan *Compaction) error {
+	ids := make([]PageID, 0, len(plan.kinds))
+	for id := range plan.kinds {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	buf := make([]byte, m.pageSize)
+	for _, id := range ids {
+		if err := m.readPageFromDisk(id, buf); err != nil {
+			return err
+		}
+		if err := plan.rewritePage(id, buf); err != nil {
+			return err
+		}
+		if err := m.writePageToDisk(plan.Relocate(id), buf); err != nil {
+			return err
+		}
+	}
+	m.header.PageCount = plan.pagesAfter
+	m.header.FreeListHead = freeListNil
+	m.header.CatalogRoot = uint32(plan.Relocate(PageID(m.header.CatalogRoot)))
+	return m.flushHeaderLocked()
+}
+
+// rewritePage remaps the page ids stored in a page.
+func (c *Compaction) rewritePage(id PageID, page []byte) error {
+	switch c.kinds[id] {
+	case pageHeap:
+		p, err := LoadHeapPage(id, page)
+		if err != nil {
+			return err
+		}
+		p.SetNextPage(c.Relocate(p.NextPage()))
+		for slot := uint16(0); slot < p.hdr.SlotCount; slot++ {
+			offset, length := p.slot(slot)
+			if length&slotExternal == 0 {
+				continue
+			}
+			stub := page[offset : offset+(length&slotLengthMask)]
+			size, first, err := decodeOverflowPointer(stub)
+			if err != nil {
+				return err
+			}
+			copy(stub, encodeOverflowPointer(size, c.Relocate(first)))
+		}
+	case pageFreeSpaceMap:
+		h := readFSMHeader(page)
+		h.NextPage = c.Relocate(h.NextPage)
+		h.HeapTail = c.Relocate(h.HeapTail)
+		writeFSMHeader(page, h)
+		for i := 0; i < int(h.Count); i++ {
+			heapID, free := fsmEntry(page, i)
+			setFSMEntry(page, i, c.Relocate(heapID), free)
+		}
+	case pageChain:
+		next, used := readChainPageHeader(page)
+		writeChainPageHeader(page, c.Relocate(next), used)
+	case pageIndex:
+		// The RowIDs are left for rebuildIndexes.
+		n, err := decodeBTreeNode(id, page)
+		if err != nil {
+			return err
+		}
+		n.next = c.Relocate(n.next)
+		for i := range n.children {
+			n.children[i] = c.Relocate(n.children[i])
+		}
+		n.encode(page)
+	}
+	return nil
+}
+
+// rebuildIndexes reloads every index tree with its RowIDs remapped. Moving
+// heap pages renumbers rows, which would leave the entries of a duplicate
+// key out of RowID order if they were rewritten where they stand. A tree
+// loaded packed full fits in the pages the old one frees; should it not,
+// allocation fails rather than grow the file and the compaction is undone.
+func (m *Manager) rebuildIndexes(plan *Compaction) error {
+	for _, root := range plan.indexRoots {
+		tree := OpenBTree(m, plan.Relocate(root))
+		cursor, err := tree.Seek(nil)
+		if err != nil {
+			return err
+		}
+		var entries []btreeEntry
+		for {
+			key, row, ok, err := cursor.Next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			entries = append(entries, btreeEntry{key: slices.Clone(key), row: plan.RelocateRow(row)})
+		}
+		sort.Slice(entries, func(i, j int) bool { return compareEntries(entries[i], entries[j]) < 0 })
+		keys := make([][]byte, len(entries))
+		rows := make([]RowID, len(entries))
+		for i, e := range entries {
+			keys[i], rows[i] = e.key, e.row
+		}
+		if err := tree.Load(nil, nil, keys, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortCompaction restores the file from the journal after a failure and
+// reloads the header and catalogue.
+func (m *Manager) abortCompaction(cause error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_ = m.pool.discard()
+	m.forgetFreeSpaceMaps()
+	if err := rollbackJournal(m.fs, m.path, m.file); err != nil {
+		return fmt.Errorf("storage: compaction failed (%v) and could not be rolled back: %w", cause, err)
+	}
+	if err := m.reloadHeaderLocked(); err != nil {
+		return fmt.Errorf("storage: compaction failed (%v) and the header could not be reloaded: %w", cause, err)
+	}
+	return cause
+}
+
+// reloadHeaderLocked re-reads the header page and catalogue from the file.
+// The key header never changes while the file is open, so the cipher stays.
+func (m *Manager) reloadHeaderLocked() error {
+	buf := make([]byte, PageSize)
+	if _, err := m.file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	header, err := readHeader(buf)
+	if err != nil {
+		return err
+	}
+	m.header = *header
+	if m.header.Version == legacyHeaderVersion {
+		m.setCatalogCache(buf[legacyCatalogOffset : legacyCatalogOffset+int(m.header.CatalogSize)])
+		return nil
+	}
+	payload, err := m.readCatalogLocked()
+	if err != nil {
+		return err
+	}
+	m.setCatalogCache(payload)
+	return nil
+}
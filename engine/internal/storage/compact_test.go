@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/vfs"
+)
+
+// newCompactionFixture builds a database holding a dropped table followed by
+// a live one with an overflow record, so the live table's pages all sit
+// beyond the space the compacted file keeps.
+func newCompactionFixture(t *testing.T, fsys vfs.FS) (*Manager, *HeapFile, map[RowID][]byte) {
+	t.Helper()
+	if err := NewWithOptions("compact.gdb", CreateOptions{FS: fsys}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	mgr, err := OpenWithOptions("compact.gdb", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := mgr.UpdateCatalog([]byte("catalogue payload")); err != nil {
+		t.Fatalf("catalogue: %v", err)
+	}
+	staging := createHeap(t, mgr)
+	for i := 0; i < 80; i++ {
+		if _, err := staging.Insert(nil, nil, bytes.Repeat([]byte{'s'}, 500)); err != nil {
+			t.Fatalf("insert staging %d: %v", i, err)
+		}
+	}
+	live := createHeap(t, mgr)
+	want := make(map[RowID][]byte)
+	for i := 0; i < 30; i++ {
+		record := []byte(fmt.Sprintf("%03d:%s", i, bytes.Repeat([]byte{'l'}, 300)))
+		rid, err := live.Insert(nil, nil, record)
+		if err != nil {
+			t.Fatalf("insert live %d: %v", i, err)
+		}
+		want[rid] = record
+	}
+	large := bytes.Repeat([]byte("overflow"), 2000)
+	rid, err := live.Insert(nil, nil, large)
+	if err != nil {
+		t.Fatalf("insert large: %v", err)
+	}
+	want[rid] = large
+
+	// Drop the staging table the way the catalogue does.
+	pages, err := staging.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	fsmPages, err := staging.FreeSpaceMapPages()
+	if err != nil {
+		t.Fatalf("fsm pages: %v", err)
+	}
+	for _, id := range append(pages, fsmPages...) {
+		if err := mgr.FreePage(id); err != nil {
+			t.Fatalf("free %d: %v", id, err)
+		}
+	}
+	return mgr, live, want
+}
+
+func createHeap(t *testing.T, mgr *Manager) *HeapFile {
+	t.Helper()
+	root, buf, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate root: %v", err)
+	}
+	if err := InitialiseHeapPage(buf); err != nil {
+		t.Fatalf("init root: %v", err)
+	}
+	if err := mgr.WritePage(root, buf); err != nil {
+		t.Fatalf("write root: %v", err)
+	}
+	fsm, err := CreateFreeSpaceMap(mgr, root)
+	if err != nil {
+		t.Fatalf("create fsm: %v", err)
+	}
+	return NewHeapFileWithMap(mgr, root, fsm)
+}
+
+func checkHeapContents(t *testing.T, heap *HeapFile, relocate func(RowID) RowID, want map[RowID][]byte) {
+	t.Helper()
+	got := make(map[RowID][]byte)
+	if err := heap.Scan(func(rid RowID, record []byte) error {
+		got[rid] = append([]byte(nil), record...)
+		return nil
+	}); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d records, got %d", len(want), len(got))
+	}
+	for rid, record := range want {
+		if !bytes.Equal(got[relocate(rid)], record) {
+			t.Fatalf("record %v was not found at %v", rid, relocate(rid))
+		}
+	}
+}
+
+func TestCompactShrinksFile(t *testing.T) {
+	fsys := vfs.NewMemory()
+	mgr, live, want := newCompactionFixture(t, fsys)
+	plan, err := mgr.PlanCompaction([]*HeapFile{live}, nil)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(plan.Moves) == 0 {
+		t.Fatalf("expected pages to move")
+	}
+	stats, err := mgr.Compact(plan, nil, nil)
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if stats.PagesAfter >= stats.PagesBefore || stats.BytesReclaimed != int64(stats.PagesBefore-stats.PagesAfter)*PageSize {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, err := fsys.Stat(JournalPath("compact.gdb")); !os.IsNotExist(err) {
+		t.Fatalf("expected the journal to be removed, got %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	info, err := fsys.Stat("compact.gdb")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Size() != int64(stats.PagesAfter)*PageSize {
+		t.Fatalf("expected %d bytes, got %d", int64(stats.PagesAfter)*PageSize, info.Size())
+	}
+
+	mgr, err = OpenWithOptions("compact.gdb", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer mgr.Close()
+	payload, err := mgr.CatalogData()
+	if err != nil || string(payload) != "catalogue payload" {
+		t.Fatalf("catalogue changed: %q (%v)", payload, err)
+	}
+	moved := NewHeapFileWithMap(mgr, plan.Relocate(live.Root()), plan.Relocate(live.FreeSpaceMap()))
+	checkHeapContents(t, moved, plan.RelocateRow, want)
+	if _, err := moved.Insert(nil, nil, []byte("after compaction")); err != nil {
+		t.Fatalf("insert after compaction: %v", err)
+	}
+}
+
+func TestCompactRollsBackOnFailure(t *testing.T) {
+	fsys := vfs.NewMemory()
+	mgr, live, want := newCompactionFixture(t, fsys)
+	if err := mgr.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	before, err := fsys.Stat("compact.gdb")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	plan, err := mgr.PlanCompaction([]*HeapFile{live}, nil)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+
+	// Capture the files as a crash in the middle of the compaction would
+	// leave them, then fail it.
+	var crashed, journal []byte
+	failure := errors.New("rewrite failed")
+	_, err = mgr.Compact(plan, nil, func() error {
+		if crashed, err = readWholeFile(fsys, "compact.gdb"); err != nil {
+			return err
+		}
+		if journal, err = readWholeFile(fsys, JournalPath("compact.gdb")); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected the rewrite failure, got %v", err)
+	}
+	checkHeapContents(t, live, func(rid RowID) RowID { return rid }, want)
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	after, err := fsys.Stat("compact.gdb")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if after.Size() != before.Size() {
+		t.Fatalf("expected the file to keep %d bytes, got %d", before.Size(), after.Size())
+	}
+
+	// Opening the crashed copy for writing rolls it back; a reader must not
+	// open it first.
+	crash := vfs.NewMemory()
+	writeWholeFile(t, crash, "compact.gdb", crashed)
+	writeWholeFile(t, crash, JournalPath("compact.gdb"), journal)
+	if _, err := OpenWithOptions("compact.gdb", Options{FS: crash, ReadOnly: true}); !errors.Is(err, errJournalPending) {
+		t.Fatalf("expected a pending journal error, got %v", err)
+	}
+	mgr, err = OpenWithOptions("compact.gdb", Options{FS: crash})
+	if err != nil {
+		t.Fatalf("open crashed copy: %v", err)
+	}
+	defer mgr.Close()
+	if _, err := crash.Stat(JournalPath("compact.gdb")); !os.IsNotExist(err) {
+		t.Fatalf("expected the journal to be removed, got %v", err)
+	}
+	payload, err := mgr.CatalogData()
+	if err != nil || string(payload) != "catalogue payload" {
+		t.Fatalf("catalogue changed: %q (%v)", payload, err)
+	}
+	restored := NewHeapFileWithMap(mgr, live.Root(), live.FreeSpaceMap())
+	checkHeapContents(t, restored, func(rid RowID) RowID { return rid }, want)
+}
+
+func writeWholeFile(t *testing.T, fsys vfs.FS, path string, data []byte) {
+	t.Helper()
+	f, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatalf("create %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/example/granite-db/engine/internal/compression"
+)
+
+// Heap pages of a compressed table record their codec in byte 10, which every
+// page format leaves reserved. When such a page is written to the data file
+// everything after the 16-byte page header is compressed and byte 11 is set
+// to mark the stored image as compressed; reading the page expands it again
+// before the checksum is verified, so callers only ever see the plain page.
+// A page that does not shrink is stored as-is.
+//
+// Pages keep their fixed slot in the file so that they can be rewritten in
+// place; the unused tail of a compressed slot is zero-filled.
+const (
+	compressionOffset      = 10
+	storedCompressedOffset = 11
+	compressedLengthOffset = 16
+	compressedBodyOffset   = 18
+	pageHeaderSize         = 16
+)
+
+// SetPageCompression records the codec used to store a heap page. Pages
+// appended to a heap file inherit the codec of the page they follow.
+func SetPageCompression(page []byte, codec compression.Codec) {
+	page[compressionOffset] = byte(codec)
+}
+
+// PageCompression returns the codec recorded on a heap page.
+func PageCompression(page []byte) compression.Codec {
+	return compression.Codec(page[compressionOffset])
+}
+
+// EnableCompression prepares the file to hold compressed pages, which needs
+// format version 4 or later. Version 3 files are bumped in place; older files
+// must be upgraded first.
+func (m *Manager) EnableCompression() error {
+	return m.enableVersion("compressed tables", compressionVersion)
+}
+
+// compressPage returns the on-disk image of a page whose checksum has been
+// stamped.
+func compressPage(image []byte) ([]byte, error) {
+	codec := PageCompression(image)
+	if codec == compression.None {
+		return image, nil
+	}
+	body, err := codec.Compress(nil, image[pageHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	if compressedBodyOffset+len(body) > len(image) {
+		return image, nil
+	}
+	stored := make([]byte, len(image))
+	copy(stored, image[:pageHeaderSize])
+	stored[storedCompressedOffset] = 1
+	binary.LittleEndian.PutUint16(stored[compressedLengthOffset:compressedBodyOffset], uint16(len(body)))
+	copy(stored[compressedBodyOffset:], body)
+	return stored, nil
+}
+
+// expandPage restores a page read from disk to its plain image.
+func expandPage(id PageID, buf []byte) error {
+	if buf[storedCompressedOffset] == 0 {
+		return nil
+	}
+	codec := PageCompression(buf)
+	if codec == compression.None || !codec.Valid() {
+		return &CorruptPageError{Page: id, Cause: fmt.Errorf("unknown compression codec %d", uint8(codec))}
+	}
+	length := int(binary.LittleEndian.Uint16(buf[compressedLengthOffset:compressedBodyOffset]))
+	if compressedBodyOffset+length > len(buf) {
+		return &CorruptPageError{Page: id, Cause: compression.ErrCorrupt}
+	}
+	body := append([]byte(nil), buf[compressedBodyOffset:compressedBodyOffset+length]...)
+	if err := codec.Decompress(buf[pageHeaderSize:], body); err != nil {
+		return &CorruptPageError{Page: id, Cause: err}
+	}
+	buf[storedCompressedOffset] = 0
+	return nil
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/compression"
+	"github.com/example/granite-db/engine/internal/vfs"
+)
+
+func TestCompressedHeapPagesRoundTrip(t *testing.T) {
+	fsys := vfs.NewMemory()
+	if err := NewWithOptions("compressed.gdb", CreateOptions{FS: fsys}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	mgr, err := OpenWithOptions("compressed.gdb", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := mgr.EnableCompression(); err != nil {
+		t.Fatalf("enable compression: %v", err)
+	}
+	root, buf, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate root: %v", err)
+	}
+	if err := InitialiseHeapPage(buf); err != nil {
+		t.Fatalf("init root: %v", err)
+	}
+	SetPageCompression(buf, compression.LZ4)
+	if err := mgr.WritePage(root, buf); err != nil {
+		t.Fatalf("write root: %v", err)
+	}
+	fsm, err := CreateFreeSpaceMap(mgr, root)
+	if err != nil {
+		t.Fatalf("create fsm: %v", err)
+	}
+	heap := NewHeapFileWithMap(mgr, root, fsm)
+	var want [][]byte
+	for i := 0; i < 100; i++ {
+		record := []byte(fmt.Sprintf("%04d:%s", i, bytes.Repeat([]byte("London;"), 20)))
+		if _, err := heap.Insert(nil, nil, record); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		want = append(want, record)
+	}
+	pages, err := heap.Pages()
+	if err != nil || len(pages) < 2 {
+		t.Fatalf("expected several heap pages, got %d (%v)", len(pages), err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	f, err := fsys.OpenFile("compressed.gdb", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open raw: %v", err)
+	}
+	last := pages[len(pages)-1]
+	raw := make([]byte, PageSize)
+	if _, err := f.ReadAt(raw, int64(last)*PageSize); err != nil {
+		t.Fatalf("read raw: %v", err)
+	}
+	if raw[storedCompressedOffset] != 1 || PageCompression(raw) != compression.LZ4 {
+		t.Fatalf("expected page %d to be stored compressed", last)
+	}
+
+	mgr, err = OpenWithOptions("compressed.gdb", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	var got [][]byte
+	if err := NewHeapFileWithMap(mgr, root, fsm).Scan(func(_ RowID, record []byte) error {
+		got = append(got, append([]byte(nil), record...))
+		return nil
+	}); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d records, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("record %d changed: %q", i, got[i])
+		}
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Damage the compressed body; the page must be reported as corrupt.
+	raw[compressedBodyOffset+1] ^= 0xFF
+	if _, err := f.WriteAt(raw, int64(last)*PageSize); err != nil {
+		t.Fatalf("write raw: %v", err)
+	}
+	f.Close()
+	mgr, err = OpenWithOptions("compressed.gdb", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer mgr.Close()
+	if _, err := mgr.ReadPage(last); !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("expected a corrupt page error, got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FormatVersion is the database file format written by this engine. Older
+// versions listed in the upgrade registry can be migrated with
+// granitectl upgrade.
+const FormatVersion = headerVersion
+
+// ReadFormatVersion returns the format version recorded in a database file's
+// header without otherwise validating the file.
+func ReadFormatVersion(path string) (uint16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return 0, fmt.Errorf("storage: reading header of %s: %w", path, err)
+	}
+	if string(buf[:8]) != headerMagic {
+		return 0, errInvalidHeader
+	}
+	return binary.LittleEndian.Uint16(buf[8:10]), nil
+}
+
+// UpgradeInlineCatalog migrates a version 1 database, whose catalogue is held
+// inline in the header page, to version 2 by moving the catalogue onto a page
+// chain.
+func UpgradeInlineCatalog(path string) error {
+	mgr, err := Open(path)
+	if err != nil {
+		return err
+	}
+	if mgr.header.Version != legacyHeaderVersion {
+		mgr.Close()
+		return fmt.Errorf("storage: %s is not a version %d database", path, legacyHeaderVersion)
+	}
+	payload, err := mgr.CatalogData()
+	if err == nil {
+		err = mgr.UpdateCatalog(payload)
+	}
+	if closeErr := mgr.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// UpgradeKeyHeader migrates a version 2 database to version 3, which reserves
+// space in the header page for the encryption key header. The file stays
+// unencrypted.
+func UpgradeKeyHeader(path string) error {
+	return bumpVersion(path, catalogChainVersion, keyHeaderVersion)
+}
+
+// UpgradeCompression migrates a version 3 database to version 4, which may
+// hold compressed heap pages. No page changes; the version only stops older
+// engines from misreading compressed pages as corrupt.
+func UpgradeCompression(path string) error {
+	return bumpVersion(path, keyHeaderVersion, compressionVersion)
+}
+
+// UpgradeIndexTrees migrates a version 4 database to version 5, which keeps
+// its indexes as B+trees inside the data file. Building the trees needs the
+// rows, and so the key of an encrypted file; it happens when the database is
+// next opened for writing, so this step only bumps the version.
+func UpgradeIndexTrees(path string) error {
+	return bumpVersion(path, compressionVersion, indexTreeVersion)
+}
+
+// UpgradePrimaryKeys migrates a version 5 database to version 6, whose
+// catalogue backs every primary key with a unique index. Like the trees of
+// version 5, the indexes are built when the database is next opened for
+// writing, so this step only bumps the version.
+func UpgradePrimaryKeys(path string) error {
+	return bumpVersion(path, indexTreeVersion, primaryKeyVersion)
+}
+
+// UpgradeOrderedKeys migrates a version 6 database to version 7, whose index
+// trees hold keys that sort in key order. The catalogue of a version 6 file
+// marks every index as holding keys in the older encoding, and those trees
+// are rebuilt when the database is next opened for writing, so this step
+// only bumps the version.
+func UpgradeOrderedKeys(path string) error {
+	return bumpVersion(path, primaryKeyVersion, orderedKeyVersion)
+}
+
+// UpgradeCoveringIndexes migrates a version 7 database to version 8, whose
+// catalogue may record columns an index stores alongside its key. No version
+// 7 index has any, so this step only bumps the version.
+func UpgradeCoveringIndexes(path string) error {
+	return bumpVersion(path, orderedKeyVersion, coveringIndexVersion)
+}
+
+// UpgradeChecksums migrates a version 8 database to version 9, in which every
+// page carries a checksum. Pages written before checksums existed hold zero
+// in the checksum bytes, which older versions accept unverified, so the step
+// rewrites every page with its checksum before the version changes. The pages
+// of an encrypted file were all written after checksums existed, and opening
+// one needs its key, so for those only the version changes.
+func UpgradeChecksums(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, headerSize)
+	_, err = io.ReadFull(f, buf)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("storage: reading header of %s: %w", path, err)
+	}
+	header, err := readHeader(buf)
+	if err != nil {
+		return err
+	}
+	if header.Version != coveringIndexVersion {
+		return fmt.Errorf("storage: %s is not a version %d database", path, coveringIndexVersion)
+	}
+	if header.Key == nil {
+		mgr, err := Open(path)
+		if err != nil {
+			return err
+		}
+		err = mgr.restampPages()
+		if closeErr := mgr.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bumpVersion(path, coveringIndexVersion, checksumVersion)
+}
+
+// EnableIndexTrees prepares the file to hold index B+trees whose keys sort in
+// key order, which needs format version 7. Version 3 to 6 files are bumped in
+// place, since none differs from version 7 in any page it already holds and
+// the catalogue records which trees use the older key encoding; older files
+// must be upgraded first.
+func (m *Manager) EnableIndexTrees() error {
+	return m.enableVersion("indexes", orderedKeyVersion)
+}
+
+// EnablePrimaryKeys prepares the file to record primary keys backed by an
+// index. The index tree needs format version 7, so this bumps the same
+// versions as EnableIndexTrees.
+func (m *Manager) EnablePrimaryKeys() error {
+	return m.enableVersion("primary keys", orderedKeyVersion)
+}
+
+// EnableCoveringIndexes prepares the file to record an index that stores
+// columns alongside its key, which needs format version 8. Older engines
+// would leave those columns out of the entries they write, so the first such
+// index bumps version 3 to 7 files in place; older files must be upgraded
+// first.
+func (m *Manager) EnableCoveringIndexes() error {
+	return m.enableVersion("covering indexes", coveringIndexVersion)
+}
+
+// enableVersion bumps the file to at least the target version, in place,
+// when the file's layout already matches it.
+func (m *Manager) enableVersion(feature string, target uint16) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.header.Version >= target:
+		return nil
+	case m.header.Version >= keyHeaderVersion:
+		m.header.Version = target
+		return m.flushHeaderLocked()
+	default:
+		return fmt.Errorf("storage: %s need database format version %d; run granitectl upgrade", feature, target)
+	}
+}
+
+// bumpVersion rewrites the version of a database whose layout is already
+// compatible with the newer format. The header page is never encrypted, so
+// this works on encrypted files without their key.
+func bumpVersion(path string, from, to uint16) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return fmt.Errorf("storage: reading header of %s: %w", path, err)
+	}
+	if string(buf[:8]) != headerMagic {
+		return errInvalidHeader
+	}
+	if version := binary.LittleEndian.Uint16(buf[8:10]); version != from {
+		return fmt.Errorf("storage: %s is not a version %d database", path, from)
+	}
+	binary.LittleEndian.PutUint16(buf[8:10], to)
+	if _, err := f.WriteAt(buf[8:10], 8); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func checkHeaderVersion(version uint16) error {
+	switch {
+	case version >= legacyHeaderVersion && version <= headerVersion:
+		return nil
+	case version > headerVersion:
+		return fmt.Errorf("storage: database format version %d is newer than this engine supports (%d)", version, headerVersion)
+	default:
+		return fmt.Errorf("storage: database format version %d is no longer readable; run granitectl upgrade", version)
+	}
+}
@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// Free-space map (FSM) pages record how many bytes each heap page of a table
+// can still accept. They are chained through their first four bytes, exactly
+// like heap pages, and the first FSM page additionally remembers the last page
+// of the heap chain so new pages can be linked without walking the heap.
+//
+// Every change to an FSM page is logged with the transaction that makes it,
+// like the heap pages it describes, so recovery never leaves the map sending
+// inserts to a page outside the chain. The entries remain hints all the same:
+// Insert re-checks the heap page it is sent to and corrects the entry when
+// the map turns out to be stale.
+//
+// A map holds one entry per heap page, so reading it from the start on every
+// insert would cost a page read per few hundred heap pages. The manager
+// instead keeps a summary of each map it has walked (see fsmSummary), which
+// lets a search skip the pages with no room and an update go straight to the
+// entry it changes.
+const (
+	fsmHeaderSize = 16
+	fsmEntrySize  = 6
+)
+
+// InitialiseFreeSpacePage prepares an empty free-space map page.
+func InitialiseFreeSpacePage(page []byte) error {
+	if err := checkPageBuffer(page); err != nil {
+		return err
+	}
+	for i := range page {
+		page[i] = 0
+	}
+	return nil
+}
+
+type fsmHeader struct {
+	NextPage PageID
+	Count    uint16
+	HeapTail PageID
+}
+
+func readFSMHeader(page []byte) fsmHeader {
+	return fsmHeader{
+		NextPage: PageID(binary.LittleEndian.Uint32(page[0:4])),
+		Count:    binary.LittleEndian.Uint16(page[4:6]),
+		HeapTail: PageID(binary.LittleEndian.Uint32(page[6:10])),
+	}
+}
+
+func writeFSMHeader(page []byte, h fsmHeader) {
+	binary.LittleEndian.PutUint32(page[0:4], uint32(h.NextPage))
+	binary.LittleEndian.PutUint16(page[4:6], h.Count)
+	binary.LittleEndian.PutUint32(page[6:10], uint32(h.HeapTail))
+}
+
+func fsmEntriesPerPage(pageSize int) int {
+	return (pageSize - fsmHeaderSize) / fsmEntrySize
+}
+
+func fsmEntry(page []byte, i int) (PageID, int) {
+	pos := fsmHeaderSize + i*fsmEntrySize
+	id := PageID(binary.LittleEndian.Uint32(page[pos : pos+4]))
+	free := int(binary.LittleEndian.Uint16(page[pos+4 : pos+6]))
+	return id, free
+}
+
+func setFSMEntry(page []byte, i int, id PageID, free int) {
+	pos := fsmHeaderSize + i*fsmEntrySize
+	binary.LittleEndian.PutUint32(page[pos:pos+4], uint32(id))
+	binary.LittleEndian.PutUint16(page[pos+4:pos+6], uint16(free))
+}
+
+// freeSpaceMap is a view over the FSM chain of one heap file.
+type freeSpaceMap struct {
+	manager *Manager
+	root    PageID
+}
+
+// fsmSummary is what the manager remembers of one map: its pages in chain
+// order, an upper bound on the free space recorded on each, where the entry
+// of each heap page sits, and the page the last successful search ended on.
+// The map pages stay authoritative. A remembered entry is checked against
+// its page before it is used, and the summary is forgotten whenever pages of
+// its chain are freed or the chain is rewritten other than through update.
+type fsmSummary struct {
+	pages   []PageID
+	maxFree []int
+	where   map[PageID]fsmSlot
+	next    int
+}
+
+// fsmSlot locates an entry: the position of its page in the chain and its
+// index on that page.
+type fsmSlot struct {
+	page  int
+	index int
+}
+
+// summary returns the manager's summary of the map, walking the chain to
+// build it when there is none.
+func (m freeSpaceMap) summary() (*fsmSummary, error) {
+	if sum := m.manager.freeSpaceSummary(m.root); sum != nil {
+		return sum, nil
+	}
+	sum := &fsmSummary{where: make(map[PageID]fsmSlot)}
+	err := m.walk(func(id PageID, page []byte) (bool, error) {
+		hdr := readFSMHeader(page)
+		most := 0
+		for i := 0; i < int(hdr.Count); i++ {
+			heapID, free := fsmEntry(page, i)
+			sum.where[heapID] = fsmSlot{page: len(sum.pages), index: i}
+			most = max(most, free)
+		}
+		sum.pages = append(sum.pages, id)
+		sum.maxFree = append(sum.maxFree, most)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.manager.storeFreeSpaceSummary(m.root, sum)
+	return sum, nil
+}
+
+// find returns a heap page recorded with at least need free bytes. The search
+// starts on the map page where the previous one succeeded, wraps round to the
+// start of the chain, and only reads pages that may hold a large enough
+// entry.
+func (m freeSpaceMap) find(need int) (PageID, bool, error) {
+	sum, err := m.summary()
+	if err != nil {
+		return 0, false, err
+	}
+	for k := range sum.pages {
+		pos := (sum.next + k) % len(sum.pages)
+		if sum.maxFree[pos] < need {
+			continue
+		}
+		page, err := m.manager.ReadPage(sum.pages[pos])
+		if err != nil {
+			return 0, false, err
+		}
+		hdr := readFSMHeader(page)
+		most := 0
+		for i := 0; i < int(hdr.Count); i++ {
+			heapID, free := fsmEntry(page, i)
+			if free >= need {
+				sum.next = pos
+				return heapID, true, nil
+			}
+			most = max(most, free)
+		}
+		sum.maxFree[pos] = most
+	}
+	return 0, false, nil
+}
+
+// update records the free space for a heap page, appending an entry when the
+// page is not yet tracked.
+func (m freeSpaceMap) update(tx *txn.Transaction, log *wal.Manager, heapID PageID, free int) error {
+	sum, err := m.summary()
+	if err != nil {
+		return err
+	}
+	if slot, ok := sum.where[heapID]; ok {
+		id := sum.pages[slot.page]
+		page, err := m.manager.ReadPage(id)
+		if err != nil {
+			return err
+		}
+		entryID, current := fsmEntry(page, slot.index)
+		if slot.index >= int(readFSMHeader(page).Count) || entryID != heapID {
+			// The summary is out of date; build it again from the map.
+			m.manager.forgetFreeSpaceMap(m.root)
+			return m.update(tx, log, heapID, free)
+		}
+		if current == free {
+			return nil
+		}
+		setFSMEntry(page, slot.index, heapID, free)
+		sum.maxFree[slot.page] = max(sum.maxFree[slot.page], free)
+		return persistPage(tx, log, m.manager, wal.RecordPageMeta, id, page)
+	}
+
+	lastPos := len(sum.pages) - 1
+	last := sum.pages[lastPos]
+	lastBuf, err := m.manager.ReadPage(last)
+	if err != nil {
+		return err
+	}
+	hdr := readFSMHeader(lastBuf)
+	if int(hdr.Count) < fsmEntriesPerPage(m.manager.pageSize) {
+		setFSMEntry(lastBuf, int(hdr.Count), heapID, free)
+		sum.where[heapID] = fsmSlot{page: lastPos, index: int(hdr.Count)}
+		sum.maxFree[lastPos] = max(sum.maxFree[lastPos], free)
+		hdr.Count++
+		writeFSMHeader(lastBuf, hdr)
+		return persistPage(tx, log, m.manager, wal.RecordPageMeta, last, lastBuf)
+	}
+	newID, newBuf, err := m.manager.AllocatePage()
+	if err != nil {
+		return err
+	}
+	if err := InitialiseFreeSpacePage(newBuf); err != nil {
+		return err
+	}
+	setFSMEntry(newBuf, 0, heapID, free)
+	writeFSMHeader(newBuf, fsmHeader{Count: 1})
+	if err := persistPage(tx, log, m.manager, wal.RecordPageMeta, newID, newBuf); err != nil {
+		return err
+	}
+	hdr.NextPage = newID
+	writeFSMHeader(lastBuf, hdr)
+	if err := persistPage(tx, log, m.manager, wal.RecordPageMeta, last, lastBuf); err != nil {
+		return err
+	}
+	sum.pages = append(sum.pages, newID)
+	sum.maxFree = append(sum.maxFree, free)
+	sum.where[heapID] = fsmSlot{page: len(sum.pages) - 1, index: 0}
+	m.manager.storeFreeSpaceSummary(m.root, sum)
+	return nil
+}
+
+// heapTail returns the last heap page recorded in the map, or 0 when unknown.
+func (m freeSpaceMap) heapTail() (PageID, error) {
+	page, err := m.manager.ReadPage(m.root)
+	if err != nil {
+		return 0, err
+	}
+	return readFSMHeader(page).HeapTail, nil
+}
+
+func (m freeSpaceMap) setHeapTail(tx *txn.Transaction, log *wal.Manager, id PageID) error {
+	page, err := m.manager.ReadPage(m.root)
+	if err != nil {
+		return err
+	}
+	hdr := readFSMHeader(page)
+	hdr.HeapTail = id
+	writeFSMHeader(page, hdr)
+	return persistPage(tx, log, m.manager, wal.RecordPageMeta, m.root, page)
+}
+
+// pages returns every page id in the FSM chain.
+func (m freeSpaceMap) pages() ([]PageID, error) {
+	ids := make([]PageID, 0, 1)
+	err := m.walk(func(id PageID, _ []byte) (bool, error) {
+		ids = append(ids, id)
+		return false, nil
+	})
+	return ids, err
+}
+
+// walk visits FSM pages in chain order until fn reports it is done. The page
+// buffer handed to fn is a private copy that may be modified and written back.
+func (m freeSpaceMap) walk(fn func(id PageID, page []byte) (bool, error)) error {
+	seen := make(map[PageID]struct{})
+	current := m.root
+	for current != 0 {
+		if _, loop := seen[current]; loop {
+			return fmt.Errorf("storage: free-space map loop at page %d", current)
+		}
+		seen[current] = struct{}{}
+		page, err := m.manager.ReadPage(current)
+		if err != nil {
+			return err
+		}
+		done, err := fn(current, page)
+		if err != nil || done {
+			return err
+		}
+		current = readFSMHeader(page).NextPage
+	}
+	return nil
+}
+
+// freeSpaceSummary returns the summary kept for the map rooted at root, or nil.
+func (m *Manager) freeSpaceSummary(root PageID) *fsmSummary {
+	m.fsmMu.Lock()
+	defer m.fsmMu.Unlock()
+	return m.fsmSummaries[root]
+}
+
+// storeFreeSpaceSummary keeps sum for the map rooted at root and records
+// which map each of its pages belongs to.
+func (m *Manager) storeFreeSpaceSummary(root PageID, sum *fsmSummary) {
+	m.fsmMu.Lock()
+	defer m.fsmMu.Unlock()
+	if m.fsmSummaries == nil {
+		m.fsmSummaries = make(map[PageID]*fsmSummary)
+		m.fsmOwners = make(map[PageID]PageID)
+	}
+	m.fsmSummaries[root] = sum
+	for _, id := range sum.pages {
+		m.fsmOwners[id] = root
+	}
+}
+
+// forgetFreeSpaceMap drops the summary of the map rooted at root. Code that
+// rewrites map pages other than through freeSpaceMap.update calls it.
+func (m *Manager) forgetFreeSpaceMap(root PageID) {
+	m.fsmMu.Lock()
+	defer m.fsmMu.Unlock()
+	m.forgetFreeSpaceMapLocked(root)
+}
+
+func (m *Manager) forgetFreeSpaceMapLocked(root PageID) {
+	sum, ok := m.fsmSummaries[root]
+	if !ok {
+		return
+	}
+	for _, id := range sum.pages {
+		if m.fsmOwners[id] == root {
+			delete(m.fsmOwners, id)
+		}
+	}
+	delete(m.fsmSummaries, root)
+}
+
+// forgetFreeSpacePage drops the summary of the map that page id belongs to,
+// if any, before the page is reused.
+func (m *Manager) forgetFreeSpacePage(id PageID) {
+	m.fsmMu.Lock()
+	defer m.fsmMu.Unlock()
+	if root, ok := m.fsmOwners[id]; ok {
+		m.forgetFreeSpaceMapLocked(root)
+	}
+}
+
+// forgetFreeSpaceMaps drops every summary, for operations that move pages.
+func (m *Manager) forgetFreeSpaceMaps() {
+	m.fsmMu.Lock()
+	defer m.fsmMu.Unlock()
+	m.fsmSummaries = nil
+	m.fsmOwners = nil
+}
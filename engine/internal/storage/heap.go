@@ -8,30 +8,35 @@ import (
 const (
 	heapHeaderSize = 16
 	slotSize       = 4
+
+	// slotExternal marks a slot whose record is a pointer to overflow pages
+	// rather than the row itself; the remaining bits hold the stored length.
+	slotExternal   = 0x8000
+	slotLengthMask = 0x7FFF
 )
 
 // InitialiseHeapPage prepares a blank heap page for row storage.
 func InitialiseHeapPage(page []byte) error {
-	if len(page) != PageSize {
-		return errShortPage
+	if err := checkPageBuffer(page); err != nil {
+		return err
 	}
 	for i := range page {
 		page[i] = 0
 	}
-	binary.LittleEndian.PutUint32(page[0:4], 0)              // next page id
-	binary.LittleEndian.PutUint16(page[4:6], 0)              // slot count
-	binary.LittleEndian.PutUint16(page[6:8], heapHeaderSize) // free start
-	binary.LittleEndian.PutUint16(page[8:10], PageSize)      // free end
-	binary.LittleEndian.PutUint32(page[12:16], 0)            // reserved/row count
+	binary.LittleEndian.PutUint32(page[0:4], 0)                  // next page id
+	binary.LittleEndian.PutUint16(page[4:6], 0)                  // slot count
+	binary.LittleEndian.PutUint16(page[6:8], heapHeaderSize)     // free start
+	binary.LittleEndian.PutUint16(page[8:10], uint16(len(page))) // free end
+	binary.LittleEndian.PutUint32(page[12:16], 0)                // reserved/row count
 	return nil
 }
 
 // HeapPageHeader exposes metadata for a heap page.
 type HeapPageHeader struct {
-	NextPage  PageID
-	SlotCount uint16
-	FreeStart uint16
-	FreeEnd   uint16
+	NextPage  PageID `json:"nextPage"`
+	SlotCount uint16 `json:"slotCount"`
+	FreeStart uint16 `json:"freeStart"`
+	FreeEnd   uint16 `json:"freeEnd"`
 }
 
 func readHeapHeader(page []byte) HeapPageHeader {
@@ -63,8 +68,8 @@ type HeapPage struct {
 
 // LoadHeapPage constructs a heap page from the supplied buffer.
 func LoadHeapPage(id PageID, buf []byte) (*HeapPage, error) {
-	if len(buf) != PageSize {
-		return nil, errShortPage
+	if err := checkPageBuffer(buf); err != nil {
+		return nil, err
 	}
 	return &HeapPage{id: id, data: buf, hdr: readHeapHeader(buf)}, nil
 }
@@ -85,31 +90,163 @@ func (p *HeapPage) SetNextPage(id PageID) {
 	writeHeapHeader(p.data, p.hdr)
 }
 
-// Insert appends a new record to the page if space permits.
+// Insert stores a record on the page. An empty slot left behind by a delete
+// is reused when available, and the page is compacted first when its free
+// bytes are fragmented.
 func (p *HeapPage) Insert(record []byte) (uint16, error) {
-	required := len(record) + slotSize
-	if required > p.FreeSpace() {
+	return p.insert(record, false)
+}
+
+func (p *HeapPage) insert(record []byte, external bool) (uint16, error) {
+	slot, reuse := p.emptySlot()
+	required := len(record)
+	if !reuse {
+		required += slotSize
+	}
+	if required > p.AvailableSpace() {
 		return 0, fmt.Errorf("storage: insufficient free space in page %d", p.id)
 	}
+	if required > p.FreeSpace() {
+		p.compact(false)
+	}
 	offset := int(p.hdr.FreeStart)
 	copy(p.data[offset:], record)
 	p.hdr.FreeStart += uint16(len(record))
 
-	slotPos := int(p.hdr.FreeEnd) - slotSize
-	binary.LittleEndian.PutUint16(p.data[slotPos:slotPos+2], uint16(offset))
-	binary.LittleEndian.PutUint16(p.data[slotPos+2:slotPos+4], uint16(len(record)))
+	if !reuse {
+		slot = p.hdr.SlotCount
+		p.hdr.SlotCount++
+		p.hdr.FreeEnd -= slotSize
+	}
+	length := uint16(len(record))
+	if external {
+		length |= slotExternal
+	}
+	p.setSlot(slot, uint16(offset), length)
+	writeHeapHeader(p.data, p.hdr)
+	return slot, nil
+}
+
+// Fits reports whether a record of the given length can be inserted, possibly
+// after compacting the page.
+func (p *HeapPage) Fits(length int) bool {
+	if _, reuse := p.emptySlot(); reuse {
+		return length <= p.AvailableSpace()
+	}
+	return length+slotSize <= p.AvailableSpace()
+}
+
+// AvailableSpace returns the bytes a new record could use once the page is
+// compacted: the contiguous free region plus space held by deleted records.
+func (p *HeapPage) AvailableSpace() int {
+	return p.FreeSpace() + p.deadBytes()
+}
+
+// External reports whether the slot holds a pointer to overflow pages.
+func (p *HeapPage) External(slot uint16) bool {
+	if slot >= p.hdr.SlotCount {
+		return false
+	}
+	_, length := p.slot(slot)
+	return length&slotExternal != 0
+}
+
+// LiveCount returns the number of slots holding a record.
+func (p *HeapPage) LiveCount() int {
+	count := 0
+	for i := uint16(0); i < p.hdr.SlotCount; i++ {
+		if _, length := p.slot(i); length != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// Compact moves live records together at the start of the data region and
+// drops empty slots from the end of the slot directory. Slot numbers of live
+// records do not change. It returns the number of bytes reclaimed.
+func (p *HeapPage) Compact() int {
+	before := p.FreeSpace()
+	p.compact(true)
+	return p.FreeSpace() - before
+}
 
-	p.hdr.SlotCount++
-	p.hdr.FreeEnd = uint16(slotPos)
+func (p *HeapPage) compact(trimSlots bool) {
+	type liveRecord struct {
+		slot  uint16
+		flags uint16
+		data  []byte
+	}
+	live := make([]liveRecord, 0, p.hdr.SlotCount)
+	for i := uint16(0); i < p.hdr.SlotCount; i++ {
+		offset, length := p.slot(i)
+		if length == 0 {
+			continue
+		}
+		data := make([]byte, length&slotLengthMask)
+		copy(data, p.data[offset:])
+		live = append(live, liveRecord{slot: i, flags: length &^ slotLengthMask, data: data})
+	}
+	if trimSlots {
+		count := uint16(0)
+		if len(live) > 0 {
+			count = live[len(live)-1].slot + 1
+		}
+		p.hdr.SlotCount = count
+		p.hdr.FreeEnd = uint16(len(p.data) - int(count)*slotSize)
+	}
+	for i := heapHeaderSize; i < int(p.hdr.FreeEnd); i++ {
+		p.data[i] = 0
+	}
+	offset := heapHeaderSize
+	for _, rec := range live {
+		copy(p.data[offset:], rec.data)
+		p.setSlot(rec.slot, uint16(offset), uint16(len(rec.data))|rec.flags)
+		offset += len(rec.data)
+	}
+	p.hdr.FreeStart = uint16(offset)
 	writeHeapHeader(p.data, p.hdr)
-	return p.hdr.SlotCount - 1, nil
 }
 
-// Records iterates over stored rows, invoking fn for each entry.
+func (p *HeapPage) emptySlot() (uint16, bool) {
+	for i := uint16(0); i < p.hdr.SlotCount; i++ {
+		if _, length := p.slot(i); length == 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (p *HeapPage) deadBytes() int {
+	used := 0
+	for i := uint16(0); i < p.hdr.SlotCount; i++ {
+		_, length := p.slot(i)
+		used += int(length & slotLengthMask)
+	}
+	return int(p.hdr.FreeStart) - heapHeaderSize - used
+}
+
+func (p *HeapPage) slotPos(slot uint16) int {
+	return int(p.hdr.FreeEnd) + int(p.hdr.SlotCount-1-slot)*slotSize
+}
+
+func (p *HeapPage) slot(slot uint16) (uint16, uint16) {
+	pos := p.slotPos(slot)
+	return binary.LittleEndian.Uint16(p.data[pos : pos+2]), binary.LittleEndian.Uint16(p.data[pos+2 : pos+4])
+}
+
+func (p *HeapPage) setSlot(slot, offset, length uint16) {
+	pos := p.slotPos(slot)
+	binary.LittleEndian.PutUint16(p.data[pos:pos+2], offset)
+	binary.LittleEndian.PutUint16(p.data[pos+2:pos+4], length)
+}
+
+// Records iterates over stored rows, invoking fn for each entry. Slots marked
+// External yield the overflow pointer rather than the row.
 func (p *HeapPage) Records(fn func(slot uint16, record []byte) error) error {
 	for i := uint16(0); i < p.hdr.SlotCount; i++ {
 		slotPos := int(p.hdr.FreeEnd) + int(p.hdr.SlotCount-1-i)*slotSize
-		length := binary.LittleEndian.Uint16(p.data[slotPos+2 : slotPos+4])
+		length := binary.LittleEndian.Uint16(p.data[slotPos+2:slotPos+4]) & slotLengthMask
 		if length == 0 {
 			continue
 		}
@@ -133,7 +270,7 @@ func (p *HeapPage) Record(slot uint16) ([]byte, error) {
                 return nil, fmt.Errorf("storage: slot %d out of bounds", slot)
         }
         slotPos := int(p.hdr.FreeEnd) + int(p.hdr.SlotCount-1-slot)*slotSize
-        length := binary.LittleEndian.Uint16(p.data[slotPos+2 : slotPos+4])
+        length := binary.LittleEndian.Uint16(p.data[slotPos+2 : slotPos+4]) & slotLengthMask
         if length == 0 {
                 return nil, fmt.Errorf("storage: slot %d is empty", slot)
         }
@@ -144,6 +281,48 @@ func (p *HeapPage) Record(slot uint16) ([]byte, error) {
         return p.data[offset : offset+length], nil
 }
 
+// Update replaces the record in slot, keeping the slot number. A record no
+// longer than the old one overwrites it; a longer one moves into the page's
+// free space, compacting the page first if needed. Update reports false and
+// leaves the page unchanged when the record does not fit.
+func (p *HeapPage) Update(slot uint16, record []byte) (bool, error) {
+	return p.update(slot, record, false)
+}
+
+func (p *HeapPage) update(slot uint16, record []byte, external bool) (bool, error) {
+	if slot >= p.hdr.SlotCount {
+		return false, fmt.Errorf("storage: slot %d out of bounds", slot)
+	}
+	offset, length := p.slot(slot)
+	if length == 0 {
+		return false, fmt.Errorf("storage: slot %d is empty", slot)
+	}
+	flags := uint16(0)
+	if external {
+		flags = slotExternal
+	}
+	old := int(length & slotLengthMask)
+	if len(record) <= old {
+		copy(p.data[offset:], record)
+		p.setSlot(slot, offset, uint16(len(record))|flags)
+		return true, nil
+	}
+	// Releasing the old copy makes its bytes available too.
+	if len(record) > p.AvailableSpace()+old {
+		return false, nil
+	}
+	p.setSlot(slot, 0, 0)
+	if len(record) > p.FreeSpace() {
+		p.compact(false)
+	}
+	start := p.hdr.FreeStart
+	copy(p.data[start:], record)
+	p.hdr.FreeStart += uint16(len(record))
+	p.setSlot(slot, start, uint16(len(record))|flags)
+	writeHeapHeader(p.data, p.hdr)
+	return true, nil
+}
+
 // Delete marks the provided slot as free.
 func (p *HeapPage) Delete(slot uint16) error {
         if slot >= p.hdr.SlotCount {
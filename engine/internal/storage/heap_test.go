@@ -40,3 +40,49 @@ func TestHeapPageInsertAndRecords(t *testing.T) {
 		t.Fatalf("expected %d records, read %d", len(records), idx)
 	}
 }
+
+func TestHeapPageUpdateKeepsSlot(t *testing.T) {
+	buf := make([]byte, PageSize)
+	if err := InitialiseHeapPage(buf); err != nil {
+		t.Fatalf("init page: %v", err)
+	}
+	page, err := LoadHeapPage(1, buf)
+	if err != nil {
+		t.Fatalf("load page: %v", err)
+	}
+	first, _ := page.Insert([]byte(strings.Repeat("a", 100)))
+	second, _ := page.Insert([]byte(strings.Repeat("b", 100)))
+
+	// A shorter record overwrites the old bytes.
+	offset, _ := page.slot(first)
+	if ok, err := page.Update(first, []byte("short")); err != nil || !ok {
+		t.Fatalf("update shorter: %v (%v)", ok, err)
+	}
+	if newOffset, _ := page.slot(first); newOffset != offset {
+		t.Fatalf("expected the record to stay at offset %d, got %d", offset, newOffset)
+	}
+
+	// A longer one moves within the page, compacting it when the free region
+	// alone is too small.
+	if _, err := page.Insert([]byte(strings.Repeat("c", page.FreeSpace()-slotSize))); err != nil {
+		t.Fatalf("fill page: %v", err)
+	}
+	longer := []byte(strings.Repeat("B", 150))
+	if ok, err := page.Update(second, longer); err != nil || !ok {
+		t.Fatalf("update longer: %v (%v)", ok, err)
+	}
+	for slot, want := range map[uint16]string{first: "short", second: string(longer)} {
+		got, err := page.Record(slot)
+		if err != nil || string(got) != want {
+			t.Fatalf("slot %d holds %q (%v)", slot, got, err)
+		}
+	}
+
+	before := append([]byte(nil), page.Data()...)
+	if ok, err := page.Update(first, []byte(strings.Repeat("x", PageSize))); err != nil || ok {
+		t.Fatalf("expected an oversized update to be refused, got %v (%v)", ok, err)
+	}
+	if string(before) != string(page.Data()) {
+		t.Fatalf("expected a refused update to leave the page unchanged")
+	}
+}
@@ -11,6 +11,7 @@ import (
 type HeapFile struct {
 	manager *Manager
 	root    PageID
+	fsm     PageID
 }
 
 // NewHeapFile creates a heap file from the provided root page id.
@@ -18,56 +19,310 @@ func NewHeapFile(mgr *Manager, root PageID) *HeapFile {
 	return &HeapFile{manager: mgr, root: root}
 }
 
+// NewHeapFileWithMap creates a heap file whose free space is tracked by the
+// free-space map rooted at fsm. A zero fsm behaves like NewHeapFile.
+func NewHeapFileWithMap(mgr *Manager, root, fsm PageID) *HeapFile {
+	return &HeapFile{manager: mgr, root: root, fsm: fsm}
+}
+
+// CreateFreeSpaceMap allocates an FSM page describing the (empty) heap page
+// root and returns its id.
+func CreateFreeSpaceMap(mgr *Manager, root PageID) (PageID, error) {
+	id, buf, err := mgr.AllocatePage()
+	if err != nil {
+		return 0, err
+	}
+	if err := InitialiseFreeSpacePage(buf); err != nil {
+		return 0, err
+	}
+	if err := mgr.WritePage(id, buf); err != nil {
+		return 0, err
+	}
+	fsm := freeSpaceMap{manager: mgr, root: id}
+	if err := fsm.update(nil, nil, root, mgr.pageSize-heapHeaderSize); err != nil {
+		return 0, err
+	}
+	if err := fsm.setHeapTail(nil, nil, root); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
 // Root returns the first page of the heap file.
 func (hf *HeapFile) Root() PageID {
 	return hf.root
 }
 
-// Insert writes the record to the first page with sufficient space.
+// FreeSpaceMap returns the first page of the free-space map, or 0 when the heap
+// file is not tracked by one.
+func (hf *HeapFile) FreeSpaceMap() PageID {
+	return hf.fsm
+}
+
+// Insert writes the record to a page with sufficient space. Heap files with a
+// free-space map consult it to pick the page; older heap files fall back to
+// walking the page chain from the root. Records too large for a heap page are
+// written to a chain of overflow pages and only a pointer is stored inline.
 func (hf *HeapFile) Insert(tx *txn.Transaction, log *wal.Manager, record []byte) (RowID, error) {
 	if hf.root == 0 {
 		return RowID{}, fmt.Errorf("storage: heap file has no root page")
 	}
+	external := false
+	if len(record) > maxInlineRecord(hf.manager.pageSize) {
+		stub, err := hf.writeOverflow(tx, log, record)
+		if err != nil {
+			return RowID{}, err
+		}
+		record, external = stub, true
+	}
+	if hf.fsm == 0 {
+		return hf.insertByWalking(tx, log, record, external)
+	}
 
-	currentID := hf.root
+	required := len(record) + slotSize
+
+	fsm := freeSpaceMap{manager: hf.manager, root: hf.fsm}
 	for {
-		pageBuf, err := hf.manager.ReadPage(currentID)
+		candidate, ok, err := fsm.find(required)
 		if err != nil {
 			return RowID{}, err
 		}
-		page, err := LoadHeapPage(currentID, pageBuf)
+		if !ok {
+			break
+		}
+		rid, inserted, free, err := hf.insertIntoPage(tx, log, candidate, record, external)
 		if err != nil {
 			return RowID{}, err
 		}
-		if page.FreeSpace() >= len(record)+slotSize {
-			slot, err := page.Insert(record)
+		// Record the page's real free space either way; a miss means the
+		// entry was stale and must not be offered again.
+		if err := fsm.update(tx, log, candidate, free); err != nil {
+			return RowID{}, err
+		}
+		if inserted {
+			return rid, nil
+		}
+	}
+
+	tail, err := hf.tailPage(fsm)
+	if err != nil {
+		return RowID{}, err
+	}
+	newID, err := hf.appendPage(tx, log, tail)
+	if err != nil {
+		return RowID{}, err
+	}
+	if err := fsm.setHeapTail(tx, log, newID); err != nil {
+		return RowID{}, err
+	}
+	rid, _, free, err := hf.insertIntoPage(tx, log, newID, record, external)
+	if err != nil {
+		return RowID{}, err
+	}
+	if err := fsm.update(tx, log, newID, free); err != nil {
+		return RowID{}, err
+	}
+	return rid, nil
+}
+
+// InsertBatch appends records to the end of the heap for bulk loads. Records
+// are packed onto the tail page and then onto fresh pages in order, and each
+// page is logged once when it is full rather than once per record. Free space
+// earlier in the heap is not reused. The row ids are returned in input order.
+func (hf *HeapFile) InsertBatch(tx *txn.Transaction, log *wal.Manager, records [][]byte) ([]RowID, error) {
+	if hf.root == 0 {
+		return nil, fmt.Errorf("storage: heap file has no root page")
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	fsm := freeSpaceMap{manager: hf.manager, root: hf.fsm}
+	var (
+		tail PageID
+		err  error
+	)
+	if hf.fsm != 0 {
+		tail, err = hf.tailPage(fsm)
+	} else {
+		tail, err = hf.walkToTail()
+	}
+	if err != nil {
+		return nil, err
+	}
+	page, err := hf.loadPage(tail)
+	if err != nil {
+		return nil, err
+	}
+	dirty := false
+	flush := func() error {
+		if !dirty {
+			return nil
+		}
+		dirty = false
+		if err := persistPage(tx, log, hf.manager, wal.RecordInsert, page.id, page.Data()); err != nil {
+			return err
+		}
+		if hf.fsm == 0 {
+			return nil
+		}
+		return fsm.update(tx, log, page.id, page.AvailableSpace())
+	}
+
+	rids := make([]RowID, 0, len(records))
+	for _, record := range records {
+		external := false
+		if len(record) > maxInlineRecord(hf.manager.pageSize) {
+			stub, err := hf.writeOverflow(tx, log, record)
 			if err != nil {
-				return RowID{}, err
-			}
-			if err := persistPage(tx, log, hf.manager, wal.RecordInsert, currentID, page.Data()); err != nil {
-				return RowID{}, err
+				return nil, err
 			}
-			return RowID{Page: currentID, Slot: slot}, nil
+			record, external = stub, true
 		}
-		if page.NextPage() == 0 {
-			newID, newBuf, err := hf.manager.AllocatePage()
+		if !page.Fits(len(record)) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			next, err := hf.appendPage(tx, log, page.id)
 			if err != nil {
-				return RowID{}, err
+				return nil, err
 			}
-			if err := InitialiseHeapPage(newBuf); err != nil {
-				return RowID{}, err
+			if hf.fsm != 0 {
+				if err := fsm.setHeapTail(tx, log, next); err != nil {
+					return nil, err
+				}
 			}
-			if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, newID, newBuf); err != nil {
-				return RowID{}, err
+			if page, err = hf.loadPage(next); err != nil {
+				return nil, err
 			}
-			page.SetNextPage(newID)
-			if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, currentID, page.Data()); err != nil {
+		}
+		slot, err := page.insert(record, external)
+		if err != nil {
+			return nil, err
+		}
+		dirty = true
+		rids = append(rids, RowID{Page: page.id, Slot: slot})
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return rids, nil
+}
+
+// walkToTail follows the page chain of a heap without a free-space map to its
+// last page.
+func (hf *HeapFile) walkToTail() (PageID, error) {
+	current := hf.root
+	for {
+		buf, err := hf.manager.ReadPage(current)
+		if err != nil {
+			return 0, err
+		}
+		next := readHeapHeader(buf).NextPage
+		if next == 0 {
+			return current, nil
+		}
+		current = next
+	}
+}
+
+func (hf *HeapFile) insertByWalking(tx *txn.Transaction, log *wal.Manager, record []byte, external bool) (RowID, error) {
+	currentID := hf.root
+	for {
+		rid, inserted, _, err := hf.insertIntoPage(tx, log, currentID, record, external)
+		if err != nil {
+			return RowID{}, err
+		}
+		if inserted {
+			return rid, nil
+		}
+		pageBuf, err := hf.manager.ReadPage(currentID)
+		if err != nil {
+			return RowID{}, err
+		}
+		next := readHeapHeader(pageBuf).NextPage
+		if next == 0 {
+			next, err = hf.appendPage(tx, log, currentID)
+			if err != nil {
 				return RowID{}, err
 			}
-			currentID = newID
-			continue
 		}
-		currentID = page.NextPage()
+		currentID = next
+	}
+}
+
+// insertIntoPage stores the record on the given page when it fits; external
+// marks the record as an overflow pointer. It reports whether the record was
+// stored and the free space left on the page.
+func (hf *HeapFile) insertIntoPage(tx *txn.Transaction, log *wal.Manager, id PageID, record []byte, external bool) (RowID, bool, int, error) {
+	pageBuf, err := hf.manager.ReadPage(id)
+	if err != nil {
+		return RowID{}, false, 0, err
+	}
+	page, err := LoadHeapPage(id, pageBuf)
+	if err != nil {
+		return RowID{}, false, 0, err
+	}
+	if !page.Fits(len(record)) {
+		return RowID{}, false, page.AvailableSpace(), nil
+	}
+	slot, err := page.insert(record, external)
+	if err != nil {
+		return RowID{}, false, 0, err
+	}
+	if err := persistPage(tx, log, hf.manager, wal.RecordInsert, id, page.Data()); err != nil {
+		return RowID{}, false, 0, err
+	}
+	return RowID{Page: id, Slot: slot}, true, page.AvailableSpace(), nil
+}
+
+// appendPage allocates a fresh heap page and links it after tail.
+func (hf *HeapFile) appendPage(tx *txn.Transaction, log *wal.Manager, tail PageID) (PageID, error) {
+	tailBuf, err := hf.manager.ReadPage(tail)
+	if err != nil {
+		return 0, err
+	}
+	tailPage, err := LoadHeapPage(tail, tailBuf)
+	if err != nil {
+		return 0, err
+	}
+	newID, newBuf, err := hf.manager.AllocatePage()
+	if err != nil {
+		return 0, err
+	}
+	if err := InitialiseHeapPage(newBuf); err != nil {
+		return 0, err
+	}
+	SetPageCompression(newBuf, PageCompression(tailBuf))
+	if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, newID, newBuf); err != nil {
+		return 0, err
+	}
+	tailPage.SetNextPage(newID)
+	if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, tail, tailPage.Data()); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// tailPage returns the last page of the heap chain, starting from the tail
+// remembered by the free-space map when it is still accurate.
+func (hf *HeapFile) tailPage(fsm freeSpaceMap) (PageID, error) {
+	current, err := fsm.heapTail()
+	if err != nil {
+		return 0, err
+	}
+	if current == 0 {
+		current = hf.root
+	}
+	for {
+		pageBuf, err := hf.manager.ReadPage(current)
+		if err != nil {
+			return 0, err
+		}
+		next := readHeapHeader(pageBuf).NextPage
+		if next == 0 {
+			return current, nil
+		}
+		current = next
 	}
 }
 
@@ -87,7 +342,11 @@ func (hf *HeapFile) Scan(fn func(rid RowID, record []byte) error) error {
 			return err
 		}
 		if err := page.Records(func(slot uint16, record []byte) error {
-			return fn(RowID{Page: currentID, Slot: slot}, record)
+			row, err := hf.resolveRecord(page, slot, record)
+			if err != nil {
+				return err
+			}
+			return fn(RowID{Page: currentID, Slot: slot}, row)
 		}); err != nil {
 			return err
 		}
@@ -110,12 +369,16 @@ func (hf *HeapFile) Fetch(id RowID) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if page.External(id.Slot) {
+		return hf.readOverflow(record)
+	}
 	clone := make([]byte, len(record))
 	copy(clone, record)
 	return clone, nil
 }
 
-// Delete removes the record stored at the specified row identifier.
+// Delete removes the record stored at the specified row identifier and frees
+// its overflow pages, if any.
 func (hf *HeapFile) Delete(tx *txn.Transaction, log *wal.Manager, id RowID) error {
 	pageBuf, err := hf.manager.ReadPage(id.Page)
 	if err != nil {
@@ -125,30 +388,125 @@ func (hf *HeapFile) Delete(tx *txn.Transaction, log *wal.Manager, id RowID) erro
 	if err != nil {
 		return err
 	}
+	var stub []byte
+	if page.External(id.Slot) {
+		record, err := page.Record(id.Slot)
+		if err != nil {
+			return err
+		}
+		stub = append(stub, record...)
+	}
 	if err := page.Delete(id.Slot); err != nil {
 		return err
 	}
-	return persistPage(tx, log, hf.manager, wal.RecordDelete, id.Page, page.Data())
+	if err := persistPage(tx, log, hf.manager, wal.RecordDelete, id.Page, page.Data()); err != nil {
+		return err
+	}
+	if stub != nil {
+		if err := hf.freeOverflow(tx, log, stub); err != nil {
+			return err
+		}
+	}
+	if hf.fsm == 0 {
+		return nil
+	}
+	fsm := freeSpaceMap{manager: hf.manager, root: hf.fsm}
+	return fsm.update(tx, log, id.Page, page.AvailableSpace())
+}
+
+// Update replaces the record at id without moving it, so the RowID and any
+// locks held on it stay valid. It reports false, changing nothing, when the
+// new record does not fit on the row's page; the caller must then move the
+// row. Overflow pages of the old record are freed and a record too large for
+// a heap page is written to new ones.
+func (hf *HeapFile) Update(tx *txn.Transaction, log *wal.Manager, id RowID, record []byte) (bool, error) {
+	pageBuf, err := hf.manager.ReadPage(id.Page)
+	if err != nil {
+		return false, err
+	}
+	page, err := LoadHeapPage(id.Page, pageBuf)
+	if err != nil {
+		return false, err
+	}
+	old, err := page.Record(id.Slot)
+	if err != nil {
+		return false, err
+	}
+	var oldStub []byte
+	if page.External(id.Slot) {
+		oldStub = append(oldStub, old...)
+	}
+	external := false
+	if len(record) > maxInlineRecord(hf.manager.pageSize) {
+		stub, err := hf.writeOverflow(tx, log, record)
+		if err != nil {
+			return false, err
+		}
+		record, external = stub, true
+	}
+	updated, err := page.update(id.Slot, record, external)
+	if err != nil || !updated {
+		if external {
+			if freeErr := hf.freeOverflow(tx, log, record); err == nil {
+				err = freeErr
+			}
+		}
+		return false, err
+	}
+	if err := persistPage(tx, log, hf.manager, wal.RecordUpdate, id.Page, page.Data()); err != nil {
+		return false, err
+	}
+	if oldStub != nil {
+		if err := hf.freeOverflow(tx, log, oldStub); err != nil {
+			return false, err
+		}
+	}
+	if hf.fsm == 0 {
+		return true, nil
+	}
+	fsm := freeSpaceMap{manager: hf.manager, root: hf.fsm}
+	return true, fsm.update(tx, log, id.Page, page.AvailableSpace())
 }
 
+// persistPage logs the new image of a page under the transaction and writes
+// it to the buffer pool. The first time a transaction changes a page, the
+// page's prior contents are logged too: the buffer pool may write the page
+// back before the transaction ends, and recovery restores that image if it
+// never does.
 func persistPage(tx *txn.Transaction, log *wal.Manager, mgr *Manager, typ wal.RecordType, id PageID, data []byte) error {
+	var lsn uint64
 	if tx != nil && log != nil {
+		if tx.TouchPage(uint32(id)) {
+			before, err := mgr.ReadPage(id)
+			if err != nil {
+				return err
+			}
+			if _, err := appendTxnPage(tx, log, wal.RecordBeforeImage, id, before); err != nil {
+				return err
+			}
+		}
 		payload := make([]byte, len(data))
 		copy(payload, data)
-		prev := tx.LastLSN()
-		lsn, err := log.Append(uint64(tx.ID()), prev, typ, uint32(id), payload)
-		if err != nil {
-			return err
-		}
-		tx.SetLastLSN(lsn)
-		if tx.StartLSN() == 0 {
-			tx.SetStartLSN(lsn)
-		}
-		if err := log.Sync(); err != nil {
+		var err error
+		if lsn, err = appendTxnPage(tx, log, typ, id, payload); err != nil {
 			return err
 		}
 	}
-	return mgr.WritePage(id, data)
+	// The image is not synced here: the page carries its LSN, and the buffer
+	// pool flushes the log up to it before writing the page back.
+	return mgr.writePageLSN(id, data, lsn)
+}
+
+func appendTxnPage(tx *txn.Transaction, log *wal.Manager, typ wal.RecordType, id PageID, payload []byte) (uint64, error) {
+	lsn, err := log.Append(uint64(tx.ID()), tx.LastLSN(), typ, uint32(id), payload)
+	if err != nil {
+		return 0, err
+	}
+	tx.SetLastLSN(lsn)
+	if tx.StartLSN() == 0 {
+		tx.SetStartLSN(lsn)
+	}
+	return lsn, nil
 }
 
 // Pages returns all page ids used by the heap file.
@@ -169,3 +527,43 @@ func (hf *HeapFile) Pages() ([]PageID, error) {
 	}
 	return pages, nil
 }
+
+// FreeSpaceMapPages returns the page ids used by the heap file's free-space map.
+func (hf *HeapFile) FreeSpaceMapPages() ([]PageID, error) {
+	if hf.fsm == 0 {
+		return nil, nil
+	}
+	return freeSpaceMap{manager: hf.manager, root: hf.fsm}.pages()
+}
+
+// OverflowPages returns the page ids of every overflow chain referenced from
+// the heap file.
+func (hf *HeapFile) OverflowPages() ([]PageID, error) {
+	var ids []PageID
+	currentID := hf.root
+	for currentID != 0 {
+		page, err := hf.loadPage(currentID)
+		if err != nil {
+			return nil, err
+		}
+		if err := page.Records(func(slot uint16, record []byte) error {
+			if !page.External(slot) {
+				return nil
+			}
+			_, first, err := decodeOverflowPointer(record)
+			if err != nil {
+				return err
+			}
+			chain, err := hf.overflowPages(first)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, chain...)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		currentID = page.NextPage()
+	}
+	return ids, nil
+}
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/vfs"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+func newTestHeapFile(t *testing.T) (*Manager, *HeapFile) {
+	t.Helper()
+	fsys := vfs.NewMemory()
+	if err := NewWithOptions("heap.gdb", CreateOptions{FS: fsys}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	mgr, err := OpenWithOptions("heap.gdb", Options{FS: fsys})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { _ = mgr.Close() })
+	root, buf, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate root: %v", err)
+	}
+	if err := InitialiseHeapPage(buf); err != nil {
+		t.Fatalf("init root: %v", err)
+	}
+	if err := mgr.WritePage(root, buf); err != nil {
+		t.Fatalf("write root: %v", err)
+	}
+	fsm, err := CreateFreeSpaceMap(mgr, root)
+	if err != nil {
+		t.Fatalf("create fsm: %v", err)
+	}
+	return mgr, NewHeapFileWithMap(mgr, root, fsm)
+}
+
+func TestHeapFileFreeSpaceMapTracksPages(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	record := bytes.Repeat([]byte{'r'}, 300)
+	for i := 0; i < 60; i++ {
+		if _, err := heap.Insert(nil, nil, record); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+
+	pages, err := heap.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	if len(pages) < 2 {
+		t.Fatalf("expected inserts to spill onto several pages, got %d", len(pages))
+	}
+
+	fsm := freeSpaceMap{manager: mgr, root: heap.FreeSpaceMap()}
+	tracked := make(map[PageID]int)
+	if err := fsm.walk(func(_ PageID, page []byte) (bool, error) {
+		hdr := readFSMHeader(page)
+		for i := 0; i < int(hdr.Count); i++ {
+			id, free := fsmEntry(page, i)
+			tracked[id] = free
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatalf("walk fsm: %v", err)
+	}
+	for _, id := range pages {
+		buf, err := mgr.ReadPage(id)
+		if err != nil {
+			t.Fatalf("read page %d: %v", id, err)
+		}
+		free, ok := tracked[id]
+		if !ok {
+			t.Fatalf("page %d missing from free-space map", id)
+		}
+		if want := heapFreeSpace(readHeapHeader(buf)); free != want {
+			t.Fatalf("page %d: map records %d free bytes, page has %d", id, free, want)
+		}
+	}
+	tail, err := fsm.heapTail()
+	if err != nil {
+		t.Fatalf("heap tail: %v", err)
+	}
+	if tail != pages[len(pages)-1] {
+		t.Fatalf("expected heap tail %d, got %d", pages[len(pages)-1], tail)
+	}
+}
+
+func TestHeapFileCorrectsStaleFreeSpaceEntries(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	filler := bytes.Repeat([]byte{'f'}, PageSize-heapHeaderSize-slotSize-8)
+	if _, err := heap.Insert(nil, nil, filler); err != nil {
+		t.Fatalf("insert filler: %v", err)
+	}
+
+	// Pretend the root page is empty again, as a map written before a crash
+	// might claim.
+	fsm := freeSpaceMap{manager: mgr, root: heap.FreeSpaceMap()}
+	if err := fsm.update(nil, nil, heap.Root(), PageSize-heapHeaderSize); err != nil {
+		t.Fatalf("corrupt map: %v", err)
+	}
+
+	rid, err := heap.Insert(nil, nil, bytes.Repeat([]byte{'x'}, 64))
+	if err != nil {
+		t.Fatalf("insert after stale entry: %v", err)
+	}
+	if rid.Page == heap.Root() {
+		t.Fatalf("expected record to land on a new page")
+	}
+	if _, ok, err := fsm.find(64 + slotSize); err != nil || !ok {
+		t.Fatalf("expected a page with room to remain tracked (ok=%v, err=%v)", ok, err)
+	}
+	found, _, err := fsm.find(PageSize - heapHeaderSize)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if found == heap.Root() {
+		t.Fatalf("stale entry for the root page was not corrected")
+	}
+}
+
+func TestHeapFileFindsRoomAcrossFreeSpaceMapPages(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	record := bytes.Repeat([]byte{'m'}, PageSize/2+100)
+	var rids []RowID
+	for i := 0; i < 1500; i++ {
+		rid, err := heap.Insert(nil, nil, record)
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		rids = append(rids, rid)
+	}
+	mapPages, err := heap.FreeSpaceMapPages()
+	if err != nil || len(mapPages) < 3 {
+		t.Fatalf("expected a map of several pages, got %v (%v)", mapPages, err)
+	}
+	before, err := heap.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+
+	log, err := wal.OpenWithOptions("heap.gdb", wal.Options{FS: vfs.NewMemory()})
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer log.Close()
+	txns := txn.NewManager(txn.NewLockManager(0), log)
+	tx := txns.Begin()
+	freed := map[PageID]bool{rids[10].Page: true, rids[1200].Page: true}
+	for id := range freed {
+		for _, rid := range rids {
+			if rid.Page == id {
+				if err := heap.Delete(tx, log, rid); err != nil {
+					t.Fatalf("delete %v: %v", rid, err)
+				}
+			}
+		}
+	}
+	// The map pages change with the heap pages, so both are logged.
+	logged, err := log.Scan()
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	touched := make(map[PageID]bool)
+	for _, rec := range logged {
+		touched[PageID(rec.PageID)] = true
+	}
+	perPage := fsmEntriesPerPage(PageSize)
+	early, late := mapPages[10/perPage], mapPages[1200/perPage]
+	if early == late || !touched[early] || !touched[late] {
+		t.Fatalf("expected the changed map pages %d and %d to be logged", early, late)
+	}
+
+	// A search resumes where the last one ended and wraps round, so both
+	// the early and the late page are found again.
+	for i := 0; i < 2; i++ {
+		rid, err := heap.Insert(tx, log, record)
+		if err != nil {
+			t.Fatalf("reinsert: %v", err)
+		}
+		if !freed[rid.Page] {
+			t.Fatalf("expected the record on a freed page, got %v", rid)
+		}
+		delete(freed, rid.Page)
+	}
+	if err := txns.Commit(tx.ID()); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	after, err := heap.Pages()
+	if err != nil || len(after) != len(before) {
+		t.Fatalf("expected no new heap pages, got %d of %d (%v)", len(after), len(before), err)
+	}
+	check, err := mgr.CheckPages(map[string]*HeapFile{"t": heap}, nil)
+	if err != nil || len(check.Problems) != 0 {
+		t.Fatalf("expected a sound heap, got %+v (%v)", check.Problems, err)
+	}
+}
+
+func TestHeapFileStoresLargeRecordsOutOfLine(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	large := make([]byte, 3*PageSize+123)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	small := bytes.Repeat([]byte{'s'}, 40)
+	if _, err := heap.Insert(nil, nil, small); err != nil {
+		t.Fatalf("insert small: %v", err)
+	}
+	rid, err := heap.Insert(nil, nil, large)
+	if err != nil {
+		t.Fatalf("insert large: %v", err)
+	}
+
+	fetched, err := heap.Fetch(rid)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if !bytes.Equal(fetched, large) {
+		t.Fatalf("fetched record differs from inserted record")
+	}
+	scanned := 0
+	if err := heap.Scan(func(id RowID, record []byte) error {
+		scanned++
+		if id == rid && !bytes.Equal(record, large) {
+			t.Fatalf("scanned record differs from inserted record")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if scanned != 2 {
+		t.Fatalf("expected 2 records, got %d", scanned)
+	}
+
+	overflow, err := heap.OverflowPages()
+	if err != nil {
+		t.Fatalf("overflow pages: %v", err)
+	}
+	if len(overflow) != 4 {
+		t.Fatalf("expected 4 overflow pages, got %d", len(overflow))
+	}
+	if err := heap.Delete(nil, nil, rid); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if remaining, err := heap.OverflowPages(); err != nil || len(remaining) != 0 {
+		t.Fatalf("expected no overflow pages after delete, got %v (err=%v)", remaining, err)
+	}
+	reused := make(map[PageID]bool)
+	for range overflow {
+		id, _, err := mgr.AllocatePage()
+		if err != nil {
+			t.Fatalf("allocate: %v", err)
+		}
+		reused[id] = true
+	}
+	for _, id := range overflow {
+		if !reused[id] {
+			t.Fatalf("overflow page %d was not returned to the free list", id)
+		}
+	}
+}
+
+func TestHeapFileReleasesOverflowPagesWhenTheTransactionEnds(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	rid, err := heap.Insert(nil, nil, make([]byte, 2*PageSize))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	overflow, err := heap.OverflowPages()
+	if err != nil || len(overflow) == 0 {
+		t.Fatalf("expected overflow pages, got %v (err=%v)", overflow, err)
+	}
+	freeList := func() int {
+		info, err := mgr.InspectFreeList()
+		if err != nil {
+			t.Fatalf("free list: %v", err)
+		}
+		return len(info.Pages)
+	}
+	txns := txn.NewManager(txn.NewLockManager(0), nil)
+	tx := txns.Begin()
+	if err := heap.Delete(tx, nil, rid); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	// Until the delete is committed, recovery may undo it and point the row
+	// back at its chain.
+	if n := freeList(); n != 0 {
+		t.Fatalf("expected no free pages before the commit, got %d", n)
+	}
+	if err := txns.Commit(tx.ID()); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if n := freeList(); n != len(overflow) {
+		t.Fatalf("expected %d free pages after the commit, got %d", len(overflow), n)
+	}
+}
+
+func TestHeapFileUpdateInPlace(t *testing.T) {
+	_, heap := newTestHeapFile(t)
+	rid, err := heap.Insert(nil, nil, bytes.Repeat([]byte{'a'}, 60))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	large := bytes.Repeat([]byte("large"), PageSize)
+	for _, record := range [][]byte{[]byte("shorter"), bytes.Repeat([]byte{'b'}, 300), large, []byte("inline again")} {
+		ok, err := heap.Update(nil, nil, rid, record)
+		if err != nil || !ok {
+			t.Fatalf("update to %d bytes: %v (%v)", len(record), ok, err)
+		}
+		fetched, err := heap.Fetch(rid)
+		if err != nil || !bytes.Equal(fetched, record) {
+			t.Fatalf("expected %d bytes at %v, got %d (%v)", len(record), rid, len(fetched), err)
+		}
+	}
+	if overflow, err := heap.OverflowPages(); err != nil || len(overflow) != 0 {
+		t.Fatalf("expected the overflow pages to be freed, got %v (%v)", overflow, err)
+	}
+
+	// Fill the page, then grow the row beyond what is left.
+	for {
+		other, err := heap.Insert(nil, nil, bytes.Repeat([]byte{'f'}, 200))
+		if err != nil {
+			t.Fatalf("fill: %v", err)
+		}
+		if other.Page != rid.Page {
+			break
+		}
+	}
+	ok, err := heap.Update(nil, nil, rid, bytes.Repeat([]byte{'g'}, 1000))
+	if err != nil || ok {
+		t.Fatalf("expected the update not to fit, got %v (%v)", ok, err)
+	}
+	if fetched, err := heap.Fetch(rid); err != nil || string(fetched) != "inline again" {
+		t.Fatalf("expected the row to be unchanged, got %q (%v)", fetched, err)
+	}
+}
+
+func TestHeapFileInsertBatch(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	log, err := wal.OpenWithOptions("heap.gdb", wal.Options{FS: vfs.NewMemory()})
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer log.Close()
+	tx := txn.NewManager(txn.NewLockManager(0), log).Begin()
+
+	first, err := heap.Insert(nil, nil, []byte("before the batch"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	records := make([][]byte, 200)
+	for i := range records {
+		records[i] = []byte(fmt.Sprintf("%03d-%s", i, bytes.Repeat([]byte{'r'}, 96)))
+	}
+	records[100] = bytes.Repeat([]byte("large"), PageSize)
+	rids, err := heap.InsertBatch(tx, log, records)
+	if err != nil {
+		t.Fatalf("insert batch: %v", err)
+	}
+	if len(rids) != len(records) || rids[0].Page != first.Page {
+		t.Fatalf("expected the batch to start on the tail page %d, got %v", first.Page, rids[:1])
+	}
+	for i, rid := range rids {
+		fetched, err := heap.Fetch(rid)
+		if err != nil || !bytes.Equal(fetched, records[i]) {
+			t.Fatalf("record %d at %v: got %d bytes (%v)", i, rid, len(fetched), err)
+		}
+	}
+
+	pages, err := heap.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	logged, err := log.Scan()
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	inserts := 0
+	for _, rec := range logged {
+		if rec.Type == wal.RecordInsert {
+			inserts++
+		}
+	}
+	if inserts != len(pages) {
+		t.Fatalf("expected one logged image per heap page (%d), got %d", len(pages), inserts)
+	}
+	check, err := mgr.CheckPages(map[string]*HeapFile{"batch": heap}, nil)
+	if err != nil || len(check.Problems) != 0 {
+		t.Fatalf("expected a sound heap, got %+v (%v)", check.Problems, err)
+	}
+}
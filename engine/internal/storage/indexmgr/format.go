@@ -0,0 +1,85 @@
+package indexmgr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Indexes used to live in files of their own next to the database, named
+// <database>.<table>_<index>.idx. They are now B+trees inside the database
+// file; the functions here only deal with the files older engines left
+// behind.
+const (
+	indexMagic = "GRNIDX01"
+
+	// indexVersion retired the index files: a file of an older version is
+	// removed by granitectl upgrade, and the index is rebuilt inside the
+	// database file when the database is next opened for writing.
+	indexVersion = uint16(3)
+)
+
+// FormatVersion is the index file format written by this engine.
+const FormatVersion = indexVersion
+
+// ReadFormatVersion returns the format version recorded in an index file.
+func ReadFormatVersion(path string) (uint16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, len(indexMagic)+2)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("indexmgr: reading header of %s: %w", path, err)
+	}
+	if string(header[:len(indexMagic)]) != indexMagic {
+		return 0, fmt.Errorf("indexmgr: invalid index file header")
+	}
+	return binary.LittleEndian.Uint16(header[len(indexMagic):]), nil
+}
+
+// Files lists the index files that belong to the database at dbPath.
+func Files(dbPath string) ([]string, error) {
+	dir := filepath.Dir(dbPath)
+	prefix := filepath.Base(dbPath) + "."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".idx") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
+
+// LegacyPath returns where older engines kept the file of an index.
+func LegacyPath(dbPath, table, name string) string {
+	dir := filepath.Dir(dbPath)
+	file := filepath.Base(dbPath)
+	safeTable := strings.ReplaceAll(strings.ToLower(table), " ", "_")
+	safeName := strings.ReplaceAll(strings.ToLower(name), " ", "_")
+	return filepath.Join(dir, fmt.Sprintf("%s.%s_%s.idx", file, safeTable, safeName))
+}
+
+// RetireFile removes an index file written by an older engine. Its entries
+// are not needed: the database rebuilds the index from the table's rows the
+// next time it is opened for writing.
+func RetireFile(path string) error {
+	version, err := ReadFormatVersion(path)
+	if err != nil {
+		return err
+	}
+	if version >= indexVersion {
+		return fmt.Errorf("indexmgr: %s is not an index file of an older version", path)
+	}
+	return os.Remove(path)
+}
@@ -2,256 +2,199 @@ package indexmgr
 
 import (
         "bytes"
-        "encoding/binary"
         "fmt"
-        "io"
-        "os"
         "sort"
         "sync"
 
         "github.com/example/granite-db/engine/internal/storage"
+        "github.com/example/granite-db/engine/internal/txn"
+        "github.com/example/granite-db/engine/internal/wal"
 )
 
-const (
-        indexMagic   = "GRNIDX01"
-        indexVersion = uint16(1)
-)
-
-// Entry represents a single key → row pointer association.
+// Entry represents a single key → row pointer association. Included holds
+// the encoded values of an index's included columns, which the tree stores
+// after the key; they take no part in uniqueness.
 type Entry struct {
-        Key []byte
-        Row storage.RowID
-}
-
-// IndexFile keeps an in-memory sorted copy of the index entries and persists
-// them to a dedicated on-disk file.
-type IndexFile struct {
-        path    string
-        mu      sync.Mutex
-        entries []Entry
-}
-
-func newIndexFile(path string) *IndexFile {
-        return &IndexFile{path: path, entries: make([]Entry, 0)}
+        Key      []byte
+        Included []byte
+        Row      storage.RowID
 }
 
-func (f *IndexFile) load() error {
-        file, err := os.Open(f.path)
-        if os.IsNotExist(err) {
-                f.entries = make([]Entry, 0)
-                return nil
-        }
-        if err != nil {
-                return err
-        }
-        defer file.Close()
-
-        header := make([]byte, len(indexMagic)+2)
-        if _, err := io.ReadFull(file, header); err != nil {
-                return err
+// StoredKey returns the key the tree stores for the entry: the key followed
+// by any included values.
+func (e Entry) StoredKey() []byte {
+        if len(e.Included) == 0 {
+                return e.Key
         }
-        if string(header[:len(indexMagic)]) != indexMagic {
-                return fmt.Errorf("indexmgr: invalid index file header")
-        }
-        version := binary.LittleEndian.Uint16(header[len(indexMagic):])
-        if version != indexVersion {
-                return fmt.Errorf("indexmgr: unsupported index file version %d", version)
-        }
-        var count uint32
-        if err := binary.Read(file, binary.LittleEndian, &count); err != nil {
-                return err
-        }
-        entries := make([]Entry, count)
-        for i := uint32(0); i < count; i++ {
-                var keyLen uint32
-                if err := binary.Read(file, binary.LittleEndian, &keyLen); err != nil {
-                        return err
-                }
-                key := make([]byte, keyLen)
-                if _, err := io.ReadFull(file, key); err != nil {
-                        return err
-                }
-                var page uint32
-                if err := binary.Read(file, binary.LittleEndian, &page); err != nil {
-                        return err
-                }
-                var slot uint16
-                if err := binary.Read(file, binary.LittleEndian, &slot); err != nil {
-                        return err
-                }
-                entries[i] = Entry{Key: key, Row: storage.RowID{Page: storage.PageID(page), Slot: slot}}
-        }
-        f.entries = entries
-        return nil
+        key := make([]byte, 0, len(e.Key)+len(e.Included))
+        return append(append(key, e.Key...), e.Included...)
 }
 
-func (f *IndexFile) persist() error {
-        f.mu.Lock()
-        defer f.mu.Unlock()
-        return f.persistLocked()
+// IndexFile is the B+tree of one index. Its nodes are pages of the database
+// file and go through the buffer pool, so an insert or delete only rewrites
+// the nodes on the path to its leaf. Changes made under a transaction are
+// logged with it, like the heap changes they accompany; a nil transaction
+// writes the nodes without logging them.
+type IndexFile struct {
+        mu   sync.Mutex
+        tree *storage.BTree
 }
 
-func (f *IndexFile) persistLocked() error {
-        tmpPath := f.path + ".tmp"
-        file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
-        if err != nil {
-                return err
-        }
-        defer file.Close()
-
-        header := make([]byte, len(indexMagic)+2)
-        copy(header, []byte(indexMagic))
-        binary.LittleEndian.PutUint16(header[len(indexMagic):], indexVersion)
-        if _, err := file.Write(header); err != nil {
-                return err
-        }
-        if err := binary.Write(file, binary.LittleEndian, uint32(len(f.entries))); err != nil {
-                return err
-        }
-        for _, entry := range f.entries {
-                if err := binary.Write(file, binary.LittleEndian, uint32(len(entry.Key))); err != nil {
-                        return err
-                }
-                if _, err := file.Write(entry.Key); err != nil {
-                        return err
-                }
-                if err := binary.Write(file, binary.LittleEndian, uint32(entry.Row.Page)); err != nil {
-                        return err
-                }
-                if err := binary.Write(file, binary.LittleEndian, entry.Row.Slot); err != nil {
-                        return err
-                }
-        }
-        if err := file.Close(); err != nil {
-                        return err
-        }
-        return os.Rename(tmpPath, f.path)
+// Root returns the page holding the root of the index's tree, which is what
+// the catalogue records.
+func (f *IndexFile) Root() storage.PageID {
+        return f.tree.Root()
 }
 
 // Rebuild replaces the entire index contents with the supplied entries.
-func (f *IndexFile) Rebuild(entries []Entry, unique bool) error {
+func (f *IndexFile) Rebuild(tx *txn.Transaction, log *wal.Manager, entries []Entry, unique bool) error {
         f.mu.Lock()
         defer f.mu.Unlock()
 
         sorted := make([]Entry, len(entries))
         copy(sorted, entries)
-        sort.Slice(sorted, func(i, j int) bool {
-                if cmp := bytes.Compare(sorted[i].Key, sorted[j].Key); cmp != 0 {
-                        return cmp < 0
-                }
-                if sorted[i].Row.Page != sorted[j].Row.Page {
-                        return sorted[i].Row.Page < sorted[j].Row.Page
-                }
-                return sorted[i].Row.Slot < sorted[j].Row.Slot
-        })
+        sortEntries(sorted)
         if unique {
+                // Keys mark the end of each column, so entries sharing a
+                // key sit together whatever they include.
                 for i := 1; i < len(sorted); i++ {
                         if bytes.Equal(sorted[i-1].Key, sorted[i].Key) {
                                 return fmt.Errorf("indexmgr: duplicate key detected during build")
                         }
                 }
         }
-        f.entries = sorted
-        return f.persistLocked()
+        treeKeys := make([][]byte, len(sorted))
+        rows := make([]storage.RowID, len(sorted))
+        for i, entry := range sorted {
+                treeKeys[i], rows[i] = entry.StoredKey(), entry.Row
+        }
+        return f.tree.Load(tx, log, treeKeys, rows)
 }
 
-// Insert adds a new key → row mapping to the index.
-func (f *IndexFile) Insert(key []byte, row storage.RowID, unique bool) error {
+// Entries returns a copy of every entry in key order. The keys are those the
+// tree stores, so they end with any included values.
+func (f *IndexFile) Entries() ([]Entry, error) {
         f.mu.Lock()
         defer f.mu.Unlock()
 
-        idx := f.lowerBound(key)
-        if unique {
-                for i := idx; i < len(f.entries); i++ {
-                        if cmp := bytes.Compare(f.entries[i].Key, key); cmp != 0 {
-                                break
-                        }
-                        return fmt.Errorf("indexmgr: duplicate key")
+        entries := make([]Entry, 0)
+        err := f.scanLocked(nil, func(key []byte, row storage.RowID) bool {
+                entries = append(entries, Entry{Key: key, Row: row})
+                return true
+        })
+        return entries, err
+}
+
+func sortEntries(entries []Entry) {
+        sort.Slice(entries, func(i, j int) bool {
+                if cmp := bytes.Compare(entries[i].StoredKey(), entries[j].StoredKey()); cmp != 0 {
+                        return cmp < 0
                 }
-        }
-        entry := Entry{Key: cloneBytes(key), Row: row}
-        f.entries = append(f.entries, Entry{})
-        copy(f.entries[idx+1:], f.entries[idx:])
-        f.entries[idx] = entry
-        return f.persistLocked()
+                if entries[i].Row.Page != entries[j].Row.Page {
+                        return entries[i].Row.Page < entries[j].Row.Page
+                }
+                return entries[i].Row.Slot < entries[j].Row.Slot
+        })
 }
 
-// Delete removes the provided key/row pair if present.
-func (f *IndexFile) Delete(key []byte, row storage.RowID) error {
+// Insert adds an entry to the index. A unique index refuses an entry whose
+// key is already present.
+func (f *IndexFile) Insert(tx *txn.Transaction, log *wal.Manager, entry Entry, unique bool) error {
         f.mu.Lock()
         defer f.mu.Unlock()
 
-        idx := f.lowerBound(key)
-        for idx < len(f.entries) && bytes.Compare(f.entries[idx].Key, key) == 0 {
-                        if f.entries[idx].Row == row {
-                                f.entries = append(f.entries[:idx], f.entries[idx+1:]...)
-                                return f.persistLocked()
-                        }
-                        idx++
+        if unique {
+                duplicate := false
+                if err := f.scanLocked(entry.Key, func(existing []byte, _ storage.RowID) bool {
+                        duplicate = hasPrefix(existing, entry.Key)
+                        return false
+                }); err != nil {
+                        return err
+                }
+                if duplicate {
+                        return fmt.Errorf("indexmgr: duplicate key")
+                }
         }
-        return nil
+        return f.tree.Insert(tx, log, entry.StoredKey(), entry.Row)
 }
 
-// SeekExact retrieves all row identifiers matching the precise key.
-func (f *IndexFile) SeekExact(key []byte) []storage.RowID {
+// Delete removes the provided entry if present.
+func (f *IndexFile) Delete(tx *txn.Transaction, log *wal.Manager, entry Entry) error {
         f.mu.Lock()
         defer f.mu.Unlock()
 
-        idx := f.lowerBound(key)
-        results := make([]storage.RowID, 0)
-        for idx < len(f.entries) && bytes.Compare(f.entries[idx].Key, key) == 0 {
-                results = append(results, f.entries[idx].Row)
-                idx++
-        }
-        return results
+        _, err := f.tree.Delete(tx, log, entry.StoredKey(), entry.Row)
+        return err
+}
+
+// SeekExact retrieves all row identifiers matching the precise key. Keys
+// mark the end of each column, so a stored key that starts with key differs
+// from it only in included values.
+func (f *IndexFile) SeekExact(key []byte) ([]storage.RowID, error) {
+        return f.Range(key, nil, false, nil, false)
 }
 
 // SeekPrefix returns the row identifiers whose keys start with the given prefix.
-func (f *IndexFile) SeekPrefix(prefix []byte) []storage.RowID {
-        f.mu.Lock()
-        defer f.mu.Unlock()
+func (f *IndexFile) SeekPrefix(prefix []byte) ([]storage.RowID, error) {
+        return f.Range(prefix, nil, false, nil, false)
+}
 
-        idx := f.lowerBound(prefix)
+// Range collects row identifiers within the provided prefix-constrained range.
+func (f *IndexFile) Range(prefix []byte, lower []byte, includeLower bool, upper []byte, includeUpper bool) ([]storage.RowID, error) {
         results := make([]storage.RowID, 0)
-        for idx < len(f.entries) && hasPrefix(f.entries[idx].Key, prefix) {
-                results = append(results, f.entries[idx].Row)
-                idx++
-        }
-        return results
+        err := f.Ascend(prefix, lower, includeLower, upper, includeUpper, func(_ []byte, row storage.RowID) bool {
+                results = append(results, row)
+                return true
+        })
+        return results, err
 }
 
-// Range collects row identifiers within the provided prefix-constrained range.
-func (f *IndexFile) Range(prefix []byte, lower []byte, includeLower bool, upper []byte, includeUpper bool) []storage.RowID {
+// Ascend calls fn, in key order, for each entry whose key starts with prefix
+// and whose next key component lies between lower and upper, until fn
+// returns false. The bounds are encoded key components, compared as bytes;
+// a nil bound leaves that side open. Fn receives the stored key, included
+// values and all, and runs with the index locked, so it must not use the
+// index itself.
+func (f *IndexFile) Ascend(prefix []byte, lower []byte, includeLower bool, upper []byte, includeUpper bool, fn func(key []byte, row storage.RowID) bool) error {
         f.mu.Lock()
         defer f.mu.Unlock()
 
-        startKey := append(cloneBytes(prefix), encodeComponentLength(lower)...)
-        idx := f.lowerBound(startKey)
-        results := make([]storage.RowID, 0)
+        startKey := append(cloneBytes(prefix), lower...)
         prefixLen := len(prefix)
-        for idx < len(f.entries) {
-                key := f.entries[idx].Key
+        return f.scanLocked(startKey, func(key []byte, row storage.RowID) bool {
                 if !hasPrefix(key, prefix) {
-                        break
+                        return false
                 }
                 component := key[prefixLen:]
-                if !componentInLowerBound(component, lower, includeLower) {
-                        idx++
-                        continue
+                if lower != nil && !includeLower && compareComponent(component, lower) == 0 {
+                        return true
                 }
-                if !componentInUpperBound(component, upper, includeUpper) {
-                        break
+                if upper != nil {
+                        cmp := compareComponent(component, upper)
+                        if cmp > 0 || (cmp == 0 && !includeUpper) {
+                                return false
+                        }
                 }
-                results = append(results, f.entries[idx].Row)
-                idx++
-        }
-        return results
+                return fn(key, row)
+        })
 }
 
-func (f *IndexFile) lowerBound(key []byte) int {
-        return sort.Search(len(f.entries), func(i int) bool {
-                return bytes.Compare(f.entries[i].Key, key) >= 0
-        })
+// scanLocked calls fn for each entry from the first whose key is not less
+// than start, in key order, until fn returns false.
+func (f *IndexFile) scanLocked(start []byte, fn func(key []byte, row storage.RowID) bool) error {
+        cursor, err := f.tree.Seek(start)
+        if err != nil {
+                return err
+        }
+        for {
+                key, row, ok, err := cursor.Next()
+                if err != nil || !ok {
+                        return err
+                }
+                if !fn(key, row) {
+                        return nil
+                }
+        }
 }
 
 func cloneBytes(src []byte) []byte {
@@ -267,48 +210,12 @@ func hasPrefix(key, prefix []byte) bool {
         return len(key) >= len(prefix) && bytes.Equal(key[:len(prefix)], prefix)
 }
 
-func encodeComponentLength(component []byte) []byte {
-        if component == nil {
-                return nil
-        }
-        buf := make([]byte, 2+len(component))
-        binary.BigEndian.PutUint16(buf[:2], uint16(len(component)))
-        copy(buf[2:], component)
-        return buf
-}
-
-func componentInLowerBound(component []byte, lower []byte, include bool) bool {
-        if lower == nil {
-                return true
-        }
-        if len(component) < 2 {
-                return false
-        }
-        length := int(binary.BigEndian.Uint16(component[:2]))
-        if len(component) < 2+length {
-                return false
-        }
-        cmp := bytes.Compare(component[2:2+length], lower)
-        if include {
-                return cmp >= 0
-        }
-        return cmp > 0
-}
-
-func componentInUpperBound(component []byte, upper []byte, include bool) bool {
-        if upper == nil {
-                return true
-        }
-        if len(component) < 2 {
-                return false
-        }
-        length := int(binary.BigEndian.Uint16(component[:2]))
-        if len(component) < 2+length {
-                return false
-        }
-        cmp := bytes.Compare(component[2:2+length], upper)
-        if include {
-                return cmp <= 0
+// compareComponent compares the start of a key's remainder with a bound. Key
+// components mark their own end, so a remainder that begins with the whole
+// bound holds a component equal to it.
+func compareComponent(rest []byte, bound []byte) int {
+        if hasPrefix(rest, bound) {
+                return 0
         }
-        return cmp < 0
+        return bytes.Compare(rest, bound)
 }
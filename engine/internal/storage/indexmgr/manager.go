@@ -2,101 +2,96 @@ package indexmgr
 
 import (
         "fmt"
-        "os"
-        "path/filepath"
-        "strings"
         "sync"
+
+        "github.com/example/granite-db/engine/internal/storage"
+        "github.com/example/granite-db/engine/internal/txn"
+        "github.com/example/granite-db/engine/internal/wal"
 )
 
-// Manager coordinates access to per-index storage files. It keeps the files in
-// memory for the lifetime of the database connection to amortise decoding
-// overhead.
+// Manager hands out the B+trees of a database's indexes. It keeps one handle
+// per tree for the lifetime of the database connection, so that everyone
+// changing an index shares its lock.
 type Manager struct {
-        basePath string
+        storage *storage.Manager
 
         mu      sync.Mutex
-        handles map[string]*IndexFile
+        handles map[storage.PageID]*IndexFile
 }
 
-// New constructs an index manager rooted at the provided database file path.
-func New(basePath string) *Manager {
+// New constructs an index manager whose trees live in the given database file.
+func New(store *storage.Manager) *Manager {
         return &Manager{
-                basePath: basePath,
-                handles:  make(map[string]*IndexFile),
+                storage: store,
+                handles: make(map[storage.PageID]*IndexFile),
         }
 }
 
-// Close flushes any pending index data. The current implementation persists on
-// every mutation, so Close simply releases references.
+// Close releases every handle. The trees keep no state outside their pages,
+// which the storage manager writes back, so nothing is lost.
 func (m *Manager) Close() error {
         m.mu.Lock()
         defer m.mu.Unlock()
-        m.handles = make(map[string]*IndexFile)
+        m.handles = make(map[storage.PageID]*IndexFile)
         return nil
 }
 
-// Create initialises a brand new index file. The file must not already exist
-// on disk.
-func (m *Manager) Create(table, name string) (*IndexFile, error) {
-        key := m.makeKey(table, name)
-        path := m.indexPath(table, name)
-
-        m.mu.Lock()
-        defer m.mu.Unlock()
+// MaxKeySize returns the longest key, included values and all, that the
+// database's trees accept.
+func (m *Manager) MaxKeySize() int {
+        return storage.MaxKeySize(m.storage.PageSize())
+}
 
-        if _, err := os.Stat(path); err == nil {
-                return nil, fmt.Errorf("indexmgr: index %s already exists", name)
+// Create allocates the root page of a new, empty index. The caller records
+// the root in the catalogue.
+func (m *Manager) Create() (*IndexFile, error) {
+        if err := m.storage.EnableIndexTrees(); err != nil {
+                return nil, err
         }
-        handle := newIndexFile(path)
-        if err := handle.persist(); err != nil {
+        tree, err := storage.CreateBTree(m.storage)
+        if err != nil {
                 return nil, err
         }
-        m.handles[key] = handle
+        handle := &IndexFile{tree: tree}
+
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        m.handles[tree.Root()] = handle
         return handle, nil
 }
 
-// Open loads an existing index file from disk.
-func (m *Manager) Open(table, name string) (*IndexFile, error) {
-        key := m.makeKey(table, name)
+// Open returns the index whose tree is rooted at the given page.
+func (m *Manager) Open(root storage.PageID) (*IndexFile, error) {
+        if root == 0 {
+                return nil, fmt.Errorf("indexmgr: the index has not been built yet; open the database for writing to build it")
+        }
 
         m.mu.Lock()
         defer m.mu.Unlock()
 
-        if handle, ok := m.handles[key]; ok {
+        if handle, ok := m.handles[root]; ok {
                 return handle, nil
         }
-        handle := newIndexFile(m.indexPath(table, name))
-        if err := handle.load(); err != nil {
-                return nil, err
-        }
-        m.handles[key] = handle
+        handle := &IndexFile{tree: storage.OpenBTree(m.storage, root)}
+        m.handles[root] = handle
         return handle, nil
 }
 
-// Drop removes the on-disk file for the index and evicts any cached handle.
-func (m *Manager) Drop(table, name string) error {
-        key := m.makeKey(table, name)
-        path := m.indexPath(table, name)
-
-        m.mu.Lock()
-        defer m.mu.Unlock()
-
-        delete(m.handles, key)
-        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+// Drop frees every page of the index and evicts its handle. Under a
+// transaction the pages return to the free list once it has ended.
+func (m *Manager) Drop(tx *txn.Transaction, log *wal.Manager, root storage.PageID) error {
+        if root == 0 {
+                return nil
+        }
+        handle, err := m.Open(root)
+        if err != nil {
                 return err
         }
-        return nil
-}
+        handle.mu.Lock()
+        defer handle.mu.Unlock()
 
-func (m *Manager) makeKey(table, name string) string {
-        return strings.ToLower(table) + ":" + strings.ToLower(name)
-}
-
-func (m *Manager) indexPath(table, name string) string {
-        base := m.basePath
-        dir := filepath.Dir(base)
-        file := filepath.Base(base)
-        safeTable := strings.ReplaceAll(strings.ToLower(table), " ", "_")
-        safeName := strings.ReplaceAll(strings.ToLower(name), " ", "_")
-        return filepath.Join(dir, fmt.Sprintf("%s.%s_%s.idx", file, safeTable, safeName))
+        m.mu.Lock()
+        delete(m.handles, root)
+        m.mu.Unlock()
+        return handle.tree.Free(tx, log)
 }
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// HeaderInfo is the decoded header page. FreeListHead is 0 when the free list
+// is empty.
+type HeaderInfo struct {
+	Version      uint16 `json:"version"`
+	PageSize     int    `json:"pageSize"`
+	PageCount    uint32 `json:"pageCount"`
+	FreeListHead PageID `json:"freeListHead"`
+	CatalogRoot  PageID `json:"catalogRoot"`
+	CatalogSize  uint32 `json:"catalogSize"`
+	Encrypted    bool   `json:"encrypted"`
+}
+
+// SlotInfo describes one entry of a heap page's slot directory. A dead slot
+// belonged to a deleted row and is reused by later inserts.
+type SlotInfo struct {
+	Slot     uint16 `json:"slot"`
+	Offset   uint16 `json:"offset"`
+	Length   uint16 `json:"length"`
+	Live     bool   `json:"live"`
+	Overflow bool   `json:"overflow,omitempty"`
+}
+
+// HeapPageInfo is the decoded header and slot directory of a heap page.
+type HeapPageInfo struct {
+	HeapPageHeader
+	FreeSpace int        `json:"freeSpace"`
+	LiveSlots int        `json:"liveSlots"`
+	DeadSlots int        `json:"deadSlots"`
+	Slots     []SlotInfo `json:"slots"`
+	// Problem explains why the page is not a sound heap page; the slots are
+	// then left out, since their positions cannot be trusted.
+	Problem string `json:"problem,omitempty"`
+}
+
+// FreeSpaceMapInfo is the decoded content of a free-space-map page.
+type FreeSpaceMapInfo struct {
+	NextPage PageID              `json:"nextPage"`
+	HeapTail PageID              `json:"heapTail"`
+	Entries  []FreeSpaceMapEntry `json:"entries"`
+}
+
+// FreeSpaceMapEntry records the free space of one heap page.
+type FreeSpaceMapEntry struct {
+	Page      PageID `json:"page"`
+	FreeSpace int    `json:"freeSpace"`
+}
+
+// IndexPageInfo is the decoded content of a B+tree node. NextPage is the next
+// leaf of a leaf and Children the children of an internal node.
+type IndexPageInfo struct {
+	Leaf      bool     `json:"leaf"`
+	Entries   int      `json:"entries"`
+	FreeSpace int      `json:"freeSpace"`
+	NextPage  PageID   `json:"nextPage,omitempty"`
+	Children  []PageID `json:"children,omitempty"`
+	// Problem explains why the node could not be decoded.
+	Problem string `json:"problem,omitempty"`
+}
+
+// PageInfo is the decoded content of a single page. Kind names the structure
+// the page belongs to: "header", "heap", "overflow", "free-space-map",
+// "index", "catalogue", "free" or, for a page nothing reaches, "unused".
+type PageInfo struct {
+	ID          PageID            `json:"id"`
+	Kind        string            `json:"kind"`
+	Table       string            `json:"table,omitempty"`
+	Index       string            `json:"index,omitempty"`
+	Compression string            `json:"compression,omitempty"`
+	Header      *HeaderInfo       `json:"header,omitempty"`
+	Heap        *HeapPageInfo     `json:"heap,omitempty"`
+	Map         *FreeSpaceMapInfo `json:"freeSpaceMap,omitempty"`
+	Node        *IndexPageInfo    `json:"node,omitempty"`
+	// NextPage and Used describe catalogue, overflow and free-list pages.
+	NextPage PageID `json:"nextPage,omitempty"`
+	Used     int    `json:"used,omitempty"`
+}
+
+// FreeListInfo lists the pages on the free list in order. Head is 0 when the
+// list is empty.
+type FreeListInfo struct {
+	Head     PageID    `json:"head"`
+	Pages    []PageID  `json:"pages"`
+	Problems []Problem `json:"problems,omitempty"`
+}
+
+// InspectHeader returns the decoded header page.
+func (m *Manager) InspectHeader() HeaderInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	head := PageID(m.header.FreeListHead)
+	if m.header.FreeListHead == freeListNil {
+		head = 0
+	}
+	return HeaderInfo{
+		Version:      m.header.Version,
+		PageSize:     m.pageSize,
+		PageCount:    m.header.PageCount,
+		FreeListHead: head,
+		CatalogRoot:  PageID(m.header.CatalogRoot),
+		CatalogSize:  m.header.CatalogSize,
+		Encrypted:    m.header.Key != nil,
+	}
+}
+
+// InspectPage decodes a page. The structure it belongs to is found by walking
+// the file the way CheckPages does, so heaps and indexes must list every
+// table and index.
+func (m *Manager) InspectPage(id PageID, heaps map[string]*HeapFile, indexes []IndexTree) (*PageInfo, error) {
+	if id == 0 {
+		header := m.InspectHeader()
+		return &PageInfo{ID: id, Kind: "header", Header: &header}, nil
+	}
+	if err := m.checkBounds(id); err != nil {
+		return nil, err
+	}
+	c, err := m.walkPages(heaps, indexes)
+	if err != nil {
+		return nil, err
+	}
+	page, err := m.ReadPage(id)
+	if err != nil {
+		return nil, err
+	}
+	use, ok := c.uses[id]
+	if !ok {
+		use.kind = "unused"
+	}
+	info := &PageInfo{ID: id, Kind: use.kind, Table: use.table, Index: use.index}
+	switch use.kind {
+	case "heap":
+		info.Compression = PageCompression(page).String()
+		info.Heap = DecodeHeapPage(page)
+	case "free-space-map":
+		info.Map = decodeFreeSpaceMapPage(page)
+	case "index":
+		info.Node = decodeIndexPage(id, page)
+	case "catalogue", "overflow":
+		next, used := readChainPageHeader(page)
+		info.NextPage, info.Used = next, used
+	case "free-list":
+		info.Kind = "free"
+		if next := binary.LittleEndian.Uint32(page[0:4]); next != freeListNil {
+			info.NextPage = PageID(next)
+		}
+	}
+	return info, nil
+}
+
+// InspectHeap decodes every page of a heap chain in order. A chain that
+// loops or leaves the file ends the walk with an error describing it,
+// alongside the pages read so far.
+func (m *Manager) InspectHeap(hf *HeapFile) ([]PageInfo, error) {
+	count := m.InspectHeader().PageCount
+	var pages []PageInfo
+	seen := make(map[PageID]bool)
+	for id := hf.root; id != 0; {
+		if uint32(id) >= count {
+			return pages, fmt.Errorf("storage: heap chain points at page %d, beyond the end of the file (%d pages)", id, count)
+		}
+		if seen[id] {
+			return pages, fmt.Errorf("storage: heap chain loops back to page %d", id)
+		}
+		seen[id] = true
+		page, err := m.ReadPage(id)
+		if err != nil {
+			return pages, err
+		}
+		heap := DecodeHeapPage(page)
+		pages = append(pages, PageInfo{ID: id, Kind: "heap", Compression: PageCompression(page).String(), Heap: heap})
+		id = heap.NextPage
+	}
+	return pages, nil
+}
+
+// InspectFreeList walks the free list, stopping at a link that loops or
+// leaves the file.
+func (m *Manager) InspectFreeList() (*FreeListInfo, error) {
+	m.mu.Lock()
+	header := m.header
+	m.mu.Unlock()
+	c := newPageChecker(m, header.PageCount)
+	info := &FreeListInfo{Pages: []PageID{}}
+	if header.FreeListHead == freeListNil {
+		return info, nil
+	}
+	info.Head = PageID(header.FreeListHead)
+	c.walkChain("free-list", "the free list", "", PageID(header.FreeListHead), PageID(freeListNil), func(page []byte) PageID {
+		return PageID(binary.LittleEndian.Uint32(page[0:4]))
+	}, func(id PageID, _ []byte) bool {
+		info.Pages = append(info.Pages, id)
+		return true
+	})
+	info.Problems = c.result.Problems
+	return info, nil
+}
+
+// DecodeHeapPage decodes the header and slot directory of a heap page.
+func DecodeHeapPage(page []byte) *HeapPageInfo {
+	h := readHeapHeader(page)
+	info := &HeapPageInfo{HeapPageHeader: h, FreeSpace: heapFreeSpace(h), Slots: []SlotInfo{}}
+	if err := validateHeapPage(page); err != nil {
+		info.Problem = err.Error()
+		return info
+	}
+	p := &HeapPage{data: page, hdr: h}
+	for i := uint16(0); i < h.SlotCount; i++ {
+		offset, length := p.slot(i)
+		slot := SlotInfo{Slot: i, Offset: offset, Length: length & slotLengthMask, Live: length != 0, Overflow: length&slotExternal != 0}
+		if slot.Live {
+			info.LiveSlots++
+		} else {
+			info.DeadSlots++
+		}
+		info.Slots = append(info.Slots, slot)
+	}
+	return info
+}
+
+func decodeFreeSpaceMapPage(page []byte) *FreeSpaceMapInfo {
+	h := readFSMHeader(page)
+	info := &FreeSpaceMapInfo{NextPage: h.NextPage, HeapTail: h.HeapTail, Entries: []FreeSpaceMapEntry{}}
+	count := int(h.Count)
+	if limit := fsmEntriesPerPage(len(page)); count > limit {
+		count = limit
+	}
+	for i := 0; i < count; i++ {
+		id, free := fsmEntry(page, i)
+		info.Entries = append(info.Entries, FreeSpaceMapEntry{Page: id, FreeSpace: free})
+	}
+	return info
+}
+
+func decodeIndexPage(id PageID, page []byte) *IndexPageInfo {
+	n, err := decodeBTreeNode(id, page)
+	if err != nil {
+		return &IndexPageInfo{Problem: err.Error()}
+	}
+	info := &IndexPageInfo{Leaf: n.leaf, Entries: len(n.entries), FreeSpace: len(page) - n.size(), NextPage: n.next}
+	if !n.leaf {
+		info.Children = n.children
+	}
+	return info
+}
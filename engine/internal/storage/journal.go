@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/example/granite-db/engine/internal/vfs"
+)
+
+// A rollback journal protects operations that rewrite pages in place without
+// going through the WAL, such as compaction. Before the first in-place write
+// the journal records the original bytes of every region of the data file
+// that may change, plus the full contents of any companion files (the index
+// files), and is synced. Deleting the journal commits the operation. A
+// journal found when the database is opened for writing belongs to an
+// operation that never committed, so its contents are written back.
+//
+// Layout: the magic, then entries, then a zero kind byte and the CRC-32C of
+// everything before it. A journal without a valid trailer was never synced
+// in full, which means no in-place write had started, and it is discarded.
+const (
+	journalMagic = "GRNJRNL1"
+
+	journalEnd   = byte(0)
+	journalRange = byte(1) // offset i64, length u32, bytes
+	journalFile  = byte(2) // path length u16, path, size i64 (-1 = absent), bytes
+
+	// journalChunk bounds the size of a single range entry.
+	journalChunk = 1 << 20
+)
+
+// errJournalPending is returned when a read-only open finds a journal that
+// only a writer may roll back.
+var errJournalPending = errors.New("storage: database has an unfinished compaction; open it for writing first")
+
+// JournalPath returns the location of the rollback journal for a database.
+func JournalPath(dbPath string) string {
+	return dbPath + ".journal"
+}
+
+type journalWriter struct {
+	file vfs.File
+	buf  *bufio.Writer
+	crc  hash.Hash32
+	out  io.Writer
+}
+
+func createJournal(fsys vfs.FS, dbPath string) (*journalWriter, error) {
+	f, err := fsys.OpenFile(JournalPath(dbPath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j := &journalWriter{file: f, buf: bufio.NewWriter(f), crc: crc32.New(castagnoli)}
+	j.out = io.MultiWriter(j.buf, j.crc)
+	if _, err := j.out.Write([]byte(journalMagic)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// saveRange records length bytes of the data file starting at offset.
+func (j *journalWriter) saveRange(src vfs.File, offset, length int64) error {
+	buf := make([]byte, journalChunk)
+	for length > 0 {
+		n := min(length, int64(len(buf)))
+		chunk := buf[:n]
+		if _, err := src.ReadAt(chunk, offset); err != nil {
+			return err
+		}
+		var head [13]byte
+		head[0] = journalRange
+		binary.LittleEndian.PutUint64(head[1:9], uint64(offset))
+		binary.LittleEndian.PutUint32(head[9:13], uint32(n))
+		if _, err := j.out.Write(head[:]); err != nil {
+			return err
+		}
+		if _, err := j.out.Write(chunk); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// saveFile records the whole contents of a companion file, or that it does
+// not exist.
+func (j *journalWriter) saveFile(fsys vfs.FS, path string) error {
+	data, err := readWholeFile(fsys, path)
+	size := int64(len(data))
+	if os.IsNotExist(err) {
+		size = -1
+	} else if err != nil {
+		return err
+	}
+	head := make([]byte, 0, 1+2+len(path)+8)
+	head = append(head, journalFile)
+	head = binary.LittleEndian.AppendUint16(head, uint16(len(path)))
+	head = append(head, path...)
+	head = binary.LittleEndian.AppendUint64(head, uint64(size))
+	if _, err := j.out.Write(head); err != nil {
+		return err
+	}
+	_, err = j.out.Write(data)
+	return err
+}
+
+// seal writes the trailer and syncs the journal, after which in-place
+// writes may begin.
+func (j *journalWriter) seal() error {
+	if _, err := j.buf.Write([]byte{journalEnd}); err != nil {
+		return err
+	}
+	j.crc.Write([]byte{journalEnd})
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], j.crc.Sum32())
+	if _, err := j.buf.Write(sum[:]); err != nil {
+		return err
+	}
+	if err := j.buf.Flush(); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	return j.file.Close()
+}
+
+func (j *journalWriter) abandon(fsys vfs.FS, dbPath string) {
+	j.file.Close()
+	_ = fsys.Remove(JournalPath(dbPath))
+}
+
+// rollbackJournal restores the data file and companion files from a complete
+// journal, if there is one, and removes it.
+func rollbackJournal(fsys vfs.FS, dbPath string, db vfs.File) error {
+	path := JournalPath(dbPath)
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = replayJournal(fsys, f, db)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("storage: rolling back journal %s: %w", path, err)
+	}
+	return fsys.Remove(path)
+}
+
+// replayJournal writes the saved contents back when the journal is complete.
+func replayJournal(fsys vfs.FS, f vfs.File, db vfs.File) error {
+	complete, err := journalComplete(f)
+	if err != nil || !complete {
+		return err
+	}
+	if _, err := f.Seek(int64(len(journalMagic)), io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case journalEnd:
+			return db.Sync()
+		case journalRange:
+			var head [12]byte
+			if _, err := io.ReadFull(r, head[:]); err != nil {
+				return err
+			}
+			data := make([]byte, binary.LittleEndian.Uint32(head[8:12]))
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if _, err := db.WriteAt(data, int64(binary.LittleEndian.Uint64(head[0:8]))); err != nil {
+				return err
+			}
+		case journalFile:
+			if err := restoreJournalFile(fsys, r); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown entry kind %d", kind)
+		}
+	}
+}
+
+// journalComplete checks the trailer of a journal.
+func journalComplete(f vfs.File) (bool, error) {
+	size, err := f.Size()
+	if err != nil {
+		return false, err
+	}
+	if size < int64(len(journalMagic))+5 {
+		return false, nil
+	}
+	magic := make([]byte, len(journalMagic))
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return false, err
+	}
+	if string(magic) != journalMagic {
+		return false, nil
+	}
+	var tail [5]byte
+	if _, err := f.ReadAt(tail[:], size-5); err != nil {
+		return false, err
+	}
+	if tail[0] != journalEnd {
+		return false, nil
+	}
+	crc := crc32.New(castagnoli)
+	if _, err := io.Copy(crc, io.NewSectionReader(f, 0, size-4)); err != nil {
+		return false, err
+	}
+	return crc.Sum32() == binary.LittleEndian.Uint32(tail[1:]), nil
+}
+
+func restoreJournalFile(fsys vfs.FS, r *bufio.Reader) error {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	name := make([]byte, binary.LittleEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, name); err != nil {
+		return err
+	}
+	var sizeBuf [8]byte
+	if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+		return err
+	}
+	path := string(name)
+	size := int64(binary.LittleEndian.Uint64(sizeBuf[:]))
+	if size < 0 {
+		if err := fsys.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := fsys.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fsys.Rename(tmp, path)
+}
+
+func readWholeFile(fsys vfs.FS, path string) ([]byte, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
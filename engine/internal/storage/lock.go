@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/granite-db/engine/internal/vfs"
+)
+
+// A writer holds an exclusive lock on the database file for as long as it is
+// open, and readers hold a shared one. The WAL and index files belong to the
+// database, so the lock on the data file covers them as well. The process id
+// of the writer is kept in a sidecar file so that a blocked opener can say who
+// holds the database.
+
+// ErrLocked is matched by errors reporting that another handle holds the
+// database.
+var ErrLocked = errors.New("storage: database is locked")
+
+// ErrReadOnly is returned when a database opened read-only would be modified.
+var ErrReadOnly = errors.New("storage: database is open read-only")
+
+// lockRetryInterval is how often a blocked open retries while waiting for the
+// lock timeout.
+const lockRetryInterval = 10 * time.Millisecond
+
+// LockedError reports the holder of a database lock. PID is zero when the
+// holder is unknown, for instance because it opened the database read-only.
+type LockedError struct {
+	Path string
+	PID  int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("storage: database %s is locked by pid %d", e.Path, e.PID)
+	}
+	return fmt.Sprintf("storage: database %s is locked by another process", e.Path)
+}
+
+// Is reports whether target is ErrLocked.
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// LockPath returns the sidecar file naming the process that holds the
+// database at path for writing.
+func LockPath(path string) string {
+	return path + ".lock"
+}
+
+// acquireLock locks f, retrying until timeout has passed. A zero timeout
+// fails straight away when the lock is held.
+func acquireLock(fsys vfs.FS, f vfs.File, path string, readOnly bool, timeout time.Duration) error {
+	mode := vfs.LockExclusive
+	if readOnly {
+		mode = vfs.LockShared
+	}
+	deadline := time.Now().Add(timeout)
+	for !lockHeld(fsys, path) {
+		err := f.Lock(mode)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, vfs.ErrLocked) {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return &LockedError{Path: path, PID: readLockOwner(fsys, path)}
+		}
+		time.Sleep(min(lockRetryInterval, time.Until(deadline)))
+	}
+	if readOnly {
+		// Holding a shared lock proves no writer is active, so a pid file
+		// left by one that crashed is stale.
+		if err := fsys.Remove(LockPath(path)); err != nil && !os.IsNotExist(err) {
+			f.Unlock()
+			return err
+		}
+		return nil
+	}
+	if err := writeLockOwner(fsys, path); err != nil {
+		f.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeLockOwner(fsys vfs.FS, path string) error {
+	f, err := fsys.OpenFile(LockPath(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, strconv.Itoa(os.Getpid())+"\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readLockOwner returns the pid recorded by the writer holding the database,
+// or zero when none is recorded.
+func readLockOwner(fsys vfs.FS, path string) int {
+	f, err := fsys.OpenFile(LockPath(path), os.O_RDONLY, 0)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	buf := make([]byte, 32)
+	n, _ := io.ReadFull(f, buf)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// DatabaseLock is an exclusive lock on a closed database, held by a tool that
+// rewrites its files. The database can still be opened for writing from the
+// same process while the lock is held: the open shares the lock rather than
+// waiting for it.
+type DatabaseLock struct {
+	path string
+	file vfs.File
+}
+
+// heldLocks records the databases this process holds a DatabaseLock on, by
+// absolute path.
+var heldLocks = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// LockDatabase takes the exclusive lock on the database at path, failing with
+// a LockedError when any process has it open.
+func LockDatabase(path string) (*DatabaseLock, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := vfs.OS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Lock(vfs.LockExclusive); err != nil {
+		f.Close()
+		if errors.Is(err, vfs.ErrLocked) {
+			return nil, &LockedError{Path: path, PID: readLockOwner(vfs.OS, path)}
+		}
+		return nil, err
+	}
+	heldLocks.Lock()
+	heldLocks.paths[abs] = true
+	heldLocks.Unlock()
+	return &DatabaseLock{path: abs, file: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *DatabaseLock) Unlock() error {
+	heldLocks.Lock()
+	delete(heldLocks.paths, l.path)
+	heldLocks.Unlock()
+	if err := l.file.Unlock(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// lockHeld reports whether this process holds a DatabaseLock on the database
+// at path.
+func lockHeld(fsys vfs.FS, path string) bool {
+	if fsys != vfs.OS {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	return heldLocks.paths[abs]
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newLockTestDatabase(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "locked.gdb")
+	if err := New(path); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	return path
+}
+
+func TestSecondWriterIsRefused(t *testing.T) {
+	path := newLockTestDatabase(t)
+	first, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = Open(path)
+	var locked *LockedError
+	if !errors.As(err, &locked) || !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected a lock error, got %v", err)
+	}
+	if locked.PID != os.Getpid() {
+		t.Fatalf("expected the lock to name pid %d, got %d", os.Getpid(), locked.PID)
+	}
+	if _, err := OpenWithOptions(path, Options{ReadOnly: true}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected a reader to be refused while writing, got %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := os.Stat(LockPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected the pid file to be removed on close, got %v", err)
+	}
+	second, err := Open(path)
+	if err != nil {
+		t.Fatalf("open after close: %v", err)
+	}
+	second.Close()
+}
+
+func TestReadersShareTheDatabase(t *testing.T) {
+	path := newLockTestDatabase(t)
+	readers := make([]*Manager, 2)
+	for i := range readers {
+		mgr, err := OpenWithOptions(path, Options{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("open reader %d: %v", i, err)
+		}
+		defer mgr.Close()
+		readers[i] = mgr
+	}
+	var locked *LockedError
+	if _, err := Open(path); !errors.As(err, &locked) || locked.PID != 0 {
+		t.Fatalf("expected writer to be refused without a pid, got %v", err)
+	}
+	if _, _, err := readers[0].AllocatePage(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only allocation to fail, got %v", err)
+	}
+	if err := readers[0].UpdateCatalog([]byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read-only catalogue update to fail, got %v", err)
+	}
+}
+
+func TestOpenWaitsForLockTimeout(t *testing.T) {
+	path := newLockTestDatabase(t)
+	first, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	released := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		released <- first.Close()
+	}()
+	second, err := OpenWithOptions(path, Options{LockTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("expected open to wait for the lock, got %v", err)
+	}
+	defer second.Close()
+	if err := <-released; err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	start := time.Now()
+	if _, err := OpenWithOptions(path, Options{LockTimeout: 30 * time.Millisecond}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected open to give up after the timeout, got %v", err)
+	}
+	if waited := time.Since(start); waited < 30*time.Millisecond {
+		t.Fatalf("gave up after %v, before the timeout", waited)
+	}
+}
+
+func TestDatabaseLockKeepsOthersOut(t *testing.T) {
+	path := newLockTestDatabase(t)
+	writer, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := LockDatabase(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected an open database to refuse the lock, got %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	lock, err := LockDatabase(path)
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if _, err := LockDatabase(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected a second lock to be refused, got %v", err)
+	}
+	// The holder may open the database itself while it keeps the lock.
+	mgr, err := Open(path)
+	if err != nil {
+		t.Fatalf("open under the lock: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := LockDatabase(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected closing the database to leave the lock held, got %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	mgr, err = Open(path)
+	if err != nil {
+		t.Fatalf("open after unlock: %v", err)
+	}
+	mgr.Close()
+}
@@ -7,14 +7,63 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/example/granite-db/engine/internal/encryption"
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/vfs"
+	"github.com/example/granite-db/engine/internal/wal"
 )
 
 const (
-	// PageSize defines the fixed page size for GraniteDB heap files.
+	// PageSize is the default page size, and the size used by databases
+	// created before the page size was recorded in the header.
 	PageSize = 4096
+	// MaxPageSize is the largest supported page size. Slot lengths keep their
+	// top bit for the overflow flag, so records must stay below 32 KiB.
+	MaxPageSize = 32768
 
 	headerMagic   = "GRANITED"
-	headerVersion = uint16(1)
+	headerVersion = uint16(9)
+
+	// checksumVersion is the first version in which every page carries a
+	// checksum, so that a zero checksum is no longer read as "unverified".
+	checksumVersion = uint16(9)
+
+	// coveringIndexVersion identifies files whose catalogue can record the
+	// included columns of an index but which may hold pages written before
+	// checksums existed.
+	coveringIndexVersion = uint16(8)
+
+	// orderedKeyVersion identifies files whose index keys sort in key order
+	// but whose catalogue cannot record the included columns of an index.
+	orderedKeyVersion = uint16(7)
+
+	// primaryKeyVersion identifies files that back every primary key with an
+	// index but may hold index trees whose keys do not sort in key order.
+	primaryKeyVersion = uint16(6)
+
+	// indexTreeVersion identifies files that keep their indexes as B+trees
+	// but whose catalogue may record a primary key without an index behind
+	// it.
+	indexTreeVersion = uint16(5)
+
+	// compressionVersion identifies files that can hold compressed pages but
+	// keep their indexes in separate files.
+	compressionVersion = uint16(4)
+
+	// keyHeaderVersion identifies files that reserve space for the encryption
+	// key header but cannot hold compressed pages.
+	keyHeaderVersion = uint16(3)
+
+	// catalogChainVersion identifies files that keep the catalogue on a page
+	// chain but predate the encryption key header.
+	catalogChainVersion = uint16(2)
+
+	// legacyHeaderVersion identifies files that keep the catalogue inline in
+	// the header page, starting at legacyCatalogOffset.
+	legacyHeaderVersion = uint16(1)
+	legacyCatalogOffset = 24
 
 	freeListNil = uint32(0xFFFFFFFF)
 )
@@ -31,30 +80,100 @@ type PageID uint32
 type databaseHeader struct {
 	Magic        [8]byte
 	Version      uint16
-	_padding     uint16
+	PageSize     uint16 // 0 in files created before it was recorded
 	PageCount    uint32
 	FreeListHead uint32
 	CatalogSize  uint32
+	CatalogRoot  uint32
+	Key          *encryption.KeyHeader // nil unless the file is encrypted
 }
 
-const headerSize = 8 + 2 + 2 + 4 + 4 + 4
+const (
+	// keyHeaderOffset is where version 3 headers record the key-derivation
+	// parameters and wrapped data key of an encrypted file.
+	keyHeaderOffset = 8 + 2 + 2 + 4 + 4 + 4 + 4
+	headerSize      = keyHeaderOffset + encryption.HeaderSize
+)
 
 // Manager coordinates access to the on-disk database file and handles page
 // allocation, deallocation and catalog persistence.
 type Manager struct {
         mu           sync.Mutex
-        file         *os.File
+        file         vfs.File
         header       databaseHeader
         catalogCache []byte
         path         string
+        pool         *bufferPool
+        pageSize     int
+        fs           vfs.FS
+        readOnly     bool
+        cipher       *encryption.Cipher
+        // stride is the distance between pages in the file: the page size plus
+        // the encryption overhead when pages are sealed.
+        stride int
+        // checksummed is set when the file's version guarantees that every
+        // page carries a checksum.
+        checksummed bool
+        // fsmSummaries caches what has been learned about each free-space
+        // map, keyed by its first page, and fsmOwners maps every page of a
+        // summarised map to that first page. Both are guarded by fsmMu.
+        fsmMu        sync.Mutex
+        fsmSummaries map[PageID]*fsmSummary
+        fsmOwners    map[PageID]PageID
+        // compacting is set while a compaction rewrites page ids, when the
+        // journal already holds the old catalogue chain.
+        compacting bool
+}
+
+// Options tunes how an existing database file is opened.
+type Options struct {
+	// BufferPoolPages bounds the number of pages cached in memory. Zero
+	// selects DefaultBufferPoolPages.
+	BufferPoolPages int
+	// FS holds the database file. Nil selects the operating system.
+	FS vfs.FS
+	// ReadOnly opens the file for reading under a shared lock, so that any
+	// number of readers can use the database while no writer has it open.
+	ReadOnly bool
+	// LockTimeout is how long to wait for a conflicting lock to be released
+	// before failing with a LockedError. Zero fails immediately.
+	LockTimeout time.Duration
+	// Key is the passphrase of an encrypted database. It must be empty for
+	// a database that is not encrypted.
+	Key string
+}
+
+// CreateOptions controls the layout of a new database file.
+type CreateOptions struct {
+	// PageSize is the size of every page in the file: a power of two between
+	// PageSize and MaxPageSize. Zero selects PageSize.
+	PageSize int
+	// FS receives the new file. Nil selects the operating system.
+	FS vfs.FS
+	// Key, when set, encrypts every page of the new database with a data key
+	// protected by this passphrase.
+	Key string
 }
 
-// New creates a brand-new GraniteDB database file.
+// New creates a brand-new GraniteDB database file with the default page size.
 func New(path string) error {
-        if _, err := os.Stat(path); err == nil {
+	return NewWithOptions(path, CreateOptions{})
+}
+
+// NewWithOptions creates a brand-new GraniteDB database file.
+func NewWithOptions(path string, opts CreateOptions) error {
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = PageSize
+	}
+	if err := ValidatePageSize(pageSize); err != nil {
+		return err
+	}
+	fsys := vfs.Or(opts.FS)
+        if _, err := fsys.Stat(path); err == nil {
                 return fmt.Errorf("storage: database %s already exists", path)
         }
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	f, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
 	if err != nil {
 		return err
 	}
@@ -63,11 +182,19 @@ func New(path string) error {
 	header := databaseHeader{}
 	copy(header.Magic[:], headerMagic)
 	header.Version = headerVersion
+	header.PageSize = uint16(pageSize)
 	header.PageCount = 1 // header page only
 	header.FreeListHead = freeListNil
 	header.CatalogSize = 0
+	if opts.Key != "" {
+		key, _, err := encryption.NewKey(opts.Key)
+		if err != nil {
+			return err
+		}
+		header.Key = key
+	}
 
-	buf := make([]byte, PageSize)
+	buf := make([]byte, pageSize)
 	writeHeader(buf, &header)
 	if _, err := f.Write(buf); err != nil {
 		return err
@@ -75,22 +202,74 @@ func New(path string) error {
 	return nil
 }
 
-// Open loads an existing database file.
+// Open loads an existing database file using default options.
 func Open(path string) (*Manager, error) {
-        f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	return OpenWithOptions(path, Options{})
+}
+
+// OpenWithOptions loads an existing database file with the supplied options.
+func OpenWithOptions(path string, opts Options) (*Manager, error) {
+	fsys := vfs.Or(opts.FS)
+	flag := os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+        f, err := fsys.OpenFile(path, flag, 0o644)
         if err != nil {
                 return nil, err
         }
-
-        m := &Manager{file: f, path: path}
-	if err := m.loadHeader(); err != nil {
+	if err := acquireLock(fsys, f, path, opts.ReadOnly, opts.LockTimeout); err != nil {
 		f.Close()
 		return nil, err
 	}
+	if opts.ReadOnly {
+		if _, err := fsys.Stat(JournalPath(path)); err == nil {
+			f.Close()
+			return nil, fmt.Errorf("%w (%s)", errJournalPending, path)
+		}
+	} else if err := rollbackJournal(fsys, path, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	m := &Manager{file: f, path: path, fs: fsys, readOnly: opts.ReadOnly}
+	if err := m.loadHeader(opts.Key); err != nil {
+		m.closeFileLocked()
+		return nil, err
+	}
+	m.pool = newBufferPool(opts.BufferPoolPages, m.pageSize, m.readPageFromDisk, m.writePageToDisk)
+	if m.header.Version != legacyHeaderVersion {
+		payload, err := m.readCatalogLocked()
+		if err != nil {
+			m.closeFileLocked()
+			return nil, err
+		}
+		m.setCatalogCache(payload)
+	}
 	return m, nil
 }
 
-func (m *Manager) loadHeader() error {
+// checkPageBuffer rejects buffers that cannot hold a page of any supported
+// size.
+func checkPageBuffer(buf []byte) error {
+	if ValidatePageSize(len(buf)) != nil {
+		return errShortPage
+	}
+	return nil
+}
+
+// ValidatePageSize reports whether size can be used as a database page size.
+func ValidatePageSize(size int) error {
+	if size < PageSize || size > MaxPageSize || size&(size-1) != 0 {
+		return fmt.Errorf("storage: unsupported page size %d (expected a power of two from %d to %d)", size, PageSize, MaxPageSize)
+	}
+	return nil
+}
+
+// loadHeader reads the header page, which also yields the page size. The
+// catalogue of legacy files is loaded from the header page here; chained
+// catalogues are read once the buffer pool exists.
+func (m *Manager) loadHeader(key string) error {
 	buf := make([]byte, PageSize)
 	if _, err := io.ReadFull(m.file, buf); err != nil {
 		return err
@@ -100,31 +279,107 @@ func (m *Manager) loadHeader() error {
 		return err
 	}
 	m.header = *header
-	if m.header.CatalogSize > uint32(PageSize-headerSize) {
-		return fmt.Errorf("storage: catalog too large")
+	m.pageSize = PageSize
+	if m.header.PageSize != 0 {
+		m.pageSize = int(m.header.PageSize)
 	}
-	size := int(m.header.CatalogSize)
-	if size == 0 {
-		m.catalogCache = nil
-	} else {
-		m.setCatalogCache(buf[headerSize : headerSize+size])
+	if err := ValidatePageSize(m.pageSize); err != nil {
+		return err
+	}
+	m.stride = m.pageSize
+	m.checksummed = m.header.Version >= checksumVersion
+	switch {
+	case m.header.Key != nil && key == "":
+		return fmt.Errorf("storage: database %s is encrypted: %w", m.path, ErrKeyRequired)
+	case m.header.Key == nil && key != "":
+		return fmt.Errorf("storage: database %s is not encrypted but a key was supplied", m.path)
+	case m.header.Key != nil:
+		c, err := m.header.Key.Unlock(key)
+		if err != nil {
+			return fmt.Errorf("storage: cannot unlock %s: %w", m.path, err)
+		}
+		m.cipher = c
+		m.stride = m.pageSize + encryption.Overhead
+	}
+	if m.header.Version == legacyHeaderVersion {
+		if m.header.CatalogSize > uint32(PageSize-legacyCatalogOffset) {
+			return fmt.Errorf("storage: catalog too large")
+		}
+		size := int(m.header.CatalogSize)
+		m.setCatalogCache(buf[legacyCatalogOffset : legacyCatalogOffset+size])
 	}
 	return nil
 }
 
-// Close flushes header information and closes the backing file.
+// PageSize returns the size of every page in the database file.
+func (m *Manager) PageSize() int {
+	return m.pageSize
+}
+
+// ReadOnly reports whether the database was opened read-only.
+func (m *Manager) ReadOnly() bool {
+	return m.readOnly
+}
+
+// Close writes back cached pages, flushes header information and closes the
+// backing file, releasing the lock on it.
 func (m *Manager) Close() error {
+	if err := m.Flush(); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if m.file == nil {
 		return nil
 	}
-	if err := m.flushHeaderLocked(nil); err != nil {
+	return m.closeFileLocked()
+}
+
+// closeFileLocked closes the data file. A writer removes its pid file first,
+// while it still holds the lock.
+func (m *Manager) closeFileLocked() error {
+	var err error
+	if !m.readOnly {
+		if rmErr := m.fs.Remove(LockPath(m.path)); rmErr != nil && !os.IsNotExist(rmErr) {
+			err = rmErr
+		}
+	}
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	m.file = nil
+	return err
+}
+
+// Flush writes every dirty page in the buffer pool back to the data file,
+// rewrites the header and syncs the file.
+func (m *Manager) Flush() error {
+	m.mu.Lock()
+	closed := m.file == nil
+	m.mu.Unlock()
+	if closed || m.readOnly {
+		return nil
+	}
+	if err := m.pool.flush(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.flushHeaderLocked(); err != nil {
 		return err
 	}
-        err := m.file.Close()
-        m.file = nil
-        return err
+	return m.file.Sync()
+}
+
+// SetLogFlusher attaches the write-ahead log that must be forced before dirty
+// pages are written back to the data file.
+func (m *Manager) SetLogFlusher(log LogFlusher) {
+	m.pool.setLog(log)
+}
+
+// BufferPoolStats reports the current state of the page cache.
+func (m *Manager) BufferPoolStats() PoolStats {
+	return m.pool.snapshot()
 }
 
 // Path returns the on-disk location of the database file.
@@ -132,98 +387,189 @@ func (m *Manager) Path() string {
         return m.path
 }
 
-// CatalogData returns a copy of the persisted catalog payload from page 0.
+// CatalogData returns a copy of the persisted catalog payload.
 func (m *Manager) CatalogData() ([]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	buf := make([]byte, PageSize)
-	if _, err := m.file.ReadAt(buf, 0); err != nil {
-		return nil, err
-	}
-	header, err := readHeader(buf)
-	if err != nil {
-		return nil, err
-	}
-	if header.CatalogSize == 0 {
+	if len(m.catalogCache) == 0 {
 		return nil, nil
 	}
-	if int(header.CatalogSize) > PageSize-headerSize {
-		return nil, fmt.Errorf("storage: catalog too large")
-	}
-	data := make([]byte, header.CatalogSize)
-	copy(data, buf[headerSize:headerSize+int(header.CatalogSize)])
+	data := make([]byte, len(m.catalogCache))
+	copy(data, m.catalogCache)
 	return data, nil
 }
 
-// UpdateCatalog persists catalog bytes to page 0.
+// UpdateCatalog persists catalog bytes to the catalogue page chain and points
+// the header page at it. Databases that still store the catalogue inline in
+// the header page are moved onto a chain by their first update.
 func (m *Manager) UpdateCatalog(payload []byte) error {
-	if len(payload) > PageSize-headerSize {
-		return fmt.Errorf("storage: catalog payload exceeds header page capacity")
+	if m.readOnly {
+		return ErrReadOnly
 	}
-
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.setCatalogCache(payload)
-	return m.flushHeaderLocked(nil)
+	return m.writeCatalogLocked(payload)
 }
 
-// ReadPage retrieves the raw bytes for the given page id.
+// ReadPage returns a private copy of the given page, served from the buffer
+// pool when the page is resident.
 func (m *Manager) ReadPage(id PageID) ([]byte, error) {
-	if id >= PageID(m.header.PageCount) {
-		return nil, fmt.Errorf("storage: page %d out of bounds", id)
+	if err := m.checkBounds(id); err != nil {
+		return nil, err
 	}
-	buf := make([]byte, PageSize)
-	offset := int64(id) * PageSize
-	if _, err := m.file.ReadAt(buf, offset); err != nil {
+	buf := make([]byte, m.pageSize)
+	if err := m.pool.readInto(id, buf); err != nil {
 		return nil, err
 	}
 	return buf, nil
 }
 
-// WritePage writes a full page back to disk.
+// WritePage replaces the cached image of a page. The page reaches disk when it
+// is evicted or the manager is flushed.
 func (m *Manager) WritePage(id PageID, data []byte) error {
-	if len(data) != PageSize {
+	return m.writePageLSN(id, data, 0)
+}
+
+// PinPage returns the buffer pool frame holding the page without copying it.
+// The frame stays resident until UnpinPage is called; callers that modify the
+// buffer must pass dirty=true when unpinning.
+func (m *Manager) PinPage(id PageID) ([]byte, error) {
+	if err := m.checkBounds(id); err != nil {
+		return nil, err
+	}
+	return m.pool.pin(id)
+}
+
+// UnpinPage releases a frame obtained from PinPage.
+func (m *Manager) UnpinPage(id PageID, dirty bool) error {
+	if dirty && m.readOnly {
+		// Keep the frame clean so that it is never written back.
+		if err := m.pool.unpin(id, false); err != nil {
+			return err
+		}
+		return ErrReadOnly
+	}
+	return m.pool.unpin(id, dirty)
+}
+
+func (m *Manager) writePageLSN(id PageID, data []byte, lsn uint64) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if len(data) != m.pageSize {
 		return errShortPage
 	}
-	if id >= PageID(m.header.PageCount) {
+	if err := m.checkBounds(id); err != nil {
+		return err
+	}
+	return m.pool.put(id, data, lsn)
+}
+
+func (m *Manager) checkBounds(id PageID) error {
+	m.mu.Lock()
+	count := m.header.PageCount
+	m.mu.Unlock()
+	if id >= PageID(count) {
 		return fmt.Errorf("storage: page %d out of bounds", id)
 	}
-	offset := int64(id) * PageSize
-	_, err := m.file.WriteAt(data, offset)
+	return nil
+}
+
+func (m *Manager) pageOffset(id PageID) int64 {
+	return int64(id) * int64(m.stride)
+}
+
+func (m *Manager) readPageFromDisk(id PageID, buf []byte) error {
+	if m.cipher == nil {
+		if _, err := m.file.ReadAt(buf, m.pageOffset(id)); err != nil {
+			return err
+		}
+		if err := expandPage(id, buf); err != nil {
+			return err
+		}
+		return verifyChecksum(id, buf, m.checksummed)
+	}
+	sealed := make([]byte, m.stride)
+	if _, err := m.file.ReadAt(sealed, m.pageOffset(id)); err != nil {
+		return err
+	}
+	if _, err := m.cipher.Open(buf[:0], sealed, pageAdditionalData(id)); err != nil {
+		return &CorruptPageError{Page: id, Cause: err}
+	}
+	if err := expandPage(id, buf); err != nil {
+		return err
+	}
+	return verifyChecksum(id, buf, m.checksummed)
+}
+
+func (m *Manager) writePageToDisk(id PageID, buf []byte) error {
+	image := make([]byte, m.pageSize)
+	copy(image, buf)
+	stampChecksum(image)
+	image, err := compressPage(image)
+	if err != nil {
+		return err
+	}
+	if m.cipher != nil {
+		sealed, err := m.cipher.Seal(make([]byte, 0, m.stride), image, pageAdditionalData(id))
+		if err != nil {
+			return err
+		}
+		image = sealed
+	}
+	_, err = m.file.WriteAt(image, m.pageOffset(id))
 	return err
 }
 
+// pageAdditionalData binds a sealed page to its position, so that a page
+// copied elsewhere in the file fails authentication.
+func pageAdditionalData(id PageID) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(id))
+	return buf[:]
+}
+
 // AllocatePage returns a zeroed page suitable for writing records.
 func (m *Manager) AllocatePage() (PageID, []byte, error) {
+	if m.readOnly {
+		return 0, nil, ErrReadOnly
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	return m.allocatePageLocked()
+}
+
+func (m *Manager) allocatePageLocked() (PageID, []byte, error) {
 	var id PageID
 	var buf []byte
 
 	if m.header.FreeListHead != freeListNil {
 		id = PageID(m.header.FreeListHead)
-		buf = make([]byte, PageSize)
-		offset := int64(id) * PageSize
-		if _, err := m.file.ReadAt(buf, offset); err != nil {
+		buf = make([]byte, m.pageSize)
+		if err := m.pool.readInto(id, buf); err != nil {
 			return 0, nil, err
 		}
 		// The first 4 bytes of the recycled page store the next pointer.
 		m.header.FreeListHead = binary.LittleEndian.Uint32(buf[:4])
-		buf = make([]byte, PageSize)
+		buf = make([]byte, m.pageSize)
 	} else {
+		if m.compacting {
+			// The journal does not cover the pages past the compacted
+			// file.
+			return 0, nil, fmt.Errorf("storage: compaction ran out of free pages")
+		}
 		id = PageID(m.header.PageCount)
-		buf = make([]byte, PageSize)
-		offset := int64(id) * PageSize
-		if _, err := m.file.WriteAt(buf, offset); err != nil {
+		buf = make([]byte, m.pageSize)
+		if err := m.writePageToDisk(id, buf); err != nil {
 			return 0, nil, err
 		}
 		m.header.PageCount++
 	}
 
-	if err := m.flushHeaderLocked(nil); err != nil {
+	if err := m.flushHeaderLocked(); err != nil {
 		return 0, nil, err
 	}
 	return id, buf, nil
@@ -231,38 +577,86 @@ func (m *Manager) AllocatePage() (PageID, []byte, error) {
 
 // FreePage adds the specified page to the freelist for reuse.
 func (m *Manager) FreePage(id PageID) error {
-	if id == 0 {
-		return fmt.Errorf("storage: cannot free header page")
+	return m.FreePages(nil, nil, id)
+}
+
+// FreePages adds pages to the freelist for reuse. The header, which is
+// written straight to the file, only names a page once its link to the next
+// is safe: logged under tx, which must have ended, so that recovery replays
+// the link after any older image of the page, or else written to the file
+// and synced.
+func (m *Manager) FreePages(tx *txn.Transaction, log *wal.Manager, ids ...PageID) error {
+	for _, id := range ids {
+		if id == 0 {
+			return fmt.Errorf("storage: cannot free header page")
+		}
+	}
+	if m.readOnly {
+		return ErrReadOnly
 	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	buf := make([]byte, PageSize)
-	binary.LittleEndian.PutUint32(buf[:4], m.header.FreeListHead)
-	offset := int64(id) * PageSize
-	if _, err := m.file.WriteAt(buf, offset); err != nil {
-		return err
+	return m.freePagesLocked(tx, log, ids)
+}
+
+// ReleasePages returns pages to the free list, or has the transaction do so
+// once it has ended: until then, undoing the transaction may link the pages
+// back in.
+func (m *Manager) ReleasePages(tx *txn.Transaction, log *wal.Manager, ids ...PageID) error {
+	if len(ids) == 0 {
+		return nil
 	}
-	m.header.FreeListHead = uint32(id)
-	return m.flushHeaderLocked(nil)
+	if tx == nil {
+		return m.FreePages(nil, nil, ids...)
+	}
+	tx.RegisterRelease(func() error { return m.FreePages(tx, log, ids...) })
+	return nil
 }
 
-func (m *Manager) flushHeaderLocked(catalog []byte) error {
-	if catalog == nil {
-		catalog = m.catalogCache
-	} else {
-		m.setCatalogCache(catalog)
+func (m *Manager) freePagesLocked(tx *txn.Transaction, log *wal.Manager, ids []PageID) error {
+	if len(ids) == 0 {
+		return nil
 	}
-	if len(catalog) > PageSize-headerSize {
-		return fmt.Errorf("storage: catalog payload exceeds header page capacity")
+	logged := tx != nil && log != nil
+	head := m.header.FreeListHead
+	var lsn uint64
+	for _, id := range ids {
+		m.forgetFreeSpacePage(id)
+		buf := make([]byte, m.pageSize)
+		binary.LittleEndian.PutUint32(buf[:4], head)
+		var err error
+		if logged {
+			if lsn, err = appendTxnPage(tx, log, wal.RecordPageMeta, id, buf); err == nil {
+				err = m.pool.put(id, buf, lsn)
+			}
+		} else {
+			err = m.pool.putThrough(id, buf)
+		}
+		if err != nil {
+			return err
+		}
+		head = uint32(id)
 	}
+	if logged {
+		if err := log.FlushTo(lsn); err != nil {
+			return err
+		}
+	} else if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.header.FreeListHead = head
+	return m.flushHeaderLocked()
+}
 
-	buf := make([]byte, PageSize)
-	m.header.CatalogSize = uint32(len(catalog))
+func (m *Manager) flushHeaderLocked() error {
+	buf := make([]byte, m.pageSize)
 	writeHeader(buf, &m.header)
-	if len(catalog) > 0 {
-		copy(buf[headerSize:], catalog)
+	if m.header.Version == legacyHeaderVersion {
+		// Until its first catalogue update a legacy file keeps the payload
+		// inline, so it has to be rewritten alongside the header.
+		copy(buf[legacyCatalogOffset:], m.catalogCache)
 	}
 	_, err := m.file.WriteAt(buf, 0)
 	return err
@@ -291,19 +685,33 @@ func readHeader(buf []byte) (*databaseHeader, error) {
 		return nil, errInvalidHeader
 	}
 	h.Version = binary.LittleEndian.Uint16(buf[8:10])
-	if h.Version != headerVersion {
-		return nil, fmt.Errorf("storage: unsupported header version %d", h.Version)
+	h.PageSize = binary.LittleEndian.Uint16(buf[10:12])
+	if err := checkHeaderVersion(h.Version); err != nil {
+		return nil, err
 	}
 	h.PageCount = binary.LittleEndian.Uint32(buf[12:16])
 	h.FreeListHead = binary.LittleEndian.Uint32(buf[16:20])
 	h.CatalogSize = binary.LittleEndian.Uint32(buf[20:24])
+	if h.Version != legacyHeaderVersion {
+		h.CatalogRoot = binary.LittleEndian.Uint32(buf[24:28])
+	}
+	if h.Version >= keyHeaderVersion {
+		h.Key = encryption.DecodeHeader(buf[keyHeaderOffset:headerSize])
+	}
 	return h, nil
 }
 
 func writeHeader(buf []byte, h *databaseHeader) {
 	copy(buf[:8], []byte(headerMagic))
 	binary.LittleEndian.PutUint16(buf[8:10], h.Version)
+	binary.LittleEndian.PutUint16(buf[10:12], h.PageSize)
 	binary.LittleEndian.PutUint32(buf[12:16], h.PageCount)
 	binary.LittleEndian.PutUint32(buf[16:20], h.FreeListHead)
 	binary.LittleEndian.PutUint32(buf[20:24], h.CatalogSize)
+	if h.Version != legacyHeaderVersion {
+		binary.LittleEndian.PutUint32(buf[24:28], h.CatalogRoot)
+	}
+	if h.Key != nil {
+		h.Key.Encode(buf[keyHeaderOffset:headerSize])
+	}
 }
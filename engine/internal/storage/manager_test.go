@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestManagerHonoursConfiguredPageSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wide.gdb")
+	if err := NewWithOptions(path, CreateOptions{PageSize: 16384}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	mgr, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if mgr.PageSize() != 16384 {
+		t.Fatalf("expected page size 16384, got %d", mgr.PageSize())
+	}
+	root, buf, err := mgr.AllocatePage()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if len(buf) != 16384 {
+		t.Fatalf("expected 16384-byte page buffer, got %d", len(buf))
+	}
+	if err := InitialiseHeapPage(buf); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if err := mgr.WritePage(root, buf); err != nil {
+		t.Fatalf("write root: %v", err)
+	}
+	fsm, err := CreateFreeSpaceMap(mgr, root)
+	if err != nil {
+		t.Fatalf("create fsm: %v", err)
+	}
+	heap := NewHeapFileWithMap(mgr, root, fsm)
+	record := bytes.Repeat([]byte{'w'}, 12000)
+	rid, err := heap.Insert(nil, nil, record)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if overflow, _ := heap.OverflowPages(); len(overflow) != 0 {
+		t.Fatalf("expected a 12000-byte record to be stored inline, got %d overflow pages", len(overflow))
+	}
+	if err := mgr.UpdateCatalog(bytes.Repeat([]byte{'c'}, 20000)); err != nil {
+		t.Fatalf("update catalogue: %v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	mgr, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer mgr.Close()
+	if mgr.PageSize() != 16384 {
+		t.Fatalf("page size not persisted, got %d", mgr.PageSize())
+	}
+	got, err := NewHeapFileWithMap(mgr, root, fsm).Fetch(rid)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if !bytes.Equal(got, record) {
+		t.Fatalf("record did not survive reopen")
+	}
+	if catalog, _ := mgr.CatalogData(); len(catalog) != 20000 {
+		t.Fatalf("expected 20000-byte catalogue, got %d", len(catalog))
+	}
+}
+
+func TestNewRejectsUnsupportedPageSize(t *testing.T) {
+	for _, size := range []int{1024, 6000, 65536} {
+		path := filepath.Join(t.TempDir(), "bad.gdb")
+		if err := NewWithOptions(path, CreateOptions{PageSize: size}); err == nil {
+			t.Fatalf("expected page size %d to be rejected", size)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// Chain pages hold a payload that is split across several pages: overflow
+// records and the catalogue. Each page stores the id of the next page in the
+// chain and the number of payload bytes it carries.
+const (
+	chainPageHeaderSize = 16
+
+	// overflowPointerSize is the size of the stub left in the heap page for a
+	// record stored out of line: its total length and first overflow page.
+	overflowPointerSize = 8
+)
+
+// chainPageCapacity is the number of payload bytes a chain page can carry.
+func chainPageCapacity(pageSize int) int {
+	return pageSize - chainPageHeaderSize
+}
+
+func readChainPageHeader(page []byte) (PageID, int) {
+	next := PageID(binary.LittleEndian.Uint32(page[0:4]))
+	used := int(binary.LittleEndian.Uint16(page[4:6]))
+	return next, used
+}
+
+func writeChainPageHeader(page []byte, next PageID, used int) {
+	binary.LittleEndian.PutUint32(page[0:4], uint32(next))
+	binary.LittleEndian.PutUint16(page[4:6], uint16(used))
+}
+
+// maxInlineRecord is the largest record stored directly on a heap page.
+func maxInlineRecord(pageSize int) int {
+	return pageSize - heapHeaderSize - slotSize
+}
+
+func encodeOverflowPointer(length int, first PageID) []byte {
+	buf := make([]byte, overflowPointerSize)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(length))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(first))
+	return buf
+}
+
+func decodeOverflowPointer(stub []byte) (int, PageID, error) {
+	if len(stub) != overflowPointerSize {
+		return 0, 0, fmt.Errorf("storage: corrupt overflow pointer")
+	}
+	length := int(binary.LittleEndian.Uint32(stub[0:4]))
+	first := PageID(binary.LittleEndian.Uint32(stub[4:8]))
+	return length, first, nil
+}
+
+// writeOverflow stores the record in a freshly allocated chain of overflow
+// pages and returns the pointer to keep in the heap page.
+func (hf *HeapFile) writeOverflow(tx *txn.Transaction, log *wal.Manager, record []byte) ([]byte, error) {
+	capacity := chainPageCapacity(hf.manager.pageSize)
+	count := (len(record) + capacity - 1) / capacity
+	ids := make([]PageID, count)
+	for i := range ids {
+		id, _, err := hf.manager.AllocatePage()
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	for i, id := range ids {
+		buf := make([]byte, hf.manager.pageSize)
+		var next PageID
+		if i+1 < len(ids) {
+			next = ids[i+1]
+		}
+		start := i * capacity
+		end := min(start+capacity, len(record))
+		writeChainPageHeader(buf, next, end-start)
+		copy(buf[chainPageHeaderSize:], record[start:end])
+		if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, id, buf); err != nil {
+			return nil, err
+		}
+	}
+	return encodeOverflowPointer(len(record), ids[0]), nil
+}
+
+// readOverflow reassembles a record stored out of line.
+func (hf *HeapFile) readOverflow(stub []byte) ([]byte, error) {
+	length, first, err := decodeOverflowPointer(stub)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 0, length)
+	err = hf.walkOverflow(first, func(id PageID, page []byte) error {
+		_, used := readChainPageHeader(page)
+		if used > chainPageCapacity(len(page)) || len(record)+used > length {
+			return fmt.Errorf("storage: overflow page %d is corrupt", id)
+		}
+		record = append(record, page[chainPageHeaderSize:chainPageHeaderSize+used]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(record) != length {
+		return nil, fmt.Errorf("storage: overflow chain at page %d holds %d of %d bytes", first, len(record), length)
+	}
+	return record, nil
+}
+
+// freeOverflow returns the pages of an out-of-line record to the free list
+// once the transaction has ended.
+func (hf *HeapFile) freeOverflow(tx *txn.Transaction, log *wal.Manager, stub []byte) error {
+	_, first, err := decodeOverflowPointer(stub)
+	if err != nil {
+		return err
+	}
+	ids, err := hf.overflowPages(first)
+	if err != nil {
+		return err
+	}
+	return hf.manager.ReleasePages(tx, log, ids...)
+}
+
+func (hf *HeapFile) overflowPages(first PageID) ([]PageID, error) {
+	var ids []PageID
+	err := hf.walkOverflow(first, func(id PageID, _ []byte) error {
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
+
+func (hf *HeapFile) walkOverflow(first PageID, fn func(id PageID, page []byte) error) error {
+	seen := make(map[PageID]struct{})
+	for current := first; current != 0; {
+		if _, loop := seen[current]; loop {
+			return fmt.Errorf("storage: overflow chain loop at page %d", current)
+		}
+		seen[current] = struct{}{}
+		page, err := hf.manager.ReadPage(current)
+		if err != nil {
+			return err
+		}
+		if err := fn(current, page); err != nil {
+			return err
+		}
+		current, _ = readChainPageHeader(page)
+	}
+	return nil
+}
+
+// resolveRecord returns the row stored in a slot, following the overflow
+// pointer when the record is held out of line.
+func (hf *HeapFile) resolveRecord(page *HeapPage, slot uint16, record []byte) ([]byte, error) {
+	if !page.External(slot) {
+		return record, nil
+	}
+	return hf.readOverflow(record)
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// Truncation records what HeapFile.Truncate replaced, so that the caller can
+// release the old pages once the transaction commits or put them back if it
+// rolls back.
+type Truncation struct {
+	heap     *HeapFile
+	tx       *txn.Transaction
+	log      *wal.Manager
+	root     []byte
+	fsm      []byte
+	released []PageID
+}
+
+// Truncate empties the heap file. The root page is reinitialised in place,
+// keeping its compression codec, and the free-space map is reset to describe
+// it, so the table's catalogue entry stays valid. Every other page of the old
+// chain, its overflow pages and the rest of the map are left untouched until
+// Release; until then Restore undoes the truncation.
+func (hf *HeapFile) Truncate(tx *txn.Transaction, log *wal.Manager) (*Truncation, error) {
+	pages, err := hf.Pages()
+	if err != nil {
+		return nil, err
+	}
+	mapPages, err := hf.FreeSpaceMapPages()
+	if err != nil {
+		return nil, err
+	}
+	overflowPages, err := hf.OverflowPages()
+	if err != nil {
+		return nil, err
+	}
+	t := &Truncation{heap: hf, tx: tx, log: log}
+	t.released = append(t.released, pages[1:]...)
+	if len(mapPages) > 0 {
+		t.released = append(t.released, mapPages[1:]...)
+	}
+	t.released = append(t.released, overflowPages...)
+
+	if t.root, err = hf.manager.ReadPage(hf.root); err != nil {
+		return nil, err
+	}
+	fresh := make([]byte, len(t.root))
+	if err := InitialiseHeapPage(fresh); err != nil {
+		return nil, err
+	}
+	SetPageCompression(fresh, PageCompression(t.root))
+	if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, hf.root, fresh); err != nil {
+		return nil, err
+	}
+
+	if hf.fsm != 0 {
+		if t.fsm, err = hf.manager.ReadPage(hf.fsm); err != nil {
+			return nil, err
+		}
+		blank := make([]byte, len(t.fsm))
+		if err := InitialiseFreeSpacePage(blank); err != nil {
+			return nil, err
+		}
+		if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, hf.fsm, blank); err != nil {
+			return nil, err
+		}
+		hf.manager.forgetFreeSpaceMap(hf.fsm)
+		fsm := freeSpaceMap{manager: hf.manager, root: hf.fsm}
+		if err := fsm.update(tx, log, hf.root, heapFreeSpace(readHeapHeader(fresh))); err != nil {
+			return nil, err
+		}
+		if err := fsm.setHeapTail(tx, log, hf.root); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Release returns the pages of the old chain to the free list. It runs once
+// the truncating transaction has committed.
+func (t *Truncation) Release() error {
+	if err := t.heap.manager.FreePages(t.tx, t.log, t.released...); err != nil {
+		return err
+	}
+	t.released = nil
+	return nil
+}
+
+// Restore links the old chain back in by rewriting the saved root and
+// free-space map pages. Pages appended to the emptied heap since the
+// truncation are left unreachable.
+func (t *Truncation) Restore(tx *txn.Transaction, log *wal.Manager) error {
+	if err := persistPage(tx, log, t.heap.manager, wal.RecordPageMeta, t.heap.root, t.root); err != nil {
+		return err
+	}
+	if t.fsm != nil {
+		t.heap.manager.forgetFreeSpaceMap(t.heap.fsm)
+		return persistPage(tx, log, t.heap.manager, wal.RecordPageMeta, t.heap.fsm, t.fsm)
+	}
+	return nil
+}
+
+// ReleasedPages returns the number of pages Release frees.
+func (t *Truncation) ReleasedPages() int {
+	return len(t.released)
+}
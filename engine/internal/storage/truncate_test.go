@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/compression"
+)
+
+func TestHeapFileTruncateRestoreAndRelease(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	if err := mgr.EnableCompression(); err != nil {
+		t.Fatalf("enable compression: %v", err)
+	}
+	root, err := mgr.ReadPage(heap.Root())
+	if err != nil {
+		t.Fatalf("read root: %v", err)
+	}
+	SetPageCompression(root, compression.LZ4)
+	if err := mgr.WritePage(heap.Root(), root); err != nil {
+		t.Fatalf("write root: %v", err)
+	}
+	record := bytes.Repeat([]byte{'t'}, 300)
+	for i := 0; i < 40; i++ {
+		if _, err := heap.Insert(nil, nil, record); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	if _, err := heap.Insert(nil, nil, bytes.Repeat([]byte("overflow"), 1000)); err != nil {
+		t.Fatalf("insert large: %v", err)
+	}
+	before, err := heap.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+
+	countRows := func() int {
+		n := 0
+		if err := heap.Scan(func(RowID, []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		return n
+	}
+	truncation, err := heap.Truncate(nil, nil)
+	if err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if n := countRows(); n != 0 {
+		t.Fatalf("expected an empty heap, got %d rows", n)
+	}
+	root, err = mgr.ReadPage(heap.Root())
+	if err != nil {
+		t.Fatalf("read root: %v", err)
+	}
+	if PageCompression(root) != compression.LZ4 {
+		t.Fatalf("expected the root page to keep its codec")
+	}
+	if err := truncation.Restore(nil, nil); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if n := countRows(); n != 41 {
+		t.Fatalf("expected 41 rows after restore, got %d", n)
+	}
+
+	truncation, err = heap.Truncate(nil, nil)
+	if err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if truncation.ReleasedPages() <= len(before)-1 {
+		t.Fatalf("expected the overflow chain to be released too, got %d pages", truncation.ReleasedPages())
+	}
+	if err := truncation.Release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	count := mgr.header.PageCount
+	if _, _, err := mgr.AllocatePage(); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if mgr.header.PageCount != count {
+		t.Fatalf("expected a released page to be reused, the file grew to %d pages", mgr.header.PageCount)
+	}
+	if _, err := heap.Insert(nil, nil, record); err != nil {
+		t.Fatalf("insert after truncate: %v", err)
+	}
+}
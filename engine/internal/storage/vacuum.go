@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// VacuumStats summarises the work performed by HeapFile.Vacuum.
+type VacuumStats struct {
+	PagesScanned   int
+	PagesFreed     int
+	RowsMoved      int
+	BytesReclaimed int
+	// FreeSpaceMap is the first page of the rebuilt free-space map. It differs
+	// from the heap file's previous map when one had to be created.
+	FreeSpaceMap PageID
+}
+
+// RowMoveFunc is called after a record has been relocated to a new RowID so
+// that callers can repoint index entries.
+type RowMoveFunc func(from, to RowID, record []byte) error
+
+// Vacuum reclaims space left behind by deleted records. Every page is
+// compacted in place, which keeps RowIDs stable. Rows on pages towards the end
+// of the chain are then moved into room on earlier pages when that empties the
+// page completely; moved reports each relocation. Emptied pages other than the
+// root are unlinked and returned to the free list once the transaction ends,
+// and the free-space map is rebuilt (or created for heap files that had none).
+func (hf *HeapFile) Vacuum(tx *txn.Transaction, log *wal.Manager, moved RowMoveFunc) (VacuumStats, error) {
+	stats := VacuumStats{}
+	pages, err := hf.Pages()
+	if err != nil {
+		return stats, err
+	}
+	stats.PagesScanned = len(pages)
+
+	available := make([]int, len(pages))
+	for i, id := range pages {
+		page, err := hf.loadPage(id)
+		if err != nil {
+			return stats, err
+		}
+		reclaimed := page.Compact()
+		if reclaimed > 0 {
+			if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, id, page.Data()); err != nil {
+				return stats, err
+			}
+			stats.BytesReclaimed += reclaimed
+		}
+		available[i] = page.AvailableSpace()
+	}
+
+	for i := len(pages) - 1; i > 0; i-- {
+		n, err := hf.drainPage(tx, log, pages, available, i, moved)
+		if err != nil {
+			return stats, err
+		}
+		stats.RowsMoved += n
+	}
+
+	remaining := make([]PageID, 0, len(pages))
+	remainingSpace := make([]int, 0, len(pages))
+	prev := pages[0]
+	remaining = append(remaining, prev)
+	remainingSpace = append(remainingSpace, available[0])
+	for i := 1; i < len(pages); i++ {
+		page, err := hf.loadPage(pages[i])
+		if err != nil {
+			return stats, err
+		}
+		if page.LiveCount() > 0 {
+			remaining = append(remaining, pages[i])
+			remainingSpace = append(remainingSpace, available[i])
+			prev = pages[i]
+			continue
+		}
+		prevPage, err := hf.loadPage(prev)
+		if err != nil {
+			return stats, err
+		}
+		prevPage.SetNextPage(page.NextPage())
+		if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, prev, prevPage.Data()); err != nil {
+			return stats, err
+		}
+		if err := hf.manager.ReleasePages(tx, log, pages[i]); err != nil {
+			return stats, err
+		}
+		stats.PagesFreed++
+	}
+
+	fsm, err := hf.rebuildFreeSpaceMap(tx, log, remaining, remainingSpace)
+	if err != nil {
+		return stats, err
+	}
+	stats.FreeSpaceMap = fsm
+	return stats, nil
+}
+
+// drainPage moves every record on pages[idx] into earlier pages, provided
+// they all fit; otherwise the page is left untouched. It returns the number of
+// rows moved.
+func (hf *HeapFile) drainPage(tx *txn.Transaction, log *wal.Manager, pages []PageID, available []int, idx int, moved RowMoveFunc) (int, error) {
+	source, err := hf.loadPage(pages[idx])
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		slot     uint16
+		record   []byte
+		external bool
+	}
+	records := make([]pending, 0, source.LiveCount())
+	if err := source.Records(func(slot uint16, record []byte) error {
+		clone := make([]byte, len(record))
+		copy(clone, record)
+		records = append(records, pending{slot: slot, record: clone, external: source.External(slot)})
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	// Plan first-fit placements against the earlier pages before touching
+	// anything, so a page is only drained when it can be emptied.
+	budget := make([]int, idx)
+	copy(budget, available[:idx])
+	targets := make([]int, len(records))
+	for i, rec := range records {
+		targets[i] = -1
+		for j := range budget {
+			if budget[j] >= len(rec.record)+slotSize {
+				budget[j] -= len(rec.record) + slotSize
+				targets[i] = j
+				break
+			}
+		}
+		if targets[i] < 0 {
+			return 0, nil
+		}
+	}
+
+	for i, rec := range records {
+		target := targets[i]
+		// Overflow records move by their pointer; the chain stays put.
+		rid, inserted, free, err := hf.insertIntoPage(tx, log, pages[target], rec.record, rec.external)
+		if err != nil {
+			return i, err
+		}
+		if !inserted {
+			// The plan is conservative, so this only happens if the page
+			// changed underneath us; leave the remaining rows in place.
+			return i, nil
+		}
+		available[target] = free
+		from := RowID{Page: pages[idx], Slot: rec.slot}
+		if err := hf.deleteRecord(tx, log, from); err != nil {
+			return i, err
+		}
+		if moved != nil {
+			row := rec.record
+			if rec.external {
+				if row, err = hf.readOverflow(rec.record); err != nil {
+					return i + 1, err
+				}
+			}
+			if err := moved(from, rid, row); err != nil {
+				return i + 1, err
+			}
+		}
+	}
+	source, err = hf.loadPage(pages[idx])
+	if err != nil {
+		return len(records), err
+	}
+	source.Compact()
+	if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, pages[idx], source.Data()); err != nil {
+		return len(records), err
+	}
+	available[idx] = source.AvailableSpace()
+	return len(records), nil
+}
+
+func (hf *HeapFile) deleteRecord(tx *txn.Transaction, log *wal.Manager, id RowID) error {
+	page, err := hf.loadPage(id.Page)
+	if err != nil {
+		return err
+	}
+	if err := page.Delete(id.Slot); err != nil {
+		return err
+	}
+	return persistPage(tx, log, hf.manager, wal.RecordDelete, id.Page, page.Data())
+}
+
+func (hf *HeapFile) loadPage(id PageID) (*HeapPage, error) {
+	buf, err := hf.manager.ReadPage(id)
+	if err != nil {
+		return nil, err
+	}
+	return LoadHeapPage(id, buf)
+}
+
+// rebuildFreeSpaceMap rewrites the map so it lists exactly the given pages,
+// reusing existing FSM pages and freeing any that are no longer needed.
+func (hf *HeapFile) rebuildFreeSpaceMap(tx *txn.Transaction, log *wal.Manager, pages []PageID, free []int) (PageID, error) {
+	var existing []PageID
+	if hf.fsm != 0 {
+		ids, err := freeSpaceMap{manager: hf.manager, root: hf.fsm}.pages()
+		if err != nil {
+			return 0, err
+		}
+		existing = ids
+		hf.manager.forgetFreeSpaceMap(hf.fsm)
+	}
+	perPage := fsmEntriesPerPage(hf.manager.pageSize)
+	needed := (len(pages) + perPage - 1) / perPage
+	if needed == 0 {
+		needed = 1
+	}
+	ids := make([]PageID, needed)
+	for i := range ids {
+		if i < len(existing) {
+			ids[i] = existing[i]
+			continue
+		}
+		id, _, err := hf.manager.AllocatePage()
+		if err != nil {
+			return 0, err
+		}
+		ids[i] = id
+	}
+	for i, id := range ids {
+		buf := make([]byte, hf.manager.pageSize)
+		hdr := fsmHeader{}
+		if i+1 < len(ids) {
+			hdr.NextPage = ids[i+1]
+		}
+		if i == 0 && len(pages) > 0 {
+			hdr.HeapTail = pages[len(pages)-1]
+		}
+		for j := i * perPage; j < len(pages) && j < (i+1)*perPage; j++ {
+			setFSMEntry(buf, int(hdr.Count), pages[j], free[j])
+			hdr.Count++
+		}
+		writeFSMHeader(buf, hdr)
+		if err := persistPage(tx, log, hf.manager, wal.RecordPageMeta, id, buf); err != nil {
+			return 0, err
+		}
+	}
+	if err := hf.manager.ReleasePages(tx, log, existing[min(len(existing), needed):]...); err != nil {
+		return 0, err
+	}
+	hf.manager.forgetFreeSpaceMap(ids[0])
+	hf.fsm = ids[0]
+	return ids[0], nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/txn"
+)
+
+func TestHeapPageReusesDeletedSlots(t *testing.T) {
+	buf := make([]byte, PageSize)
+	if err := InitialiseHeapPage(buf); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	page, err := LoadHeapPage(1, buf)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	first, err := page.Insert(bytes.Repeat([]byte{'a'}, 100))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := page.Insert(bytes.Repeat([]byte{'b'}, 100)); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := page.Delete(first); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	reused, err := page.Insert(bytes.Repeat([]byte{'c'}, 50))
+	if err != nil {
+		t.Fatalf("reinsert: %v", err)
+	}
+	if reused != first {
+		t.Fatalf("expected slot %d to be reused, got %d", first, reused)
+	}
+}
+
+func TestHeapFileVacuumFreesTrailingPages(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	record := bytes.Repeat([]byte{'v'}, 300)
+	var ids []RowID
+	for i := 0; i < 60; i++ {
+		rid, err := heap.Insert(nil, nil, record)
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		ids = append(ids, rid)
+	}
+	before, err := heap.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	keep := make(map[RowID]bool)
+	for i, rid := range ids {
+		if i%6 == 0 {
+			keep[rid] = true
+			continue
+		}
+		if err := heap.Delete(nil, nil, rid); err != nil {
+			t.Fatalf("delete %v: %v", rid, err)
+		}
+	}
+
+	moves := make(map[RowID]RowID)
+	stats, err := heap.Vacuum(nil, nil, func(from, to RowID, _ []byte) error {
+		moves[from] = to
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("vacuum: %v", err)
+	}
+	if stats.PagesFreed == 0 || stats.BytesReclaimed == 0 {
+		t.Fatalf("expected vacuum to free pages, got %+v", stats)
+	}
+	after, err := heap.Pages()
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	if len(after) != len(before)-stats.PagesFreed {
+		t.Fatalf("expected %d pages after vacuum, got %d", len(before)-stats.PagesFreed, len(after))
+	}
+
+	for rid := range keep {
+		if to, ok := moves[rid]; ok {
+			rid = to
+		}
+		buf, err := mgr.ReadPage(rid.Page)
+		if err != nil {
+			t.Fatalf("read %v: %v", rid, err)
+		}
+		page, err := LoadHeapPage(rid.Page, buf)
+		if err != nil {
+			t.Fatalf("load %v: %v", rid, err)
+		}
+		got, err := page.Record(rid.Slot)
+		if err != nil {
+			t.Fatalf("record %v: %v", rid, err)
+		}
+		if !bytes.Equal(got, record) {
+			t.Fatalf("record %v changed during vacuum", rid)
+		}
+	}
+	if _, err := heap.Insert(nil, nil, record); err != nil {
+		t.Fatalf("insert after vacuum: %v", err)
+	}
+}
+
+func TestHeapFileVacuumReleasesPagesWhenTheTransactionEnds(t *testing.T) {
+	mgr, heap := newTestHeapFile(t)
+	record := bytes.Repeat([]byte{'v'}, 300)
+	var ids []RowID
+	for i := 0; i < 60; i++ {
+		rid, err := heap.Insert(nil, nil, record)
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		ids = append(ids, rid)
+	}
+	for _, rid := range ids[1:] {
+		if err := heap.Delete(nil, nil, rid); err != nil {
+			t.Fatalf("delete %v: %v", rid, err)
+		}
+	}
+	freeList := func() int {
+		info, err := mgr.InspectFreeList()
+		if err != nil {
+			t.Fatalf("free list: %v", err)
+		}
+		return len(info.Pages)
+	}
+	txns := txn.NewManager(txn.NewLockManager(0), nil)
+	tx := txns.Begin()
+	stats, err := heap.Vacuum(tx, nil, func(_, _ RowID, _ []byte) error { return nil })
+	if err != nil {
+		t.Fatalf("vacuum: %v", err)
+	}
+	if stats.PagesFreed == 0 {
+		t.Fatalf("expected vacuum to free pages, got %+v", stats)
+	}
+	// Recovery may still undo the vacuum and link the pages back in.
+	if n := freeList(); n != 0 {
+		t.Fatalf("expected no free pages before the commit, got %d", n)
+	}
+	if err := txns.Commit(tx.ID()); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if n := freeList(); n < stats.PagesFreed {
+		t.Fatalf("expected at least %d free pages after the commit, got %d", stats.PagesFreed, n)
+	}
+}
+
+func TestHeapFileVacuumMovesOverflowPointers(t *testing.T) {
+	_, heap := newTestHeapFile(t)
+	// Four fillers leave too little room on the root page for even a pointer.
+	filler := bytes.Repeat([]byte{'f'}, 1015)
+	var fillers []RowID
+	for i := 0; i < 4; i++ {
+		rid, err := heap.Insert(nil, nil, filler)
+		if err != nil {
+			t.Fatalf("insert filler: %v", err)
+		}
+		fillers = append(fillers, rid)
+	}
+	large := bytes.Repeat([]byte{'L'}, 2*PageSize)
+	rid, err := heap.Insert(nil, nil, large)
+	if err != nil {
+		t.Fatalf("insert large: %v", err)
+	}
+	if rid.Page == heap.Root() {
+		t.Fatalf("expected overflow pointer to land on a second page")
+	}
+	if err := heap.Delete(nil, nil, fillers[0]); err != nil {
+		t.Fatalf("delete filler: %v", err)
+	}
+	before, err := heap.OverflowPages()
+	if err != nil {
+		t.Fatalf("overflow pages: %v", err)
+	}
+
+	var moved []byte
+	stats, err := heap.Vacuum(nil, nil, func(_, _ RowID, record []byte) error {
+		moved = record
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("vacuum: %v", err)
+	}
+	if stats.RowsMoved != 1 || !bytes.Equal(moved, large) {
+		t.Fatalf("expected the large row to be reported in full, got %d moves", stats.RowsMoved)
+	}
+	after, err := heap.OverflowPages()
+	if err != nil {
+		t.Fatalf("overflow pages: %v", err)
+	}
+	if len(after) != len(before) || after[0] != before[0] {
+		t.Fatalf("vacuum should keep the overflow chain: before %v, after %v", before, after)
+	}
+}
@@ -47,17 +47,29 @@ func (m *Manager) Commit(id ID) error {
 		return err
 	}
 	if m.wal != nil {
-		if err := m.appendTxnRecord(tx, wal.RecordCommit); err != nil {
+		// The commit is durable once the log is flushed past its commit
+		// record; concurrent commits share that flush.
+		lsn, err := m.appendTxnRecord(tx, wal.RecordCommit)
+		if err != nil {
+			return err
+		}
+		if err := m.wal.FlushTo(lsn); err != nil {
 			return err
 		}
 	}
 	tx.setState(StateCommitted)
 	tx.discardRollback()
+	// Commit actions run while the locks are still held, so that nobody
+	// sees the state they tidy up.
+	commitErr := tx.runCommit()
+	if err := tx.runRelease(); commitErr == nil {
+		commitErr = err
+	}
 	if m.lockMgr != nil {
 		m.lockMgr.ReleaseAll(id)
 	}
 	tx.clearLocks()
-	return nil
+	return commitErr
 }
 
 // Rollback aborts the transaction and releases its locks.
@@ -66,11 +78,25 @@ func (m *Manager) Rollback(id ID) error {
 	if err != nil {
 		return err
 	}
+	tx.discardCommit()
 	rollbackErr := tx.runRollback()
+	// Recovery replays an aborted transaction together with the changes its
+	// rollback made, and undoes one without an abort record instead, so the
+	// record only has to be durable before pages are released: undo would
+	// point back at them.
 	if m.wal != nil {
-		if err := m.appendTxnRecord(tx, wal.RecordAbort); err != nil {
+		lsn, err := m.appendTxnRecord(tx, wal.RecordAbort)
+		if err != nil {
 			return err
 		}
+		if tx.hasRelease() {
+			if err := m.wal.FlushTo(lsn); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.runRelease(); rollbackErr == nil {
+		rollbackErr = err
 	}
 	tx.setState(StateRolledBack)
 	if m.lockMgr != nil {
@@ -99,15 +125,15 @@ func (m *Manager) remove(id ID) (*Transaction, error) {
 	return tx, nil
 }
 
-func (m *Manager) appendTxnRecord(tx *Transaction, typ wal.RecordType) error {
+func (m *Manager) appendTxnRecord(tx *Transaction, typ wal.RecordType) (uint64, error) {
 	prev := tx.LastLSN()
 	lsn, err := m.wal.Append(uint64(tx.ID()), prev, typ, 0, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	tx.SetLastLSN(lsn)
 	if tx.StartLSN() == 0 {
 		tx.SetStartLSN(lsn)
 	}
-	return m.wal.Sync()
+	return lsn, nil
 }
@@ -1,9 +1,13 @@
 package txn_test
 
 import (
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/example/granite-db/engine/internal/txn"
+	"github.com/example/granite-db/engine/internal/wal"
 )
 
 func TestManagerLifecycle(t *testing.T) {
@@ -38,3 +42,156 @@ func TestManagerLifecycle(t *testing.T) {
 		t.Fatalf("expected ErrNotActive on double rollback, got %v", err)
 	}
 }
+
+func TestCommitActionsRunOnlyOnCommit(t *testing.T) {
+	mgr := txn.NewManager(txn.NewLockManager(0), nil)
+
+	committed := 0
+	tx := mgr.Begin()
+	tx.RegisterCommit(func() error {
+		committed++
+		return nil
+	})
+	if err := mgr.Commit(tx.ID()); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	if committed != 1 {
+		t.Fatalf("expected the commit action to run once, ran %d times", committed)
+	}
+
+	tx2 := mgr.Begin()
+	tx2.RegisterCommit(func() error {
+		committed++
+		return nil
+	})
+	if err := mgr.Rollback(tx2.ID()); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if committed != 1 {
+		t.Fatalf("expected the commit action to be discarded on rollback")
+	}
+}
+
+func TestReleaseActionsRunOnceTheOutcomeIsDurable(t *testing.T) {
+	log, err := wal.Open(filepath.Join(t.TempDir(), "release.gdb"))
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer log.Close()
+	mgr := txn.NewManager(txn.NewLockManager(0), log)
+
+	for _, rollback := range []bool{false, true} {
+		tx := mgr.Begin()
+		if _, err := log.Append(uint64(tx.ID()), 0, wal.RecordInsert, 1, nil); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		before := log.Syncs()
+		released := 0
+		tx.RegisterRelease(func() error {
+			if log.Syncs() == before {
+				t.Errorf("pages released before the outcome was synced (rollback %v)", rollback)
+			}
+			released++
+			return nil
+		})
+		end := mgr.Commit
+		if rollback {
+			end = mgr.Rollback
+		}
+		if err := end(tx.ID()); err != nil {
+			t.Fatalf("end transaction: %v", err)
+		}
+		if released != 1 {
+			t.Fatalf("expected the release to run once, ran %d times (rollback %v)", released, rollback)
+		}
+	}
+
+	tx := mgr.Begin()
+	if !tx.TouchPage(7) || tx.TouchPage(7) || !tx.TouchPage(8) {
+		t.Fatalf("expected only the first change to each page to count")
+	}
+}
+
+func TestConcurrentCommitsShareLogFlush(t *testing.T) {
+	log, err := wal.OpenWithOptions(filepath.Join(t.TempDir(), "group.gdb"), wal.Options{CommitWindow: 20 * time.Millisecond, Synchronous: wal.SyncNormal})
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer log.Close()
+	mgr := txn.NewManager(txn.NewLockManager(0), log)
+
+	const committers = 8
+	before := log.Syncs()
+	var wg sync.WaitGroup
+	errs := make(chan error, committers)
+	for i := 0; i < committers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- commitPageChange(mgr, log, 4)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	if syncs := log.Syncs() - before; syncs == 0 || syncs >= committers {
+		t.Fatalf("expected %d commits to share fewer fsyncs, got %d", committers, syncs)
+	}
+}
+
+// BenchmarkCommit measures transactions that log a few page images and commit,
+// reporting how many fsyncs each commit cost.
+func BenchmarkCommit(b *testing.B) {
+	run := func(b *testing.B, window time.Duration, parallel bool) {
+		log, err := wal.OpenWithOptions(filepath.Join(b.TempDir(), "bench.gdb"), wal.Options{CommitWindow: window, Synchronous: wal.SyncNormal})
+		if err != nil {
+			b.Fatalf("open wal: %v", err)
+		}
+		defer log.Close()
+		mgr := txn.NewManager(txn.NewLockManager(0), log)
+		before := log.Syncs()
+		b.ResetTimer()
+		if parallel {
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := commitPageChange(mgr, log, 4); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		} else {
+			for i := 0; i < b.N; i++ {
+				if err := commitPageChange(mgr, log, 4); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(log.Syncs()-before)/float64(b.N), "fsyncs/commit")
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "commits/s")
+	}
+	b.Run("serial", func(b *testing.B) { run(b, 0, false) })
+	b.Run("parallel", func(b *testing.B) { run(b, 0, true) })
+	b.Run("parallel-window", func(b *testing.B) { run(b, time.Millisecond, true) })
+}
+
+// commitPageChange runs a transaction that logs pages page images, the way
+// the heap logs its changes, and commits it.
+func commitPageChange(mgr *txn.Manager, log *wal.Manager, pages int) error {
+	tx := mgr.Begin()
+	image := make([]byte, 256)
+	for i := 0; i < pages; i++ {
+		lsn, err := log.Append(uint64(tx.ID()), tx.LastLSN(), wal.RecordInsert, uint32(i+1), image)
+		if err != nil {
+			return err
+		}
+		tx.SetLastLSN(lsn)
+	}
+	return mgr.Commit(tx.ID())
+}
@@ -45,6 +45,9 @@ type Transaction struct {
 	locks      []HeldLock
 	writes     []WriteOperation
 	rollback   []func() error
+	commit     []func() error
+	release    []func() error
+	touched    map[uint32]struct{}
 	autocommit bool
 }
 
@@ -111,6 +114,22 @@ func (tx *Transaction) SetLastLSN(lsn uint64) {
 	tx.mu.Unlock()
 }
 
+// TouchPage reports whether this is the first time the transaction changes
+// the given page, in which case the page's prior contents must be logged so
+// that recovery can undo the change.
+func (tx *Transaction) TouchPage(id uint32) bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if _, seen := tx.touched[id]; seen {
+		return false
+	}
+	if tx.touched == nil {
+		tx.touched = make(map[uint32]struct{})
+	}
+	tx.touched[id] = struct{}{}
+	return true
+}
+
 func (tx *Transaction) recordLock(res Resource, mode LockMode) {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
@@ -186,6 +205,74 @@ func (tx *Transaction) RegisterRollback(action func() error) {
 	tx.mu.Unlock()
 }
 
+// RegisterCommit registers an action to execute once the transaction has
+// committed, such as releasing storage that a rollback would still have
+// needed.
+func (tx *Transaction) RegisterCommit(action func() error) {
+	if action == nil {
+		return
+	}
+	tx.mu.Lock()
+	tx.commit = append(tx.commit, action)
+	tx.mu.Unlock()
+}
+
+// RegisterRelease registers an action that returns pages the transaction no
+// longer references to the free list. It runs once the transaction has ended,
+// whichever way, and only after the log holds its outcome: until then,
+// recovery may need to undo the transaction and point back at the pages.
+func (tx *Transaction) RegisterRelease(action func() error) {
+	if action == nil {
+		return
+	}
+	tx.mu.Lock()
+	tx.release = append(tx.release, action)
+	tx.mu.Unlock()
+}
+
+func (tx *Transaction) hasRelease() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return len(tx.release) > 0
+}
+
+func (tx *Transaction) runRelease() error {
+	tx.mu.Lock()
+	actions := tx.release
+	tx.release = nil
+	tx.touched = nil
+	tx.mu.Unlock()
+
+	var errs []string
+	for _, action := range actions {
+		if err := action(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("txn: releasing pages encountered errors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (tx *Transaction) runCommit() error {
+	tx.mu.Lock()
+	actions := tx.commit
+	tx.commit = nil
+	tx.mu.Unlock()
+
+	var errs []string
+	for _, action := range actions {
+		if err := action(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("txn: post-commit actions encountered errors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 func (tx *Transaction) runRollback() error {
 	tx.mu.Lock()
 	actions := make([]func() error, len(tx.rollback))
@@ -213,3 +300,9 @@ func (tx *Transaction) discardRollback() {
 	tx.rollback = nil
 	tx.mu.Unlock()
 }
+
+func (tx *Transaction) discardCommit() {
+	tx.mu.Lock()
+	tx.commit = nil
+	tx.mu.Unlock()
+}
@@ -0,0 +1,90 @@
+package upgrade
+
+import (
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/storage/indexmgr"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// The built-in steps. New format changes register their migration here.
+func init() {
+	Register(Step{
+		Component:   ComponentDatabase,
+		From:        1,
+		To:          2,
+		Description: "move the catalogue from the header page onto a page chain",
+		Apply:       storage.UpgradeInlineCatalog,
+	})
+	Register(Step{
+		Component:   ComponentDatabase,
+		From:        2,
+		To:          3,
+		Description: "reserve header space for the encryption key header",
+		Apply:       storage.UpgradeKeyHeader,
+	})
+	Register(Step{
+		Component:   ComponentDatabase,
+		From:        3,
+		To:          4,
+		Description: "allow compressed heap pages",
+		Apply:       storage.UpgradeCompression,
+	})
+	Register(Step{
+		Component:   ComponentDatabase,
+		From:        4,
+		To:          5,
+		Description: "keep indexes as B+trees inside the database file",
+		Apply:       storage.UpgradeIndexTrees,
+	})
+	Register(Step{
+		Component:   ComponentDatabase,
+		From:        5,
+		To:          6,
+		Description: "back every primary key with a unique index",
+		Apply:       storage.UpgradePrimaryKeys,
+	})
+	Register(Step{
+		Component:   ComponentDatabase,
+		From:        6,
+		To:          7,
+		Description: "store index keys in an order-preserving encoding",
+		Apply:       storage.UpgradeOrderedKeys,
+	})
+	Register(Step{
+		Component:   ComponentDatabase,
+		From:        7,
+		To:          8,
+		Description: "record the columns covering indexes store alongside their keys",
+		Apply:       storage.UpgradeCoveringIndexes,
+	})
+	Register(Step{
+		Component:   ComponentDatabase,
+		From:        8,
+		To:          9,
+		Description: "stamp a checksum on every page written before checksums existed",
+		Apply:       storage.UpgradeChecksums,
+	})
+	// Index files are retired rather than converted: the trees are built
+	// from the table rows when the database is next opened for writing.
+	Register(Step{
+		Component:   ComponentIndex,
+		From:        1,
+		To:          3,
+		Description: "remove the index file; the index is rebuilt in the database file",
+		Apply:       indexmgr.RetireFile,
+	})
+	Register(Step{
+		Component:   ComponentIndex,
+		From:        2,
+		To:          3,
+		Description: "remove the index file; the index is rebuilt in the database file",
+		Apply:       indexmgr.RetireFile,
+	})
+	Register(Step{
+		Component:   ComponentWAL,
+		From:        1,
+		To:          2,
+		Description: "add a versioned file header to the write-ahead log",
+		Apply:       wal.UpgradeLegacy,
+	})
+}
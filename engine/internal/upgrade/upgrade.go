@@ -0,0 +1,251 @@
+// Package upgrade migrates database, index and WAL files written by older
+// engine versions to the current on-disk formats.
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/storage/indexmgr"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// Component identifies the kind of file a step applies to.
+type Component string
+
+const (
+	ComponentDatabase Component = "database"
+	ComponentIndex    Component = "index"
+	ComponentWAL      Component = "wal"
+)
+
+// Step migrates one file of a component from version From to version To.
+type Step struct {
+	Component   Component
+	From        uint16
+	To          uint16
+	Description string
+	Apply       func(path string) error
+}
+
+var registry = make(map[Component]map[uint16]Step)
+
+// Register adds a step to the registry. Registering two steps that start from
+// the same version of a component panics.
+func Register(step Step) {
+	if step.To <= step.From {
+		panic(fmt.Sprintf("upgrade: step for %s must move forwards (%d -> %d)", step.Component, step.From, step.To))
+	}
+	steps := registry[step.Component]
+	if steps == nil {
+		steps = make(map[uint16]Step)
+		registry[step.Component] = steps
+	}
+	if _, exists := steps[step.From]; exists {
+		panic(fmt.Sprintf("upgrade: duplicate %s step from version %d", step.Component, step.From))
+	}
+	steps[step.From] = step
+}
+
+// File describes one on-disk file belonging to a database.
+type File struct {
+	Component Component
+	Path      string
+	Version   uint16
+	Target    uint16
+	Steps     []Step
+}
+
+// UpToDate reports whether the file already uses the current format.
+func (f File) UpToDate() bool {
+	return f.Version == f.Target
+}
+
+// Plan lists the files of a database together with the steps that bring each
+// of them to the current format.
+type Plan struct {
+	Files []File
+}
+
+// Pending returns the number of steps the plan would apply.
+func (p *Plan) Pending() int {
+	count := 0
+	for _, f := range p.Files {
+		count += len(f.Steps)
+	}
+	return count
+}
+
+// Options controls Run.
+type Options struct {
+	// DryRun reports the plan without touching any file.
+	DryRun bool
+	// NoBackup skips copying the files before they are upgraded.
+	NoBackup bool
+	// BackupDir overrides the backup location. By default a directory named
+	// after the database and the current time is created next to it.
+	BackupDir string
+}
+
+// Report describes the outcome of Run.
+type Report struct {
+	Plan      *Plan
+	BackupDir string
+	Applied   int
+}
+
+// PlanUpgrade inspects the database at dbPath, its WAL and its index files.
+// It fails when a file is newer than this engine or when no chain of
+// registered steps leads from a file's version to the current one.
+func PlanUpgrade(dbPath string) (*Plan, error) {
+	plan := &Plan{}
+	version, err := storage.ReadFormatVersion(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.add(ComponentDatabase, dbPath, version, storage.FormatVersion); err != nil {
+		return nil, err
+	}
+
+	walPath := wal.PathFor(dbPath)
+	if _, err := os.Stat(walPath); err == nil {
+		version, err := wal.ReadFormatVersion(walPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := plan.add(ComponentWAL, walPath, version, wal.FormatVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	indexFiles, err := indexmgr.Files(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(indexFiles)
+	for _, path := range indexFiles {
+		version, err := indexmgr.ReadFormatVersion(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := plan.add(ComponentIndex, path, version, indexmgr.FormatVersion); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+func (p *Plan) add(component Component, path string, version, target uint16) error {
+	if version > target {
+		return fmt.Errorf("upgrade: %s file %s has version %d, newer than this engine supports (%d)", component, path, version, target)
+	}
+	file := File{Component: component, Path: path, Version: version, Target: target}
+	for current := version; current < target; {
+		step, ok := registry[component][current]
+		if !ok {
+			return fmt.Errorf("upgrade: no upgrade path for %s file %s from version %d", component, path, current)
+		}
+		file.Steps = append(file.Steps, step)
+		current = step.To
+	}
+	p.Files = append(p.Files, file)
+	return nil
+}
+
+// Run plans the upgrade of the database at dbPath and, unless opts.DryRun is
+// set, backs up every file that needs work and applies the steps. The
+// database must not be open while it is upgraded: Run holds its exclusive
+// lock from planning the steps until the last one has run, so that nobody
+// can open it halfway through. Steps that open the database share the lock.
+func Run(dbPath string, opts Options) (*Report, error) {
+	plan, err := PlanUpgrade(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Plan: plan}
+	if opts.DryRun || plan.Pending() == 0 {
+		return report, nil
+	}
+	lock, err := storage.LockDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	// A writer may have changed the files before the lock was taken.
+	if plan, err = PlanUpgrade(dbPath); err != nil {
+		return nil, err
+	}
+	report.Plan = plan
+	if plan.Pending() == 0 {
+		return report, nil
+	}
+	if !opts.NoBackup {
+		dir := opts.BackupDir
+		if dir == "" {
+			dir = fmt.Sprintf("%s.backup-%s", dbPath, time.Now().UTC().Format("20060102T150405Z"))
+		}
+		if err := backup(plan, dir); err != nil {
+			return nil, err
+		}
+		report.BackupDir = dir
+	}
+	// The WAL goes first so that a database upgrade which opens the file
+	// replays any logged changes with the current log reader.
+	order := make([]File, 0, len(plan.Files))
+	for _, component := range []Component{ComponentWAL, ComponentDatabase, ComponentIndex} {
+		for _, f := range plan.Files {
+			if f.Component == component {
+				order = append(order, f)
+			}
+		}
+	}
+	for _, f := range order {
+		for _, step := range f.Steps {
+			if err := step.Apply(f.Path); err != nil {
+				return report, fmt.Errorf("upgrade: %s (%s v%d -> v%d): %w", f.Path, f.Component, step.From, step.To, err)
+			}
+			report.Applied++
+		}
+	}
+	return report, nil
+}
+
+// backup copies every file of the database, including those already up to
+// date, so that the backup directory is a consistent copy.
+func backup(plan *Plan, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, f := range plan.Files {
+		if err := copyFile(f.Path, filepath.Join(dir, filepath.Base(f.Path))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
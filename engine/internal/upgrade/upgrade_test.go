@@ -0,0 +1,133 @@
+package upgrade
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/example/granite-db/engine/internal/storage"
+	"github.com/example/granite-db/engine/internal/storage/indexmgr"
+	"github.com/example/granite-db/engine/internal/wal"
+)
+
+// writeLegacyFiles lays out a version 1 database (catalogue inline in the
+// header page) and a version 1 WAL (no file header).
+func writeLegacyFiles(t *testing.T, dbPath string) ([]byte, []byte) {
+	t.Helper()
+	catalogue := []byte("legacy catalogue")
+	page := make([]byte, storage.PageSize)
+	copy(page[:8], "GRANITED")
+	binary.LittleEndian.PutUint16(page[8:10], 1)
+	binary.LittleEndian.PutUint32(page[12:16], 1)
+	binary.LittleEndian.PutUint32(page[16:20], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(page[20:24], uint32(len(catalogue)))
+	copy(page[24:], catalogue)
+	if err := os.WriteFile(dbPath, page, 0o644); err != nil {
+		t.Fatalf("write database: %v", err)
+	}
+	records := []byte{0x05, 0x00, 0x00, 0x00, 'r', 'e', 'c', 'o', 'r'}
+	if err := os.WriteFile(wal.PathFor(dbPath), records, 0o644); err != nil {
+		t.Fatalf("write wal: %v", err)
+	}
+	return page, records
+}
+
+func TestDryRunLeavesFilesUntouched(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "legacy.gdb")
+	page, records := writeLegacyFiles(t, dbPath)
+
+	report, err := Run(dbPath, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if report.Plan.Pending() != 9 || report.Applied != 0 || report.BackupDir != "" {
+		t.Fatalf("unexpected dry run report: pending %d, applied %d, backup %q", report.Plan.Pending(), report.Applied, report.BackupDir)
+	}
+	if got, _ := os.ReadFile(dbPath); !bytes.Equal(got, page) {
+		t.Fatalf("dry run modified the database file")
+	}
+	if got, _ := os.ReadFile(wal.PathFor(dbPath)); !bytes.Equal(got, records) {
+		t.Fatalf("dry run modified the wal")
+	}
+}
+
+func TestRunUpgradesAndBacksUp(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "legacy.gdb")
+	page, records := writeLegacyFiles(t, dbPath)
+	backupDir := filepath.Join(dir, "backup")
+
+	report, err := Run(dbPath, Options{BackupDir: backupDir})
+	if err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if report.Applied != 9 || report.BackupDir != backupDir {
+		t.Fatalf("unexpected report: applied %d, backup %q", report.Applied, report.BackupDir)
+	}
+	if version, err := storage.ReadFormatVersion(dbPath); err != nil || version != storage.FormatVersion {
+		t.Fatalf("database version after upgrade: %d, %v", version, err)
+	}
+	if version, err := wal.ReadFormatVersion(wal.PathFor(dbPath)); err != nil || version != wal.FormatVersion {
+		t.Fatalf("wal version after upgrade: %d, %v", version, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(backupDir, "legacy.gdb")); !bytes.Equal(got, page) {
+		t.Fatalf("backup does not hold the original database")
+	}
+	if got, _ := os.ReadFile(filepath.Join(backupDir, "legacy.gdb.wal")); !bytes.Equal(got, records) {
+		t.Fatalf("backup does not hold the original wal")
+	}
+
+	mgr, err := storage.Open(dbPath)
+	if err != nil {
+		t.Fatalf("open upgraded database: %v", err)
+	}
+	defer mgr.Close()
+	if got, _ := mgr.CatalogData(); string(got) != "legacy catalogue" {
+		t.Fatalf("catalogue lost during upgrade: %q", got)
+	}
+
+	again, err := Run(dbPath, Options{})
+	if err != nil {
+		t.Fatalf("second upgrade: %v", err)
+	}
+	if again.Plan.Pending() != 0 || again.BackupDir != "" {
+		t.Fatalf("expected nothing left to upgrade, got %d step(s)", again.Plan.Pending())
+	}
+}
+
+func TestPlanRejectsNewerFormat(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "future.gdb")
+	page := make([]byte, storage.PageSize)
+	copy(page[:8], "GRANITED")
+	binary.LittleEndian.PutUint16(page[8:10], storage.FormatVersion+1)
+	if err := os.WriteFile(dbPath, page, 0o644); err != nil {
+		t.Fatalf("write database: %v", err)
+	}
+	if _, err := PlanUpgrade(dbPath); err == nil {
+		t.Fatalf("expected a newer database format to be rejected")
+	}
+}
+
+func TestRunRetiresIndexFiles(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "legacy.gdb")
+	writeLegacyFiles(t, dbPath)
+	indexPath := indexmgr.LegacyPath(dbPath, "people", "idx_people_name")
+	header := append([]byte("GRNIDX01"), 2, 0, 0, 0)
+	if err := os.WriteFile(indexPath, header, 0o644); err != nil {
+		t.Fatalf("write index file: %v", err)
+	}
+
+	report, err := Run(dbPath, Options{NoBackup: true})
+	if err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if report.Applied != 10 {
+		t.Fatalf("expected 10 steps applied, got %d", report.Applied)
+	}
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the index file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package vfs
+
+// Lock is a no-op on platforms without flock(2): the file is not protected
+// against other processes there.
+func (f osFile) Lock(LockMode) error {
+	return nil
+}
+
+func (f osFile) Unlock() error {
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package vfs
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Lock uses flock(2), so locks taken through separate handles conflict even
+// within one process.
+func (f osFile) Lock(mode LockMode) error {
+	how := syscall.LOCK_SH
+	if mode == LockExclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, syscall.EINTR):
+			continue
+		case errors.Is(err, syscall.EWOULDBLOCK):
+			return ErrLocked
+		default:
+			return err
+		}
+	}
+}
+
+func (f osFile) Unlock() error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
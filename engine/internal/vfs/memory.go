@@ -0,0 +1,350 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// MemoryFS keeps every file in memory. Its contents disappear with the value,
+// which makes it suitable for throwaway databases and tests. Directories are
+// not modelled: any name can be created and MkdirAll does nothing.
+type MemoryFS struct {
+	mu    sync.Mutex
+	files map[string]*memoryData
+	// crashable records each file's synced contents for Crash.
+	crashable bool
+}
+
+type memoryData struct {
+	mu        sync.Mutex
+	data      []byte
+	synced    []byte
+	modTime   time.Time
+	shared    int
+	exclusive bool
+	crashable bool
+}
+
+// NewMemory returns an empty in-memory file system.
+func NewMemory() *MemoryFS {
+	return &MemoryFS{files: make(map[string]*memoryData)}
+}
+
+// NewCrashable returns an empty in-memory file system that also keeps each
+// file's contents as of its last Sync, so that tests can simulate a crash
+// with Crash. Creating, renaming and removing files count as durable at once.
+func NewCrashable() *MemoryFS {
+	return &MemoryFS{files: make(map[string]*memoryData), crashable: true}
+}
+
+// Crash returns a copy of the file system as a restarted process would find
+// it. After a process crash every write is kept, since the operating system
+// already has it. After a power loss each file reverts to its contents at its
+// last Sync. Locks are not carried over. It panics unless the file system was
+// created by NewCrashable.
+func (m *MemoryFS) Crash(powerLoss bool) *MemoryFS {
+	if !m.crashable {
+		panic("vfs: Crash needs a file system created by NewCrashable")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	after := NewCrashable()
+	for name, data := range m.files {
+		data.mu.Lock()
+		kept := data.data
+		if powerLoss {
+			kept = data.synced
+		}
+		kept = append([]byte(nil), kept...)
+		after.files[name] = &memoryData{data: kept, synced: kept, modTime: data.modTime, crashable: true}
+		data.mu.Unlock()
+	}
+	return after
+}
+
+// OpenFile opens the named file. O_CREATE, O_EXCL, O_TRUNC and O_APPEND behave
+// as they do for os.OpenFile; access modes are not enforced.
+func (m *MemoryFS) OpenFile(name string, flag int, _ fs.FileMode) (File, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		data = &memoryData{modTime: time.Now(), crashable: m.crashable}
+		m.files[name] = data
+	}
+	if flag&os.O_TRUNC != 0 {
+		data.mu.Lock()
+		data.data = data.data[:0]
+		data.mu.Unlock()
+	}
+	return &memoryFile{name: name, file: data, append: flag&os.O_APPEND != 0}, nil
+}
+
+// Stat describes the named file.
+func (m *MemoryFS) Stat(name string) (fs.FileInfo, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	data, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	return memoryInfo{name: path.Base(name), size: int64(len(data.data)), modTime: data.modTime}, nil
+}
+
+// Remove deletes the named file. Open handles keep working on the old
+// contents, as they would on a Unix file system.
+func (m *MemoryFS) Remove(name string) error {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// Rename moves a file, replacing any file already called newName.
+func (m *MemoryFS) Rename(oldName, newName string) error {
+	oldName, newName = path.Clean(oldName), path.Clean(newName)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldName)
+	m.files[newName] = data
+	return nil
+}
+
+// MkdirAll does nothing: the in-memory file system has no directories.
+func (m *MemoryFS) MkdirAll(string, fs.FileMode) error {
+	return nil
+}
+
+var errClosedFile = errors.New("vfs: file already closed")
+
+type memoryFile struct {
+	name   string
+	file   *memoryData
+	offset int64
+	append bool
+	closed bool
+	lock   LockMode
+}
+
+func (f *memoryFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errClosedFile
+	}
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errClosedFile
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	if off >= int64(len(f.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.file.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, errClosedFile
+	}
+	if f.append {
+		size, _ := f.Size()
+		f.offset = size
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errClosedFile
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	end := off + int64(len(p))
+	if end > int64(len(f.file.data)) {
+		f.file.data = grow(f.file.data, int(end))
+	}
+	copy(f.file.data[off:], p)
+	f.file.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, errClosedFile
+	}
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.offset
+	case io.SeekEnd:
+		size, _ := f.Size()
+		base = size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if base+offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = base + offset
+	return f.offset, nil
+}
+
+func (f *memoryFile) Size() (int64, error) {
+	if f.closed {
+		return 0, errClosedFile
+	}
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	return int64(len(f.file.data)), nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	if f.closed {
+		return errClosedFile
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	if size > int64(len(f.file.data)) {
+		f.file.data = grow(f.file.data, int(size))
+	} else {
+		f.file.data = f.file.data[:size]
+	}
+	f.file.modTime = time.Now()
+	return nil
+}
+
+func (f *memoryFile) Sync() error {
+	if f.closed {
+		return errClosedFile
+	}
+	if f.file.crashable {
+		f.file.mu.Lock()
+		f.file.synced = append(f.file.synced[:0], f.file.data...)
+		f.file.mu.Unlock()
+	}
+	return nil
+}
+
+func (f *memoryFile) Lock(mode LockMode) error {
+	if f.closed {
+		return errClosedFile
+	}
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	f.releaseLocked()
+	switch mode {
+	case LockShared:
+		if f.file.exclusive {
+			return ErrLocked
+		}
+		f.file.shared++
+	case LockExclusive:
+		if f.file.exclusive || f.file.shared > 0 {
+			return ErrLocked
+		}
+		f.file.exclusive = true
+	default:
+		return &fs.PathError{Op: "lock", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.lock = mode
+	return nil
+}
+
+func (f *memoryFile) Unlock() error {
+	if f.closed {
+		return errClosedFile
+	}
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	f.releaseLocked()
+	return nil
+}
+
+func (f *memoryFile) releaseLocked() {
+	switch f.lock {
+	case LockShared:
+		f.file.shared--
+	case LockExclusive:
+		f.file.exclusive = false
+	}
+	f.lock = 0
+}
+
+func (f *memoryFile) Close() error {
+	if f.closed {
+		return errClosedFile
+	}
+	f.file.mu.Lock()
+	f.releaseLocked()
+	f.file.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// grow extends data to size bytes, zero-filling the new tail.
+func grow(data []byte, size int) []byte {
+	if size <= cap(data) {
+		tail := data[len(data):size]
+		clear(tail)
+		return data[:size]
+	}
+	grown := make([]byte, size, max(size, 2*cap(data)))
+	copy(grown, data)
+	return grown
+}
+
+type memoryInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memoryInfo) Name() string       { return i.name }
+func (i memoryInfo) Size() int64        { return i.size }
+func (i memoryInfo) Mode() fs.FileMode  { return 0o644 }
+func (i memoryInfo) ModTime() time.Time { return i.modTime }
+func (i memoryInfo) IsDir() bool        { return false }
+func (i memoryInfo) Sys() any           { return nil }
@@ -0,0 +1,121 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemoryFileReadWriteAndTruncate(t *testing.T) {
+	fsys := NewMemory()
+	f, err := fsys.OpenFile("data", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("world"), 6); err != nil {
+		t.Fatalf("write at: %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 11)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatalf("read at: %v", err)
+	}
+	if !bytes.Equal(buf, []byte("hello\x00world")) {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+	if _, err := f.ReadAt(buf, 4); err != io.EOF {
+		t.Fatalf("expected EOF on a short read, got %v", err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := f.Truncate(8); err != nil {
+		t.Fatalf("extend: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read all: %v", err)
+	}
+	if !bytes.Equal(got, []byte("hello\x00\x00\x00")) {
+		t.Fatalf("truncate should zero the regrown tail, got %q", got)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestMemoryFSNamespace(t *testing.T) {
+	fsys := NewMemory()
+	if _, err := fsys.OpenFile("missing", os.O_RDWR, 0); !os.IsNotExist(err) {
+		t.Fatalf("expected not-exist error, got %v", err)
+	}
+	f, err := fsys.OpenFile("a", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	f.Write([]byte("payload"))
+	f.Close()
+	if _, err := fsys.OpenFile("a", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644); !os.IsExist(err) {
+		t.Fatalf("expected exclusive create to fail, got %v", err)
+	}
+	if err := fsys.Rename("a", "b"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if _, err := fsys.Stat("a"); !os.IsNotExist(err) {
+		t.Fatalf("old name still present after rename: %v", err)
+	}
+	info, err := fsys.Stat("b")
+	if err != nil || info.Size() != int64(len("payload")) {
+		t.Fatalf("stat renamed file: %v, %v", info, err)
+	}
+	if err := fsys.Remove("b"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := fsys.Remove("b"); !os.IsNotExist(err) {
+		t.Fatalf("expected second remove to fail, got %v", err)
+	}
+}
+
+func TestCrashKeepsSyncedContents(t *testing.T) {
+	fsys := NewCrashable()
+	f, err := fsys.OpenFile("log", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	f.Write([]byte("synced"))
+	if err := f.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	f.Write([]byte(" pending"))
+
+	read := func(fsys *MemoryFS) string {
+		t.Helper()
+		f, err := fsys.OpenFile("log", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return string(data)
+	}
+	if got := read(fsys.Crash(false)); got != "synced pending" {
+		t.Fatalf("a process crash should keep every write, got %q", got)
+	}
+	lost := fsys.Crash(true)
+	if got := read(lost); got != "synced" {
+		t.Fatalf("a power loss should keep only synced data, got %q", got)
+	}
+	// The surviving contents are on disk, so a second power loss keeps them.
+	if got := read(lost.Crash(true)); got != "synced" {
+		t.Fatalf("expected the synced contents to survive again, got %q", got)
+	}
+}
@@ -0,0 +1,104 @@
+// Package vfs abstracts the files a database is made of so that the storage
+// engine can run against the operating system or entirely in memory.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// File is an open file. The semantics follow *os.File: reads and writes
+// through Read and Write advance the file offset, ReadAt and WriteAt do not.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	// Size returns the current length of the file in bytes.
+	Size() (int64, error)
+	Truncate(size int64) error
+	Sync() error
+	// Lock takes an advisory lock on the whole file without waiting. It
+	// returns ErrLocked when a conflicting lock is held through another
+	// handle, and replaces any lock already held through this one.
+	Lock(mode LockMode) error
+	// Unlock releases the lock held through this handle. Closing the handle
+	// releases it too.
+	Unlock() error
+}
+
+// LockMode selects between shared and exclusive file locks.
+type LockMode int
+
+const (
+	// LockShared may be held through any number of handles at once.
+	LockShared LockMode = iota + 1
+	// LockExclusive excludes every other lock on the file.
+	LockExclusive
+)
+
+// ErrLocked reports that a lock is held through another handle.
+var ErrLocked = errors.New("vfs: file is locked")
+
+// FS opens, renames and removes files by name.
+type FS interface {
+	// OpenFile opens the named file with the os.O_* flags.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	Remove(name string) error
+	Rename(oldName, newName string) error
+	MkdirAll(path string, perm fs.FileMode) error
+}
+
+// OS is the file system of the host operating system.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (f osFile) Size() (int64, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Or returns fsys, or OS when fsys is nil.
+func Or(fsys FS) FS {
+	if fsys == nil {
+		return OS
+	}
+	return fsys
+}
@@ -3,11 +3,17 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/example/granite-db/engine/internal/encryption"
+	"github.com/example/granite-db/engine/internal/vfs"
 )
 
 // RecordType identifies the kind of WAL record stored on disk.
@@ -26,6 +32,12 @@ const (
 	RecordCommit
 	// RecordAbort marks an aborted transaction.
 	RecordAbort
+	// RecordIndexPage captures a physical index page image after a change to
+	// one of its entries.
+	RecordIndexPage
+	// RecordBeforeImage captures a page as it was before a transaction first
+	// changed it, so that recovery can undo a transaction that never ended.
+	RecordBeforeImage
 )
 
 // Record exposes the parsed representation of a WAL entry.
@@ -38,6 +50,53 @@ type Record struct {
 	Payload []byte
 }
 
+// SyncMode selects when the log is forced to durable storage. The zero value
+// is SyncFull, the behaviour of logs opened before the mode existed.
+type SyncMode uint8
+
+const (
+	// SyncFull syncs every record as it is appended, on top of what
+	// SyncNormal does.
+	SyncFull SyncMode = iota
+	// SyncNormal syncs the log when a transaction commits, sharing the fsync
+	// between concurrent commits, and before a dirty page is written back.
+	SyncNormal
+	// SyncOff never syncs the log: commits survive a crash of the process
+	// but not of the operating system.
+	SyncOff
+)
+
+// ParseSyncMode returns the mode with the given name, as written in
+// SET synchronous = ....
+func ParseSyncMode(name string) (SyncMode, error) {
+	switch strings.ToUpper(name) {
+	case "FULL":
+		return SyncFull, nil
+	case "NORMAL":
+		return SyncNormal, nil
+	case "OFF":
+		return SyncOff, nil
+	default:
+		return SyncFull, fmt.Errorf("wal: unknown synchronous mode %q; use FULL, NORMAL or OFF", name)
+	}
+}
+
+// String returns the name accepted by ParseSyncMode.
+func (s SyncMode) String() string {
+	switch s {
+	case SyncFull:
+		return "FULL"
+	case SyncNormal:
+		return "NORMAL"
+	case SyncOff:
+		return "OFF"
+	default:
+		return fmt.Sprintf("SyncMode(%d)", uint8(s))
+	}
+}
+
+var errClosed = errors.New("wal: log is closed")
+
 const (
 	recordHeaderSize = 8 + 8 + 8 + 1 + 3 + 4 + 4 // LSN, TxnID, PrevLSN, Type+pad, PageID, PayloadLen
 	lengthFieldSize  = 4
@@ -47,23 +106,58 @@ const (
 // Manager coordinates access to the WAL file.
 type Manager struct {
 	mu              sync.Mutex
-	file            *os.File
+	file            vfs.File
 	path            string
 	lastLSN         uint64
+	flushedLSN      uint64
 	walBytesWritten uint64
+	start           int64 // offset of the first record
+	cipher          *encryption.Cipher
+
+	// syncing is set while a group flush runs outside mu; flushed is
+	// signalled when it ends so that waiting committers can check whether
+	// it covered them.
+	syncing      bool
+	flushed      *sync.Cond
+	syncs        uint64
+	commitWindow time.Duration
+	mode         SyncMode
+}
+
+// Options tunes how the WAL is opened.
+type Options struct {
+	// FS holds the log file. Nil selects the operating system.
+	FS vfs.FS
+	// Cipher seals the records of an encrypted database's log. It must be
+	// set exactly when the database is encrypted.
+	Cipher *encryption.Cipher
+	// CommitWindow is how long the committer leading a log flush waits for
+	// others to join it before calling fsync. Zero flushes at once; commits
+	// that arrive while a flush is running still share the next one.
+	CommitWindow time.Duration
+	// Synchronous selects when the log is synced; see SyncMode.
+	Synchronous SyncMode
 }
 
 // Open initialises a WAL manager anchored to the supplied database path.
 func Open(dbPath string) (*Manager, error) {
-	walPath := dbPath + ".wal"
-	if err := os.MkdirAll(filepath.Dir(walPath), 0o755); err != nil {
+	return OpenWithOptions(dbPath, Options{})
+}
+
+// OpenWithOptions initialises a WAL manager for the database at dbPath using
+// the supplied options.
+func OpenWithOptions(dbPath string, opts Options) (*Manager, error) {
+	fsys := vfs.Or(opts.FS)
+	walPath := PathFor(dbPath)
+	if err := fsys.MkdirAll(filepath.Dir(walPath), 0o755); err != nil {
 		return nil, err
 	}
-	file, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0o644)
+	file, err := fsys.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
 		return nil, err
 	}
-	m := &Manager{file: file, path: walPath}
+	m := &Manager{file: file, path: walPath, cipher: opts.Cipher, commitWindow: opts.CommitWindow, mode: opts.Synchronous}
+	m.flushed = sync.NewCond(&m.mu)
 	if err := m.bootstrap(); err != nil {
 		file.Close()
 		return nil, err
@@ -75,7 +169,32 @@ func (m *Manager) bootstrap() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+	_, start, err := detectFormat(m.file)
+	if err != nil {
+		return err
+	}
+	size, err := m.file.Size()
+	if err != nil {
+		return err
+	}
+	encrypted, err := logEncrypted(m.file, start)
+	if err != nil {
+		return err
+	}
+	if encrypted != (m.cipher != nil) && size > start {
+		if encrypted {
+			return fmt.Errorf("wal: log %s is encrypted but no key was supplied", m.path)
+		}
+		return fmt.Errorf("wal: log %s of an encrypted database holds unencrypted records", m.path)
+	}
+	if size == 0 || encrypted != (m.cipher != nil) {
+		if _, err := m.file.WriteAt(encodeFileHeader(m.cipher != nil), 0); err != nil {
+			return err
+		}
+		start = fileHeaderSize
+	}
+	m.start = start
+	if _, err := m.file.Seek(start, io.SeekStart); err != nil {
 		return err
 	}
 
@@ -110,23 +229,28 @@ func (m *Manager) bootstrap() error {
 		if storedChecksum != computed {
 			break
 		}
-		if length < recordHeaderSize+checksumSize {
+		body, err := m.openRecord(recBuf[:length-checksumSize])
+		if err != nil {
+			return err
+		}
+		if len(body) < recordHeaderSize {
 			break
 		}
-		lsn := binary.LittleEndian.Uint64(recBuf[0:8])
+		lsn := binary.LittleEndian.Uint64(body[0:8])
 		if lsn > m.lastLSN {
 			m.lastLSN = lsn
 		}
 		recordsSize += uint64(lengthFieldSize) + uint64(length)
 	}
 
-	if err := m.file.Truncate(int64(recordsSize)); err != nil {
+	if err := m.file.Truncate(start + int64(recordsSize)); err != nil {
 		return err
 	}
-	if _, err := m.file.Seek(int64(recordsSize), io.SeekStart); err != nil {
+	if _, err := m.file.Seek(start+int64(recordsSize), io.SeekStart); err != nil {
 		return err
 	}
 	m.walBytesWritten = recordsSize
+	m.flushedLSN = m.lastLSN
 	return nil
 }
 
@@ -137,6 +261,7 @@ func (m *Manager) Close() error {
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.waitForFlushLocked()
 	if m.file == nil {
 		return nil
 	}
@@ -145,7 +270,8 @@ func (m *Manager) Close() error {
 	return err
 }
 
-// Append writes a record to the WAL, returning the assigned LSN.
+// Append writes a record to the WAL, returning the assigned LSN. The record is
+// not durable until a later Sync or FlushTo covers it.
 func (m *Manager) Append(txnID, prevLSN uint64, typ RecordType, pageID uint32, payload []byte) (uint64, error) {
 	if m == nil {
 		return 0, nil
@@ -155,9 +281,7 @@ func (m *Manager) Append(txnID, prevLSN uint64, typ RecordType, pageID uint32, p
 
 	lsn := m.lastLSN + 1
 	payloadLen := len(payload)
-	length := recordHeaderSize + payloadLen + checksumSize
-	buf := make([]byte, lengthFieldSize+length)
-	binary.LittleEndian.PutUint32(buf[:lengthFieldSize], uint32(length))
+	buf := make([]byte, lengthFieldSize+recordHeaderSize+payloadLen+checksumSize)
 	pos := lengthFieldSize
 	binary.LittleEndian.PutUint64(buf[pos:pos+8], lsn)
 	pos += 8
@@ -177,24 +301,140 @@ func (m *Manager) Append(txnID, prevLSN uint64, typ RecordType, pageID uint32, p
 	pos += 4
 	copy(buf[pos:pos+payloadLen], payload)
 	pos += payloadLen
-	checksum := crc32.ChecksumIEEE(buf[lengthFieldSize : lengthFieldSize+recordHeaderSize+payloadLen])
+	if m.cipher != nil {
+		plain := buf[lengthFieldSize:pos]
+		frame := make([]byte, lengthFieldSize, lengthFieldSize+len(plain)+encryption.Overhead+checksumSize)
+		sealed, err := m.cipher.Seal(frame, plain, nil)
+		if err != nil {
+			return 0, err
+		}
+		pos = len(sealed)
+		buf = sealed[:pos+checksumSize]
+	}
+	binary.LittleEndian.PutUint32(buf[:lengthFieldSize], uint32(pos-lengthFieldSize+checksumSize))
+	checksum := crc32.ChecksumIEEE(buf[lengthFieldSize:pos])
 	binary.LittleEndian.PutUint32(buf[pos:pos+checksumSize], checksum)
 	if _, err := m.file.Write(buf); err != nil {
 		return 0, err
 	}
 	m.lastLSN = lsn
 	m.walBytesWritten += uint64(len(buf))
+	if m.mode == SyncFull {
+		if err := m.flushToLocked(lsn); err != nil {
+			return 0, err
+		}
+	}
 	return lsn, nil
 }
 
-// Sync forces the WAL contents to durable storage.
+// Sync forces the WAL contents to durable storage. Like FlushTo, it does
+// nothing under SyncOff.
 func (m *Manager) Sync() error {
 	if m == nil {
 		return nil
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.file.Sync()
+	return m.flushToLocked(m.lastLSN)
+}
+
+// FlushTo ensures every record up to and including lsn is durable. It is a
+// no-op when the log has already been synced past that point. Callers that
+// arrive while another flush is running wait for it and, if it did not cover
+// them, share a single fsync for everything appended since: this is how
+// concurrent commits are grouped.
+func (m *Manager) FlushTo(lsn uint64) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.flushToLocked(lsn)
+}
+
+func (m *Manager) flushToLocked(lsn uint64) error {
+	if m.mode == SyncOff {
+		return nil
+	}
+	for lsn > m.flushedLSN {
+		if m.syncing {
+			m.flushed.Wait()
+			continue
+		}
+		if err := m.groupFlushLocked(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupFlushLocked syncs the log on behalf of every record appended so far.
+// The lock is released for the commit window and the fsync, so that other
+// transactions can append and queue up behind this flush meanwhile.
+func (m *Manager) groupFlushLocked() error {
+	m.syncing = true
+	defer func() {
+		m.syncing = false
+		m.flushed.Broadcast()
+	}()
+	if m.commitWindow > 0 {
+		m.mu.Unlock()
+		time.Sleep(m.commitWindow)
+		m.mu.Lock()
+	}
+	if m.file == nil {
+		return errClosed
+	}
+	file, target := m.file, m.lastLSN
+	m.mu.Unlock()
+	err := file.Sync()
+	m.mu.Lock()
+	if err != nil {
+		return err
+	}
+	m.syncs++
+	if target > m.flushedLSN {
+		m.flushedLSN = target
+	}
+	return nil
+}
+
+// waitForFlushLocked waits until no group flush is using the file.
+func (m *Manager) waitForFlushLocked() {
+	for m.syncing {
+		m.flushed.Wait()
+	}
+}
+
+// Reset discards every record in the log. Callers must ensure the data file
+// already reflects all logged changes before resetting.
+func (m *Manager) Reset() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waitForFlushLocked()
+	if m.file == nil {
+		return errClosed
+	}
+	// Rewriting the header here also upgrades a legacy log in place.
+	if err := m.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := m.file.WriteAt(encodeFileHeader(m.cipher != nil), 0); err != nil {
+		return err
+	}
+	m.start = fileHeaderSize
+	if _, err := m.file.Seek(m.start, io.SeekStart); err != nil {
+		return err
+	}
+	m.walBytesWritten = 0
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.flushedLSN = m.lastLSN
+	return nil
 }
 
 // LastLSN returns the last assigned log sequence number.
@@ -204,6 +444,29 @@ func (m *Manager) LastLSN() uint64 {
 	return m.lastLSN
 }
 
+// SyncMode returns the current synchronous mode.
+func (m *Manager) SyncMode() SyncMode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mode
+}
+
+// SetSyncMode changes when the log is synced. Records appended under SyncOff
+// are covered by the next flush once syncing resumes.
+func (m *Manager) SetSyncMode(mode SyncMode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mode = mode
+}
+
+// Syncs returns the number of times the log has been flushed to durable
+// storage.
+func (m *Manager) Syncs() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.syncs
+}
+
 // BytesWritten returns the number of bytes flushed to the WAL.
 func (m *Manager) BytesWritten() uint64 {
 	m.mu.Lock()
@@ -216,7 +479,7 @@ func (m *Manager) Scan() ([]Record, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+	if _, err := m.file.Seek(m.start, io.SeekStart); err != nil {
 		return nil, err
 	}
 
@@ -249,7 +512,14 @@ func (m *Manager) Scan() ([]Record, error) {
 		if storedChecksum != computed {
 			break
 		}
-		record := decodeRecord(recBuf[:length-checksumSize])
+		body, err := m.openRecord(recBuf[:length-checksumSize])
+		if err != nil {
+			return nil, err
+		}
+		if len(body) < recordHeaderSize {
+			break
+		}
+		record := decodeRecord(body)
 		records = append(records, record)
 	}
 
@@ -257,6 +527,20 @@ func (m *Manager) Scan() ([]Record, error) {
 	return records, err
 }
 
+// openRecord returns the plaintext of a record body whose checksum has been
+// verified. A sealed record that fails authentication was not torn but
+// altered, so it is reported rather than treated as the end of the log.
+func (m *Manager) openRecord(body []byte) ([]byte, error) {
+	if m.cipher == nil {
+		return body, nil
+	}
+	plain, err := m.cipher.Open(nil, body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wal: log %s: %w", m.path, err)
+	}
+	return plain, nil
+}
+
 func decodeRecord(buf []byte) Record {
 	pos := 0
 	lsn := binary.LittleEndian.Uint64(buf[pos : pos+8])